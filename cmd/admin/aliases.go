@@ -0,0 +1,141 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+const aliasesUsage = `usage: admin aliases list
+       admin aliases add -type <component type> [-name <component name>] [-country <country>] [-city <city>] [-priority <n>]
+       admin aliases remove <id>
+
+An alias matches an address component returned by the geocoder by its type (e.g. "administrative_area_level_1" or
+"neighborhood") and optionally by its name and country. The city of matching places is set to the alias' city or,
+if that is empty, to the name of the component. If several aliases match, the one with the highest priority wins.
+`
+
+var errUsage = errors.New("invalid arguments")
+
+func runAliases(ctx context.Context, db coa.Database, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(aliasesUsage)
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return listAliases(ctx, db)
+	case "add":
+		return addAlias(ctx, db, args[1:])
+	case "remove":
+		if len(args) != 2 {
+			fmt.Print(aliasesUsage)
+			return errUsage
+		}
+		return removeAlias(ctx, db, args[1])
+	default:
+		fmt.Print(aliasesUsage)
+		return errUsage
+	}
+}
+
+func listAliases(ctx context.Context, db coa.Database) error {
+	aliases, err := db.GetPlaceAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tNAME\tCOUNTRY\tCITY\tPRIORITY")
+	for _, a := range aliases {
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%s\t%s\t%d\n",
+			a.ID,
+			a.ComponentType,
+			orAny(a.ComponentName),
+			orAny(a.Country),
+			orComponentName(a.City),
+			a.Priority,
+		)
+	}
+	return w.Flush()
+}
+
+func addAlias(ctx context.Context, db coa.Database, args []string) error {
+	var alias coa.PlaceAlias
+
+	fs := flag.NewFlagSet("aliases add", flag.ContinueOnError)
+	fs.StringVar(&alias.ComponentType, "type", "", "type of the address component to match (required)")
+	fs.StringVar(&alias.ComponentName, "name", "", "name of the address component to match (default: any)")
+	fs.StringVar(&alias.Country, "country", "", "country to match (default: any)")
+	fs.StringVar(&alias.City, "city", "", "city name to use (default: name of the matching component)")
+	fs.IntVar(&alias.Priority, "priority", 0, "priority over other matching aliases")
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if alias.ComponentType == "" || fs.NArg() > 0 {
+		fmt.Print(aliasesUsage)
+		return errUsage
+	}
+
+	id, err := db.InsertPlaceAlias(ctx, alias)
+	if err != nil {
+		return fmt.Errorf("unable to add place alias: %w", err)
+	}
+
+	fmt.Printf("added place alias %d\n", id)
+	return nil
+}
+
+func removeAlias(ctx context.Context, db coa.Database, idStr string) error {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid place alias id %s: %w", idStr, err)
+	}
+
+	if err := db.DeletePlaceAlias(ctx, id); err != nil {
+		return fmt.Errorf("unable to remove place alias %d: %w", id, err)
+	}
+
+	fmt.Printf("removed place alias %d\n", id)
+	return nil
+}
+
+func orAny(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+func orComponentName(s string) string {
+	if s == "" {
+		return "(component name)"
+	}
+	return s
+}
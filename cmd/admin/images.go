@@ -0,0 +1,178 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/config"
+	"github.com/haikoschol/cats-of-asia/pkg/ingestion"
+	"github.com/haikoschol/cats-of-asia/pkg/storage"
+	"github.com/haikoschol/cats-of-asia/pkg/validation"
+	"log"
+	"strconv"
+)
+
+const imagesUsage = `usage: admin images delete [-purge] <id>
+       admin images restore <id>
+       admin images sanitize [-workdir <dir>]
+
+delete hides an image from the website and the bots. With -purge, the image, its posts and the stored files are
+removed for good, which also allows ingesting it again. restore makes a hidden image visible again.
+sanitize removes metadata that isn't on the allowlist (COA_EXIF_ALLOWLIST) from the large renditions of images that
+were stored before ingestion did that. The untouched files are kept in the storage for originals
+(COA_ORIGINALS_STORAGE etc.), which is required. Sanitized files are stored under new URLs and the old public files
+are deleted. Hidden images are skipped.
+Purging and sanitizing require the same storage configuration (COA_STORAGE etc.) as the ingest command.
+`
+
+func runImages(ctx context.Context, db coa.Database, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(imagesUsage)
+		return errUsage
+	}
+
+	switch args[0] {
+	case "delete":
+		return deleteImage(ctx, db, args[1:])
+	case "sanitize":
+		return sanitizeImages(ctx, db, args[1:])
+	case "restore":
+		if len(args) != 2 {
+			fmt.Print(imagesUsage)
+			return errUsage
+		}
+		return restoreImage(ctx, db, args[1])
+	default:
+		fmt.Print(imagesUsage)
+		return errUsage
+	}
+}
+
+func deleteImage(ctx context.Context, db coa.Database, args []string) error {
+	fs := flag.NewFlagSet("images delete", flag.ContinueOnError)
+	purge := fs.Bool("purge", false, "remove the image from the database and storage instead of hiding it")
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Print(imagesUsage)
+		return errUsage
+	}
+
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid image id %s: %w", fs.Arg(0), err)
+	}
+
+	var store, originals coa.Storage
+	if *purge {
+		validation.LogErrors(config.ValidateStorage(), true)
+		validation.LogErrors(config.ValidateMetadata(), true)
+
+		store, err = storage.New(config.Storage())
+		if err != nil {
+			return err
+		}
+
+		metadata, err := config.Metadata()
+		if err != nil {
+			return err
+		}
+		originals = metadata.Originals
+	}
+
+	if err := coa.DeleteImage(ctx, db, store, originals, id, *purge); err != nil {
+		return fmt.Errorf("unable to delete image %d: %w", id, err)
+	}
+
+	if *purge {
+		fmt.Printf("purged image %d\n", id)
+	} else {
+		fmt.Printf("hid image %d\n", id)
+	}
+	return nil
+}
+
+func restoreImage(ctx context.Context, db coa.Database, idStr string) error {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid image id %s: %w", idStr, err)
+	}
+
+	if err := db.SetImageHidden(ctx, id, false); err != nil {
+		return fmt.Errorf("unable to restore image %d: %w", id, err)
+	}
+
+	fmt.Printf("restored image %d\n", id)
+	return nil
+}
+
+func sanitizeImages(ctx context.Context, db coa.Database, args []string) error {
+	fs := flag.NewFlagSet("images sanitize", flag.ContinueOnError)
+	workDir := fs.String("workdir", "", "directory for temporary files")
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() != 0 {
+		fmt.Print(imagesUsage)
+		return errUsage
+	}
+
+	validation.LogErrors(config.ValidateStorage(), true)
+	validation.LogErrors(config.ValidateMetadata(), true)
+
+	store, err := storage.New(config.Storage())
+	if err != nil {
+		return err
+	}
+
+	metadata, err := config.Metadata()
+	if err != nil {
+		return err
+	}
+
+	images, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	// only storage and the database are needed for sanitizing stored images
+	ingestor := ingestion.NewIngestor(
+		db,
+		store,
+		nil,
+		nil,
+		ingestion.NearDuplicateConfig{},
+		nil,
+		metadata,
+		ingestion.ConcurrencyConfig{},
+		false,
+		log.Printf,
+		true,
+	)
+
+	updated, err := ingestor.SanitizeStoredImages(ctx, images, *workDir)
+	fmt.Printf("sanitized %d of %d images\n", updated, len(images))
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/config"
+	"github.com/haikoschol/cats-of-asia/pkg/database"
+	"github.com/haikoschol/cats-of-asia/pkg/validation"
+	_ "github.com/joho/godotenv/autoload"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `usage: %s <command> [arguments]
+
+commands:
+    aliases    list, add or remove place aliases used during ingestion
+    images     hide, restore or delete images
+    migrate    apply or revert database migrations
+    renditions create missing renditions of ingested images
+    tags       manage tags and tag images in bulk
+    zones      list, add or remove privacy zones in which locations are obscured
+`
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "--help" || os.Args[1] == "-h" {
+		fmt.Printf(usage, os.Args[0])
+		os.Exit(1)
+	}
+
+	validateEnv()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+
+	switch os.Args[1] {
+	case "aliases":
+		db := openDatabase()
+		defer db.Close()
+		err = runAliases(ctx, db, os.Args[2:])
+	case "images":
+		db := openDatabase()
+		defer db.Close()
+		err = runImages(ctx, db, os.Args[2:])
+	case "tags":
+		db := openDatabase()
+		defer db.Close()
+		err = runTags(ctx, db, os.Args[2:])
+	case "renditions":
+		db := openDatabase()
+		defer db.Close()
+		err = runRenditions(ctx, db, os.Args[2:])
+	case "zones":
+		db := openDatabase()
+		defer db.Close()
+		err = runZones(ctx, db, os.Args[2:])
+	case "migrate":
+		err = runMigrate(ctx, config.DB(), os.Args[2:])
+	default:
+		fmt.Printf(usage, os.Args[0])
+		os.Exit(1)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func openDatabase() coa.Database {
+	db, err := database.New(config.DB())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+func validateEnv() {
+	errs := config.ValidateDB()
+	validation.LogErrors(errs, true)
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/haikoschol/cats-of-asia/pkg/database"
+	"github.com/haikoschol/cats-of-asia/pkg/migrate"
+	"strconv"
+)
+
+const migrateUsage = `usage: admin migrate up
+       admin migrate down [n]
+       admin migrate status
+
+up applies all pending migrations, down reverts the last n (default 1) migrations and status shows the current schema
+version and pending migrations. COA_DB_DRIVER determines which set of migrations is used.
+`
+
+func runMigrate(ctx context.Context, cfg database.Config, args []string) error {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[0] != "down") {
+		fmt.Print(migrateUsage)
+		return errUsage
+	}
+
+	db, migrations, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	m, err := migrate.New(db, migrations)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, mig := range applied {
+			fmt.Printf("applied %d_%s\n", mig.Version, mig.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations to revert: %s", args[1])
+			}
+		}
+
+		reverted, err := m.Down(ctx, steps)
+		for _, mig := range reverted {
+			fmt.Printf("reverted %d_%s\n", mig.Version, mig.Name)
+		}
+		return err
+	case "status":
+		return printMigrationStatus(ctx, m)
+	default:
+		fmt.Print(migrateUsage)
+		return errUsage
+	}
+}
+
+func printMigrationStatus(ctx context.Context, m *migrate.Migrator) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	dirty := ""
+	if status.Dirty {
+		dirty = " (dirty)"
+	}
+
+	fmt.Printf("schema version: %d%s\nlatest version: %d\n", status.Version, dirty, m.Latest())
+
+	if len(status.Pending) == 0 {
+		fmt.Println("no pending migrations")
+		return nil
+	}
+
+	fmt.Println("pending migrations:")
+	for _, mig := range status.Pending {
+		fmt.Printf("    %d_%s\n", mig.Version, mig.Name)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/config"
+	"github.com/haikoschol/cats-of-asia/pkg/ingestion"
+	"github.com/haikoschol/cats-of-asia/pkg/storage"
+	"github.com/haikoschol/cats-of-asia/pkg/validation"
+	"log"
+)
+
+const renditionsUsage = `usage: admin renditions backfill [-workdir <dir>]
+
+backfill creates the renditions of the configured profiles (COA_RENDITION_PROFILES) that are missing for images
+ingested before the profiles were added, and records the size of their large renditions. The large renditions are
+downloaded to temporary directories in -workdir. Existing renditions are not recreated. Hidden images are skipped.
+It requires the same storage configuration (COA_STORAGE etc.) as the ingest command.
+`
+
+func runRenditions(ctx context.Context, db coa.Database, args []string) error {
+	if len(args) == 0 || args[0] != "backfill" {
+		fmt.Print(renditionsUsage)
+		return errUsage
+	}
+
+	fs := flag.NewFlagSet("renditions backfill", flag.ContinueOnError)
+	workDir := fs.String("workdir", "", "directory for temporary files")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() != 0 {
+		fmt.Print(renditionsUsage)
+		return errUsage
+	}
+
+	validation.LogErrors(config.ValidateStorage(), true)
+
+	store, err := storage.New(config.Storage())
+	if err != nil {
+		return err
+	}
+
+	profiles, err := ingestion.LoadRenditionProfiles(config.RenditionProfilesPath())
+	if err != nil {
+		return err
+	}
+
+	images, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	// only storage and the database are needed for creating renditions
+	ingestor := ingestion.NewIngestor(
+		db,
+		store,
+		nil,
+		nil,
+		ingestion.NearDuplicateConfig{},
+		profiles,
+		ingestion.MetadataConfig{},
+		ingestion.ConcurrencyConfig{},
+		false,
+		log.Printf,
+		true,
+	)
+
+	updated, err := ingestor.BackfillRenditions(ctx, images, *workDir)
+	fmt.Printf("created renditions for %d of %d images\n", updated, len(images))
+	return err
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const tagsUsage = `usage: admin tags list
+       admin tags create [-controlled] <name>...
+       admin tags delete <name>
+       admin tags add <tag>[,<tag>...] <image id>...
+       admin tags remove <tag>[,<tag>...] <image id>...
+
+create adds tags to the vocabulary. Controlled tags are the curated ones, the others are free-form tags that are
+created on the fly by add. delete removes a tag from all images. If the only image id is "-", image ids are read
+from stdin, one per line, e.g. to tag the output of a query in bulk.
+`
+
+func runTags(ctx context.Context, db coa.Database, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(tagsUsage)
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return listTags(ctx, db)
+	case "create":
+		return createTags(ctx, db, args[1:])
+	case "delete":
+		if len(args) != 2 {
+			fmt.Print(tagsUsage)
+			return errUsage
+		}
+		return deleteTag(ctx, db, args[1])
+	case "add", "remove":
+		if len(args) < 3 {
+			fmt.Print(tagsUsage)
+			return errUsage
+		}
+		return changeTags(ctx, db, args[0] == "add", args[1], args[2:])
+	default:
+		fmt.Print(tagsUsage)
+		return errUsage
+	}
+}
+
+func listTags(ctx context.Context, db coa.Database) error {
+	tags, err := db.GetTags(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCONTROLLED\tIMAGES")
+	for _, t := range tags {
+		fmt.Fprintf(w, "%s\t%v\t%d\n", t.Name, t.Controlled, t.Images)
+	}
+	return w.Flush()
+}
+
+func createTags(ctx context.Context, db coa.Database, args []string) error {
+	fs := flag.NewFlagSet("tags create", flag.ContinueOnError)
+	controlled := fs.Bool("controlled", false, "add the tags to the curated vocabulary")
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Print(tagsUsage)
+		return errUsage
+	}
+
+	names, err := coa.ValidateTags(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := db.CreateTag(ctx, name, *controlled); err != nil {
+			return fmt.Errorf("unable to create tag '%s': %w", name, err)
+		}
+		fmt.Printf("created tag '%s'\n", name)
+	}
+	return nil
+}
+
+func deleteTag(ctx context.Context, db coa.Database, name string) error {
+	name = coa.NormalizeTag(name)
+	if err := db.DeleteTag(ctx, name); err != nil {
+		return fmt.Errorf("unable to delete tag '%s': %w", name, err)
+	}
+
+	fmt.Printf("deleted tag '%s'\n", name)
+	return nil
+}
+
+func changeTags(ctx context.Context, db coa.Database, add bool, tagList string, idArgs []string) error {
+	tags, err := coa.ValidateTags(strings.Split(tagList, ","))
+	if err != nil {
+		return err
+	}
+
+	if len(idArgs) == 1 && idArgs[0] == "-" {
+		idArgs, err = readLines(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("unable to read image ids from stdin: %w", err)
+		}
+	}
+
+	var ids []int64
+	for _, arg := range idArgs {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid image id %s: %w", arg, err)
+		}
+		ids = append(ids, id)
+	}
+
+	if add {
+		if err := db.TagImages(ctx, ids, tags); err != nil {
+			return fmt.Errorf("unable to tag images: %w", err)
+		}
+		fmt.Printf("tagged %d images with %s\n", len(ids), strings.Join(tags, ", "))
+	} else {
+		if err := db.UntagImages(ctx, ids, tags); err != nil {
+			return fmt.Errorf("unable to untag images: %w", err)
+		}
+		fmt.Printf("removed %s from %d images\n", strings.Join(tags, ", "), len(ids))
+	}
+	return nil
+}
+
+// readLines returns the non-empty lines read from f.
+func readLines(f *os.File) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
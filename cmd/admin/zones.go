@@ -0,0 +1,171 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const zonesUsage = `usage: admin zones list
+       admin zones add -name <name> -center <latitude,longitude> -radius <meters>
+       admin zones add -name <name> -polygon "<latitude,longitude> <latitude,longitude> <latitude,longitude> ..."
+       admin zones remove <id>
+
+The coordinates of images taken inside a privacy zone are not published. Instead, each of them is shown at a fixed
+random position in the grid cell of about 2 km that contains the zone. The database keeps the true coordinates.
+`
+
+func runZones(ctx context.Context, db coa.Database, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(zonesUsage)
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return listZones(ctx, db)
+	case "add":
+		return addZone(ctx, db, args[1:])
+	case "remove":
+		if len(args) != 2 {
+			fmt.Print(zonesUsage)
+			return errUsage
+		}
+		return removeZone(ctx, db, args[1])
+	default:
+		fmt.Print(zonesUsage)
+		return errUsage
+	}
+}
+
+func listZones(ctx context.Context, db coa.Database) error {
+	zones, err := db.GetPrivacyZones(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tAREA")
+	for _, z := range zones {
+		var area string
+		if len(z.Polygon) > 0 {
+			var corners []string
+			for _, p := range z.Polygon {
+				corners = append(corners, formatGeoPoint(p))
+			}
+			area = "polygon " + strings.Join(corners, " ")
+		} else {
+			area = fmt.Sprintf("%gm around %s", z.Radius, formatGeoPoint(z.Center))
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\n", z.ID, z.Name, area)
+	}
+	return w.Flush()
+}
+
+func addZone(ctx context.Context, db coa.Database, args []string) error {
+	var zone coa.PrivacyZone
+	var center, polygon string
+
+	fs := flag.NewFlagSet("zones add", flag.ContinueOnError)
+	fs.StringVar(&zone.Name, "name", "", "name of the zone (required)")
+	fs.StringVar(&center, "center", "", "center of a circular zone, e.g. 13.7563,100.5018")
+	fs.Float64Var(&zone.Radius, "radius", 0, "radius of a circular zone in meters")
+	fs.StringVar(&polygon, "polygon", "", "space separated corners of the zone")
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if zone.Name == "" || fs.NArg() > 0 || (center == "") == (polygon == "") {
+		fmt.Print(zonesUsage)
+		return errUsage
+	}
+
+	if center != "" {
+		p, err := parseGeoPoint(center)
+		if err != nil {
+			return err
+		}
+		zone.Center = p
+	}
+
+	for _, corner := range strings.Fields(polygon) {
+		p, err := parseGeoPoint(corner)
+		if err != nil {
+			return err
+		}
+		zone.Polygon = append(zone.Polygon, p)
+	}
+
+	if err := coa.ValidatePrivacyZone(zone); err != nil {
+		return err
+	}
+
+	id, err := db.InsertPrivacyZone(ctx, zone)
+	if err != nil {
+		return fmt.Errorf("unable to add privacy zone: %w", err)
+	}
+
+	fmt.Printf("added privacy zone %d\n", id)
+	return nil
+}
+
+func removeZone(ctx context.Context, db coa.Database, idStr string) error {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid privacy zone id %s: %w", idStr, err)
+	}
+
+	if err := db.DeletePrivacyZone(ctx, id); err != nil {
+		return fmt.Errorf("unable to remove privacy zone %d: %w", id, err)
+	}
+
+	fmt.Printf("removed privacy zone %d\n", id)
+	return nil
+}
+
+// parseGeoPoint parses coordinates in the format "<latitude>,<longitude>".
+func parseGeoPoint(s string) (coa.GeoPoint, error) {
+	latStr, lngStr, found := strings.Cut(s, ",")
+	if !found {
+		return coa.GeoPoint{}, fmt.Errorf("invalid coordinates %s, expected <latitude>,<longitude>", s)
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	if err != nil {
+		return coa.GeoPoint{}, fmt.Errorf("invalid latitude %s: %w", latStr, err)
+	}
+
+	lng, err := strconv.ParseFloat(strings.TrimSpace(lngStr), 64)
+	if err != nil {
+		return coa.GeoPoint{}, fmt.Errorf("invalid longitude %s: %w", lngStr, err)
+	}
+
+	return coa.GeoPoint{Latitude: lat, Longitude: lng}, nil
+}
+
+func formatGeoPoint(p coa.GeoPoint) string {
+	return fmt.Sprintf("%g,%g", p.Latitude, p.Longitude)
+}
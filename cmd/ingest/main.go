@@ -17,92 +17,379 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/config"
+	"github.com/haikoschol/cats-of-asia/pkg/database"
 	"github.com/haikoschol/cats-of-asia/pkg/ingestion"
-	"github.com/haikoschol/cats-of-asia/pkg/postgres"
+	"github.com/haikoschol/cats-of-asia/pkg/storage"
 	"github.com/haikoschol/cats-of-asia/pkg/validation"
 	_ "github.com/joho/godotenv/autoload"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-const verbose = true // TODO make cli flag
+const usage = `usage: %s [flags] [path...]
+       %s --watch [flags] [dir]
+
+Ingests the images in the given directories and files (default: current directory). With --watch, new images in the
+directory tree are ingested as they appear, until the process is stopped.
+
+flags:
+`
+
+// reportFormats are the values of the --report flag
+var reportFormats = []string{"text", "json"}
 
 var (
-	dbHost     = os.Getenv("COA_DB_HOST")
-	dbSSLMode  = os.Getenv("COA_DB_SSLMODE")
-	dbName     = os.Getenv("COA_DB_NAME")
-	dbUser     = os.Getenv("COA_DB_USER")
-	dbPassword = os.Getenv("COA_DB_PASSWORD")
-
-	googleMapsAPIKey     = os.Getenv("COA_GOOGLE_MAPS_API_KEY")
-	svcAccountEmail      = os.Getenv("COA_GOOGLE_DRIVE_EMAIL")
-	svcAccountPrivateKey = os.Getenv("COA_GOOGLE_DRIVE_PRIVATE_KEY")
-	gdriveFolderID       = os.Getenv("COA_GOOGLE_DRIVE_FOLDER_ID")
+	// optional directory that rejected files are moved to. defaults to "quarantine" in the directory that is ingested
+	quarantineDir = os.Getenv("COA_QUARANTINE_DIR")
+	// optional exit code for runs in which files were rejected or failed. defaults to 0
+	failureExitCode = os.Getenv("COA_INGEST_FAILURE_EXIT_CODE")
+
+	// optional settings of --watch. processed files are moved to the archive directory, which defaults to "archive" in
+	// the watched directory. the durations use the syntax of time.ParseDuration, e.g. "30s"
+	archiveDir        = os.Getenv("COA_ARCHIVE_DIR")
+	watchPollInterval = os.Getenv("COA_WATCH_POLL_INTERVAL")
+	watchStableFor    = os.Getenv("COA_WATCH_STABLE_FOR")
 )
 
 func main() {
+	opts := parseFlags()
 	validateEnv()
 
-	db, err := postgres.NewDatabase(dbUser, dbPassword, dbHost, dbName, postgres.SSLMode(dbSSLMode))
+	db, err := database.New(config.DB())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	geocoder, err := config.NewGeocoder()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	timezones, err := config.NewTimezoneResolver()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	creds := ingestion.GoogleCredentials{
-		MapsAPIKey:           googleMapsAPIKey,
-		SvcAccountEmail:      svcAccountEmail,
-		SvcAccountPrivateKey: svcAccountPrivateKey,
+	profiles, err := ingestion.LoadRenditionProfiles(config.RenditionProfilesPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// a dry run doesn't store anything, so the storages aren't even set up
+	var store coa.Storage
+	metadata := ingestion.MetadataConfig{AllowedExifFields: config.ExifAllowlist()}
+	if !opts.dryRun {
+		if store, err = storage.New(config.Storage()); err != nil {
+			log.Fatal(err)
+		}
+
+		if metadata, err = config.Metadata(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	i := ingestion.NewIngestor(
+		db,
+		store,
+		geocoder,
+		timezones,
+		config.NearDuplicates(),
+		profiles,
+		metadata,
+		config.Concurrency(),
+		opts.dryRun,
+		log.Printf,
+		opts.verbose,
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.watch {
+		watch(ctx, i, opts)
+		return
 	}
 
-	i, err := ingestion.NewIngestor(db, creds, gdriveFolderID, log.Printf, verbose)
+	paths, roots, err := collectPaths(i, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	images, err := i.IngestDirectory(getImageDir())
+	results, err := i.IngestFiles(ctx, paths)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("ingested %d new images\n", len(images))
+	var quarantined map[string]string
+	if !opts.dryRun {
+		quarantined = quarantine(results, roots)
+	}
+
+	printReport(results, quarantined, opts)
+
+	if code, _ := strconv.Atoi(failureExitCode); code != 0 && hasFailures(results) {
+		os.Exit(code)
+	}
 }
 
-func getImageDir() string {
-	dir, err := os.Getwd()
+// watch ingests new files in the directory given on the command line until ctx is cancelled.
+func watch(ctx context.Context, i *ingestion.Ingestor, opts options) {
+	dir := opts.paths[0]
+
+	info, err := os.Stat(dir)
 	if err != nil {
-		log.Fatalf("os.Getcwd(): %v\n", err)
+		log.Fatal(err)
+	}
+	if !info.IsDir() {
+		log.Fatalf("%s is not a directory\n", dir)
+	}
+
+	archive := archiveDir
+	if archive == "" {
+		archive = filepath.Join(dir, "archive")
+	}
+
+	// already validated. zero means the default
+	pollInterval, _ := time.ParseDuration(watchPollInterval)
+	stableFor, _ := time.ParseDuration(watchStableFor)
+
+	// processed files must not be picked up again
+	exclude := slices.Clone(opts.exclude)
+	exclude = append(exclude, excludePattern(dir, quarantineDirFor(dir))...)
+	exclude = append(exclude, excludePattern(dir, archive)...)
+
+	cfg := ingestion.WatchConfig{
+		List:          ingestion.ListOptions{Include: opts.include, Exclude: exclude},
+		ArchiveDir:    archive,
+		QuarantineDir: quarantineDirFor(dir),
+		PollInterval:  pollInterval,
+		StableFor:     stableFor,
+		Processed: func(results []ingestion.FileResult, moved map[string]string) {
+			printReport(results, moved, opts)
+		},
 	}
 
-	if len(os.Args) > 1 {
-		if os.Args[1] == "--help" || os.Args[1] == "-h" {
-			fmt.Printf("usage: %s <path> - directory to scan for new images (default: current directory)\n", os.Args[0])
-			os.Exit(1)
-		} else {
-			dir = os.Args[1]
+	if !opts.quiet {
+		log.Printf("watching %s for new images\n", dir)
+	}
+
+	if err := ingestion.NewWatcher(i, dir, cfg, log.Printf).Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if !opts.quiet {
+		log.Printf("stopped watching %s\n", dir)
+	}
+}
+
+// printReport prints a summary of the results in the format selected with --report.
+func printReport(results []ingestion.FileResult, moved map[string]string, opts options) {
+	switch {
+	case opts.report == "json":
+		if err := writeJSONReport(os.Stdout, results, moved, opts.dryRun); err != nil {
+			log.Fatal(err)
 		}
+	case !opts.quiet:
+		printSummary(results, opts.dryRun)
+		printNearDuplicates(results, opts.dryRun)
 	}
-	return dir
 }
 
-func validateEnv() {
-	errs := validation.ValidateDbEnv(dbHost, dbSSLMode, dbName, dbUser, dbPassword)
+type options struct {
+	paths     []string
+	dryRun    bool
+	recursive bool
+	watch     bool
+	include   patterns
+	exclude   patterns
+	verbose   bool
+	quiet     bool
+	report    string
+}
+
+// patterns collects the values of a flag that can be given more than once.
+type patterns []string
 
-	if googleMapsAPIKey == "" {
-		errs = append(errs, "COA_GOOGLE_MAPS_API_KEY env var missing")
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func parseFlags() options {
+	var opts options
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.BoolVar(
+		&opts.dryRun,
+		"dry-run",
+		false,
+		"look for new images and duplicates, but don't upload, insert or quarantine anything. places and time zones "+
+			"are only taken from the database",
+	)
+	flag.BoolVar(&opts.recursive, "recursive", false, "include images in subdirectories")
+	flag.BoolVar(
+		&opts.watch,
+		"watch",
+		false,
+		"keep running and ingest images in the directory tree once they haven't changed for a while, then move them "+
+			"to the archive directory",
+	)
+	flag.Var(&opts.include, "include", "only ingest files matching this `glob`, e.g. '*.heic' (can be repeated)")
+	flag.Var(&opts.exclude, "exclude", "leave out files and directories matching this `glob` (can be repeated)")
+	flag.BoolVar(&opts.verbose, "verbose", false, "log the progress of each stage of the ingestion pipeline")
+	flag.BoolVar(&opts.quiet, "quiet", false, "only log errors")
+	flag.StringVar(&opts.report, "report", "text", "format of the summary, either 'text' or 'json'")
+	flag.Parse()
+
+	opts.paths = flag.Args()
+	if len(opts.paths) == 0 {
+		opts.paths = []string{"."}
+	}
+
+	var errs []string
+
+	if opts.verbose && opts.quiet {
+		errs = append(errs, "--verbose and --quiet can't be used together")
+	}
+
+	if opts.watch && opts.dryRun {
+		errs = append(errs, "--watch and --dry-run can't be used together")
 	}
 
-	if svcAccountEmail == "" {
-		errs = append(errs, "env var COA_GOOGLE_DRIVE_EMAIL not set")
+	if opts.watch && len(opts.paths) > 1 {
+		errs = append(errs, "--watch takes a single directory")
 	}
 
-	if svcAccountPrivateKey == "" {
-		errs = append(errs, "env var COA_GOOGLE_DRIVE_PRIVATE_KEY not set")
+	if !slices.Contains(reportFormats, opts.report) {
+		errs = append(errs, fmt.Sprintf("--report has invalid value '%s'", opts.report))
 	}
 
-	if gdriveFolderID == "" {
-		errs = append(errs, "COA_GOOGLE_DRIVE_FOLDER_ID env var missing")
+	listOpts := ingestion.ListOptions{Include: opts.include, Exclude: opts.exclude}
+	if err := listOpts.ValidatePatterns(); err != nil {
+		errs = append(errs, err.Error())
 	}
 
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+		}
+		flag.Usage()
+		os.Exit(2)
+	}
+	return opts
+}
+
+// collectPaths returns the files to ingest and the directory each of them was found in, which is the directory that
+// was passed for listed files and the parent directory for files that were passed directly.
+func collectPaths(i *ingestion.Ingestor, opts options) ([]string, map[string]string, error) {
+	var paths []string
+	roots := make(map[string]string)
+
+	for _, p := range opts.paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !info.IsDir() {
+			paths = append(paths, p)
+			roots[p] = filepath.Dir(p)
+			continue
+		}
+
+		listOpts := ingestion.ListOptions{
+			Recursive: opts.recursive,
+			Include:   opts.include,
+			// rejected files must not be scanned again
+			Exclude: append(slices.Clone(opts.exclude), excludePattern(p, quarantineDirFor(p))...),
+		}
+
+		listed, err := i.ListFiles(p, listOpts)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, l := range listed {
+			paths = append(paths, l)
+			roots[l] = p
+		}
+	}
+	return paths, roots, nil
+}
+
+// quarantineDirFor returns the directory that rejected files found in root are moved to.
+func quarantineDirFor(root string) string {
+	if quarantineDir != "" {
+		return quarantineDir
+	}
+	return filepath.Join(root, "quarantine")
+}
+
+// excludePattern returns a pattern that matches dir, if it is inside root.
+func excludePattern(root, dir string) []string {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+	return []string{escaper.Replace(rel)}
+}
+
+// quarantine moves rejected files out of the way, so that they aren't scanned again on the next run, and returns where
+// each of them went. Files that failed are left in place to be retried.
+func quarantine(results []ingestion.FileResult, roots map[string]string) map[string]string {
+	quarantined := make(map[string]string)
+
+	for _, r := range results {
+		if r.Status != ingestion.FileRejected {
+			continue
+		}
+
+		// files from subdirectories keep their relative path, so that files with the same name don't collide
+		root := roots[r.Path]
+		rel, err := filepath.Rel(root, r.Path)
+		if err != nil {
+			rel = filepath.Base(r.Path)
+		}
+		dst := filepath.Join(quarantineDirFor(root), rel)
+
+		if err := ingestion.QuarantineFile(r, dst); err != nil {
+			log.Println(err)
+			continue
+		}
+		quarantined[r.Path] = dst
+	}
+	return quarantined
+}
+
+func validateEnv() {
+	errs := config.ValidateDB()
+	errs = append(errs, config.ValidateStorage()...)
+	errs = append(errs, config.ValidateIngestion()...)
+	errs = append(errs, validation.ValidateExitCodeEnv("COA_INGEST_FAILURE_EXIT_CODE", failureExitCode)...)
+	errs = append(errs, validation.ValidateDurationEnv("COA_WATCH_POLL_INTERVAL", watchPollInterval)...)
+	errs = append(errs, validation.ValidateDurationEnv("COA_WATCH_STABLE_FOR", watchStableFor)...)
+
 	validation.LogErrors(errs, true)
 }
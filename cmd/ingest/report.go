@@ -0,0 +1,173 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/haikoschol/cats-of-asia/pkg/ingestion"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+// report is the machine-readable summary of a run that is written with --report=json.
+type report struct {
+	DryRun bool                         `json:"dryRun"`
+	Counts map[ingestion.FileStatus]int `json:"counts"`
+	Files  []fileReport                 `json:"files"`
+}
+
+type fileReport struct {
+	Path   string               `json:"path"`
+	Status ingestion.FileStatus `json:"status"`
+	Reason string               `json:"reason,omitempty"`
+	// SHA256, City and Country are only set for new images
+	SHA256        string               `json:"sha256,omitempty"`
+	City          string               `json:"city,omitempty"`
+	Country       string               `json:"country,omitempty"`
+	NearDuplicate *nearDuplicateReport `json:"nearDuplicate,omitempty"`
+	// Quarantine is where a rejected file was moved to.
+	Quarantine string `json:"quarantine,omitempty"`
+	// Archive is where a file was moved to after it was processed in watch mode.
+	Archive string `json:"archive,omitempty"`
+}
+
+type nearDuplicateReport struct {
+	MatchID  int64 `json:"matchId"`
+	Distance int   `json:"distance"`
+	Skipped  bool  `json:"skipped"`
+}
+
+// writeJSONReport writes what happened to each file as JSON to w. moved maps the paths of files that were quarantined
+// or archived to where they were moved.
+func writeJSONReport(w io.Writer, results []ingestion.FileResult, moved map[string]string, dryRun bool) error {
+	rep := report{DryRun: dryRun, Counts: countStatuses(results), Files: []fileReport{}}
+
+	for _, r := range results {
+		f := fileReport{Path: r.Path, Status: r.Status, Reason: r.Reason}
+
+		if r.Status == ingestion.FileRejected {
+			f.Quarantine = moved[r.Path]
+		} else {
+			f.Archive = moved[r.Path]
+		}
+
+		if r.Status == ingestion.FileIngested || r.Status == ingestion.FileNew {
+			f.SHA256 = r.Image.SHA256
+			f.City = r.Image.City
+			f.Country = r.Image.Country
+		}
+
+		if d := r.NearDuplicate; d != nil {
+			f.NearDuplicate = &nearDuplicateReport{MatchID: d.MatchID, Distance: d.Distance, Skipped: d.Skipped}
+		}
+
+		rep.Files = append(rep.Files, f)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+func countStatuses(results []ingestion.FileResult) map[ingestion.FileStatus]int {
+	counts := make(map[ingestion.FileStatus]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	return counts
+}
+
+func hasFailures(results []ingestion.FileResult) bool {
+	for _, r := range results {
+		if r.Status == ingestion.FileRejected || r.Status == ingestion.FileFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// printSummary lists each file that was not ingested, together with the reason, and the number of files per status.
+func printSummary(results []ingestion.FileResult, dryRun bool) {
+	counts := countStatuses(results)
+
+	newStatus := ingestion.FileIngested
+	if dryRun {
+		newStatus = ingestion.FileNew
+	}
+
+	if len(results) > counts[newStatus] {
+		fmt.Println()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FILE\tSTATUS\tREASON")
+		for _, r := range results {
+			if r.Status != newStatus {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", r.Path, r.Status, r.Reason)
+			}
+		}
+
+		if err := w.Flush(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	fmt.Printf(
+		"\n%d files: %d %s, %d skipped as duplicates, %d rejected, %d failed\n",
+		len(results),
+		counts[newStatus],
+		newStatus,
+		counts[ingestion.FileDuplicate],
+		counts[ingestion.FileRejected],
+		counts[ingestion.FileFailed],
+	)
+}
+
+// printNearDuplicates lists each file that looks like an image in the database together with the ID of that image.
+func printNearDuplicates(results []ingestion.FileResult, dryRun bool) {
+	var duplicates []ingestion.NearDuplicate
+	for _, r := range results {
+		if r.NearDuplicate != nil {
+			duplicates = append(duplicates, *r.NearDuplicate)
+		}
+	}
+
+	if len(duplicates) == 0 {
+		return
+	}
+
+	fmt.Printf("\nfound %d near-duplicates of known images:\n", len(duplicates))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tMATCHED IMAGE\tDISTANCE\tACTION")
+	for _, d := range duplicates {
+		action := "ingested"
+		if dryRun {
+			action = "new"
+		}
+		if d.Skipped {
+			action = "skipped"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", d.Path, d.MatchID, d.Distance, action)
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Println(err)
+	}
+}
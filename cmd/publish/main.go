@@ -17,27 +17,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	coa "github.com/haikoschol/cats-of-asia"
 	"github.com/haikoschol/cats-of-asia/internal/mastodon"
 	"github.com/haikoschol/cats-of-asia/internal/twitter"
+	"github.com/haikoschol/cats-of-asia/pkg/config"
+	"github.com/haikoschol/cats-of-asia/pkg/database"
 	"github.com/haikoschol/cats-of-asia/pkg/monitoring"
-	"github.com/haikoschol/cats-of-asia/pkg/postgres"
+	"github.com/haikoschol/cats-of-asia/pkg/sanitize"
+	"github.com/haikoschol/cats-of-asia/pkg/storage"
 	"github.com/haikoschol/cats-of-asia/pkg/validation"
 	_ "github.com/joho/godotenv/autoload"
+	"io"
 	"log"
 	"os"
+	"time"
 )
 
 var (
-	dbHost     = os.Getenv("COA_DB_HOST")
-	dbSSLMode  = os.Getenv("COA_DB_SSLMODE")
-	dbName     = os.Getenv("COA_DB_NAME")
-	dbUser     = os.Getenv("COA_DB_USER")
-	dbPassword = os.Getenv("COA_DB_PASSWORD")
-
 	mastodonServer      = os.Getenv("COABOT_MASTODON_SERVER")
 	mastodonAccessToken = os.Getenv("COABOT_MASTODON_ACCESS_TOKEN")
 
@@ -46,9 +47,14 @@ var (
 	twitterAccessToken    = os.Getenv("COABOT_TWITTER_ACCESS_TOKEN")
 	twitterAccessSecret   = os.Getenv("COABOT_TWITTER_ACCESS_SECRET")
 
+	// optional limit for the whole run, e.g. "90s" (default 5m)
+	publishTimeout = os.Getenv("COABOT_TIMEOUT")
+
 	sentryDSN = os.Getenv("SENTRY_DSN")
 )
 
+const defaultTimeout = 5 * time.Minute
+
 func main() {
 	validateEnv()
 
@@ -56,7 +62,13 @@ func main() {
 		log.Fatal(err)
 	}
 
-	db, err := postgres.NewDatabase(dbUser, dbPassword, dbHost, dbName, postgres.SSLMode(dbSSLMode))
+	db, err := database.New(config.DB())
+	if err != nil {
+		log.Fatal(err)
+		sentry.CaptureException(err)
+	}
+
+	store, err := storage.New(config.Storage())
 	if err != nil {
 		log.Fatal(err)
 		sentry.CaptureException(err)
@@ -68,21 +80,32 @@ func main() {
 		sentry.CaptureException(err)
 	}
 
-	if err := publish(publishers, db); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout())
+	defer cancel()
+
+	if err := publish(ctx, publishers, db, store); err != nil {
 		log.Fatal(err)
 		sentry.CaptureException(err)
 	}
 }
 
-func publish(publishers []coa.Publisher, db coa.Database) error {
+func publish(ctx context.Context, publishers []coa.Publisher, db coa.Database, store coa.Storage) error {
+	zones, err := db.GetPrivacyZones(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch privacy zones from db: %w", err)
+	}
+
 	published := false
 	for _, pub := range publishers {
-		img, err := db.GetRandomUnusedImage(pub.Platform())
+		img, err := db.GetRandomUnusedImage(ctx, pub.Platform())
 		if err != nil {
 			return fmt.Errorf("failed to fetch random unused image for platform '%s' from db: %w", pub.Platform(), err)
 		}
 
-		if err := pub.Publish(img, buildDescription(img)); err != nil {
+		// publishers and the description only get to see the obscured coordinates of images inside a privacy zone
+		img = coa.ApplyPrivacyZones(img, zones)
+
+		if err := publishImage(ctx, pub, img, store); err != nil {
 			return fmt.Errorf(
 				"failed to publish file '%s' on platform %s: %w",
 				img.PathLarge,
@@ -90,7 +113,8 @@ func publish(publishers []coa.Publisher, db coa.Database) error {
 				err,
 			)
 		} else {
-			err := db.InsertPost(img, pub.Platform())
+			// the image is out there, so record the post even if the deadline has been reached in the meantime
+			err := db.InsertPost(context.WithoutCancel(ctx), img, pub.Platform())
 			if err != nil {
 				return fmt.Errorf(
 					"failed to insert post of file '%s' on platform %s: %w",
@@ -111,6 +135,31 @@ func publish(publishers []coa.Publisher, db coa.Database) error {
 	return nil
 }
 
+func publishImage(ctx context.Context, pub coa.Publisher, img coa.Image, store coa.Storage) error {
+	content, err := store.Get(ctx, img.StorageKey(coa.RenditionLarge))
+	if err != nil {
+		// images ingested before storage keys were derived from checksums can only be downloaded via their URL
+		content, err = img.Read(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	defer content.Close()
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	// images ingested before metadata was removed during ingestion may still have it
+	sanitized, err := sanitize.JPEG(data, config.ExifAllowlist())
+	if err != nil {
+		return err
+	}
+
+	return pub.Publish(ctx, img, bytes.NewReader(sanitized), buildDescription(img))
+}
+
 func buildDescription(img coa.Image) string {
 	return fmt.Sprintf(
 		"Another fine feline, captured in %v on %v, %v %d %d",
@@ -147,8 +196,27 @@ func buildPublishers() ([]coa.Publisher, error) {
 	return publishers, nil
 }
 
+func timeout() time.Duration {
+	if publishTimeout == "" {
+		return defaultTimeout
+	}
+
+	// validateEnv() made sure this parses
+	d, _ := time.ParseDuration(publishTimeout)
+	return d
+}
+
 func validateEnv() {
-	errs := validation.ValidateDbEnv(dbHost, dbSSLMode, dbName, dbUser, dbPassword)
+	errs := config.ValidateDB()
+	errs = append(errs, config.ValidateStorage()...)
+
+	if err := sanitize.ValidateFields(config.ExifAllowlist()); err != nil {
+		errs = append(errs, fmt.Sprintf("COA_EXIF_ALLOWLIST env var has invalid value: %v", err))
+	}
+
+	if d, err := time.ParseDuration(publishTimeout); publishTimeout != "" && (err != nil || d <= 0) {
+		errs = append(errs, fmt.Sprintf("COABOT_TIMEOUT env var has invalid value '%s'", publishTimeout))
+	}
 
 	if twitterConsumerKey == "" && twitterConsumerSecret == "" && twitterAccessToken == "" && twitterAccessSecret == "" {
 		if mastodonServer == "" && mastodonAccessToken == "" {
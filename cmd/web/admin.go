@@ -0,0 +1,434 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// newAdminHandler returns the handler for the admin API. It expects the "/admin" prefix to still be part of the path
+// and needs to be protected with basicAuth().
+func (app *webApp) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/images/", app.handleAdminImage)
+	mux.HandleFunc("/admin/tags", app.handleAdminTags)
+	mux.HandleFunc("/admin/tags/", app.handleAdminTag)
+	mux.HandleFunc("/admin/cats", app.handleAdminCats)
+	mux.HandleFunc("/admin/cats/", app.handleAdminCat)
+	mux.HandleFunc("/admin/jobs", app.handleAdminJobs)
+	return mux
+}
+
+// handleAdminImage returns an image with its true coordinates, even if it was taken inside a privacy zone, on
+// GET /admin/images/{id} and deletes it on DELETE /admin/images/{id}. The image is only hidden, unless the query
+// parameter "purge" is set to "true". Then it is removed from the database and storage. Requests to
+// /admin/images/{id}/tags are passed on to handleAdminImageTags and requests to /admin/images/{id}/original to
+// handleAdminOriginal.
+func (app *webApp) handleAdminImage(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/admin/images/")
+	idStr, isTags := strings.CutSuffix(idStr, "/tags")
+	idStr, isOriginal := strings.CutSuffix(idStr, "/original")
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid image id"))
+		return
+	}
+
+	if isTags {
+		app.handleAdminImageTags(w, r, id)
+		return
+	}
+
+	if isOriginal {
+		app.handleAdminOriginal(w, r, id)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		image, err := app.db.GetImage(r.Context(), id)
+		if err != nil {
+			writeCatError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, image)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	purge := r.URL.Query().Get("purge") == "true"
+
+	if err := coa.DeleteImage(r.Context(), app.db, app.store, app.originals, id, purge); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("no such catto"))
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("deleted image %d (purge: %v)\n", id, purge)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminOriginal sends the untouched file an image was ingested from on GET /admin/images/{id}/original,
+// including all metadata. Hidden images are included.
+func (app *webApp) handleAdminOriginal(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if app.originals == nil {
+		writeError(w, http.StatusNotFound, errors.New("originals are not kept"))
+		return
+	}
+
+	image, err := app.db.GetImage(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("no such catto"))
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	content, err := app.originals.Get(r.Context(), image.StorageKey(coa.RenditionOriginal))
+	if err != nil {
+		// images ingested before originals were kept don't have one
+		writeError(w, http.StatusNotFound, fmt.Errorf("no original found: %w", err))
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "image/"+image.Format)
+	if _, err := io.Copy(w, content); err != nil {
+		log.Printf("unable to send original of image %d: %v\n", id, err)
+	}
+}
+
+type tagChanges struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// handleAdminImageTags changes the tags of an image on POST /admin/images/{id}/tags. The request body contains the
+// tags to add and remove, e.g. {"add": ["kitten"], "remove": ["ginger"]}. The response contains the updated image.
+func (app *webApp) handleAdminImageTags(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var changes tagChanges
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	add, err := coa.ValidateTags(changes.Add)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	remove, err := coa.ValidateTags(changes.Remove)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// also makes sure the image exists before tagging it
+	if _, err := app.db.GetImage(r.Context(), id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("no such catto"))
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ids := []int64{id}
+	if len(remove) > 0 {
+		if err := app.db.UntagImages(r.Context(), ids, remove); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if len(add) > 0 {
+		if err := app.db.TagImages(r.Context(), ids, add); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	image, err := app.db.GetImage(r.Context(), id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, image)
+}
+
+type tag struct {
+	Name       string `json:"name"`
+	Controlled bool   `json:"controlled"`
+	Images     int    `json:"images"`
+}
+
+// handleAdminTags lists all tags on GET /admin/tags and creates a tag on POST /admin/tags. The request body for
+// creating a tag looks like {"name": "temple", "controlled": true}. Creating an existing tag changes whether it is
+// controlled.
+func (app *webApp) handleAdminTags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tags, err := app.db.GetTags(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		payload := []tag{}
+		for _, t := range tags {
+			payload = append(payload, tag{t.Name, t.Controlled, t.Images})
+		}
+		writeJSON(w, http.StatusOK, payload)
+	case http.MethodPost:
+		var t tag
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+
+		names, err := coa.ValidateTags([]string{t.Name})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := app.db.CreateTag(r.Context(), names[0], t.Controlled); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		log.Printf("created tag '%s' (controlled: %v)\n", names[0], t.Controlled)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminTag deletes a tag and removes it from all images on DELETE /admin/tags/{name}.
+func (app *webApp) handleAdminTag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := coa.NormalizeTag(strings.TrimPrefix(r.URL.Path, "/admin/tags/"))
+
+	if err := app.db.DeleteTag(r.Context(), name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("no such tag"))
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("deleted tag '%s'\n", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type newCat struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// handleAdminCats creates a cat on POST /admin/cats. The request body looks like
+// {"name": "Tiger", "description": "ginger tabby near the temple"}. The response contains the new cat.
+func (app *webApp) handleAdminCats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var c newCat
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name must not be empty"))
+		return
+	}
+
+	id, err := app.db.InsertCat(r.Context(), coa.Cat{Name: c.Name, Description: strings.TrimSpace(c.Description)})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("created cat %d (%s)\n", id, c.Name)
+	app.writeCat(w, r, id, http.StatusCreated)
+}
+
+type catImageChanges struct {
+	Add    []int64 `json:"add"`
+	Remove []int64 `json:"remove"`
+}
+
+type catMerge struct {
+	Cats []int64 `json:"cats"`
+}
+
+// handleAdminCat changes a cat. POST /admin/cats/{id}/images attaches and detaches images, with a request body like
+// {"add": [1, 2], "remove": [3]}. POST /admin/cats/{id}/merge merges other cats that turned out to be the same cat
+// into this one, with a request body like {"cats": [4, 5]}. The response contains the updated cat.
+func (app *webApp) handleAdminCat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/cats/"), "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid cat id"))
+		return
+	}
+
+	switch action {
+	case "images":
+		var changes catImageChanges
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+
+		if err := app.db.UpdateCatImages(r.Context(), id, changes.Add, changes.Remove); err != nil {
+			writeCatError(w, err)
+			return
+		}
+	case "merge":
+		var merge catMerge
+		if err := json.NewDecoder(r.Body).Decode(&merge); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+
+		if slices.Contains(merge.Cats, id) {
+			writeError(w, http.StatusBadRequest, errors.New("unable to merge a cat with itself"))
+			return
+		}
+
+		if err := app.db.MergeCats(r.Context(), id, merge.Cats); err != nil {
+			writeCatError(w, err)
+			return
+		}
+		log.Printf("merged cats %v into cat %d\n", merge.Cats, id)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action '%s'", action))
+		return
+	}
+
+	app.writeCat(w, r, id, http.StatusOK)
+}
+
+// handleAdminJobs lists the jobs for ingesting uploaded files, newest first, on GET /admin/jobs. The query parameter
+// "state" limits the list to jobs in that state, e.g. /admin/jobs?state=failed.
+func (app *webApp) handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobs, err := app.db.GetJobs(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	state := coa.JobState(r.URL.Query().Get("state"))
+	filtered := []coa.Job{}
+	for _, job := range jobs {
+		if state == "" || job.State == state {
+			filtered = append(filtered, job)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, filtered)
+}
+
+func (app *webApp) writeCat(w http.ResponseWriter, r *http.Request, id int64, status int) {
+	cat, err := app.db.GetCat(r.Context(), id)
+	if err != nil {
+		writeCatError(w, err)
+		return
+	}
+
+	writeJSON(w, status, cat)
+}
+
+// writeCatError responds with 404 if a cat or image wasn't found and with 500 otherwise.
+func writeCatError(w http.ResponseWriter, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, errors.New("no such catto"))
+		return
+	}
+
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if _, err := w.Write(b); err != nil {
+		log.Println("failed writing http response:", err)
+	}
+}
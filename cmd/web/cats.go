@@ -0,0 +1,114 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	coa "github.com/haikoschol/cats-of-asia"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type catSightings struct {
+	Cat coa.Cat `json:"cat"`
+	// Sightings are ordered by timestamp, so that the map can draw the territory of the cat.
+	Sightings []coa.Image `json:"sightings"`
+}
+
+func (app *webApp) handleCats(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		handleCorsRequest(w, "GET")
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	cats, err := app.db.GetCats(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if cats == nil {
+		cats = []coa.Cat{}
+	}
+
+	writeCorsHeaders(w, "GET")
+	writeJSON(w, http.StatusOK, cats)
+}
+
+// handleGetCat returns a cat together with all images it appears in on GET /cats/{id}.
+func (app *webApp) handleGetCat(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		handleCorsRequest(w, "GET")
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr, found := strings.CutPrefix(r.URL.Path, "/cats/")
+	if !found || idStr == "" {
+		http.Redirect(w, r, "/cats", http.StatusMovedPermanently)
+		return
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		log.Printf("invalid cat id in url path %s: %v\n", idStr, err)
+		writeError(w, http.StatusNotFound, errors.New("no such catto"))
+		return
+	}
+
+	cat, err := app.db.GetCat(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("no such catto"))
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sightings, err := app.db.GetSightings(r.Context(), id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if sightings == nil {
+		sightings = []coa.Image{}
+	}
+
+	sightings, err = app.applyPrivacyZones(r.Context(), sightings)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeCorsHeaders(w, "GET")
+	writeJSON(w, http.StatusOK, catSightings{cat, sightings})
+}
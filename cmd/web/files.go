@@ -0,0 +1,114 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var sha256Pattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// handleFile serves image files from the directory of the local storage backend. The path below the prefix is the
+// storage key of the file, i.e. <sha256>/<rendition>. Files of hidden images are not served.
+func (app *webApp) handleFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		handleCorsRequest(w, "GET, HEAD")
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	hash, rendition, found := strings.Cut(r.URL.Path, "/")
+	if !found || !sha256Pattern.MatchString(hash) {
+		serve404(w)
+		return
+	}
+
+	// the files of hidden images stay in storage, since they can be shown again
+	image, err := app.db.GetImageBySHA256(r.Context(), hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			serve404(w)
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if image.Hidden {
+		serve404(w)
+		return
+	}
+
+	app.serveImageFile(w, r, hash, rendition, "")
+}
+
+// serveImageFile sends a rendition of an image from the image directory. If the file does not exist and fallbackURL is
+// not empty, the client is redirected there instead.
+//
+// The key of a rendition doesn't change when the file is replaced, e.g. when renditions are created again for changed
+// profiles. So responses are only cached for a day and the ETag is derived from the file, which keeps revalidating
+// cheap.
+func (app *webApp) serveImageFile(w http.ResponseWriter, r *http.Request, hash, rendition, fallbackURL string) {
+	// originals have all metadata and are only available to admins
+	if !sha256Pattern.MatchString(hash) || !coa.IsRenditionName(rendition) || rendition == coa.RenditionOriginal {
+		serve404(w)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(app.imageDir, hash, rendition))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			if fallbackURL != "" {
+				http.Redirect(w, r, fallbackURL, http.StatusFound)
+				return
+			}
+			serve404(w)
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	writeCorsHeaders(w, "GET, HEAD")
+
+	// handles range and conditional requests and detects the Content-Type, since files are stored without extension
+	http.ServeContent(w, r, rendition, stat.ModTime(), f)
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/memory"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleFile(t *testing.T) {
+	ctx := context.Background()
+	db := memory.NewDatabase(1)
+	imageDir := t.TempDir()
+
+	visible := testImage(strings.Repeat("a", 64))
+	hidden := testImage(strings.Repeat("b", 64))
+	if err := db.InsertImages(ctx, []coa.Image{visible, hidden}); err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := db.GetImages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range []string{visible.SHA256, hidden.SHA256, strings.Repeat("c", 64)} {
+		writeTestFile(t, filepath.Join(imageDir, hash, coa.RenditionLarge), hash)
+		writeTestFile(t, filepath.Join(imageDir, hash, coa.RenditionOriginal), hash)
+	}
+
+	for _, img := range images {
+		if img.SHA256 == hidden.SHA256 {
+			if err := db.SetImageHidden(ctx, img.ID, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	app := newWebApp(db, nil, nil, imageDir)
+	handler := http.StripPrefix("/files/", http.HandlerFunc(app.handleFile))
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"visible image", visible.SHA256 + "/large", http.StatusOK},
+		{"hidden image", hidden.SHA256 + "/large", http.StatusNotFound},
+		{"unknown image", strings.Repeat("c", 64) + "/large", http.StatusNotFound},
+		{"original", visible.SHA256 + "/original", http.StatusNotFound},
+		{"missing rendition", visible.SHA256 + "/small", http.StatusNotFound},
+		{"invalid hash", "../" + visible.SHA256 + "/large", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/"+tt.path, nil))
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rec.Code)
+			}
+
+			if tt.status == http.StatusOK && rec.Body.String() != visible.SHA256 {
+				t.Errorf("expected the file of image %s, got %q", visible.SHA256, rec.Body.String())
+			}
+		})
+	}
+}
+
+func testImage(hash string) coa.Image {
+	return coa.Image{
+		URLLarge:  mustParseURL(fmt.Sprintf("https://example.com/files/%s/large", hash)),
+		URLMedium: mustParseURL(fmt.Sprintf("https://example.com/files/%s/medium", hash)),
+		URLSmall:  mustParseURL(fmt.Sprintf("https://example.com/files/%s/small", hash)),
+		SHA256:    hash,
+		Timestamp: time.Date(2023, 10, 29, 7, 30, 0, 0, time.UTC),
+		Timezone:  "Asia/Bangkok",
+		Latitude:  13.7563,
+		Longitude: 100.5018,
+		City:      "Bangkok",
+		Country:   "Thailand",
+	}
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustParseURL(raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
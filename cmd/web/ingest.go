@@ -21,21 +21,23 @@ import (
 	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
-	coa "github.com/haikoschol/cats-of-asia"
 	"github.com/haikoschol/cats-of-asia/pkg/ingestion"
 	"golang.org/x/net/webdav"
 	"io/fs"
+	"log"
 	"os"
 	"path"
 )
 
 type file struct {
-	name     string
-	path     string
-	mode     os.FileMode
-	created  bool
-	f        webdav.File
-	ingestor *ingestion.Ingestor
+	// ctx is the context of the request that uploads the file
+	ctx     context.Context
+	name    string
+	path    string
+	mode    os.FileMode
+	created bool
+	f       webdav.File
+	queue   *ingestion.JobQueue
 }
 
 func (f *file) Read(p []byte) (n int, err error) {
@@ -64,60 +66,50 @@ func (f *file) Close() error {
 	}
 
 	if f.mode.IsRegular() && f.created {
-		// TODO only pass the new file to Ingestor
-		// TODO offload ingestion onto a goroutine worker pool (maybe put impl in Ingestor)
-		images, err := f.ingestor.IngestDirectory(f.path)
-		if err != nil {
-			sentry.CaptureMessage(fmt.Sprintf("failed to ingest uploaded image: %v", err))
-			return err // returning an error causes the webdav request handler to respond with 404
-		}
-
-		if err := f.cleanup(images); err != nil {
+		// ingestion takes too long for the request, so the file is ingested in the background
+		if err := f.enqueue(); err != nil {
 			sentry.CaptureException(err)
-			return err
+			return err // returning an error causes the webdav request handler to respond with 404
 		}
 	}
 
 	return nil
 }
 
-func (f *file) cleanup(images []coa.Image) error {
-	msg := "failed to delete uploaded file %s: %w"
-	// the uploaded file was already found in the database
-	if len(images) == 0 {
-		p := path.Join(f.path, f.name)
-		if err := os.Remove(p); err != nil {
-			return fmt.Errorf(msg, p, err)
-		}
-	} else {
-		for _, img := range images {
-			if err := os.Remove(img.PathLarge); err != nil {
-				return fmt.Errorf(msg, img.PathLarge, err)
-			}
-
-			if err := os.Remove(img.PathMedium); err != nil {
-				return fmt.Errorf(msg, img.PathMedium, err)
-			}
-
-			if err := os.Remove(img.PathSmall); err != nil {
-				return fmt.Errorf(msg, img.PathSmall, err)
-			}
-		}
+// enqueue adds a job for ingesting the uploaded file and removes the local copy.
+func (f *file) enqueue() error {
+	p := path.Join(f.path, f.name)
+
+	content, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("unable to open uploaded file %s: %w", p, err)
+	}
+	defer content.Close()
+
+	id, err := f.queue.Enqueue(f.ctx, f.name, content)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("added job %d for ingesting %s\n", id, f.name)
+
+	if err := os.Remove(p); err != nil {
+		return fmt.Errorf("failed to delete uploaded file %s: %w", p, err)
 	}
 	return nil
 }
 
 type fileSystem struct {
-	path     string
-	dir      webdav.Dir
-	ingestor *ingestion.Ingestor
+	path  string
+	dir   webdav.Dir
+	queue *ingestion.JobQueue
 }
 
-func newFileSystem(path string, ingestor *ingestion.Ingestor) *fileSystem {
+func newFileSystem(path string, queue *ingestion.JobQueue) *fileSystem {
 	return &fileSystem{
-		path:     path,
-		dir:      webdav.Dir(path),
-		ingestor: ingestor,
+		path:  path,
+		dir:   webdav.Dir(path),
+		queue: queue,
 	}
 }
 
@@ -126,7 +118,7 @@ func (fs *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode)
 }
 
 func (fs *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
-	if !coa.IsSupportedMedia(name) {
+	if !fs.queue.SupportsMedia(name) {
 		return nil, errors.New("unsupported file type")
 	}
 
@@ -136,12 +128,13 @@ func (fs *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm
 	}
 
 	return &file{
-		name:     name,
-		path:     fs.path,
-		mode:     perm,
-		created:  flag&os.O_CREATE != 0,
-		f:        wf,
-		ingestor: fs.ingestor,
+		ctx:     ctx,
+		name:    name,
+		path:    fs.path,
+		mode:    perm,
+		created: flag&os.O_CREATE != 0,
+		f:       wf,
+		queue:   fs.queue,
 	}, nil
 }
 
@@ -17,6 +17,8 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"database/sql"
 	"embed"
 	"encoding/json"
@@ -24,9 +26,11 @@ import (
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/config"
+	"github.com/haikoschol/cats-of-asia/pkg/database"
 	"github.com/haikoschol/cats-of-asia/pkg/ingestion"
 	"github.com/haikoschol/cats-of-asia/pkg/monitoring"
-	"github.com/haikoschol/cats-of-asia/pkg/postgres"
+	"github.com/haikoschol/cats-of-asia/pkg/storage"
 	"github.com/haikoschol/cats-of-asia/pkg/validation"
 	_ "github.com/joho/godotenv/autoload"
 	_ "github.com/lib/pq"
@@ -35,28 +39,32 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
-var (
-	dbHost     = os.Getenv("COA_DB_HOST")
-	dbSSLMode  = os.Getenv("COA_DB_SSLMODE")
-	dbName     = os.Getenv("COA_DB_NAME")
-	dbUser     = os.Getenv("COA_DB_USER")
-	dbPassword = os.Getenv("COA_DB_PASSWORD")
+// shutdownTimeout is the time running requests have to finish when the server is stopped.
+const shutdownTimeout = 30 * time.Second
 
+var (
 	mapboxAccessToken = os.Getenv("COA_MAPBOX_ACCESS_TOKEN")
 
-	googleMapsAPIKey     = os.Getenv("COA_GOOGLE_MAPS_API_KEY")
-	svcAccountEmail      = os.Getenv("COA_GOOGLE_DRIVE_EMAIL")
-	svcAccountPrivateKey = os.Getenv("COA_GOOGLE_DRIVE_PRIVATE_KEY")
-	gdriveFolderID       = os.Getenv("COA_GOOGLE_DRIVE_FOLDER_ID")
-
 	webdavUsername = os.Getenv("COA_WEBDAV_USERNAME")
 	webdavPassword = os.Getenv("COA_WEBDAV_PASSWORD")
 
+	// optional number of uploads ingested at the same time and of attempts per upload
+	jobWorkers     = os.Getenv("COA_JOB_WORKERS")
+	jobMaxAttempts = os.Getenv("COA_JOB_MAX_ATTEMPTS")
+
+	// optional, the admin API under /admin/ is only available if both are set
+	adminUsername = os.Getenv("COA_ADMIN_USERNAME")
+	adminPassword = os.Getenv("COA_ADMIN_PASSWORD")
+
 	sentryDSN = os.Getenv("SENTRY_DSN")
 
 	//go:embed "static"
@@ -75,42 +83,118 @@ func main() {
 		log.Fatal(err)
 	}
 
-	db, err := postgres.NewDatabase(dbUser, dbPassword, dbHost, dbName, postgres.SSLMode(dbSSLMode))
+	db, err := database.New(config.DB())
 	if err != nil {
 		log.Fatalf("unable to connect to database: %v\n", err)
 	}
 
-	creds := ingestion.GoogleCredentials{
-		MapsAPIKey:           googleMapsAPIKey,
-		SvcAccountEmail:      svcAccountEmail,
-		SvcAccountPrivateKey: svcAccountPrivateKey,
+	storageCfg := config.Storage()
+	store, err := storage.New(storageCfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	ingestor, err := ingestion.NewIngestor(db, creds, gdriveFolderID, log.Printf, false)
+	geocoder, err := config.NewGeocoder()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	webdavHandler, err := newWebDavHandler(webdavUsername, webdavPassword, ingestor)
+	timezones, err := config.NewTimezoneResolver()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	api, err := newWebApp(dbUser, dbPassword, dbHost, dbName, dbSSLMode)
+	profiles, err := ingestion.LoadRenditionProfiles(config.RenditionProfilesPath())
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	metadata, err := config.Metadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ingestor := ingestion.NewIngestor(
+		db,
+		store,
+		geocoder,
+		timezones,
+		config.NearDuplicates(),
+		profiles,
+		metadata,
+		config.Concurrency(),
+		false,
+		log.Printf,
+		false,
+	)
+
+	queue := ingestion.NewJobQueue(db, ingestor, jobConfig(), log.Printf)
+
+	webdavHandler, err := newWebDavHandler(webdavUsername, webdavPassword, queue)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var imageDir string
+	if storageCfg.Backend == storage.Local {
+		imageDir = storageCfg.LocalDir
+	}
+
+	api := newWebApp(db, store, metadata.Originals, imageDir)
+
 	mux := http.NewServeMux()
 	mux.Handle("/webdav/", http.StripPrefix("/webdav", webdavHandler))
 	mux.HandleFunc("/images", api.handleImages)
 	mux.HandleFunc("/images/", api.handleGetImage)
+	mux.HandleFunc("/cats", api.handleCats)
+	mux.HandleFunc("/cats/", api.handleGetCat)
+
+	if adminUsername != "" && adminPassword != "" {
+		mux.Handle("/admin/", basicAuth(adminUsername, adminPassword, api.newAdminHandler()))
+	}
+
+	if imageDir != "" {
+		// serve images from local storage under the path of the URL they were stored with (e.g. /files/)
+		u, err := url.Parse(storageCfg.LocalURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		prefix := strings.TrimSuffix(u.Path, "/") + "/"
+		mux.Handle(prefix, http.StripPrefix(prefix, http.HandlerFunc(api.handleFile)))
+	}
 
 	mux.Handle("/static/", http.FileServer(staticFs))
 	mux.HandleFunc("/", api.handleIndex)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	queueDone := make(chan struct{})
+	go func() {
+		queue.Run(ctx)
+		close(queueDone)
+	}()
+
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("unable to shut down server: %v\n", err)
+		}
+	}()
+
 	log.Print("Starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// interrupted jobs are put back into the queue before exiting
+	<-queueDone
 }
 
 func (app *webApp) handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -147,7 +231,30 @@ func (app *webApp) handleImages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	images, err := app.db.GetImages()
+	// several tags can be given by repeating the parameter, e.g. /images?tag=kitten&tag=ginger
+	tags, err := coa.ValidateTags(r.URL.Query()["tag"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	images, err := app.db.GetImages(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(tags) > 0 {
+		var tagged []coa.Image
+		for _, img := range images {
+			if img.HasTags(tags...) {
+				tagged = append(tagged, img)
+			}
+		}
+		images = tagged
+	}
+
+	images, err = app.applyPrivacyZones(r.Context(), images)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -192,7 +299,7 @@ func (app *webApp) handleGetImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	image, err := app.db.GetImage(int64(id))
+	image, err := app.db.GetImage(r.Context(), int64(id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("no such catto"))
@@ -203,57 +310,97 @@ func (app *webApp) handleGetImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if image.Hidden {
+		writeError(w, http.StatusNotFound, errors.New("no such catto"))
+		return
+	}
+
 	var url string
-	switch strings.ToLower(r.URL.Query().Get("size")) {
-	case "small":
-	case "smol":
+	var rendition string
+	size := strings.ToLower(r.URL.Query().Get("size"))
+	switch size {
+	case "small", "smol":
 		url = image.URLSmall.String()
+		rendition = coa.RenditionSmall
 	case "medium":
 		url = image.URLMedium.String()
+		rendition = coa.RenditionMedium
 	default:
 		url = image.URLLarge.String()
+		rendition = coa.RenditionLarge
+
+		// renditions of other profiles
+		if custom, ok := image.Rendition(size); ok {
+			url = custom.URL.String()
+			rendition = custom.Name
+		}
+	}
+
+	if app.imageDir != "" {
+		// images ingested before the local storage backend was used still live at their original URL
+		app.serveImageFile(w, r, image.SHA256, rendition, url)
+		return
 	}
 
 	http.Redirect(w, r, url, http.StatusMovedPermanently)
 }
 
 type webApp struct {
-	db coa.Database
+	db    coa.Database
+	store coa.Storage
+	// originals is the private storage for the files images were ingested from. nil if originals are not kept.
+	originals coa.Storage
+	// imageDir is the directory of the local storage backend. Empty if images are kept elsewhere.
+	imageDir string
 }
 
-func newWebApp(dbUser, dbPassword, dbHost, dbName, dbSSLMode string) (*webApp, error) {
-	db, err := postgres.NewDatabase(dbUser, dbPassword, dbHost, dbName, postgres.SSLMode(dbSSLMode))
+// applyPrivacyZones obscures the coordinates of images that were taken inside a privacy zone. It must be called
+// before images are sent to anyone but admins.
+func (app *webApp) applyPrivacyZones(ctx context.Context, images []coa.Image) ([]coa.Image, error) {
+	zones, err := app.db.GetPrivacyZones(ctx)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to load privacy zones: %w", err)
 	}
 
-	return &webApp{db}, nil
+	for idx := range images {
+		images[idx] = coa.ApplyPrivacyZones(images[idx], zones)
+	}
+	return images, nil
+}
+
+func newWebApp(db coa.Database, store, originals coa.Storage, imageDir string) *webApp {
+	return &webApp{db, store, originals, imageDir}
 }
 
-func newWebDavHandler(username, password string, ingestor *ingestion.Ingestor) (http.Handler, error) {
+func newWebDavHandler(username, password string, queue *ingestion.JobQueue) (http.Handler, error) {
 	imgDir, err := os.MkdirTemp("", "coa-webdav")
 	if err != nil {
 		return nil, err
 	}
 
 	handler := &webdav.Handler{
-		FileSystem: newFileSystem(imgDir, ingestor),
+		FileSystem: newFileSystem(imgDir, queue),
 		LockSystem: webdav.NewMemLS(),
 	}
 
-	wrappedHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return basicAuth(username, password, handler), nil
+}
+
+// basicAuth only passes requests with the given credentials on to h.
+func basicAuth(username, password string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 
 		user, pass, ok := r.BasicAuth()
-		if !ok || user != username || pass != password {
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !userOK || !passOK {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		handler.ServeHTTP(w, r)
+		h.ServeHTTP(w, r)
 	})
-
-	return wrappedHandler, nil
 }
 
 func writeError(w http.ResponseWriter, status int, err error) {
@@ -309,27 +456,40 @@ func serve404(w http.ResponseWriter) {
 	}
 }
 
-func validateEnv() {
-	errs := validation.ValidateDbEnv(dbHost, dbSSLMode, dbName, dbUser, dbPassword)
-
-	if mapboxAccessToken == "" {
-		errs = append(errs, "env var COA_MAPBOX_ACCESS_TOKEN not set")
+func jobConfig() ingestion.JobConfig {
+	// files uploaded via WebDAV are kept in private storage until they have been ingested
+	uploads, err := storage.New(config.PrivateStorage("UPLOADS"))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if svcAccountEmail == "" {
-		errs = append(errs, "env var COA_GOOGLE_DRIVE_EMAIL not set")
-	}
+	// already validated. zero means the default
+	workers, _ := strconv.Atoi(jobWorkers)
+	maxAttempts, _ := strconv.Atoi(jobMaxAttempts)
 
-	if svcAccountPrivateKey == "" {
-		errs = append(errs, "env var COA_GOOGLE_DRIVE_PRIVATE_KEY not set")
+	return ingestion.JobConfig{
+		Uploads:     uploads,
+		Workers:     workers,
+		MaxAttempts: maxAttempts,
+		Failed: func(job coa.Job, err error) {
+			sentry.CaptureMessage(fmt.Sprintf("failed to ingest uploaded image %s: %v", job.FileName, err))
+		},
 	}
+}
 
-	if googleMapsAPIKey == "" {
-		errs = append(errs, "env var COA_GOOGLE_MAPS_API_KEY not set")
-	}
+func validateEnv() {
+	errs := config.ValidateDB()
+	errs = append(errs, config.ValidateStorage()...)
+	errs = append(errs, config.ValidateIngestion()...)
+	errs = append(errs, validation.ValidateJobEnv(
+		config.PrivateStorage("UPLOADS"),
+		config.Storage(),
+		jobWorkers,
+		jobMaxAttempts,
+	)...)
 
-	if gdriveFolderID == "" {
-		errs = append(errs, "COA_GOOGLE_DRIVE_FOLDER_ID env var missing")
+	if mapboxAccessToken == "" {
+		errs = append(errs, "env var COA_MAPBOX_ACCESS_TOKEN not set")
 	}
 
 	if webdavUsername == "" {
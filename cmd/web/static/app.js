@@ -23,11 +23,11 @@ let images = [];
 let map = null;
 
 function makePopupContent(image, map) {
-    const {id, urlSmall, urlLarge, timestamp} = image;
+    const {id, urlSmall, urlLarge, timestamp, renditions} = image;
     const date = new Date(timestamp).toDateString();
     const location = formatLocation(image);
     const outer = document.createElement('div');
-    const catImage = makeImageLink(urlLarge, urlSmall, `photo #${id}, showing one or more cats`);
+    const catImage = makeImageLink(urlLarge, urlSmall, `photo #${id}, showing one or more cats`, renditions);
     outer.appendChild(catImage);
 
     const footer = document.createElement('div');
@@ -54,11 +54,18 @@ function makePopupContent(image, map) {
     return outer;
 }
 
-function makeImageLink(href, src, alt) {
+function makeImageLink(href, src, alt, renditions = []) {
     const img = document.createElement('img');
     img.src = src;
     img.alt = alt;
 
+    // lets the browser pick a sharper rendition on high density screens. the popup shows the small rendition
+    const small = renditions.find(r => r.name === 'small');
+    if (small) {
+        img.srcset = renditions.map(r => `${r.url} ${r.width}w`).join(', ');
+        img.sizes = `${small.width}px`;
+    }
+
     const a = document.createElement('a');
     a.href = href;
     a.appendChild(img);
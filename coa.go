@@ -17,19 +17,43 @@
 package coa
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
+)
+
+const (
+	RenditionLarge  = "large"
+	RenditionMedium = "medium"
+	RenditionSmall  = "small"
+	// RenditionOriginal is the untouched file the image was ingested from. It is kept in a separate storage that isn't
+	// publicly accessible, since it contains all metadata, e.g. the precise location.
+	RenditionOriginal = "original"
+)
+
+// Formats of the files images can be ingested from
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+	FormatHEIC = "heic"
 )
 
 type Image struct {
 	ID           int64
 	CoordinateID *int64
+	PathOriginal string
 	PathLarge    string
 	PathMedium   string
 	PathSmall    string
@@ -43,6 +67,20 @@ type Image struct {
 	Longitude    float64
 	City         string
 	Country      string
+	// Hidden images are not shown or published, but are still known to the ingestor.
+	Hidden bool
+	// Tags are sorted by name.
+	Tags []string
+	// PHash is the perceptual hash of the image, used for finding near-duplicates. Zero if unknown.
+	PHash uint64
+	// Format of the original file, e.g. FormatHEIC
+	Format string
+	// Renditions contains all stored versions of the image, sorted by width. Images that were ingested before
+	// renditions were recorded may have none.
+	Renditions []Rendition
+	// Obscured replaces Latitude and Longitude in the public representation of the image if it was taken inside a
+	// privacy zone. It is set by ApplyPrivacyZones.
+	Obscured *GeoPoint
 }
 
 func (img Image) Path() string {
@@ -53,27 +91,46 @@ func (img Image) Name() string {
 	return filepath.Base(img.Path())
 }
 
-func (img Image) Read() (io.ReadCloser, error) {
-	resp, err := http.Get(img.URLLarge.String())
-	if err != nil {
-		return nil, fmt.Errorf("unable to download image from %s: %w", img.URLLarge, err)
-	}
-	return resp.Body, nil
+// StorageKey returns the key under which the given rendition of the image is kept in a Storage. Keys are derived
+// from the SHA256 checksum of the image, since file names of photos from different devices tend to collide.
+func (img Image) StorageKey(rendition string) string {
+	return path.Join(img.SHA256, rendition)
+}
+
+// HasOriginal checks whether the image was ingested from a file in another format than the large rendition.
+func (img Image) HasOriginal() bool {
+	return img.Format != "" && img.Format != FormatJPEG
 }
 
-func (img Image) Content() ([]byte, error) {
-	body, err := img.Read()
+func (img Image) Read(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, img.URLLarge.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	defer body.Close()
 
-	data, err := io.ReadAll(body)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read image response: %w", err)
+		return nil, fmt.Errorf("unable to download image from %s: %w", img.URLLarge, err)
 	}
+	return resp.Body, nil
+}
 
-	return data, nil
+// HasTags checks whether the image has all the given tags.
+func (img Image) HasTags(tags ...string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range img.Tags {
+			if t == NormalizeTag(tag) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+	return true
 }
 
 func (img Image) Location() string {
@@ -90,29 +147,236 @@ func (img Image) Location() string {
 	return fmt.Sprintf("%s, %s", img.City, img.Country)
 }
 
+// PublicCoordinates returns the coordinates of the image that may be published.
+func (img Image) PublicCoordinates() GeoPoint {
+	if img.Obscured != nil {
+		return *img.Obscured
+	}
+	return GeoPoint{img.Latitude, img.Longitude}
+}
+
+// Rendition returns the rendition with the given name.
+func (img Image) Rendition(name string) (Rendition, bool) {
+	for _, r := range img.Renditions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rendition{}, false
+}
+
+type renditionJSON struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+	Format string `json:"format"`
+}
+
 func (img Image) MarshalJSON() ([]byte, error) {
+	// always an array, so clients don't need to check for null
+	tags := img.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	// allows the frontend to build a srcset
+	renditions := []renditionJSON{}
+	for _, r := range img.Renditions {
+		renditions = append(renditions, renditionJSON{r.Name, r.URL.String(), r.Width, r.Height, r.Size, r.Format})
+	}
+
+	coordinates := img.PublicCoordinates()
+
+	return json.Marshal(struct {
+		ID         int64           `json:"id"`
+		URLLarge   string          `json:"urlLarge"`
+		URLMedium  string          `json:"urlMedium"`
+		URLSmall   string          `json:"urlSmall"`
+		SHA256     string          `json:"sha256"`
+		Timestamp  time.Time       `json:"timestamp"`
+		Latitude   float64         `json:"latitude"`
+		Longitude  float64         `json:"longitude"`
+		City       string          `json:"city"`
+		Country    string          `json:"country"`
+		Tags       []string        `json:"tags"`
+		Format     string          `json:"format"`
+		Renditions []renditionJSON `json:"renditions"`
+	}{
+		ID:         img.ID,
+		URLLarge:   img.URLLarge.String(),
+		URLMedium:  img.URLMedium.String(),
+		URLSmall:   img.URLSmall.String(),
+		SHA256:     img.SHA256,
+		Timestamp:  img.Timestamp,
+		Latitude:   coordinates.Latitude,
+		Longitude:  coordinates.Longitude,
+		City:       img.City,
+		Country:    img.Country,
+		Tags:       tags,
+		Format:     img.Format,
+		Renditions: renditions,
+	})
+}
+
+// Rendition is a version of an image in a particular size and format.
+type Rendition struct {
+	Name string
+	URL  *url.URL
+	// Path is the local file of the rendition during ingestion.
+	Path   string
+	Width  int
+	Height int
+	// Size of the file in bytes
+	Size   int64
+	Format string
+}
+
+// RenditionProfile describes how a rendition is derived from the large rendition of an image.
+type RenditionProfile struct {
+	Name string `json:"name"`
+	// MaxWidth and MaxHeight limit the size of the rendition. The aspect ratio is kept and images are never scaled up.
+	// Zero means no limit.
+	MaxWidth  int `json:"maxWidth"`
+	MaxHeight int `json:"maxHeight"`
+	// Format is either FormatJPEG or FormatPNG.
+	Format string `json:"format"`
+	// Quality of JPEGs from 1 to 100
+	Quality     int  `json:"quality"`
+	Progressive bool `json:"progressive"`
+}
+
+// DefaultRenditionProfiles are used unless other profiles are configured. The website and the bots need at least the
+// small and medium renditions.
+var DefaultRenditionProfiles = []RenditionProfile{
+	{Name: RenditionMedium, MaxWidth: 600, Format: FormatJPEG, Quality: 100},
+	{Name: RenditionSmall, MaxWidth: 300, Format: FormatJPEG, Quality: 100},
+}
+
+var renditionNamePattern = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+// IsRenditionName checks whether name is a valid name for a rendition, which is also safe to use in storage keys and
+// file paths.
+func IsRenditionName(name string) bool {
+	return renditionNamePattern.MatchString(name)
+}
+
+// ValidateRenditionProfiles checks that the profiles include the small and medium renditions, that names are unique
+// and can be used in storage keys, and that all settings are in range.
+func ValidateRenditionProfiles(profiles []RenditionProfile) error {
+	names := make(map[string]bool)
+
+	for _, p := range profiles {
+		if !IsRenditionName(p.Name) {
+			return fmt.Errorf("invalid rendition name '%s'", p.Name)
+		}
+
+		if p.Name == RenditionLarge || p.Name == RenditionOriginal {
+			return fmt.Errorf("rendition name '%s' is reserved", p.Name)
+		}
+
+		if names[p.Name] {
+			return fmt.Errorf("duplicate rendition profile '%s'", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.MaxWidth < 0 || p.MaxHeight < 0 {
+			return fmt.Errorf("rendition profile '%s' has a negative size", p.Name)
+		}
+
+		switch p.Format {
+		case FormatJPEG:
+			if p.Quality < 1 || p.Quality > 100 {
+				return fmt.Errorf("rendition profile '%s' has invalid quality %d", p.Name, p.Quality)
+			}
+		case FormatPNG:
+			if p.Progressive {
+				return fmt.Errorf("rendition profile '%s': only JPEGs can be progressive", p.Name)
+			}
+		default:
+			return fmt.Errorf("rendition profile '%s' has unsupported format '%s'", p.Name, p.Format)
+		}
+	}
+
+	for _, required := range []string{RenditionSmall, RenditionMedium} {
+		if !names[required] {
+			return fmt.Errorf("rendition profile '%s' is missing", required)
+		}
+	}
+	return nil
+}
+
+// MaxTagLength is the maximum number of characters in a tag.
+const MaxTagLength = 64
+
+// Tag is a label that can be attached to images, e.g. "kitten" or "temple". Controlled tags are part of the curated
+// vocabulary and are created explicitly, whereas free-form tags are created on the fly when tagging an image.
+type Tag struct {
+	Name       string
+	Controlled bool
+	// Images is the number of images with this tag.
+	Images int
+}
+
+// NormalizeTag converts a tag to lower case and collapses whitespace, so that e.g. "Ginger " and "ginger" are the
+// same tag.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// ValidateTags normalizes tags and checks that they are neither empty nor too long.
+func ValidateTags(tags []string) ([]string, error) {
+	var normalized []string
+	for _, tag := range tags {
+		t := NormalizeTag(tag)
+		if t == "" {
+			return nil, errors.New("tags must not be empty")
+		}
+
+		if utf8.RuneCountInString(t) > MaxTagLength {
+			return nil, fmt.Errorf("tag '%s' is longer than %d characters", t, MaxTagLength)
+		}
+		normalized = append(normalized, t)
+	}
+	return normalized, nil
+}
+
+// Cat is an individual cat that appears in one or more images, e.g. a street cat that was photographed on different
+// days.
+type Cat struct {
+	ID          int64
+	Name        string
+	Description string
+	// FirstSeen and LastSeen are the timestamps of the earliest and latest image of the cat, in UTC. Both are zero if
+	// there are no images of the cat.
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Sightings is the number of images of the cat.
+	Sightings int
+}
+
+func (c Cat) MarshalJSON() ([]byte, error) {
+	var firstSeen, lastSeen *time.Time
+	if !c.FirstSeen.IsZero() {
+		firstSeen = &c.FirstSeen
+		lastSeen = &c.LastSeen
+	}
+
 	return json.Marshal(struct {
-		ID        int64     `json:"id"`
-		URLLarge  string    `json:"urlLarge"`
-		URLMedium string    `json:"urlMedium"`
-		URLSmall  string    `json:"urlSmall"`
-		SHA256    string    `json:"sha256"`
-		Timestamp time.Time `json:"timestamp"`
-		Latitude  float64   `json:"latitude"`
-		Longitude float64   `json:"longitude"`
-		City      string    `json:"city"`
-		Country   string    `json:"country"`
+		ID          int64      `json:"id"`
+		Name        string     `json:"name"`
+		Description string     `json:"description"`
+		FirstSeen   *time.Time `json:"firstSeen"`
+		LastSeen    *time.Time `json:"lastSeen"`
+		Sightings   int        `json:"sightings"`
 	}{
-		ID:        img.ID,
-		URLLarge:  img.URLLarge.String(),
-		URLMedium: img.URLMedium.String(),
-		URLSmall:  img.URLSmall.String(),
-		SHA256:    img.SHA256,
-		Timestamp: img.Timestamp,
-		Latitude:  img.Latitude,
-		Longitude: img.Longitude,
-		City:      img.City,
-		Country:   img.Country,
+		ID:          c.ID,
+		Name:        c.Name,
+		Description: c.Description,
+		FirstSeen:   firstSeen,
+		LastSeen:    lastSeen,
+		Sightings:   c.Sightings,
 	})
 }
 
@@ -124,29 +388,264 @@ const (
 )
 
 type Database interface {
-	GetOrCreateLocation(city, country, timezone string) (int64, error)
-	GetOrCreateCoordinates(latitude, longitude float64, locationId int64) (int64, error)
-	GetCoordinateID(latitude, longitude float64) (int64, error)
-	GetImage(id int64) (Image, error)
-	GetImages() ([]Image, error)
-	GetRandomUnusedImage(platform Platform) (Image, error)
-	GetUnusedImageCount(platform Platform) (int, error)
-	RemoveKnownImages(images []Image) ([]Image, error)
-	InsertImages(images []Image) error
-	InsertPost(image Image, platform Platform) error
+	GetOrCreateLocation(ctx context.Context, city, country, timezone string) (int64, error)
+	GetOrCreateCoordinates(ctx context.Context, latitude, longitude float64, locationId int64) (int64, error)
+	GetCoordinateID(ctx context.Context, latitude, longitude float64) (int64, error)
+	// GetKnownLocation returns the place and time zone of coordinates that are in the database already. Returns
+	// sql.ErrNoRows if they aren't.
+	GetKnownLocation(ctx context.Context, latitude, longitude float64) (KnownLocation, error)
+	GetImage(ctx context.Context, id int64) (Image, error)
+	// GetImageBySHA256 returns the image with the given checksum, including hidden images. Returns sql.ErrNoRows if
+	// there is none.
+	GetImageBySHA256(ctx context.Context, sha256 string) (Image, error)
+	GetImages(ctx context.Context) ([]Image, error)
+	GetRandomUnusedImage(ctx context.Context, platform Platform) (Image, error)
+	GetUnusedImageCount(ctx context.Context, platform Platform) (int, error)
+	RemoveKnownImages(ctx context.Context, images []Image) ([]Image, error)
+	// GetPerceptualHashes returns the perceptual hashes of all images by image ID, including hidden images.
+	GetPerceptualHashes(ctx context.Context) (map[int64]uint64, error)
+	InsertImages(ctx context.Context, images []Image) error
+	// InsertRenditions adds renditions to an image or replaces existing ones with the same name. The URLs of the
+	// large, medium and small renditions of the image are updated as well.
+	InsertRenditions(ctx context.Context, imageID int64, renditions []Rendition) error
+	InsertPost(ctx context.Context, image Image, platform Platform) error
+	GetPlaceAliases(ctx context.Context) ([]PlaceAlias, error)
+	InsertPlaceAlias(ctx context.Context, alias PlaceAlias) (int64, error)
+	DeletePlaceAlias(ctx context.Context, id int64) error
+	// GetPrivacyZones returns all privacy zones, ordered by ID.
+	GetPrivacyZones(ctx context.Context) ([]PrivacyZone, error)
+	InsertPrivacyZone(ctx context.Context, zone PrivacyZone) (int64, error)
+	DeletePrivacyZone(ctx context.Context, id int64) error
+	SetImageHidden(ctx context.Context, id int64, hidden bool) error
+	DeleteImage(ctx context.Context, id int64) error
+	GetTags(ctx context.Context) ([]Tag, error)
+	CreateTag(ctx context.Context, name string, controlled bool) error
+	DeleteTag(ctx context.Context, name string) error
+	TagImages(ctx context.Context, imageIDs []int64, tags []string) error
+	UntagImages(ctx context.Context, imageIDs []int64, tags []string) error
+	GetCats(ctx context.Context) ([]Cat, error)
+	GetCat(ctx context.Context, id int64) (Cat, error)
+	// GetSightings returns the images of a cat, ordered by timestamp.
+	GetSightings(ctx context.Context, catID int64) ([]Image, error)
+	InsertCat(ctx context.Context, cat Cat) (int64, error)
+	// MergeCats moves the images of the cats with the IDs sourceIDs to the cat with ID targetID and deletes the former,
+	// all in one transaction. Returns sql.ErrNoRows if one of the cats doesn't exist.
+	MergeCats(ctx context.Context, targetID int64, sourceIDs []int64) error
+	// UpdateCatImages detaches and then attaches images of a cat in one transaction. Returns sql.ErrNoRows if the cat
+	// or one of the images to attach doesn't exist.
+	UpdateCatImages(ctx context.Context, catID int64, attach, detach []int64) error
+	InsertJob(ctx context.Context, job Job) (int64, error)
+	// ClaimJob marks the job that has been due for the longest time as running and returns it. Jobs that have been
+	// running for longer than lease are claimed again, since their worker probably died, unless that happened in
+	// attempt number maxAttempts. Those are marked as failed with JobAbandoned instead. Concurrent callers never get
+	// the same job. Returns sql.ErrNoRows if no job is due.
+	ClaimJob(ctx context.Context, lease time.Duration, maxAttempts int) (Job, error)
+	// CompleteJob, RetryJob, FailJob and ReleaseJob update a job that was returned by ClaimJob. They return
+	// sql.ErrNoRows if the job has been updated or claimed again since, e.g. because its lease expired.
+	CompleteJob(ctx context.Context, job Job) error
+	// RetryJob puts a job back into the queue after a failed attempt.
+	RetryJob(ctx context.Context, job Job, lastError string, runAt time.Time) error
+	// FailJob marks a job as failed for good.
+	FailJob(ctx context.Context, job Job, lastError string) error
+	// ReleaseJob puts a claimed job back into the queue without counting the attempt, e.g. because it was interrupted
+	// by a shutdown.
+	ReleaseJob(ctx context.Context, job Job) error
+	// GetJobs returns all jobs, newest first.
+	GetJobs(ctx context.Context) ([]Job, error)
 	Close() error
 }
 
+// DeleteImage hides an image or, if purge is true, removes it from the database together with its posts and deletes
+// the files of all renditions from storage. The original file is deleted from originals, unless it is nil.
+// Coordinates and locations that are no longer used by any image are removed as well.
+func DeleteImage(ctx context.Context, db Database, store, originals Storage, id int64, purge bool) error {
+	if !purge {
+		return db.SetImageHidden(ctx, id, true)
+	}
+
+	img, err := db.GetImage(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// the database goes first, so that nothing refers to the files anymore if deleting them fails
+	if err := db.DeleteImage(ctx, id); err != nil {
+		return err
+	}
+
+	// files are deleted by URL, since not all of them are stored under the key derived from the rendition name
+	urls := make(map[string]*url.URL)
+	for _, u := range []*url.URL{img.URLLarge, img.URLMedium, img.URLSmall} {
+		if u != nil {
+			urls[u.String()] = u
+		}
+	}
+	for _, r := range img.Renditions {
+		if r.URL != nil {
+			urls[r.URL.String()] = r.URL
+		}
+	}
+
+	var errs []error
+	for _, u := range urls {
+		if err := store.DeleteURL(ctx, u); err != nil {
+			errs = append(errs, fmt.Errorf("unable to delete %s from storage: %w", u, err))
+		}
+	}
+
+	if originals != nil {
+		key := img.StorageKey(RenditionOriginal)
+		// images ingested before originals were kept don't have one
+		if err := originals.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("unable to delete %s from storage for originals: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // Publisher allows posting images to a platform.
 type Publisher interface {
 	// Platform returns the platform a Publisher instance posts to.
 	Platform() Platform
-	// Publish sends an image together with a description to a platform.
-	Publish(image Image, description string) error
+	// Publish sends an image, the file content of which is read from content, together with a description to a
+	// platform.
+	Publish(ctx context.Context, image Image, content io.Reader, description string) error
+}
+
+// Storage allows storing image files and retrieving them again.
+type Storage interface {
+	// Put stores the content read from r under the given key.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the content stored under the given key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the content stored under the given key.
+	Delete(ctx context.Context, key string) error
+	// URL returns the public URL of the content stored under the given key.
+	URL(ctx context.Context, key string) (*url.URL, error)
+	// DeleteURL removes the content at a URL that was returned by URL. Unlike Delete it also works for files that were
+	// stored under other keys than the ones derived from the rendition name, e.g. before keys were derived from
+	// checksums.
+	DeleteURL(ctx context.Context, u *url.URL) error
+}
+
+// Place is the result of reverse geocoding a pair of coordinates.
+type Place struct {
+	City    string
+	Country string
+	// Components contains all parts of the address found at the coordinates, e.g. neighborhood, city and country.
+	Components []AddressComponent
+}
+
+// KnownLocation is what the database knows about a pair of coordinates, so that they don't need to be looked up again.
+type KnownLocation struct {
+	CoordinateID int64
+	City         string
+	Country      string
+	Timezone     string
+}
+
+// AddressComponent is a part of an address with the types that describe it, e.g. "locality" or "country". Type names
+// follow the Google Maps Geocoding API.
+type AddressComponent struct {
+	Name  string
+	Types []string
+}
+
+// PlaceAlias is a rule that overrides the city name of a Place, based on one of its address components. This allows
+// e.g. using the English name of a place or preferring the neighborhood over the administrative area in some
+// countries.
+type PlaceAlias struct {
+	ID int64
+	// ComponentType is the type an address component must have for the alias to match, e.g. "neighborhood".
+	ComponentType string
+	// ComponentName is the name an address component must have. Empty matches any name.
+	ComponentName string
+	// Country the place must be in. Empty matches any country.
+	Country string
+	// City is the name to use for the place. Empty means the name of the matching address component is used.
+	City string
+	// Priority determines which alias is applied when several match. Higher wins.
+	Priority int
+}
+
+// Matches checks whether the alias applies to an address component of a place in the given country.
+func (a PlaceAlias) Matches(component AddressComponent, country string) bool {
+	if a.ComponentName != "" && a.ComponentName != component.Name {
+		return false
+	}
+
+	if a.Country != "" && a.Country != country {
+		return false
+	}
+
+	for _, t := range component.Types {
+		if t == a.ComponentType {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyPlaceAliases sets the city of a place according to the matching alias with the highest priority. The place is
+// returned unchanged if no alias matches.
+func ApplyPlaceAliases(place Place, aliases []PlaceAlias) Place {
+	var match *PlaceAlias
+	var component AddressComponent
+
+	for idx, alias := range aliases {
+		if match != nil && alias.Priority <= match.Priority {
+			continue
+		}
+
+		for _, comp := range place.Components {
+			if alias.Matches(comp, place.Country) {
+				match = &aliases[idx]
+				component = comp
+				break
+			}
+		}
+	}
+
+	if match == nil {
+		return place
+	}
+
+	if match.City != "" {
+		place.City = match.City
+	} else {
+		place.City = component.Name
+	}
+	return place
+}
+
+// Geocoder finds the place at a pair of coordinates.
+type Geocoder interface {
+	ReverseGeocode(ctx context.Context, latitude, longitude float64) (Place, error)
+}
+
+// TimezoneResolver finds the time zone at a pair of coordinates at a given time.
+type TimezoneResolver interface {
+	Timezone(ctx context.Context, latitude, longitude float64, t time.Time) (*time.Location, error)
+}
+
+// MediaFormat returns the format of an image file based on its extension. The result is empty if the file type is not
+// supported.
+func MediaFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		return FormatJPEG
+	case ".png":
+		return FormatPNG
+	case ".webp":
+		return FormatWebP
+	case ".heic", ".heif":
+		return FormatHEIC
+	default:
+		return ""
+	}
 }
 
-// IsSupportedMedia checks whether a given file type can be used by the bot/web app (JPEG only for now)
+// IsSupportedMedia checks whether a given file type can be ingested. Images in other formats than JPEG are converted.
 func IsSupportedMedia(filename string) bool {
-	filename = strings.ToLower(filename)
-	return strings.HasSuffix(filename, ".jpg") || strings.HasSuffix(filename, ".jpeg")
+	return MediaFormat(filename) != ""
 }
@@ -9,6 +9,7 @@ require (
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
 	github.com/mattn/go-mastodon v0.0.6
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	golang.org/x/image v0.14.0
 	golang.org/x/net v0.18.0
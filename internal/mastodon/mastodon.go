@@ -21,6 +21,7 @@ import (
 	"fmt"
 	coa "github.com/haikoschol/cats-of-asia"
 	"github.com/mattn/go-mastodon"
+	"io"
 	"strings"
 )
 
@@ -51,20 +52,14 @@ func (mp *mastodonPublisher) Platform() coa.Platform {
 	return coa.Mastodon
 }
 
-func (mp *mastodonPublisher) Publish(image coa.Image, description string) error {
-	rc, err := image.Read()
-	if err != nil {
-		return err
-	}
-	defer rc.Close()
-
+func (mp *mastodonPublisher) Publish(ctx context.Context, image coa.Image, content io.Reader, description string) error {
 	media := &mastodon.Media{
-		File:        rc,
+		File:        content,
 		Thumbnail:   nil,
 		Description: description,
 	}
 
-	attachment, err := mp.client.UploadMediaFromMedia(context.Background(), media)
+	attachment, err := mp.client.UploadMediaFromMedia(ctx, media)
 	if err != nil {
 		return err
 	}
@@ -78,7 +73,7 @@ func (mp *mastodonPublisher) Publish(image coa.Image, description string) error
 		MediaIDs: []mastodon.ID{attachment.ID},
 	}
 
-	_, err = mp.client.PostStatus(context.Background(), toot)
+	_, err = mp.client.PostStatus(ctx, toot)
 	if err != nil {
 		return err
 	}
@@ -18,11 +18,13 @@ package twitter
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
 	coa "github.com/haikoschol/cats-of-asia"
+	"io"
 	"mime/multipart"
 	"net/http"
 )
@@ -61,8 +63,16 @@ func (tp twitterPublisher) Platform() coa.Platform {
 	return coa.X
 }
 
-func (tp twitterPublisher) Publish(image coa.Image, description string) error {
-	upload, err := tp.upload(image)
+func (tp twitterPublisher) Publish(ctx context.Context, image coa.Image, content io.Reader, description string) error {
+	upload, err := tp.upload(ctx, image, content)
+	if err != nil {
+		return err
+	}
+
+	// the go-twitter client doesn't accept a context, so this is the last chance to bail out
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	_, _, err = tp.client.Statuses.Update(description, &twitter.StatusUpdateParams{
 		MediaIds: []int64{upload.MediaId},
@@ -78,7 +88,7 @@ type upload struct {
 	MediaId int64 `json:"media_id"`
 }
 
-func (tp twitterPublisher) upload(image coa.Image) (*upload, error) {
+func (tp twitterPublisher) upload(ctx context.Context, image coa.Image, content io.Reader) (*upload, error) {
 	b := &bytes.Buffer{}
 	form := multipart.NewWriter(b)
 
@@ -87,12 +97,7 @@ func (tp twitterPublisher) upload(image coa.Image) (*upload, error) {
 		return nil, fmt.Errorf("unable to encode media for upload to Twitter: %w", err)
 	}
 
-	content, err := image.Content()
-	if err != nil {
-		return nil, err
-	}
-
-	if _, err := fw.Write(content); err != nil {
+	if _, err := io.Copy(fw, content); err != nil {
 		return nil, fmt.Errorf("unable to copy media content into the multipart form: %w", err)
 	}
 
@@ -100,11 +105,18 @@ func (tp twitterPublisher) upload(image coa.Image) (*upload, error) {
 		return nil, fmt.Errorf("unable to close the multipart form: %w", err)
 	}
 
-	response, err := tp.httpClient.Post(
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
 		"https://upload.twitter.com/1.1/media/upload.json?media_category=tweet_image",
-		form.FormDataContentType(),
 		bytes.NewReader(b.Bytes()),
 	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create media upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	response, err := tp.httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("unable to upload media to Twitter: %w", err)
 	}
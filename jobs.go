@@ -0,0 +1,56 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package coa
+
+import (
+	"time"
+)
+
+type JobState string
+
+const (
+	JobQueued  JobState = "queued"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	// JobFailed jobs ran out of attempts and are not retried anymore.
+	JobFailed JobState = "failed"
+)
+
+// JobAbandoned is the last error of jobs whose worker stopped responding during the last attempt. They aren't tried
+// again, so that a file that crashes the process doesn't do that forever.
+const JobAbandoned = "the worker stopped responding during the last attempt, e.g. because the process crashed"
+
+// Job is a file that was uploaded and waits to be ingested in the background. Jobs are kept in the database, so that
+// they survive restarts.
+type Job struct {
+	ID int64 `json:"id"`
+	// FileName is the name the file was uploaded with.
+	FileName string `json:"fileName"`
+	// StorageKey is the key of the uploaded file in the private storage for uploads.
+	StorageKey string   `json:"storageKey"`
+	State      JobState `json:"state"`
+	// Attempts is the number of times processing the job was started.
+	Attempts int `json:"attempts"`
+	// Claim changes every time the job is claimed, so that a worker whose lease has expired can't update the job
+	// after another worker took it over.
+	Claim     int64  `json:"claim"`
+	LastError string `json:"lastError"`
+	// RunAt is the earliest time the job is processed (again).
+	RunAt     time.Time `json:"runAt"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
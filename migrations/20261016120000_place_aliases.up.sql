@@ -0,0 +1,18 @@
+CREATE TABLE place_aliases
+(
+    id             SERIAL PRIMARY KEY,
+    component_type TEXT    NOT NULL,
+    component_name TEXT    NOT NULL DEFAULT '',
+    country        TEXT    NOT NULL DEFAULT '',
+    city           TEXT    NOT NULL DEFAULT '',
+    priority       INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (component_type, component_name, country)
+);
+
+-- these used to be hardcoded in the ingestor
+INSERT INTO place_aliases (component_type, component_name, country, city, priority)
+VALUES ('administrative_area_level_1', 'กรุงเทพมหานคร', '', 'Bangkok', 0),
+       ('administrative_area_level_1', 'เชียงใหม่', '', 'Chang Wat Chiang Mai', 0),
+       ('administrative_area_level_1', 'Chang Wat Samut Prakan', '', 'Samut Prakan', 0),
+       ('administrative_area_level_1', 'Wilayah Persekutuan Kuala Lumpur', '', 'Kuala Lumpur', 0),
+       ('neighborhood', '', 'Taiwan', '', 10);
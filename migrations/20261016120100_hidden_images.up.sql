@@ -0,0 +1,2 @@
+ALTER TABLE images
+    ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;
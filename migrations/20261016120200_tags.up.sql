@@ -0,0 +1,13 @@
+CREATE TABLE tags
+(
+    id         SERIAL PRIMARY KEY,
+    name       TEXT    NOT NULL UNIQUE,
+    controlled BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE image_tags
+(
+    image_id INTEGER NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    tag_id   INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    PRIMARY KEY (image_id, tag_id)
+);
@@ -0,0 +1,2 @@
+DROP TABLE cat_images;
+DROP TABLE cats;
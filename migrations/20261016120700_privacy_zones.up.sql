@@ -0,0 +1,10 @@
+CREATE TABLE privacy_zones
+(
+    id        SERIAL PRIMARY KEY,
+    name      TEXT  NOT NULL UNIQUE,
+    latitude  FLOAT NOT NULL DEFAULT 0,
+    longitude FLOAT NOT NULL DEFAULT 0,
+    radius    FLOAT NOT NULL DEFAULT 0,
+    -- JSON array of the corners of the zone, e.g. [{"latitude": 13.7, "longitude": 100.5}, ...]. empty for circles.
+    polygon   TEXT  NOT NULL DEFAULT ''
+);
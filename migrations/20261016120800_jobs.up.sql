@@ -0,0 +1,18 @@
+CREATE TABLE jobs
+(
+    id           SERIAL PRIMARY KEY,
+    file_name    TEXT        NOT NULL,
+    storage_key  TEXT        NOT NULL,
+    state        TEXT        NOT NULL DEFAULT 'queued',
+    attempts     INTEGER     NOT NULL DEFAULT 0,
+    -- changes with every claim, so that a worker whose lease expired can't update the job anymore
+    claim        BIGINT      NOT NULL DEFAULT 0,
+    last_error   TEXT        NOT NULL DEFAULT '',
+    run_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- running jobs are handed to another worker after this, in case their worker died
+    locked_until TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX jobs_state_run_at ON jobs (state, run_at);
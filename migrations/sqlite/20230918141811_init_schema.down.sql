@@ -0,0 +1,5 @@
+DROP TABLE posts;
+DROP TABLE platforms;
+DROP TABLE images;
+DROP TABLE coordinates;
+DROP TABLE locations;
@@ -0,0 +1,47 @@
+CREATE TABLE locations
+(
+    id       INTEGER PRIMARY KEY,
+    city     TEXT NOT NULL,
+    country  TEXT NOT NULL,
+    timezone TEXT NOT NULL,
+    UNIQUE (city, country)
+);
+
+CREATE TABLE coordinates
+(
+    id          INTEGER PRIMARY KEY,
+    latitude    REAL NOT NULL,
+    longitude   REAL NOT NULL,
+    location_id INTEGER REFERENCES locations (id),
+    UNIQUE (latitude, longitude)
+);
+
+CREATE TABLE images
+(
+    id            INTEGER PRIMARY KEY,
+    path_small    TEXT      NOT NULL,
+    path_medium   TEXT      NOT NULL,
+    path_large    TEXT      NOT NULL,
+    sha256        TEXT      NOT NULL UNIQUE,
+    timestamp     TIMESTAMP NOT NULL,
+    coordinate_id INTEGER REFERENCES coordinates (id)
+);
+
+CREATE TABLE platforms
+(
+    id          INTEGER PRIMARY KEY,
+    name        TEXT NOT NULL UNIQUE,
+    profile_url TEXT NOT NULL UNIQUE
+);
+
+INSERT INTO platforms (name, profile_url)
+VALUES ('Mastodon', 'https://botsin.space/@CatsOfAsia'),
+       ('X', 'https://twitter.com/CatsOfAsia');
+
+CREATE TABLE posts
+(
+    id          INTEGER PRIMARY KEY,
+    image_id    INTEGER REFERENCES images (id),
+    platform_id INTEGER REFERENCES platforms (id),
+    timestamp   TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
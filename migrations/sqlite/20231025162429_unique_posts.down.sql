@@ -0,0 +1 @@
+DROP INDEX posts_unique_image_platform;
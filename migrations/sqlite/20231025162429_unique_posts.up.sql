@@ -0,0 +1,2 @@
+-- SQLite does not support adding constraints to existing tables
+CREATE UNIQUE INDEX posts_unique_image_platform ON posts (image_id, platform_id);
@@ -0,0 +1,6 @@
+ALTER TABLE images
+    RENAME COLUMN path_large TO url_large;
+ALTER TABLE images
+    RENAME COLUMN path_medium TO url_medium;
+ALTER TABLE images
+    RENAME COLUMN path_small TO url_small;
@@ -0,0 +1,13 @@
+CREATE TABLE cats
+(
+    id          INTEGER PRIMARY KEY,
+    name        TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE cat_images
+(
+    cat_id   INTEGER NOT NULL REFERENCES cats (id) ON DELETE CASCADE,
+    image_id INTEGER NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    PRIMARY KEY (cat_id, image_id)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE renditions
+(
+    image_id INTEGER NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    name     TEXT    NOT NULL,
+    url      TEXT    NOT NULL,
+    width    INTEGER NOT NULL,
+    height   INTEGER NOT NULL,
+    size     BIGINT  NOT NULL,
+    format   TEXT    NOT NULL,
+    PRIMARY KEY (image_id, name)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE privacy_zones
+(
+    id        INTEGER PRIMARY KEY,
+    name      TEXT NOT NULL UNIQUE,
+    latitude  REAL NOT NULL DEFAULT 0,
+    longitude REAL NOT NULL DEFAULT 0,
+    radius    REAL NOT NULL DEFAULT 0,
+    -- JSON array of the corners of the zone, e.g. [{"latitude": 13.7, "longitude": 100.5}, ...]. empty for circles.
+    polygon   TEXT NOT NULL DEFAULT ''
+);
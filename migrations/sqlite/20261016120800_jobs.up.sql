@@ -0,0 +1,19 @@
+CREATE TABLE jobs
+(
+    id           INTEGER PRIMARY KEY,
+    file_name    TEXT      NOT NULL,
+    storage_key  TEXT      NOT NULL,
+    state        TEXT      NOT NULL DEFAULT 'queued',
+    attempts     INTEGER   NOT NULL DEFAULT 0,
+    -- changes with every claim, so that a worker whose lease expired can't update the job anymore
+    claim        INTEGER   NOT NULL DEFAULT 0,
+    last_error   TEXT      NOT NULL DEFAULT '',
+    -- timestamps are written in UTC with second precision, so that they can be compared as text
+    run_at       TIMESTAMP NOT NULL,
+    -- running jobs are handed to another worker after this, in case their worker died
+    locked_until TIMESTAMP,
+    created_at   TIMESTAMP NOT NULL,
+    updated_at   TIMESTAMP NOT NULL
+);
+
+CREATE INDEX jobs_state_run_at ON jobs (state, run_at);
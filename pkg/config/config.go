@@ -0,0 +1,228 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package config reads the settings that are shared by the commands from env vars.
+//
+// The env vars are read when the functions are called rather than when the package is initialized, so that values
+// loaded from a .env file by github.com/joho/godotenv/autoload are picked up.
+package config
+
+import (
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/database"
+	"github.com/haikoschol/cats-of-asia/pkg/geo"
+	"github.com/haikoschol/cats-of-asia/pkg/ingestion"
+	"github.com/haikoschol/cats-of-asia/pkg/sanitize"
+	"github.com/haikoschol/cats-of-asia/pkg/storage"
+	"github.com/haikoschol/cats-of-asia/pkg/validation"
+	"log"
+	"os"
+	"strconv"
+)
+
+// DB returns the database settings. COA_DB_DRIVER is either "postgres" (default) or "sqlite".
+func DB() database.Config {
+	driver := database.Driver(os.Getenv("COA_DB_DRIVER"))
+	if driver == "" {
+		driver = database.Postgres
+	}
+
+	return database.Config{
+		Driver:   driver,
+		Host:     os.Getenv("COA_DB_HOST"),
+		SSLMode:  os.Getenv("COA_DB_SSLMODE"),
+		Name:     os.Getenv("COA_DB_NAME"),
+		User:     os.Getenv("COA_DB_USER"),
+		Password: os.Getenv("COA_DB_PASSWORD"),
+		Path:     os.Getenv("COA_DB_PATH"),
+	}
+}
+
+// Storage returns the settings of the public storage. COA_STORAGE is one of "gdrive" (default), "local" or "s3".
+func Storage() storage.Config {
+	backend := storage.Backend(os.Getenv("COA_STORAGE"))
+	if backend == "" {
+		backend = storage.GoogleDrive
+	}
+
+	return storage.Config{
+		Backend:              backend,
+		SvcAccountEmail:      os.Getenv("COA_GOOGLE_DRIVE_EMAIL"),
+		SvcAccountPrivateKey: os.Getenv("COA_GOOGLE_DRIVE_PRIVATE_KEY"),
+		GDriveFolderID:       os.Getenv("COA_GOOGLE_DRIVE_FOLDER_ID"),
+		LocalDir:             os.Getenv("COA_STORAGE_DIR"),
+		LocalURL:             os.Getenv("COA_STORAGE_URL"),
+		S3: storage.S3Config{
+			Endpoint:        os.Getenv("COA_S3_ENDPOINT"),
+			Region:          os.Getenv("COA_S3_REGION"),
+			Bucket:          os.Getenv("COA_S3_BUCKET"),
+			AccessKeyID:     os.Getenv("COA_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("COA_S3_SECRET_ACCESS_KEY"),
+			PublicURL:       os.Getenv("COA_S3_PUBLIC_URL"),
+		},
+	}
+}
+
+// PrivateStorage returns the settings of a storage that is not publicly accessible. name is the part of the env vars
+// after "COA_", e.g. "ORIGINALS" for COA_ORIGINALS_STORAGE, which is either "local" or "s3". The other S3 settings are
+// shared with the public storage.
+func PrivateStorage(name string) storage.Config {
+	cfg := Storage()
+	cfg.Backend = storage.Backend(os.Getenv("COA_" + name + "_STORAGE"))
+	cfg.LocalDir = os.Getenv("COA_" + name + "_DIR")
+	cfg.LocalURL = ""
+	cfg.S3.Bucket = os.Getenv("COA_" + name + "_S3_BUCKET")
+	cfg.S3.PublicURL = ""
+	return cfg
+}
+
+// Originals returns the settings of the private storage for the untouched files images were ingested from. The backend
+// is storage.None if originals are discarded.
+func Originals() storage.Config {
+	return PrivateStorage("ORIGINALS")
+}
+
+// ExifAllowlist returns the EXIF fields that are kept in public files, from the comma separated COA_EXIF_ALLOWLIST.
+func ExifAllowlist() []string {
+	return sanitize.ParseFields(os.Getenv("COA_EXIF_ALLOWLIST"))
+}
+
+// Metadata returns the settings for handling metadata during ingestion and creates the storage for originals, unless
+// originals are discarded.
+func Metadata() (ingestion.MetadataConfig, error) {
+	cfg := ingestion.MetadataConfig{AllowedExifFields: ExifAllowlist()}
+
+	originals := Originals()
+	if originals.Backend == storage.None {
+		log.Println("WARNING: COA_ORIGINALS_STORAGE is 'none'. original files are not kept, so the metadata removed " +
+			"from public files (e.g. the precise location) is lost")
+		return cfg, nil
+	}
+
+	store, err := storage.New(originals)
+	if err != nil {
+		return ingestion.MetadataConfig{}, err
+	}
+	cfg.Originals = store
+	return cfg, nil
+}
+
+// RenditionProfilesPath returns the optional JSON file with rendition profiles.
+func RenditionProfilesPath() string {
+	return os.Getenv("COA_RENDITION_PROFILES")
+}
+
+// Concurrency returns the optional number of images each stage of the ingestion pipeline works on at the same time.
+func Concurrency() ingestion.ConcurrencyConfig {
+	// already validated. zero means the default
+	scan, _ := strconv.Atoi(os.Getenv("COA_SCAN_CONCURRENCY"))
+	process, _ := strconv.Atoi(os.Getenv("COA_PROCESS_CONCURRENCY"))
+	lookup, _ := strconv.Atoi(os.Getenv("COA_LOOKUP_CONCURRENCY"))
+	upload, _ := strconv.Atoi(os.Getenv("COA_UPLOAD_CONCURRENCY"))
+
+	return ingestion.ConcurrencyConfig{Scan: scan, Process: process, Lookup: lookup, Upload: upload}
+}
+
+// NearDuplicates returns how near duplicates are handled. COA_NEAR_DUPLICATES is one of "skip" (default), "flag" or
+// "off".
+func NearDuplicates() ingestion.NearDuplicateConfig {
+	action := ingestion.NearDuplicateAction(os.Getenv("COA_NEAR_DUPLICATES"))
+	if action == "" {
+		action = ingestion.SkipNearDuplicates
+	}
+
+	distance := ingestion.DefaultNearDuplicateDistance
+	if d := os.Getenv("COA_NEAR_DUPLICATE_DISTANCE"); d != "" {
+		// already validated
+		distance, _ = strconv.Atoi(d)
+	}
+
+	return ingestion.NearDuplicateConfig{Action: action, MaxDistance: distance}
+}
+
+// NewGeocoder creates the geocoder selected by COA_GEOCODER, either "google" (default) or "geonames".
+func NewGeocoder() (coa.Geocoder, error) {
+	if os.Getenv("COA_GEOCODER") == geo.GeoNames {
+		return geo.NewGeoNames(os.Getenv("COA_GEONAMES_DIR"))
+	}
+	return geo.NewGoogleGeocoder(os.Getenv("COA_GOOGLE_MAPS_API_KEY"))
+}
+
+// NewTimezoneResolver prefers the offline time zone boundaries if available and falls back to the Google Maps API.
+// COA_TIMEZONE_BOUNDARIES is a GeoJSON file from https://github.com/evansiroky/timezone-boundary-builder.
+func NewTimezoneResolver() (coa.TimezoneResolver, error) {
+	var resolvers []coa.TimezoneResolver
+
+	if boundaries := os.Getenv("COA_TIMEZONE_BOUNDARIES"); boundaries != "" {
+		tb, err := geo.NewTimezoneBoundaries(boundaries)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, tb)
+	}
+
+	if key := os.Getenv("COA_GOOGLE_MAPS_API_KEY"); key != "" {
+		gm, err := geo.NewGoogleTimezoneResolver(key)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, gm)
+	}
+
+	return geo.NewFallbackTimezoneResolver(resolvers...), nil
+}
+
+// ValidateDB checks the database settings.
+func ValidateDB() (errors []string) {
+	return validation.ValidateDbEnv(DB())
+}
+
+// ValidateStorage checks the settings of the public storage.
+func ValidateStorage() (errors []string) {
+	return validation.ValidateStorageEnv(Storage())
+}
+
+// ValidateMetadata checks the EXIF allowlist and the storage for originals.
+func ValidateMetadata() (errors []string) {
+	return validation.ValidateMetadataEnv(os.Getenv("COA_EXIF_ALLOWLIST"), Originals(), Storage())
+}
+
+// ValidateIngestion checks everything the ingestion pipeline needs apart from the database and the public storage.
+func ValidateIngestion() (errors []string) {
+	geocoder := os.Getenv("COA_GEOCODER")
+	errors = validation.ValidateGeocoderEnv(geocoder, os.Getenv("COA_GEONAMES_DIR"))
+	errors = append(
+		errors,
+		validation.ValidateNearDuplicateEnv(os.Getenv("COA_NEAR_DUPLICATES"), os.Getenv("COA_NEAR_DUPLICATE_DISTANCE"))...,
+	)
+	errors = append(
+		errors,
+		validation.ValidateConcurrencyEnv(
+			os.Getenv("COA_SCAN_CONCURRENCY"),
+			os.Getenv("COA_PROCESS_CONCURRENCY"),
+			os.Getenv("COA_LOOKUP_CONCURRENCY"),
+			os.Getenv("COA_UPLOAD_CONCURRENCY"),
+		)...,
+	)
+	errors = append(errors, ValidateMetadata()...)
+
+	needsGoogleMaps := geocoder != geo.GeoNames || os.Getenv("COA_TIMEZONE_BOUNDARIES") == ""
+	if needsGoogleMaps && os.Getenv("COA_GOOGLE_MAPS_API_KEY") == "" {
+		errors = append(errors, "COA_GOOGLE_MAPS_API_KEY env var missing")
+	}
+
+	return errors
+}
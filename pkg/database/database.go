@@ -0,0 +1,75 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package database creates the configured implementation of coa.Database.
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/migrations"
+	"github.com/haikoschol/cats-of-asia/pkg/postgres"
+	"github.com/haikoschol/cats-of-asia/pkg/sqlite"
+	"io/fs"
+)
+
+type Driver string
+
+const (
+	Postgres Driver = "postgres"
+	SQLite   Driver = "sqlite"
+)
+
+type Config struct {
+	Driver Driver
+
+	// Postgres
+	Host     string
+	SSLMode  string
+	Name     string
+	User     string
+	Password string
+
+	// SQLite
+	Path string
+}
+
+func New(cfg Config) (coa.Database, error) {
+	switch cfg.Driver {
+	case Postgres:
+		return postgres.NewDatabase(cfg.User, cfg.Password, cfg.Host, cfg.Name, postgres.SSLMode(cfg.SSLMode))
+	case SQLite:
+		return sqlite.NewDatabase(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown database driver '%s'", cfg.Driver)
+	}
+}
+
+// Open connects to the database without checking the schema version and returns the connection together with the
+// migrations for the driver.
+func Open(cfg Config) (*sql.DB, fs.FS, error) {
+	switch cfg.Driver {
+	case Postgres:
+		db, err := postgres.Open(cfg.User, cfg.Password, cfg.Host, cfg.Name, postgres.SSLMode(cfg.SSLMode))
+		return db, migrations.Postgres, err
+	case SQLite:
+		db, err := sqlite.Open(cfg.Path)
+		return db, migrations.SQLite, err
+	default:
+		return nil, nil, fmt.Errorf("unknown database driver '%s'", cfg.Driver)
+	}
+}
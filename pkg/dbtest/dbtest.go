@@ -0,0 +1,1216 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package dbtest implements a behavioural test suite for implementations of coa.Database.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type check struct {
+	name string
+	run  func(ctx context.Context, db coa.Database) error
+}
+
+var checks = []check{
+	{"GetOrCreateLocation", checkGetOrCreateLocation},
+	{"GetOrCreateCoordinates", checkGetOrCreateCoordinates},
+	{"InsertAndGetImages", checkInsertAndGetImages},
+	{"InsertImagesWithCoordinateID", checkInsertImagesWithCoordinateID},
+	{"UniqueSHA256", checkUniqueSHA256},
+	{"RemoveKnownImages", checkRemoveKnownImages},
+	{"UnusedImages", checkUnusedImages},
+	{"PlaceAliases", checkPlaceAliases},
+	{"PrivacyZones", checkPrivacyZones},
+	{"HiddenImages", checkHiddenImages},
+	{"DeleteImage", checkDeleteImage},
+	{"Tags", checkTags},
+	{"Cats", checkCats},
+	{"PerceptualHashes", checkPerceptualHashes},
+	{"Renditions", checkRenditions},
+	{"Jobs", checkJobs},
+}
+
+// TestDatabase checks that a coa.Database implementation behaves like the others. Each check runs as a subtest with a
+// database from newDB, which must be empty, apart from the platforms that the migrations create. The database is
+// closed after the check. It is meant to be called from the tests of each implementation:
+//
+//	func TestDatabase(t *testing.T) {
+//		dbtest.TestDatabase(t, newTestDatabase)
+//	}
+func TestDatabase(t *testing.T, newDB func(t *testing.T) coa.Database) {
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			db := newDB(t)
+			defer func() {
+				if err := db.Close(); err != nil {
+					t.Errorf("Close(): %v", err)
+				}
+			}()
+
+			if err := c.run(context.Background(), db); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func checkGetOrCreateLocation(ctx context.Context, db coa.Database) error {
+	id1, err := db.GetOrCreateLocation(ctx, "Bangkok", "Thailand", "Asia/Bangkok")
+	if err != nil {
+		return err
+	}
+
+	id2, err := db.GetOrCreateLocation(ctx, "Bangkok", "Thailand", "Asia/Bangkok")
+	if err != nil {
+		return err
+	}
+
+	if id1 != id2 {
+		return fmt.Errorf("got different IDs %d and %d for the same location", id1, id2)
+	}
+
+	id3, err := db.GetOrCreateLocation(ctx, "Kuala Lumpur", "Malaysia", "Asia/Kuala_Lumpur")
+	if err != nil {
+		return err
+	}
+
+	if id3 == id1 {
+		return fmt.Errorf("got the same ID %d for different locations", id1)
+	}
+	return nil
+}
+
+func checkGetOrCreateCoordinates(ctx context.Context, db coa.Database) error {
+	if _, err := db.GetCoordinateID(ctx, 13.7563, 100.5018); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for unknown coordinates, got %v", err)
+	}
+
+	locID, err := db.GetOrCreateLocation(ctx, "Bangkok", "Thailand", "Asia/Bangkok")
+	if err != nil {
+		return err
+	}
+
+	id1, err := db.GetOrCreateCoordinates(ctx, 13.7563, 100.5018, locID)
+	if err != nil {
+		return err
+	}
+
+	id2, err := db.GetOrCreateCoordinates(ctx, 13.7563, 100.5018, locID)
+	if err != nil {
+		return err
+	}
+
+	if id1 != id2 {
+		return fmt.Errorf("got different IDs %d and %d for the same coordinates", id1, id2)
+	}
+
+	id3, err := db.GetCoordinateID(ctx, 13.7563, 100.5018)
+	if err != nil {
+		return err
+	}
+
+	if id3 != id1 {
+		return fmt.Errorf("GetCoordinateID() returned %d, expected %d", id3, id1)
+	}
+
+	loc, err := db.GetKnownLocation(ctx, 13.7563, 100.5018)
+	if err != nil {
+		return err
+	}
+
+	expected := coa.KnownLocation{CoordinateID: id1, City: "Bangkok", Country: "Thailand", Timezone: "Asia/Bangkok"}
+	if loc != expected {
+		return fmt.Errorf("GetKnownLocation() returned %+v, expected %+v", loc, expected)
+	}
+
+	if _, err := db.GetKnownLocation(ctx, 1.3521, 103.8198); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for the location of unknown coordinates, got %v", err)
+	}
+	return nil
+}
+
+func checkInsertAndGetImages(ctx context.Context, db coa.Database) error {
+	if _, err := db.GetImage(ctx, 1); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for unknown image, got %v", err)
+	}
+
+	want := newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok")
+	want.Format = coa.FormatHEIC
+	if err := db.InsertImages(ctx, []coa.Image{want}); err != nil {
+		return err
+	}
+
+	images, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(images) != 1 {
+		return fmt.Errorf("expected 1 image, got %d", len(images))
+	}
+
+	got, err := db.GetImage(ctx, images[0].ID)
+	if err != nil {
+		return err
+	}
+
+	for _, img := range []coa.Image{images[0], got} {
+		if err := compareImages(img, want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkInsertImagesWithCoordinateID(ctx context.Context, db coa.Database) error {
+	locID, err := db.GetOrCreateLocation(ctx, "Taipei", "Taiwan", "Asia/Taipei")
+	if err != nil {
+		return err
+	}
+
+	coordID, err := db.GetOrCreateCoordinates(ctx, 25.0330, 121.5654, locID)
+	if err != nil {
+		return err
+	}
+
+	// the location of the image is ignored, since it comes from the coordinates
+	img := newImage("a", 0, 0, "", "", "")
+	img.CoordinateID = &coordID
+	if err := db.InsertImages(ctx, []coa.Image{img}); err != nil {
+		return err
+	}
+
+	images, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(images) != 1 {
+		return fmt.Errorf("expected 1 image, got %d", len(images))
+	}
+
+	if images[0].City != "Taipei" || images[0].Latitude != 25.0330 || images[0].Timezone != "Asia/Taipei" {
+		return fmt.Errorf("image does not have the location of coordinates %d: %+v", coordID, images[0])
+	}
+	return nil
+}
+
+func checkUniqueSHA256(ctx context.Context, db coa.Database) error {
+	img := newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok")
+	if err := db.InsertImages(ctx, []coa.Image{img}); err != nil {
+		return err
+	}
+
+	if err := db.InsertImages(ctx, []coa.Image{img}); err == nil {
+		return errors.New("inserting an image with a known SHA256 checksum succeeded")
+	}
+	return nil
+}
+
+func checkRemoveKnownImages(ctx context.Context, db coa.Database) error {
+	known := newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok")
+	unknown := newImage("b", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok")
+
+	if err := db.InsertImages(ctx, []coa.Image{known}); err != nil {
+		return err
+	}
+
+	filtered, err := db.RemoveKnownImages(ctx, []coa.Image{known, unknown})
+	if err != nil {
+		return err
+	}
+
+	if len(filtered) != 1 || filtered[0].SHA256 != unknown.SHA256 {
+		return fmt.Errorf("expected only the unknown image to remain, got %d images", len(filtered))
+	}
+	return nil
+}
+
+func checkUnusedImages(ctx context.Context, db coa.Database) error {
+	if _, err := db.GetRandomUnusedImage(ctx, coa.Mastodon); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows without images, got %v", err)
+	}
+
+	images := []coa.Image{
+		newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+		newImage("b", 3.1390, 101.6869, "Kuala Lumpur", "Malaysia", "Asia/Kuala_Lumpur"),
+	}
+	if err := db.InsertImages(ctx, images); err != nil {
+		return err
+	}
+
+	if err := expectUnusedCount(ctx, db, coa.Mastodon, 2); err != nil {
+		return err
+	}
+
+	img, err := db.GetRandomUnusedImage(ctx, coa.Mastodon)
+	if err != nil {
+		return err
+	}
+
+	if err := db.InsertPost(ctx, img, coa.Mastodon); err != nil {
+		return err
+	}
+
+	if err := db.InsertPost(ctx, img, coa.Mastodon); err == nil {
+		return errors.New("posting the same image twice on the same platform succeeded")
+	}
+
+	if err := expectUnusedCount(ctx, db, coa.Mastodon, 1); err != nil {
+		return err
+	}
+
+	if err := expectUnusedCount(ctx, db, coa.X, 2); err != nil {
+		return err
+	}
+
+	next, err := db.GetRandomUnusedImage(ctx, coa.Mastodon)
+	if err != nil {
+		return err
+	}
+
+	if next.ID == img.ID {
+		return fmt.Errorf("GetRandomUnusedImage() returned image %d, which has been posted already", img.ID)
+	}
+
+	if err := db.InsertPost(ctx, next, coa.Mastodon); err != nil {
+		return err
+	}
+
+	if _, err := db.GetRandomUnusedImage(ctx, coa.Mastodon); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows after posting all images, got %v", err)
+	}
+	return nil
+}
+
+func checkPlaceAliases(ctx context.Context, db coa.Database) error {
+	// the migrations may have added some already
+	existing, err := db.GetPlaceAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	low := coa.PlaceAlias{ComponentType: "locality", ComponentName: "dbtest", City: "Low", Priority: -100}
+	high := coa.PlaceAlias{ComponentType: "locality", Country: "dbtest", Priority: 100}
+
+	lowID, err := db.InsertPlaceAlias(ctx, low)
+	if err != nil {
+		return err
+	}
+
+	highID, err := db.InsertPlaceAlias(ctx, high)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.InsertPlaceAlias(ctx, high); err == nil {
+		return errors.New("inserting the same place alias twice succeeded")
+	}
+
+	aliases, err := db.GetPlaceAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(aliases) != len(existing)+2 {
+		return fmt.Errorf("expected %d place aliases, got %d", len(existing)+2, len(aliases))
+	}
+
+	if aliases[0].ID != highID || aliases[len(aliases)-1].ID != lowID {
+		return errors.New("place aliases are not ordered by priority")
+	}
+
+	if aliases[len(aliases)-1].City != low.City {
+		return fmt.Errorf("expected city %s, got %s", low.City, aliases[len(aliases)-1].City)
+	}
+
+	if err := db.DeletePlaceAlias(ctx, lowID); err != nil {
+		return err
+	}
+
+	if err := db.DeletePlaceAlias(ctx, lowID); err == nil {
+		return errors.New("deleting a place alias twice succeeded")
+	}
+	return nil
+}
+
+func checkPrivacyZones(ctx context.Context, db coa.Database) error {
+	circle := coa.PrivacyZone{Name: "circle", Center: coa.GeoPoint{Latitude: 13.75, Longitude: 100.5}, Radius: 250}
+	polygon := coa.PrivacyZone{
+		Name: "polygon",
+		Polygon: []coa.GeoPoint{
+			{Latitude: 18.78, Longitude: 98.98},
+			{Latitude: 18.79, Longitude: 98.98},
+			{Latitude: 18.79, Longitude: 98.99},
+		},
+	}
+
+	circleID, err := db.InsertPrivacyZone(ctx, circle)
+	if err != nil {
+		return err
+	}
+
+	polygonID, err := db.InsertPrivacyZone(ctx, polygon)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.InsertPrivacyZone(ctx, circle); err == nil {
+		return errors.New("inserting a privacy zone with the same name twice succeeded")
+	}
+
+	zones, err := db.GetPrivacyZones(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(zones) != 2 {
+		return fmt.Errorf("expected 2 privacy zones, got %d", len(zones))
+	}
+
+	if zones[0].ID != circleID || zones[1].ID != polygonID {
+		return errors.New("privacy zones are not ordered by ID")
+	}
+
+	circle.ID = circleID
+	polygon.ID = polygonID
+	if !reflect.DeepEqual(zones[0], circle) {
+		return fmt.Errorf("expected privacy zone %+v, got %+v", circle, zones[0])
+	}
+	if !reflect.DeepEqual(zones[1], polygon) {
+		return fmt.Errorf("expected privacy zone %+v, got %+v", polygon, zones[1])
+	}
+
+	if err := db.DeletePrivacyZone(ctx, circleID); err != nil {
+		return err
+	}
+
+	if err := db.DeletePrivacyZone(ctx, circleID); err == nil {
+		return errors.New("deleting a privacy zone twice succeeded")
+	}
+	return nil
+}
+
+func checkHiddenImages(ctx context.Context, db coa.Database) error {
+	if err := db.SetImageHidden(ctx, 1, true); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for hiding an unknown image, got %v", err)
+	}
+
+	images := []coa.Image{
+		newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+		newImage("b", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+	}
+	if err := db.InsertImages(ctx, images); err != nil {
+		return err
+	}
+
+	inserted, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	hidden := inserted[0]
+	if err := db.SetImageHidden(ctx, hidden.ID, true); err != nil {
+		return err
+	}
+
+	visible, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(visible) != 1 || visible[0].ID == hidden.ID {
+		return fmt.Errorf("expected only image %d to be returned, got %d images", inserted[1].ID, len(visible))
+	}
+
+	if err := expectUnusedCount(ctx, db, coa.Mastodon, 1); err != nil {
+		return err
+	}
+
+	img, err := db.GetImage(ctx, hidden.ID)
+	if err != nil {
+		return err
+	}
+
+	if !img.Hidden {
+		return fmt.Errorf("image %d is not marked as hidden", hidden.ID)
+	}
+
+	img, err = db.GetImageBySHA256(ctx, hidden.SHA256)
+	if err != nil {
+		return err
+	}
+
+	if img.ID != hidden.ID || !img.Hidden {
+		return fmt.Errorf("expected hidden image %d by checksum, got %+v", hidden.ID, img)
+	}
+
+	if _, err := db.GetImageBySHA256(ctx, "c"); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for unknown checksum, got %v", err)
+	}
+
+	// hidden images must not be ingested again
+	filtered, err := db.RemoveKnownImages(ctx, images)
+	if err != nil {
+		return err
+	}
+
+	if len(filtered) != 0 {
+		return fmt.Errorf("expected hidden image to be known, got %d unknown images", len(filtered))
+	}
+
+	if err := db.SetImageHidden(ctx, hidden.ID, false); err != nil {
+		return err
+	}
+	return expectUnusedCount(ctx, db, coa.Mastodon, 2)
+}
+
+func checkDeleteImage(ctx context.Context, db coa.Database) error {
+	if err := db.DeleteImage(ctx, 1); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for deleting an unknown image, got %v", err)
+	}
+
+	images := []coa.Image{
+		newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+		newImage("b", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+	}
+	if err := db.InsertImages(ctx, images); err != nil {
+		return err
+	}
+
+	inserted, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	first, second := inserted[0], inserted[1]
+	if err := db.InsertPost(ctx, first, coa.Mastodon); err != nil {
+		return err
+	}
+
+	if err := db.DeleteImage(ctx, first.ID); err != nil {
+		return err
+	}
+
+	if _, err := db.GetImage(ctx, first.ID); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for deleted image, got %v", err)
+	}
+
+	// still used by the second image
+	if _, err := db.GetCoordinateID(ctx, first.Latitude, first.Longitude); err != nil {
+		return fmt.Errorf("coordinates of remaining image were deleted: %w", err)
+	}
+
+	if err := db.DeleteImage(ctx, second.ID); err != nil {
+		return err
+	}
+
+	if _, err := db.GetCoordinateID(ctx, first.Latitude, first.Longitude); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected orphaned coordinates to be deleted, got %v", err)
+	}
+
+	// purged images can be ingested again
+	filtered, err := db.RemoveKnownImages(ctx, images)
+	if err != nil {
+		return err
+	}
+
+	if len(filtered) != len(images) {
+		return fmt.Errorf("expected %d unknown images after deleting them, got %d", len(images), len(filtered))
+	}
+	return db.InsertImages(ctx, images)
+}
+
+func checkTags(ctx context.Context, db coa.Database) error {
+	if err := db.DeleteTag(ctx, "kitten"); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for deleting an unknown tag, got %v", err)
+	}
+
+	images := []coa.Image{
+		newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+		newImage("b", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+	}
+	if err := db.InsertImages(ctx, images); err != nil {
+		return err
+	}
+
+	inserted, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	first, second := inserted[0], inserted[1]
+
+	if err := db.CreateTag(ctx, "temple", true); err != nil {
+		return err
+	}
+
+	ids := []int64{first.ID, second.ID}
+	if err := db.TagImages(ctx, ids, []string{"kitten", "ginger"}); err != nil {
+		return err
+	}
+
+	// tagging twice is not an error
+	if err := db.TagImages(ctx, []int64{first.ID}, []string{"temple", "kitten"}); err != nil {
+		return err
+	}
+
+	img, err := db.GetImage(ctx, first.ID)
+	if err != nil {
+		return err
+	}
+
+	if fmt.Sprint(img.Tags) != "[ginger kitten temple]" {
+		return fmt.Errorf("expected tags [ginger kitten temple] on image %d, got %v", first.ID, img.Tags)
+	}
+
+	tags, err := db.GetTags(ctx)
+	if err != nil {
+		return err
+	}
+
+	expected := []coa.Tag{
+		{Name: "ginger", Controlled: false, Images: 2},
+		{Name: "kitten", Controlled: false, Images: 2},
+		{Name: "temple", Controlled: true, Images: 1},
+	}
+	if fmt.Sprint(tags) != fmt.Sprint(expected) {
+		return fmt.Errorf("expected tags %v, got %v", expected, tags)
+	}
+
+	if err := db.UntagImages(ctx, ids, []string{"ginger"}); err != nil {
+		return err
+	}
+
+	if err := db.DeleteTag(ctx, "temple"); err != nil {
+		return err
+	}
+
+	all, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, img := range all {
+		if fmt.Sprint(img.Tags) != "[kitten]" {
+			return fmt.Errorf("expected tags [kitten] on image %d, got %v", img.ID, img.Tags)
+		}
+	}
+
+	tags, err = db.GetTags(ctx)
+	if err != nil {
+		return err
+	}
+
+	// untagging keeps the tag itself
+	if len(tags) != 2 || tags[0].Name != "ginger" || tags[0].Images != 0 {
+		return fmt.Errorf("expected tags ginger and kitten, got %v", tags)
+	}
+
+	if err := db.TagImages(ctx, []int64{second.ID + 1}, []string{"kitten"}); err == nil {
+		return errors.New("tagging an unknown image succeeded")
+	}
+
+	// tags go away together with the image
+	if err := db.DeleteImage(ctx, first.ID); err != nil {
+		return err
+	}
+
+	tags, err = db.GetTags(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(tags) != 2 || tags[1].Name != "kitten" || tags[1].Images != 1 {
+		return fmt.Errorf("expected tag kitten to be used by one image, got %v", tags)
+	}
+	return nil
+}
+
+func checkCats(ctx context.Context, db coa.Database) error {
+	if _, err := db.GetCat(ctx, 1); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for an unknown cat, got %v", err)
+	}
+
+	if err := db.UpdateCatImages(ctx, 1, nil, nil); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for attaching images to an unknown cat, got %v", err)
+	}
+
+	images := []coa.Image{
+		newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+		newImage("b", 18.7883, 98.9853, "Chiang Mai", "Thailand", "Asia/Bangkok"),
+		newImage("c", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+	}
+	// inserted out of order to check that sightings are sorted by timestamp
+	images[0].Timestamp = images[0].Timestamp.Add(48 * time.Hour)
+	images[2].Timestamp = images[2].Timestamp.Add(24 * time.Hour)
+
+	if err := db.InsertImages(ctx, images); err != nil {
+		return err
+	}
+
+	inserted, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for _, img := range inserted {
+		ids = append(ids, img.ID)
+	}
+
+	tiger, err := db.InsertCat(ctx, coa.Cat{Name: "Tiger", Description: "ginger tabby near the temple"})
+	if err != nil {
+		return err
+	}
+
+	noodle, err := db.InsertCat(ctx, coa.Cat{Name: "Noodle"})
+	if err != nil {
+		return err
+	}
+
+	empty, err := db.GetCat(ctx, noodle)
+	if err != nil {
+		return err
+	}
+
+	if empty.Sightings != 0 || !empty.FirstSeen.IsZero() || !empty.LastSeen.IsZero() {
+		return fmt.Errorf("expected cat without sightings, got %+v", empty)
+	}
+
+	mochi, err := db.InsertCat(ctx, coa.Cat{Name: "Mochi"})
+	if err != nil {
+		return err
+	}
+
+	if err := db.UpdateCatImages(ctx, tiger, ids[:2], nil); err != nil {
+		return err
+	}
+
+	if err := db.UpdateCatImages(ctx, noodle, ids[1:], nil); err != nil {
+		return err
+	}
+
+	if err := db.UpdateCatImages(ctx, mochi, ids[2:], nil); err != nil {
+		return err
+	}
+
+	unknownCat := mochi + 1000
+	if err := db.MergeCats(ctx, tiger, []int64{noodle, unknownCat}); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for merging an unknown cat, got %v", err)
+	}
+
+	// nothing is merged if one of the cats doesn't exist
+	if c, err := db.GetCat(ctx, noodle); err != nil || c.Sightings != 2 {
+		return fmt.Errorf("expected Noodle to be left alone by the failed merge, got %+v, %v", c, err)
+	}
+
+	if err := db.MergeCats(ctx, tiger, []int64{noodle, mochi}); err != nil {
+		return err
+	}
+
+	for _, id := range []int64{noodle, mochi} {
+		if _, err := db.GetCat(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("expected merged cat %d to be deleted, got %v", id, err)
+		}
+	}
+
+	cats, err := db.GetCats(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(cats) != 1 {
+		return fmt.Errorf("expected 1 cat, got %d", len(cats))
+	}
+
+	c := cats[0]
+	if c.Name != "Tiger" || c.Description != "ginger tabby near the temple" || c.Sightings != 3 {
+		return fmt.Errorf("expected Tiger with 3 sightings, got %+v", c)
+	}
+
+	if !c.FirstSeen.Equal(images[1].Timestamp) || !c.LastSeen.Equal(images[0].Timestamp) {
+		return fmt.Errorf(
+			"expected cat to be seen from %v to %v, got %v to %v",
+			images[1].Timestamp,
+			images[0].Timestamp,
+			c.FirstSeen,
+			c.LastSeen,
+		)
+	}
+
+	sightings, err := db.GetSightings(ctx, tiger)
+	if err != nil {
+		return err
+	}
+
+	if len(sightings) != 3 {
+		return fmt.Errorf("expected 3 sightings, got %d", len(sightings))
+	}
+
+	for idx, want := range []coa.Image{images[1], images[2], images[0]} {
+		if err := compareImages(sightings[idx], want); err != nil {
+			return fmt.Errorf("sighting %d: %w", idx, err)
+		}
+	}
+
+	unknownImage := ids[len(ids)-1] + 1000
+	err = db.UpdateCatImages(ctx, tiger, []int64{unknownImage}, []int64{sightings[0].ID})
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for attaching an unknown image, got %v", err)
+	}
+
+	// nothing is detached if attaching fails
+	if c, err := db.GetCat(ctx, tiger); err != nil || c.Sightings != 3 {
+		return fmt.Errorf("expected the failed update to leave 3 sightings, got %+v, %v", c, err)
+	}
+
+	// hidden images don't count as sightings
+	if err := db.SetImageHidden(ctx, sightings[2].ID, true); err != nil {
+		return err
+	}
+
+	if err := db.UpdateCatImages(ctx, tiger, nil, []int64{sightings[0].ID}); err != nil {
+		return err
+	}
+
+	c, err = db.GetCat(ctx, tiger)
+	if err != nil {
+		return err
+	}
+
+	if c.Sightings != 1 || !c.FirstSeen.Equal(images[2].Timestamp) || !c.LastSeen.Equal(images[2].Timestamp) {
+		return fmt.Errorf("expected one sighting at %v, got %+v", images[2].Timestamp, c)
+	}
+
+	if err := db.MergeCats(ctx, tiger, []int64{tiger}); err == nil {
+		return errors.New("merging a cat with itself succeeded")
+	}
+	return nil
+}
+
+func checkPerceptualHashes(ctx context.Context, db coa.Database) error {
+	images := []coa.Image{
+		newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+		newImage("b", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+		newImage("c", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok"),
+	}
+	// the highest bit must survive being stored in a signed column
+	images[0].PHash = 0xf0f0f0f0f0f0f0f1
+	images[1].PHash = 42
+
+	if err := db.InsertImages(ctx, images); err != nil {
+		return err
+	}
+
+	inserted, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	byHash := make(map[string]coa.Image)
+	for _, img := range inserted {
+		byHash[img.SHA256] = img
+	}
+
+	for _, want := range images {
+		if got := byHash[want.SHA256].PHash; got != want.PHash {
+			return fmt.Errorf("expected perceptual hash %x for image %s, got %x", want.PHash, want.SHA256, got)
+		}
+	}
+
+	// hidden images are still known
+	hidden := byHash[images[0].SHA256]
+	if err := db.SetImageHidden(ctx, hidden.ID, true); err != nil {
+		return err
+	}
+
+	hashes, err := db.GetPerceptualHashes(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(hashes) != 2 || hashes[hidden.ID] != images[0].PHash || hashes[byHash[images[1].SHA256].ID] != 42 {
+		return fmt.Errorf("expected perceptual hashes of two images, got %v", hashes)
+	}
+	return nil
+}
+
+func checkRenditions(ctx context.Context, db coa.Database) error {
+	img := newImage("a", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok")
+	img.Renditions = []coa.Rendition{
+		newRendition("a", coa.RenditionLarge, 4032, 3024),
+		newRendition("a", coa.RenditionSmall, 300, 225),
+	}
+
+	other := newImage("b", 13.7563, 100.5018, "Bangkok", "Thailand", "Asia/Bangkok")
+	if err := db.InsertImages(ctx, []coa.Image{img, other}); err != nil {
+		return err
+	}
+
+	images, err := db.GetImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(images) != 2 {
+		return fmt.Errorf("expected 2 images, got %d", len(images))
+	}
+
+	if len(images[1].Renditions) != 0 {
+		return fmt.Errorf("expected no renditions for image without any, got %+v", images[1].Renditions)
+	}
+
+	if err := compareRenditions(images[0].Renditions, []coa.Rendition{img.Renditions[1], img.Renditions[0]}); err != nil {
+		return err
+	}
+
+	if err := db.InsertRenditions(ctx, 1000, img.Renditions); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for renditions of unknown image, got %v", err)
+	}
+
+	// replaces the small rendition and adds two new ones
+	added := []coa.Rendition{
+		newRendition("a2", coa.RenditionSmall, 320, 240),
+		newRendition("a", coa.RenditionMedium, 600, 450),
+		newRendition("a", "thumbnail", 100, 75),
+	}
+	added[2].Format = coa.FormatPNG
+
+	if err := db.InsertRenditions(ctx, images[0].ID, added); err != nil {
+		return err
+	}
+
+	got, err := db.GetImage(ctx, images[0].ID)
+	if err != nil {
+		return err
+	}
+
+	want := []coa.Rendition{added[2], added[0], added[1], img.Renditions[0]}
+	if err := compareRenditions(got.Renditions, want); err != nil {
+		return err
+	}
+
+	// the URLs of the standard renditions are kept in sync
+	if got.URLSmall.String() != added[0].URL.String() || got.URLMedium.String() != added[1].URL.String() {
+		return fmt.Errorf("expected URLs of the new renditions, got %s and %s", got.URLSmall, got.URLMedium)
+	}
+
+	if err := db.DeleteImage(ctx, got.ID); err != nil {
+		return err
+	}
+
+	if err := db.InsertRenditions(ctx, got.ID, added); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for renditions of deleted image, got %v", err)
+	}
+	return nil
+}
+
+func expectUnusedCount(ctx context.Context, db coa.Database, platform coa.Platform, expected int) error {
+	count, err := db.GetUnusedImageCount(ctx, platform)
+	if err != nil {
+		return err
+	}
+
+	if count != expected {
+		return fmt.Errorf("expected %d unused images for %s, got %d", expected, platform, count)
+	}
+	return nil
+}
+
+func newImage(name string, latitude, longitude float64, city, country, timezone string) coa.Image {
+	return coa.Image{
+		URLLarge:  mustParseURL(fmt.Sprintf("https://example.com/%s/large", name)),
+		URLMedium: mustParseURL(fmt.Sprintf("https://example.com/%s/medium", name)),
+		URLSmall:  mustParseURL(fmt.Sprintf("https://example.com/%s/small", name)),
+		SHA256:    fmt.Sprintf("%064s", name),
+		Timestamp: time.Date(2023, 10, 29, 7, 30, 0, 0, time.UTC),
+		Timezone:  timezone,
+		Latitude:  latitude,
+		Longitude: longitude,
+		City:      city,
+		Country:   country,
+	}
+}
+
+func newRendition(image, name string, width, height int) coa.Rendition {
+	return coa.Rendition{
+		Name:   name,
+		URL:    mustParseURL(fmt.Sprintf("https://example.com/%s/%s", image, name)),
+		Width:  width,
+		Height: height,
+		Size:   int64(width * height),
+		Format: coa.FormatJPEG,
+	}
+}
+
+func compareRenditions(got, want []coa.Rendition) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("expected %d renditions, got %d", len(want), len(got))
+	}
+
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Name != w.Name || g.URL.String() != w.URL.String() || g.Width != w.Width || g.Height != w.Height ||
+			g.Size != w.Size || g.Format != w.Format {
+			return fmt.Errorf("expected rendition %+v at index %d, got %+v", w, i, g)
+		}
+	}
+	return nil
+}
+
+func compareImages(got, want coa.Image) error {
+	if got.URLLarge.String() != want.URLLarge.String() ||
+		got.URLMedium.String() != want.URLMedium.String() ||
+		got.URLSmall.String() != want.URLSmall.String() {
+		return fmt.Errorf("URLs do not match: got %+v, want %+v", got, want)
+	}
+
+	// images without a format are JPEGs
+	wantFormat := want.Format
+	if wantFormat == "" {
+		wantFormat = coa.FormatJPEG
+	}
+
+	if got.Format != wantFormat {
+		return fmt.Errorf("expected format %s, got %s", wantFormat, got.Format)
+	}
+
+	if got.SHA256 != want.SHA256 {
+		return fmt.Errorf("expected SHA256 %s, got %s", want.SHA256, got.SHA256)
+	}
+
+	if !got.Timestamp.Equal(want.Timestamp) {
+		return fmt.Errorf("expected timestamp %v, got %v", want.Timestamp, got.Timestamp)
+	}
+
+	if got.Timestamp.Location().String() != want.Timezone {
+		return fmt.Errorf("expected timestamp in time zone %s, got %s", want.Timezone, got.Timestamp.Location())
+	}
+
+	if got.Latitude != want.Latitude || got.Longitude != want.Longitude {
+		return fmt.Errorf(
+			"expected coordinates %f, %f, got %f, %f",
+			want.Latitude,
+			want.Longitude,
+			got.Latitude,
+			got.Longitude,
+		)
+	}
+
+	if got.City != want.City || got.Country != want.Country || got.Timezone != want.Timezone {
+		return fmt.Errorf("expected location %s (%s), got %s (%s)", want.Location(), want.Timezone, got.Location(), got.Timezone)
+	}
+	return nil
+}
+
+func mustParseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func checkJobs(ctx context.Context, db coa.Database) error {
+	const maxAttempts = 3
+
+	if _, err := db.ClaimJob(ctx, time.Hour, maxAttempts); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows from empty queue, got %v", err)
+	}
+
+	firstID, err := db.InsertJob(ctx, coa.Job{FileName: "first.jpg", StorageKey: "uploads/first.jpg"})
+	if err != nil {
+		return err
+	}
+
+	secondID, err := db.InsertJob(ctx, coa.Job{FileName: "second.jpg", StorageKey: "uploads/second.jpg"})
+	if err != nil {
+		return err
+	}
+
+	jobs, err := db.GetJobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(jobs) != 2 || jobs[0].ID != secondID || jobs[1].ID != firstID {
+		return fmt.Errorf("expected jobs %d and %d, newest first, got %+v", secondID, firstID, jobs)
+	}
+
+	if jobs[1].State != coa.JobQueued || jobs[1].Attempts != 0 || jobs[1].StorageKey != "uploads/first.jpg" {
+		return fmt.Errorf("unexpected new job %+v", jobs[1])
+	}
+
+	first, err := db.ClaimJob(ctx, time.Hour, maxAttempts)
+	if err != nil {
+		return err
+	}
+
+	if first.ID != firstID || first.State != coa.JobRunning || first.Attempts != 1 {
+		return fmt.Errorf("expected first job to be claimed, got %+v", first)
+	}
+
+	second, err := db.ClaimJob(ctx, time.Hour, maxAttempts)
+	if err != nil {
+		return err
+	}
+
+	if second.ID != secondID {
+		return fmt.Errorf("expected second job to be claimed, got %+v", second)
+	}
+
+	if _, err := db.ClaimJob(ctx, time.Hour, maxAttempts); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows while all jobs are running, got %v", err)
+	}
+
+	if err := db.RetryJob(ctx, second, "try later", time.Now().Add(time.Hour)); err != nil {
+		return err
+	}
+
+	if _, err := db.ClaimJob(ctx, time.Hour, maxAttempts); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for a job that is not due yet, got %v", err)
+	}
+
+	// the claim was used up by the retry
+	if err := db.FailJob(ctx, second, "boom"); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for a job that was updated already, got %v", err)
+	}
+
+	if err := db.RetryJob(ctx, first, "boom", time.Now().Add(-time.Minute)); err != nil {
+		return err
+	}
+
+	// claimed with a lease that has expired already, like a job whose worker died
+	stale, err := db.ClaimJob(ctx, -time.Minute, maxAttempts)
+	if err != nil {
+		return err
+	}
+
+	if stale.ID != firstID || stale.Attempts != 2 || stale.LastError != "boom" {
+		return fmt.Errorf("expected retried first job, got %+v", stale)
+	}
+
+	first, err = db.ClaimJob(ctx, time.Hour, maxAttempts)
+	if err != nil {
+		return err
+	}
+
+	if first.ID != firstID || first.Attempts != 3 || first.Claim == stale.Claim {
+		return fmt.Errorf("expected first job with expired lease to be claimed again, got %+v", first)
+	}
+
+	// the worker whose lease expired must not overwrite what the worker that took over does
+	if err := db.CompleteJob(ctx, stale); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows when completing a job with an expired claim, got %v", err)
+	}
+
+	if err := db.FailJob(ctx, stale, "stale"); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows when failing a job with an expired claim, got %v", err)
+	}
+
+	// an interrupted attempt doesn't count
+	if err := db.ReleaseJob(ctx, first); err != nil {
+		return err
+	}
+
+	first, err = db.ClaimJob(ctx, time.Hour, maxAttempts)
+	if err != nil {
+		return err
+	}
+
+	if first.ID != firstID || first.Attempts != 3 || first.LastError != "boom" {
+		return fmt.Errorf("expected released first job to be claimed again with the same attempts, got %+v", first)
+	}
+
+	if err := db.CompleteJob(ctx, first); err != nil {
+		return err
+	}
+
+	if err := db.CompleteJob(ctx, coa.Job{ID: secondID + firstID}); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows for unknown job, got %v", err)
+	}
+
+	// a job whose worker dies in every attempt, e.g. because the file crashes the process
+	crashingID, err := db.InsertJob(ctx, coa.Job{FileName: "crashing.heic", StorageKey: "uploads/crashing.heic"})
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		crashing, err := db.ClaimJob(ctx, -time.Minute, maxAttempts)
+		if err != nil {
+			return err
+		}
+
+		if crashing.ID != crashingID || crashing.Attempts != attempt {
+			return fmt.Errorf("expected attempt %d of the crashing job, got %+v", attempt, crashing)
+		}
+	}
+
+	if job, err := db.ClaimJob(ctx, time.Hour, maxAttempts); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows after the last attempt of the crashing job, got %+v, %v", job, err)
+	}
+
+	if _, err := db.InsertJob(ctx, coa.Job{FileName: "nogps.jpg", StorageKey: "uploads/nogps.jpg"}); err != nil {
+		return err
+	}
+
+	noGPS, err := db.ClaimJob(ctx, time.Hour, maxAttempts)
+	if err != nil {
+		return err
+	}
+
+	if err := db.FailJob(ctx, noGPS, "no GPS coordinates"); err != nil {
+		return err
+	}
+
+	jobs, err = db.GetJobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(jobs) != 4 {
+		return fmt.Errorf("expected 4 jobs, got %+v", jobs)
+	}
+
+	if jobs[0].State != coa.JobFailed || jobs[0].LastError != "no GPS coordinates" {
+		return fmt.Errorf("unexpected failed job %+v", jobs[0])
+	}
+
+	if jobs[1].State != coa.JobFailed || jobs[1].LastError != coa.JobAbandoned || jobs[1].Attempts != maxAttempts {
+		return fmt.Errorf("expected crashing job to fail after %d attempts, got %+v", maxAttempts, jobs[1])
+	}
+
+	if jobs[2].State != coa.JobQueued || jobs[2].LastError != "try later" || jobs[3].State != coa.JobDone {
+		return fmt.Errorf("unexpected final jobs %+v", jobs)
+	}
+
+	if _, err := db.ClaimJob(ctx, time.Hour, maxAttempts); !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("expected sql.ErrNoRows after all due jobs are finished, got %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package dhash implements the difference hash, a perceptual hash that stays (almost) the same when an image is
+// resized, re-encoded or has its colors slightly adjusted. This allows finding near-duplicates of an image by
+// comparing the Hamming distance between hashes.
+package dhash
+
+import (
+	"golang.org/x/image/draw"
+	"image"
+	"math/bits"
+)
+
+const (
+	width  = 9
+	height = 8
+)
+
+// Hash calculates the difference hash of an image. The image is scaled down to 9x8 grayscale pixels and each bit of
+// the hash says whether a pixel is brighter than its right neighbour.
+func Hash(img image.Image) uint64 {
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(gray, gray.Rect, img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if gray.GrayAt(x, y).Y > gray.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// Distance returns the number of bits that differ between two hashes. Images with a distance of up to about 10 are
+// usually the same picture.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,136 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dhash
+
+import (
+	"bytes"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// maxSameDistance is the highest distance at which the ingestion treats images as near-duplicates by default.
+const maxSameDistance = 6
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b     uint64
+		expected int
+	}{
+		{0, 0, 0},
+		{0xff00ff00ff00ff00, 0xff00ff00ff00ff00, 0},
+		{0, 1, 1},
+		{1 << 63, 1, 2},
+		{0, math.MaxUint64, 64},
+		{0xf0f0f0f0f0f0f0f0, 0x0f0f0f0f0f0f0f0f, 64},
+		{0b1011, 0b0110, 3},
+	}
+
+	for _, tt := range tests {
+		if d := Distance(tt.a, tt.b); d != tt.expected {
+			t.Errorf("expected distance %d between %x and %x, got %d", tt.expected, tt.a, tt.b, d)
+		}
+
+		if d := Distance(tt.b, tt.a); d != tt.expected {
+			t.Errorf("expected distance to be symmetric for %x and %x, got %d", tt.a, tt.b, d)
+		}
+	}
+}
+
+func TestHashStability(t *testing.T) {
+	original := testImage(1200, 900)
+	hash := Hash(original)
+
+	if Hash(original) != hash {
+		t.Fatal("expected the same hash for the same image")
+	}
+
+	tests := []struct {
+		name    string
+		width   int
+		quality int
+	}{
+		{"same size", 1200, 95},
+		{"low quality", 1200, 40},
+		{"half size", 600, 85},
+		{"thumbnail", 160, 75},
+		{"larger", 2400, 85},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			copied := reencode(t, resize(original, tt.width), tt.quality)
+
+			if d := Distance(hash, Hash(copied)); d > maxSameDistance {
+				t.Errorf("expected a distance of at most %d to the original, got %d", maxSameDistance, d)
+			}
+		})
+	}
+
+	mirrored := image.NewRGBA(original.Bounds())
+	for y := 0; y < original.Bounds().Dy(); y++ {
+		for x := 0; x < original.Bounds().Dx(); x++ {
+			mirrored.Set(original.Bounds().Dx()-1-x, y, original.At(x, y))
+		}
+	}
+
+	if d := Distance(hash, Hash(mirrored)); d <= maxSameDistance {
+		t.Errorf("expected a distance above %d for a different image, got %d", maxSameDistance, d)
+	}
+}
+
+// testImage creates a picture with shapes at different scales, so that it has details that get lost when it is
+// resized or compressed.
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx := float64(x) / float64(width)
+			fy := float64(y) / float64(height)
+
+			v := 128 + 50*math.Sin(fx*7+fy*2) + 40*math.Cos(fy*9-fx*3) + 20*math.Sin(fx*90)*math.Sin(fy*70)
+			img.Set(x, y, color.RGBA{R: uint8(v), G: uint8(v * 0.8), B: uint8(255 - v), A: 255})
+		}
+	}
+	return img
+}
+
+func resize(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, b.Dy()*width/b.Dx()))
+	draw.CatmullRom.Scale(dst, dst.Rect, img, b, draw.Src, nil)
+	return dst
+}
+
+func reencode(t *testing.T, img image.Image, quality int) image.Image {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
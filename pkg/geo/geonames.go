@@ -0,0 +1,302 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package geo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Names of the files from https://download.geonames.org/export/dump/ that are used for offline geocoding. The first
+// cities file found is used, so the most detailed one wins if several have been downloaded.
+var (
+	geoNamesCitiesFiles   = []string{"cities500.txt", "cities1000.txt", "cities5000.txt", "cities15000.txt"}
+	geoNamesAdmin1File    = "admin1CodesASCII.txt"
+	geoNamesCountriesFile = "countryInfo.txt"
+)
+
+type city struct {
+	name      string
+	latitude  float64
+	longitude float64
+	admin1    string
+	country   string
+}
+
+// cell is a square of one degree latitude by one degree longitude, identified by the coordinates of its south-west
+// corner. Cities are bucketed by cell, so that looking up the nearest one only needs to look at the cells around a
+// point instead of at all of the over 200,000 cities in cities500.txt.
+type cell struct {
+	latitude  int
+	longitude int
+}
+
+func cellOf(latitude, longitude float64) cell {
+	return cell{int(math.Floor(latitude)), wrapLongitude(int(math.Floor(longitude)))}
+}
+
+// wrapLongitude maps the longitude of a cell to the range [-180, 180).
+func wrapLongitude(longitude int) int {
+	return ((longitude+180)%360+360)%360 - 180
+}
+
+type geoNames struct {
+	cells map[cell][]city
+}
+
+func newGeoNames(cities []city) *geoNames {
+	g := &geoNames{make(map[cell][]city)}
+
+	for _, c := range cities {
+		key := cellOf(c.latitude, c.longitude)
+		g.cells[key] = append(g.cells[key], c)
+	}
+	return g
+}
+
+// NewGeoNames creates a coa.Geocoder that works without network access by looking up the city closest to a pair of
+// coordinates in the GeoNames dataset. dir needs to contain one of the cities files, admin1CodesASCII.txt and
+// countryInfo.txt.
+func NewGeoNames(dir string) (coa.Geocoder, error) {
+	countries, err := loadGeoNamesNames(filepath.Join(dir, geoNamesCountriesFile), 0, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	admin1, err := loadGeoNamesNames(filepath.Join(dir, geoNamesAdmin1File), 0, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range geoNamesCitiesFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		cities, err := loadGeoNamesCities(path, admin1, countries)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(cities) == 0 {
+			return nil, fmt.Errorf("no cities found in %s", path)
+		}
+		return newGeoNames(cities), nil
+	}
+
+	return nil, fmt.Errorf("none of the GeoNames files %s found in %s", strings.Join(geoNamesCitiesFiles, ", "), dir)
+}
+
+// ReverseGeocode names the place of the city closest to the coordinates after the first-level administrative division
+// it is in, e.g. the province or state, like the Google geocoder does.
+func (g *geoNames) ReverseGeocode(_ context.Context, latitude, longitude float64) (coa.Place, error) {
+	nearest := g.nearest(latitude, longitude)
+
+	name := nearest.admin1
+	if name == "" {
+		name = nearest.name
+	}
+
+	place := coa.Place{
+		City:    name,
+		Country: nearest.country,
+		Components: []coa.AddressComponent{
+			{Name: nearest.name, Types: []string{"locality", "political"}},
+		},
+	}
+
+	if nearest.admin1 != "" {
+		place.Components = append(place.Components, coa.AddressComponent{
+			Name:  nearest.admin1,
+			Types: []string{"administrative_area_level_1", "political"},
+		})
+	}
+
+	place.Components = append(place.Components, coa.AddressComponent{
+		Name:  nearest.country,
+		Types: []string{"country", "political"},
+	})
+
+	return place, nil
+}
+
+// nearest returns the city closest to the coordinates. The cells in rings around the cell of the coordinates are
+// searched until there is one with cities. The closest of those is not necessarily the nearest city, e.g. when the
+// coordinates are at the edge of their cell, so then all cells that are close enough to contain a closer city are
+// searched.
+func (g *geoNames) nearest(latitude, longitude float64) city {
+	center := cellOf(latitude, longitude)
+	nearest := city{}
+	minDist := math.Inf(1)
+
+	search := func(key cell) {
+		for _, c := range g.cells[key] {
+			if d := distance(latitude, longitude, c.latitude, c.longitude); d < minDist {
+				nearest = c
+				minDist = d
+			}
+		}
+	}
+
+	// one ring more than half the circumference covers the whole globe
+	for ring := 0; ring <= 181 && math.IsInf(minDist, 1); ring++ {
+		for lat := center.latitude - ring; lat <= center.latitude+ring; lat++ {
+			for lng := center.longitude - ring; lng <= center.longitude+ring; lng++ {
+				if max(abs(lat-center.latitude), abs(lng-center.longitude)) == ring {
+					search(cell{lat, wrapLongitude(lng)})
+				}
+			}
+		}
+	}
+
+	// a city within minDist can't be further away than this in latitude
+	radius := minDist / earthRadius
+	latMin := latitude - radius*180/math.Pi
+	latMax := latitude + radius*180/math.Pi
+
+	// nor further away than this in longitude, which stretches towards the poles
+	lngMin, lngMax := -180, 179
+	if latMin > -90 && latMax < 90 {
+		cos := math.Cos(max(math.Abs(latMin), math.Abs(latMax)) * math.Pi / 180)
+		if s := math.Sin(radius/2) / cos; s < 1 {
+			delta := 2 * math.Asin(s) * 180 / math.Pi
+			lngMin = int(math.Floor(longitude - delta))
+			lngMax = min(int(math.Floor(longitude+delta)), lngMin+359)
+		}
+	}
+
+	for lat := int(math.Floor(latMin)); lat <= int(math.Floor(latMax)); lat++ {
+		for lng := lngMin; lng <= lngMax; lng++ {
+			search(cell{lat, wrapLongitude(lng)})
+		}
+	}
+	return nearest
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func loadGeoNamesCities(path string, admin1, countries map[string]string) ([]city, error) {
+	var cities []city
+
+	err := readGeoNamesFile(path, func(fields []string) error {
+		if len(fields) < 11 {
+			return fmt.Errorf("expected at least 11 fields, got %d", len(fields))
+		}
+
+		latitude, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return fmt.Errorf("invalid latitude %s: %w", fields[4], err)
+		}
+
+		longitude, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return fmt.Errorf("invalid longitude %s: %w", fields[5], err)
+		}
+
+		countryCode := fields[8]
+		country, ok := countries[countryCode]
+		if !ok {
+			country = countryCode
+		}
+
+		cities = append(cities, city{
+			name:      fields[1],
+			latitude:  latitude,
+			longitude: longitude,
+			admin1:    admin1[countryCode+"."+fields[10]],
+			country:   country,
+		})
+		return nil
+	})
+
+	return cities, err
+}
+
+// loadGeoNamesNames reads a mapping from codes to names from the columns keyColumn and nameColumn of a GeoNames file.
+func loadGeoNamesNames(path string, keyColumn, nameColumn int) (map[string]string, error) {
+	names := make(map[string]string)
+
+	err := readGeoNamesFile(path, func(fields []string) error {
+		if len(fields) <= keyColumn || len(fields) <= nameColumn {
+			return fmt.Errorf("expected at least %d fields, got %d", max(keyColumn, nameColumn)+1, len(fields))
+		}
+
+		names[fields[keyColumn]] = fields[nameColumn]
+		return nil
+	})
+
+	return names, err
+}
+
+// readGeoNamesFile calls handleLine with the fields of each line in a tab-separated GeoNames file, skipping comments.
+func readGeoNamesFile(path string, handleLine func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open GeoNames file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// the alternate names column can get quite long
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := handleLine(strings.Split(line, "\t")); err != nil {
+			return fmt.Errorf("invalid line %d in %s: %w", lineNo, path, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read GeoNames file %s: %w", path, err)
+	}
+	return nil
+}
+
+// earthRadius is the mean radius of the earth in kilometers.
+const earthRadius = 6371.0
+
+// distance returns the great-circle distance between two points in kilometers.
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lng2 - lng1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
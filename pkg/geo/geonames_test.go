@@ -0,0 +1,242 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package geo_test
+
+import (
+	"context"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/geo"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const countryInfo = `#ISO	ISO3	ISO-Numeric	fips	Country	Capital
+TH	THA	764	TH	Thailand	Bangkok
+LA	LAO	418	LA	Laos	Vientiane
+FJ	FJI	242	FJ	Fiji	Suva
+`
+
+const admin1Codes = `TH.40	Bangkok	Bangkok	1609348
+TH.02	Chiang Mai	Chiang Mai	1153670
+TH.81	Krabi	Krabi	1152632
+LA.27	Vientiane Prefecture	Vientiane Prefecture	1904618
+FJ.03	Northern	Northern	2204350
+`
+
+// cities are a few places in Thailand, Laos, Cambodia and Fiji, which spans the antimeridian. Ko Lanta has no admin1
+// code and Laem Sak has one that is missing from admin1Codes. Siem Reap is in the cell north of Kampong Thom.
+var cities = [][]string{
+	geoNamesCity("Bangkok", 13.75398, 100.50144, "TH", "40"),
+	geoNamesCity("Chiang Mai", 18.79038, 98.98468, "TH", "02"),
+	geoNamesCity("Krabi", 8.07257, 98.91052, "TH", "81"),
+	geoNamesCity("Ko Lanta", 7.6, 99.05, "TH", ""),
+	geoNamesCity("Laem Sak", 8.25, 98.6, "TH", "99"),
+	geoNamesCity("Vientiane", 17.96667, 102.6, "LA", "27"),
+	geoNamesCity("Siem Reap", 13.36, 103.86, "KH", ""),
+	geoNamesCity("Kampong Thom", 12.71, 104.89, "KH", ""),
+	geoNamesCity("Labasa", -16.41667, 179.38333, "FJ", "03"),
+	geoNamesCity("Naqara", -16.81, -179.98, "ZZ", "01"),
+}
+
+func geoNamesCity(name string, latitude, longitude float64, country, admin1 string) []string {
+	return []string{
+		"1", name, name, "", fmt.Sprint(latitude), fmt.Sprint(longitude), "P", "PPL", country, "", admin1, "", "", "",
+		"1000", "", "10", "Asia/Bangkok", "2023-01-01",
+	}
+}
+
+func writeGeoNames(t *testing.T, dir, citiesFile string, cities [][]string) {
+	t.Helper()
+
+	var lines []string
+	for _, c := range cities {
+		lines = append(lines, strings.Join(c, "\t"))
+	}
+
+	files := map[string]string{
+		"countryInfo.txt":      countryInfo,
+		"admin1CodesASCII.txt": admin1Codes,
+		citiesFile:             strings.Join(lines, "\n") + "\n",
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGeoNamesReverseGeocode(t *testing.T) {
+	dir := t.TempDir()
+	writeGeoNames(t, dir, "cities15000.txt", cities)
+
+	geocoder, err := geo.NewGeoNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+		city      string
+		locality  string
+		admin1    string
+		country   string
+	}{
+		{"city center", 13.75398, 100.50144, "Bangkok", "Bangkok", "Bangkok", "Thailand"},
+		{"near a city", 18.8, 99.0, "Chiang Mai", "Chiang Mai", "Chiang Mai", "Thailand"},
+		{"city in a neighbouring cell", 17.99, 101.01, "Vientiane Prefecture", "Vientiane", "Vientiane Prefecture", "Laos"},
+		{"closer city in a neighbouring cell", 12.99, 104.01, "Siem Reap", "Siem Reap", "", "KH"},
+		{"closest of cities in the same area", 8.1, 98.9, "Krabi", "Krabi", "Krabi", "Thailand"},
+		{"no admin1 code", 7.61, 99.04, "Ko Lanta", "Ko Lanta", "", "Thailand"},
+		{"unknown admin1 code", 8.26, 98.6, "Laem Sak", "Laem Sak", "", "Thailand"},
+		{"unknown country", -16.8, -179.99, "Naqara", "Naqara", "", "ZZ"},
+		{"across the antimeridian", -16.5, 179.99, "Naqara", "Naqara", "", "ZZ"},
+		{"far away from all cities", 60, -30, "Chiang Mai", "Chiang Mai", "Chiang Mai", "Thailand"},
+		{"near the pole", 89.9, 10, "Chiang Mai", "Chiang Mai", "Chiang Mai", "Thailand"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			place, err := geocoder.ReverseGeocode(context.Background(), tt.latitude, tt.longitude)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if place.City != tt.city || place.Country != tt.country {
+				t.Fatalf("expected %s, %s, got %s, %s", tt.city, tt.country, place.City, place.Country)
+			}
+
+			if name := component(place, "locality"); name != tt.locality {
+				t.Errorf("expected locality %s, got %s", tt.locality, name)
+			}
+
+			if name := component(place, "country"); name != tt.country {
+				t.Errorf("expected country component %s, got %s", tt.country, name)
+			}
+
+			if name := component(place, "administrative_area_level_1"); name != tt.admin1 {
+				t.Errorf("expected administrative_area_level_1 %q, got %q", tt.admin1, name)
+			}
+		})
+	}
+}
+
+func component(place coa.Place, typ string) string {
+	for _, c := range place.Components {
+		for _, t := range c.Types {
+			if t == typ {
+				return c.Name
+			}
+		}
+	}
+	return ""
+}
+
+func TestNewGeoNames(t *testing.T) {
+	t.Run("most detailed cities file", func(t *testing.T) {
+		dir := t.TempDir()
+		writeGeoNames(t, dir, "cities15000.txt", cities[:1])
+		writeGeoNames(t, dir, "cities500.txt", cities[1:2])
+
+		geocoder, err := geo.NewGeoNames(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		place, err := geocoder.ReverseGeocode(context.Background(), 13.75, 100.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if place.City != "Chiang Mai" {
+			t.Errorf("expected the city from cities500.txt, got %s", place.City)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, dir string)
+		err     string
+	}{
+		{
+			name:    "no cities file",
+			prepare: func(t *testing.T, dir string) { writeGeoNames(t, dir, "other.txt", cities) },
+			err:     "none of the GeoNames files",
+		},
+		{
+			name: "missing countries",
+			prepare: func(t *testing.T, dir string) {
+				writeGeoNames(t, dir, "cities500.txt", cities)
+				removeFile(t, filepath.Join(dir, "countryInfo.txt"))
+			},
+			err: "unable to open GeoNames file",
+		},
+		{
+			name: "missing admin1 codes",
+			prepare: func(t *testing.T, dir string) {
+				writeGeoNames(t, dir, "cities500.txt", cities)
+				removeFile(t, filepath.Join(dir, "admin1CodesASCII.txt"))
+			},
+			err: "unable to open GeoNames file",
+		},
+		{
+			name:    "no cities",
+			prepare: func(t *testing.T, dir string) { writeGeoNames(t, dir, "cities500.txt", nil) },
+			err:     "no cities found",
+		},
+		{
+			name: "too few fields",
+			prepare: func(t *testing.T, dir string) {
+				writeGeoNames(t, dir, "cities500.txt", [][]string{cities[0][:10]})
+			},
+			err: "invalid line 1",
+		},
+		{
+			name: "invalid latitude",
+			prepare: func(t *testing.T, dir string) {
+				city := append([]string{}, cities[0]...)
+				city[4] = "north"
+				writeGeoNames(t, dir, "cities500.txt", [][]string{cities[1], city})
+			},
+			err: "invalid line 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.prepare(t, dir)
+
+			if _, err := geo.NewGeoNames(dir); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func removeFile(t *testing.T, path string) {
+	t.Helper()
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package geo
+
+import (
+	"context"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"googlemaps.github.io/maps"
+	"time"
+)
+
+type googleMaps struct {
+	client *maps.Client
+}
+
+// NewGoogleGeocoder creates a coa.Geocoder that uses the Google Maps Geocoding API.
+func NewGoogleGeocoder(apiKey string) (coa.Geocoder, error) {
+	client, err := maps.NewClient(maps.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate Google Maps client: %w", err)
+	}
+
+	return &googleMaps{client}, nil
+}
+
+// NewGoogleTimezoneResolver creates a coa.TimezoneResolver that uses the Google Maps Time Zone API.
+func NewGoogleTimezoneResolver(apiKey string) (coa.TimezoneResolver, error) {
+	client, err := maps.NewClient(maps.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate Google Maps client: %w", err)
+	}
+
+	return &googleMaps{client}, nil
+}
+
+func (g *googleMaps) Timezone(ctx context.Context, latitude, longitude float64, t time.Time) (*time.Location, error) {
+	t, err := time.ParseInLocation(time.DateTime, t.Format(time.DateTime), time.UTC)
+	if err != nil {
+		return nil, err
+	}
+
+	req := maps.TimezoneRequest{
+		Location: &maps.LatLng{
+			Lat: latitude,
+			Lng: longitude,
+		},
+		Timestamp: t,
+		Language:  "English",
+	}
+
+	res, err := g.client.Timezone(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	return time.LoadLocation(res.TimeZoneID)
+}
+
+func (g *googleMaps) ReverseGeocode(ctx context.Context, latitude, longitude float64) (coa.Place, error) {
+	r := &maps.GeocodingRequest{
+		LatLng: &maps.LatLng{
+			Lat: latitude,
+			Lng: longitude,
+		},
+	}
+
+	locs, err := g.client.ReverseGeocode(ctx, r)
+	if err != nil {
+		return coa.Place{}, err
+	}
+
+	if len(locs) == 0 || len(locs[0].AddressComponents) == 0 {
+		return coa.Place{}, fmt.Errorf(
+			"the Google Maps API did not return required address components for latitude %f, longitude %f",
+			latitude,
+			longitude,
+		)
+	}
+
+	var place coa.Place
+	for _, comp := range locs[0].AddressComponents {
+		place.Components = append(place.Components, coa.AddressComponent{Name: comp.LongName, Types: comp.Types})
+
+		for _, t := range comp.Types {
+			if t == "administrative_area_level_1" {
+				place.City = comp.LongName
+			} else if t == "country" {
+				place.Country = comp.LongName
+			}
+		}
+	}
+
+	return place, nil
+}
@@ -0,0 +1,210 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package geo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"os"
+	"time"
+)
+
+// ErrNoTimezone is returned when no time zone could be found for a pair of coordinates.
+var ErrNoTimezone = errors.New("no time zone found")
+
+// point is a pair of coordinates in GeoJSON order, i.e. longitude first
+type point [2]float64
+
+// ring is a closed line of points
+type ring []point
+
+// polygon consists of an outer ring and optional holes
+type polygon struct {
+	rings                          []ring
+	minLng, minLat, maxLng, maxLat float64
+}
+
+type zone struct {
+	location *time.Location
+	polygons []polygon
+}
+
+type timezoneBoundaries struct {
+	zones []zone
+}
+
+// NewTimezoneBoundaries creates a coa.TimezoneResolver that works without network access by looking up coordinates in
+// the time zone polygons from a GeoJSON file as published by https://github.com/evansiroky/timezone-boundary-builder.
+func NewTimezoneBoundaries(path string) (coa.TimezoneResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open time zone boundaries: %w", err)
+	}
+	defer f.Close()
+
+	var collection struct {
+		Features []struct {
+			Properties struct {
+				TZID string `json:"tzid"`
+			} `json:"properties"`
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+
+	if err := json.NewDecoder(f).Decode(&collection); err != nil {
+		return nil, fmt.Errorf("unable to decode time zone boundaries from %s: %w", path, err)
+	}
+
+	var zones []zone
+	for _, feature := range collection.Features {
+		loc, err := time.LoadLocation(feature.Properties.TZID)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone in %s: %w", path, err)
+		}
+
+		var polygons [][]ring
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var p []ring
+			err = json.Unmarshal(feature.Geometry.Coordinates, &p)
+			polygons = [][]ring{p}
+		case "MultiPolygon":
+			err = json.Unmarshal(feature.Geometry.Coordinates, &polygons)
+		default:
+			err = fmt.Errorf("unsupported geometry type '%s'", feature.Geometry.Type)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid geometry for time zone %s in %s: %w", feature.Properties.TZID, path, err)
+		}
+
+		z := zone{location: loc}
+		for _, rings := range polygons {
+			if len(rings) > 0 {
+				z.polygons = append(z.polygons, newPolygon(rings))
+			}
+		}
+		zones = append(zones, z)
+	}
+
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no time zones found in %s", path)
+	}
+	return &timezoneBoundaries{zones}, nil
+}
+
+func (tb *timezoneBoundaries) Timezone(
+	_ context.Context,
+	latitude, longitude float64,
+	_ time.Time,
+) (*time.Location, error) {
+	for _, z := range tb.zones {
+		for _, p := range z.polygons {
+			if p.contains(longitude, latitude) {
+				return z.location, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w for latitude %f, longitude %f", ErrNoTimezone, latitude, longitude)
+}
+
+func newPolygon(rings []ring) polygon {
+	p := polygon{
+		rings:  rings,
+		minLng: 180,
+		minLat: 90,
+		maxLng: -180,
+		maxLat: -90,
+	}
+
+	// the bounding box of the outer ring allows skipping most polygons without looking at every point
+	for _, pt := range rings[0] {
+		p.minLng = min(p.minLng, pt[0])
+		p.maxLng = max(p.maxLng, pt[0])
+		p.minLat = min(p.minLat, pt[1])
+		p.maxLat = max(p.maxLat, pt[1])
+	}
+	return p
+}
+
+func (p polygon) contains(lng, lat float64) bool {
+	if lng < p.minLng || lng > p.maxLng || lat < p.minLat || lat > p.maxLat {
+		return false
+	}
+
+	if !p.rings[0].contains(lng, lat) {
+		return false
+	}
+
+	for _, hole := range p.rings[1:] {
+		if hole.contains(lng, lat) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains checks whether a point is inside the ring using the even-odd rule
+func (r ring) contains(lng, lat float64) bool {
+	inside := false
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		a, b := r[i], r[j]
+		if (a[1] > lat) != (b[1] > lat) && lng < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+type fallbackTimezoneResolver struct {
+	resolvers []coa.TimezoneResolver
+}
+
+// NewFallbackTimezoneResolver creates a coa.TimezoneResolver that asks each of the given resolvers in turn until one of
+// them finds a time zone.
+func NewFallbackTimezoneResolver(resolvers ...coa.TimezoneResolver) coa.TimezoneResolver {
+	return &fallbackTimezoneResolver{resolvers}
+}
+
+func (fr *fallbackTimezoneResolver) Timezone(
+	ctx context.Context,
+	latitude, longitude float64,
+	t time.Time,
+) (*time.Location, error) {
+	var errs []error
+
+	for _, r := range fr.resolvers {
+		loc, err := r.Timezone(ctx, latitude, longitude, t)
+		if err == nil {
+			return loc, nil
+		}
+
+		// no point in asking the next resolver
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,300 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package geo_test
+
+import (
+	"context"
+	"errors"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/geo"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// boundaries is a coarse version of a few time zones in the format of timezone-boundary-builder. Bangkok and Vientiane
+// share the border at longitude 105. Kuala Lumpur has two polygons and the one on the peninsula has a hole for
+// Singapore.
+const boundaries = `{
+  "type": "FeatureCollection",
+  "features": [
+    {
+      "type": "Feature",
+      "properties": {"tzid": "Asia/Bangkok"},
+      "geometry": {
+        "type": "Polygon",
+        "coordinates": [[[97, 5], [105, 5], [105, 20], [97, 20], [97, 5]]]
+      }
+    },
+    {
+      "type": "Feature",
+      "properties": {"tzid": "Asia/Vientiane"},
+      "geometry": {
+        "type": "Polygon",
+        "coordinates": [[[105, 14], [108, 14], [108, 22], [105, 22], [105, 14]]]
+      }
+    },
+    {
+      "type": "Feature",
+      "properties": {"tzid": "Asia/Kuala_Lumpur"},
+      "geometry": {
+        "type": "MultiPolygon",
+        "coordinates": [
+          [
+            [[100, 1], [104.5, 1], [104.5, 5], [100, 5], [100, 1]],
+            [[103.6, 1.2], [104.1, 1.2], [104.1, 1.5], [103.6, 1.5], [103.6, 1.2]]
+          ],
+          [[[109, 1], [119, 1], [119, 7], [109, 7], [109, 1]]]
+        ]
+      }
+    },
+    {
+      "type": "Feature",
+      "properties": {"tzid": "Asia/Singapore"},
+      "geometry": {
+        "type": "Polygon",
+        "coordinates": [[[103.6, 1.2], [104.1, 1.2], [104.1, 1.5], [103.6, 1.5], [103.6, 1.2]]]
+      }
+    }
+  ]
+}`
+
+func writeBoundaries(t *testing.T, geojson string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "timezones.geojson")
+	if err := os.WriteFile(path, []byte(geojson), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTimezoneBoundaries(t *testing.T) {
+	tb, err := geo.NewTimezoneBoundaries(writeBoundaries(t, boundaries))
+	if err != nil {
+		t.Fatalf("NewTimezoneBoundaries() failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+		want      string
+	}{
+		{"Bangkok", 13.7563, 100.5018, "Asia/Bangkok"},
+		{"Chiang Mai", 18.7883, 98.9853, "Asia/Bangkok"},
+		{"Pakse", 15.1202, 105.7999, "Asia/Vientiane"},
+		{"Kuala Lumpur", 3.1390, 101.6869, "Asia/Kuala_Lumpur"},
+		{"Kota Kinabalu, second polygon", 5.9804, 116.0735, "Asia/Kuala_Lumpur"},
+		{"Singapore, in the hole", 1.3521, 103.8198, "Asia/Singapore"},
+		// points on a shared border belong to exactly one of the zones
+		{"border of Bangkok and Vientiane", 15, 105, "Asia/Vientiane"},
+		{"corner of a polygon", 5, 97, "Asia/Bangkok"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := tb.Timezone(context.Background(), tt.latitude, tt.longitude, time.Now())
+			if err != nil {
+				t.Fatalf("Timezone(%f, %f) failed: %v", tt.latitude, tt.longitude, err)
+			}
+			if loc.String() != tt.want {
+				t.Errorf("Timezone(%f, %f) = %s, want %s", tt.latitude, tt.longitude, loc, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimezoneBoundariesNotFound(t *testing.T) {
+	tb, err := geo.NewTimezoneBoundaries(writeBoundaries(t, boundaries))
+	if err != nil {
+		t.Fatalf("NewTimezoneBoundaries() failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+	}{
+		{"Andaman Sea", 10, 96},
+		{"South China Sea, inside the bounding box of Kuala Lumpur", 6, 107},
+		{"outside of all bounding boxes", -33.8688, 151.2093},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := tb.Timezone(context.Background(), tt.latitude, tt.longitude, time.Now())
+			if !errors.Is(err, geo.ErrNoTimezone) {
+				t.Fatalf("Timezone(%f, %f) = %v, %v, want ErrNoTimezone", tt.latitude, tt.longitude, loc, err)
+			}
+		})
+	}
+}
+
+func TestNewTimezoneBoundariesInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		geojson string
+		wantErr string
+	}{
+		{"not JSON", "timezones", "unable to decode"},
+		{"no features", `{"type": "FeatureCollection", "features": []}`, "no time zones found"},
+		{
+			"unknown time zone",
+			`{"features": [{"properties": {"tzid": "Asia/Atlantis"}, "geometry": {"type": "Polygon", "coordinates": []}}]}`,
+			"unknown time zone",
+		},
+		{
+			"unsupported geometry",
+			`{"features": [{"properties": {"tzid": "UTC"}, "geometry": {"type": "Point", "coordinates": [1, 2]}}]}`,
+			"unsupported geometry type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := geo.NewTimezoneBoundaries(writeBoundaries(t, tt.geojson))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("NewTimezoneBoundaries() = %v, want error containing '%s'", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := geo.NewTimezoneBoundaries(filepath.Join(t.TempDir(), "missing.geojson")); err == nil {
+		t.Fatal("NewTimezoneBoundaries() of a missing file succeeded")
+	}
+}
+
+// fakeResolver returns loc or err and counts how often it was asked.
+type fakeResolver struct {
+	loc   *time.Location
+	err   error
+	calls int
+}
+
+func (r *fakeResolver) Timezone(context.Context, float64, float64, time.Time) (*time.Location, error) {
+	r.calls++
+	return r.loc, r.err
+}
+
+func TestFallbackTimezoneResolver(t *testing.T) {
+	bangkok, err := time.LoadLocation("Asia/Bangkok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errAPI := errors.New("API is down")
+
+	tests := []struct {
+		name      string
+		resolvers []*fakeResolver
+		want      *time.Location
+		wantErrs  []error
+		wantCalls []int
+	}{
+		{
+			name:      "first resolver finds the time zone",
+			resolvers: []*fakeResolver{{loc: bangkok}, {loc: time.UTC}},
+			want:      bangkok,
+			wantCalls: []int{1, 0},
+		},
+		{
+			name:      "falls back when the point is not covered",
+			resolvers: []*fakeResolver{{err: geo.ErrNoTimezone}, {loc: bangkok}},
+			want:      bangkok,
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "falls back on errors",
+			resolvers: []*fakeResolver{{err: errAPI}, {loc: bangkok}},
+			want:      bangkok,
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "all resolvers fail",
+			resolvers: []*fakeResolver{{err: geo.ErrNoTimezone}, {err: errAPI}},
+			wantErrs:  []error{geo.ErrNoTimezone, errAPI},
+			wantCalls: []int{1, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resolvers []coa.TimezoneResolver
+			for _, r := range tt.resolvers {
+				resolvers = append(resolvers, r)
+			}
+
+			loc, err := geo.NewFallbackTimezoneResolver(resolvers...).Timezone(context.Background(), 1, 2, time.Now())
+			if tt.wantErrs == nil && err != nil {
+				t.Fatalf("Timezone() failed: %v", err)
+			}
+			for _, wantErr := range tt.wantErrs {
+				if !errors.Is(err, wantErr) {
+					t.Errorf("Timezone() returned error '%v', want it to wrap '%v'", err, wantErr)
+				}
+			}
+
+			if loc != tt.want {
+				t.Errorf("Timezone() = %v, want %v", loc, tt.want)
+			}
+
+			for i, r := range tt.resolvers {
+				if r.calls != tt.wantCalls[i] {
+					t.Errorf("resolver %d was called %d times, want %d", i, r.calls, tt.wantCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFallbackTimezoneResolverCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	first := &fakeResolver{err: context.Canceled}
+	second := &fakeResolver{loc: time.UTC}
+
+	_, err := geo.NewFallbackTimezoneResolver(first, second).Timezone(ctx, 1, 2, time.Now())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Timezone() = %v, want context.Canceled", err)
+	}
+	if second.calls != 0 {
+		t.Fatal("the next resolver was asked after the context was canceled")
+	}
+}
+
+func TestTimezoneBoundariesWithFallback(t *testing.T) {
+	tb, err := geo.NewTimezoneBoundaries(writeBoundaries(t, boundaries))
+	if err != nil {
+		t.Fatalf("NewTimezoneBoundaries() failed: %v", err)
+	}
+
+	api := &fakeResolver{loc: time.UTC}
+	r := geo.NewFallbackTimezoneResolver(tb, api)
+
+	loc, err := r.Timezone(context.Background(), 13.7563, 100.5018, time.Now())
+	if err != nil || loc.String() != "Asia/Bangkok" || api.calls != 0 {
+		t.Fatalf("Timezone() of Bangkok = %v, %v after %d API calls, want Asia/Bangkok without any", loc, err, api.calls)
+	}
+
+	loc, err = r.Timezone(context.Background(), 10, 96, time.Now())
+	if err != nil || loc != time.UTC || api.calls != 1 {
+		t.Fatalf("Timezone() of the Andaman Sea = %v, %v after %d API calls, want UTC after 1", loc, err, api.calls)
+	}
+}
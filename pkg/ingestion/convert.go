@@ -0,0 +1,142 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"golang.org/x/image/draw"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// heifConvert is the command line tool from libheif that is used for decoding HEIC images, since there is no decoder
+// for HEVC in Go.
+const heifConvert = "heif-convert"
+
+// normalizeImages creates the large rendition of each image, which is a JPEG without sensitive metadata. Images in
+// other formats are converted first. The original file is kept, so that it can be stored privately. Images that can't
+// be decoded are rejected, other errors only fail them. The large renditions are created next to the original files,
+// unless dir is set.
+func (i *Ingestor) normalizeImages(
+	ctx context.Context,
+	images []coa.Image,
+	dir string,
+	failed failures,
+) ([]coa.Image, error) {
+	normalize := func(ctx context.Context, img coa.Image) (coa.Image, error) {
+		return i.normalizeImage(ctx, img, dir)
+	}
+	return i.runStage(ctx, i.concurrency.Process, images, failed, normalize)
+}
+
+func (i *Ingestor) normalizeImage(ctx context.Context, img coa.Image, dir string) (coa.Image, error) {
+	path := img.PathOriginal
+	if dir != "" {
+		// files in different directories may have the same name, but not the same checksum at this point
+		path = filepath.Join(dir, img.SHA256+filepath.Ext(path))
+	}
+	pathLarge := largePath(path, "")
+
+	exists, err := i.outputExists(pathLarge)
+	if err != nil {
+		return img, err
+	}
+
+	if !exists {
+		if err := i.createLarge(ctx, img, pathLarge); err != nil {
+			return img, err
+		}
+	}
+
+	img.PathLarge = pathLarge
+	return img, nil
+}
+
+// largePath returns the path of the large rendition for an original file at path, e.g. IMG_0042.HEIC becomes
+// IMG_0042-heic-large.jpg, so that it doesn't collide with IMG_0042.PNG.
+func largePath(path, infix string) string {
+	ext := filepath.Ext(path)
+	withoutExt := strings.TrimSuffix(path, ext)
+	return fmt.Sprintf("%s-%s%s%s.jpg", withoutExt, strings.ToLower(ext[1:]), infix, imageSuffixLarge)
+}
+
+func (i *Ingestor) createLarge(ctx context.Context, img coa.Image, pathLarge string) error {
+	src := img.PathOriginal
+
+	if img.HasOriginal() {
+		if i.verbose {
+			i.logger("converting %s to JPEG...\n", img.PathOriginal)
+		}
+
+		// the converted file still has all metadata, so it must not be mistaken for a finished one on the next run.
+		// e.g. IMG_0042-heic-unsanitized-large.jpg next to the large rendition
+		src = strings.TrimSuffix(pathLarge, imageSuffixLarge+".jpg") + "-unsanitized" + imageSuffixLarge + ".jpg"
+		if err := i.convertToJPEG(ctx, img.PathOriginal, img.Format, src); err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.Remove(src); err != nil && i.verbose {
+				i.logger("unable to remove %s: %v\n", src, err)
+			}
+		}()
+	}
+
+	return sanitizeFile(src, pathLarge, i.metadata.AllowedExifFields)
+}
+
+func (i *Ingestor) convertToJPEG(ctx context.Context, path, format, pathLarge string) error {
+	// heif-convert rotates the image and resets the EXIF orientation itself
+	if format == coa.FormatHEIC {
+		if i.heifConvert == "" {
+			return fmt.Errorf("converting HEIC images requires %s from libheif, which is not installed", heifConvert)
+		}
+
+		cmd := exec.CommandContext(ctx, i.heifConvert, "-q", "100", path, pathLarge)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			err = fmt.Errorf("%s failed for %s: %w: %s", heifConvert, path, err, out)
+
+			// the file can't be decoded if heif-convert ran and failed on its own
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && ctx.Err() == nil {
+				return reject(err)
+			}
+			return err
+		}
+		return nil
+	}
+
+	src, err := decodeImage(path)
+	if err != nil {
+		return err
+	}
+
+	// the converted JPEG has no metadata, so the pixels need to be upright
+	src = applyOrientation(src, orientationOf(path, format))
+
+	// JPEGs have no alpha channel, so transparent areas become white instead of black
+	dst := image.NewRGBA(src.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Over)
+
+	return encodeImage(dst, pathLarge)
+}
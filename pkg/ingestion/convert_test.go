@@ -0,0 +1,43 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import "testing"
+
+func TestSupportsMedia(t *testing.T) {
+	tests := []struct {
+		name        string
+		heifConvert string
+		want        bool
+	}{
+		{"IMG_0042.JPG", "", true},
+		{"cat.png", "", true},
+		{"cat.webp", "", true},
+		{"IMG_0042.HEIC", "/usr/bin/heif-convert", true},
+		{"IMG_0042.heif", "/usr/bin/heif-convert", true},
+		{"IMG_0042.HEIC", "", false},
+		{"cat.gif", "/usr/bin/heif-convert", false},
+		{"notes.txt", "", false},
+	}
+
+	for _, tt := range tests {
+		i := &Ingestor{heifConvert: tt.heifConvert}
+		if got := i.SupportsMedia(tt.name); got != tt.want {
+			t.Errorf("SupportsMedia(%s) with heif-convert at '%s' = %v, want %v", tt.name, tt.heifConvert, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/dhash"
+)
+
+// NearDuplicateAction says what happens to images that look like an image in the database, e.g. because they were
+// re-exported from a phone or re-saved by a WebDAV client.
+type NearDuplicateAction string
+
+const (
+	// SkipNearDuplicates leaves near-duplicates out.
+	SkipNearDuplicates NearDuplicateAction = "skip"
+	// FlagNearDuplicates ingests near-duplicates anyway and only reports them.
+	FlagNearDuplicates NearDuplicateAction = "flag"
+	// IgnoreNearDuplicates disables the check. Perceptual hashes are still stored.
+	IgnoreNearDuplicates NearDuplicateAction = "off"
+)
+
+// DefaultNearDuplicateDistance is a Hamming distance that catches re-encoded and resized copies of an image, but
+// usually not different photos of the same scene.
+const DefaultNearDuplicateDistance = 6
+
+type NearDuplicateConfig struct {
+	Action NearDuplicateAction
+	// MaxDistance is the highest Hamming distance between perceptual hashes of two images that are considered the
+	// same.
+	MaxDistance int
+}
+
+// NearDuplicate is an image that looks like an image in the database.
+type NearDuplicate struct {
+	Path string
+	// MatchID is the ID of the image in the database that the file matched.
+	MatchID  int64
+	Distance int
+	// Skipped is false if the image was ingested anyway.
+	Skipped bool
+}
+
+func (d NearDuplicate) String() string {
+	action := "flagged"
+	if d.Skipped {
+		action = "skipped"
+	}
+	return fmt.Sprintf("%s: %s, matches image %d (distance %d)", action, d.Path, d.MatchID, d.Distance)
+}
+
+// findNearDuplicates calculates the perceptual hash of each image and compares it to the hashes of the images in the
+// database. Depending on the configured action, images that are close enough to a known image are left out. Images that
+// can't be decoded are rejected.
+func (i *Ingestor) findNearDuplicates(
+	ctx context.Context,
+	images []coa.Image,
+	failed failures,
+) ([]coa.Image, []NearDuplicate, error) {
+	if i.verbose {
+		i.logger("looking for near-duplicates...\n")
+	}
+
+	var known map[int64]uint64
+	if i.nearDuplicates.Action != IgnoreNearDuplicates {
+		var err error
+		known, err = i.db.GetPerceptualHashes(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load perceptual hashes: %w", err)
+		}
+	}
+
+	// decoding is the expensive part, so only that happens concurrently
+	images, err := i.runStage(ctx, i.concurrency.Process, images, failed, hashImage)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unique []coa.Image
+	var duplicates []NearDuplicate
+
+	for _, img := range images {
+		if matchID, distance, ok := i.closestImage(img.PHash, known); ok {
+			d := NearDuplicate{
+				Path:     img.PathOriginal,
+				MatchID:  matchID,
+				Distance: distance,
+				Skipped:  i.nearDuplicates.Action == SkipNearDuplicates,
+			}
+			duplicates = append(duplicates, d)
+
+			if i.verbose {
+				i.logger("%v\n", d)
+			}
+
+			if d.Skipped {
+				continue
+			}
+		}
+
+		unique = append(unique, img)
+	}
+
+	if i.verbose {
+		i.logger("done\n")
+	}
+	return unique, duplicates, nil
+}
+
+// hashImage sets the perceptual hash of an image.
+func hashImage(_ context.Context, img coa.Image) (coa.Image, error) {
+	src, err := decodeOriented(img.PathLarge)
+	if err != nil {
+		return img, err
+	}
+
+	img.PHash = dhash.Hash(src)
+	return img, nil
+}
+
+// closestImage returns the ID of the known image with the lowest distance to hash, if that distance is within the
+// configured maximum.
+func (i *Ingestor) closestImage(hash uint64, known map[int64]uint64) (int64, int, bool) {
+	var matchID int64
+	best := -1
+
+	for id, h := range known {
+		d := dhash.Distance(hash, h)
+		if d > i.nearDuplicates.MaxDistance {
+			continue
+		}
+
+		// the lower ID wins on a tie, so that the result does not depend on the iteration order of the map
+		if best < 0 || d < best || (d == best && id < matchID) {
+			matchID = id
+			best = d
+		}
+	}
+	return matchID, best, best >= 0
+}
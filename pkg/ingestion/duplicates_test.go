@@ -0,0 +1,57 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import "testing"
+
+func TestClosestImage(t *testing.T) {
+	i := &Ingestor{nearDuplicates: NearDuplicateConfig{Action: SkipNearDuplicates, MaxDistance: 6}}
+
+	tests := []struct {
+		name     string
+		hash     uint64
+		known    map[int64]uint64
+		expected int64
+		distance int
+		found    bool
+	}{
+		{"no known images", 0, nil, 0, 0, false},
+		{"exact match", 0xff, map[int64]uint64{1: 0xff00, 2: 0xff}, 2, 0, true},
+		{"lowest distance", 0, map[int64]uint64{1: 0b111, 2: 0b1, 3: 0b11}, 2, 1, true},
+		{"at maximum distance", 0, map[int64]uint64{4: 0b111111}, 4, 6, true},
+		{"above maximum distance", 0, map[int64]uint64{4: 0b1111111}, 0, 0, false},
+		{"distance goes before ID", 0, map[int64]uint64{7: 0b11, 3: 0b110, 5: 0b1100, 9: 0b1}, 9, 1, true},
+		{"lower ID wins a tie", 0, map[int64]uint64{7: 0b11, 3: 0b110, 5: 0b1100, 1: 0b111}, 3, 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the order of iterating a map changes between runs, so a wrong tie-break shows up eventually
+			for run := 0; run < 20; run++ {
+				id, distance, found := i.closestImage(tt.hash, tt.known)
+				if found != tt.found {
+					t.Fatalf("expected found to be %v, got %v", tt.found, found)
+				}
+
+				if found && (id != tt.expected || distance != tt.distance) {
+					t.Fatalf("expected image %d at distance %d, got image %d at distance %d", tt.expected, tt.distance,
+						id, distance)
+				}
+			}
+		})
+	}
+}
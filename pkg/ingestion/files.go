@@ -0,0 +1,107 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// ListOptions determines which files in a directory are ingested.
+type ListOptions struct {
+	// Recursive includes the files in subdirectories.
+	Recursive bool
+	// Include limits the files to those that match at least one of these patterns. Optional.
+	Include []string
+	// Exclude leaves out files and subdirectories that match any of these patterns.
+	Exclude []string
+}
+
+// ValidatePatterns checks the syntax of the include and exclude patterns.
+func (o ListOptions) ValidatePatterns() error {
+	for _, pattern := range append(o.Include, o.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// ListFiles returns the paths of the supported files in dir, in lexical order. Renditions created by a previous run
+// are left out. The patterns of opts use the syntax of filepath.Match and are matched against both the name of a file
+// and its path relative to dir, so "*.heic" and "2023/*" both work.
+func (i *Ingestor) ListFiles(dir string, opts ListOptions) ([]string, error) {
+	if err := opts.ValidatePatterns(); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+
+	walk := func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if !opts.Recursive || matchesAny(opts.Exclude, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name := entry.Name()
+		if !i.SupportsMedia(name) || i.isRenditionPath(name) || matchesAny(opts.Exclude, rel) {
+			return nil
+		}
+
+		if len(opts.Include) > 0 && !matchesAny(opts.Include, rel) {
+			return nil
+		}
+
+		paths = append(paths, p)
+		return nil
+	}
+
+	if err := filepath.WalkDir(dir, walk); err != nil {
+		return nil, fmt.Errorf("unable to list files in %s: %w", dir, err)
+	}
+	return paths, nil
+}
+
+// matchesAny checks whether the path relative to the directory that is listed, or the name of the file, match any of
+// the patterns. The patterns have been validated.
+func matchesAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -24,223 +24,447 @@ import (
 	"fmt"
 	coa "github.com/haikoschol/cats-of-asia"
 	_ "github.com/joho/godotenv/autoload"
-	"github.com/rwcarlsen/goexif/exif"
-	"golang.org/x/image/draw"
-	"golang.org/x/oauth2/google"
-	"golang.org/x/oauth2/jwt"
-	"google.golang.org/api/drive/v3"
-	"google.golang.org/api/googleapi"
-	"google.golang.org/api/option"
-	"googlemaps.github.io/maps"
+	"golang.org/x/image/webp"
 	"image"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"log"
-	"mime"
 	"net/url"
 	"os"
-	"path"
+	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
 
-const (
-	imageWidthSmall   = 300
-	imageWidthMedium  = 600
-	imageSuffixSmall  = "-small"
-	imageSuffixMedium = "-medium"
-)
+// suffix of the JPEG that images in other formats are converted to
+const imageSuffixLarge = "-large"
 
 type Ingestor struct {
-	db       coa.Database
-	gmaps    *maps.Client
-	gdrive   *drive.Service
-	folderID string
-	logger   func(format string, v ...any)
-	verbose  bool
+	db             coa.Database
+	store          coa.Storage
+	geocoder       coa.Geocoder
+	timezones      coa.TimezoneResolver
+	nearDuplicates NearDuplicateConfig
+	profiles       []coa.RenditionProfile
+	metadata       MetadataConfig
+	concurrency    ConcurrencyConfig
+	// dryRun leaves out everything that changes storage or the database, as well as lookups of places and time zones
+	// that aren't in the database yet
+	dryRun  bool
+	logger  func(format string, v ...any)
+	verbose bool
+	// heifConvert is the path of the heif-convert binary or empty if it isn't installed
+	heifConvert string
 }
 
 type Logger func(string, ...any)
 
-type GoogleCredentials struct {
-	MapsAPIKey           string
-	SvcAccountEmail      string
-	SvcAccountPrivateKey string
-}
-
 func NewIngestor(
 	db coa.Database,
-	credentials GoogleCredentials,
-	folderID string,
+	store coa.Storage,
+	geocoder coa.Geocoder,
+	timezones coa.TimezoneResolver,
+	nearDuplicates NearDuplicateConfig,
+	profiles []coa.RenditionProfile,
+	metadata MetadataConfig,
+	concurrency ConcurrencyConfig,
+	dryRun bool,
 	logger Logger,
 	verbose bool,
-) (*Ingestor, error) {
+) *Ingestor {
+	// without heif-convert, HEIC files are not accepted instead of failing in the middle of the pipeline
+	heifConvertPath, err := exec.LookPath(heifConvert)
+	if err != nil {
+		logger("%s from libheif not found, HEIC images won't be ingested: %v\n", heifConvert, err)
+	}
+
+	return &Ingestor{
+		db,
+		store,
+		geocoder,
+		timezones,
+		nearDuplicates,
+		profiles,
+		metadata,
+		concurrency.withDefaults(),
+		dryRun,
+		logger,
+		verbose,
+		heifConvertPath,
+	}
+}
+
+// SupportsMedia checks whether the file with the given name can be ingested. Unlike coa.IsSupportedMedia, this depends
+// on the tools that are installed.
+func (i *Ingestor) SupportsMedia(filename string) bool {
+	format := coa.MediaFormat(filename)
+	return format != "" && (format != coa.FormatHEIC || i.heifConvert != "")
+}
+
+// FileStatus is the outcome of ingesting a file.
+type FileStatus string
+
+const (
+	FileIngested FileStatus = "ingested"
+	// FileDuplicate files are in the database already or, if near-duplicates are skipped, look like an image in it.
+	FileDuplicate FileStatus = "duplicate"
+	// FileRejected files can't be ingested, e.g. because they have no GPS coordinates.
+	FileRejected FileStatus = "rejected"
+	// FileFailed files couldn't be ingested because of an error that may go away, e.g. when the geocoder is down.
+	FileFailed FileStatus = "failed"
+	// FileNew files would have been ingested, if it wasn't a dry run.
+	FileNew FileStatus = "new"
+)
+
+// FileResult is the outcome of ingesting a file.
+type FileResult struct {
+	Path   string
+	Status FileStatus
+	// Reason explains why a file is a duplicate, was rejected or failed.
+	Reason string
+	// Image is the image that was added to the database for an ingested file.
+	Image coa.Image
+	// NearDuplicate is set if the file looks like an image in the database, regardless of whether it was ingested.
+	NearDuplicate *NearDuplicate
+}
+
+func (r FileResult) String() string {
+	if r.Reason == "" {
+		return fmt.Sprintf("%s: %s", r.Path, r.Status)
+	}
+	return fmt.Sprintf("%s: %s (%s)", r.Path, r.Status, r.Reason)
+}
+
+// IngestDirectory adds the images in the files in dir to storage and the database, like IngestFiles. Which files are
+// ingested is determined by opts.
+func (i *Ingestor) IngestDirectory(ctx context.Context, dir string, opts ListOptions) ([]FileResult, error) {
+	paths, err := i.ListFiles(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := i.IngestFiles(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
 
-	gmaps, err := maps.NewClient(maps.WithAPIKey(credentials.MapsAPIKey))
+	isNew := func(r FileResult) bool { return r.Status == FileIngested || r.Status == FileNew }
+	if i.verbose && !slices.ContainsFunc(results, isNew) {
+		i.logger("no new images found at %s\n", dir)
+	}
+	return results, nil
+}
+
+// IngestFile adds the image in the file at filePath to storage and the database, like IngestFiles.
+func (i *Ingestor) IngestFile(ctx context.Context, filePath string) (FileResult, error) {
+	results, err := i.IngestFiles(ctx, []string{filePath})
 	if err != nil {
-		return nil, fmt.Errorf("unable to instantiate Google Maps client: %w", err)
+		return FileResult{}, err
 	}
+	return results[0], nil
+}
 
-	config := &jwt.Config{
-		Email:      credentials.SvcAccountEmail,
-		PrivateKey: []byte(credentials.SvcAccountPrivateKey),
-		TokenURL:   google.JWTTokenURL,
-		Scopes:     []string{drive.DriveScope},
+// IngestReader adds the image read from r to storage and the database, like IngestFiles. name is the name of the file
+// the image was read from, e.g. the one it was uploaded with. It is used as the path of the result. All local files
+// are removed afterwards.
+func (i *Ingestor) IngestReader(ctx context.Context, name string, r io.Reader) (FileResult, error) {
+	dir, err := os.MkdirTemp("", "coa-ingest")
+	if err != nil {
+		return FileResult{}, err
 	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil && i.verbose {
+			i.logger("unable to remove temporary directory %s: %v\n", dir, err)
+		}
+	}()
+
+	p := filepath.Join(dir, filepath.Base(name))
 
-	ctx := context.Background()
-	client := config.Client(ctx)
-	gdrive, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	f, err := os.Create(p)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create Google Drive service: %w", err)
+		return FileResult{}, err
 	}
 
-	return &Ingestor{
-		db,
-		gmaps,
-		gdrive,
-		folderID,
-		logger,
-		verbose,
-	}, nil
+	if _, err := io.Copy(f, r); err != nil {
+		i.close(f)
+		return FileResult{}, fmt.Errorf("unable to write %s to %s: %w", name, p, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return FileResult{}, err
+	}
+
+	result, err := i.IngestFile(ctx, p)
+	if err != nil {
+		return FileResult{}, err
+	}
+
+	// the temporary file means nothing to the caller
+	result.Path = name
+	result.Reason = strings.ReplaceAll(result.Reason, p, name)
+	return result, nil
 }
 
-func (i *Ingestor) IngestDirectory(dir string) ([]coa.Image, error) {
-	images, err := i.collectFileInfo(dir)
+// IngestFiles adds the images in the files at the given paths to storage and the database and returns a result for
+// each file, in the same order. Files that aren't supported, can't be decoded or lack the necessary EXIF data are
+// rejected, files that are in the database already are reported as duplicates. Errors while looking up or uploading
+// an image only fail its file, so that the other files are still ingested. Errors of the database fail the whole call.
+//
+// Each stage of the pipeline works on several images at the same time, as configured by ConcurrencyConfig. When ctx is
+// cancelled, the pipeline stops before processing the next image and nothing is inserted into the database. Files that
+// have been uploaded already are left in storage and reused on the next run.
+//
+// In a dry run, files that would have been ingested are reported as new instead. Their large renditions are still
+// created, since they are needed for finding near-duplicates, but in a temporary directory that is removed afterwards.
+func (i *Ingestor) IngestFiles(ctx context.Context, paths []string) ([]FileResult, error) {
+	results := make([]FileResult, len(paths))
+	// byPath maps the path of each image that is still in the pipeline to its result
+	byPath := make(map[string]*FileResult)
+
+	images, err := i.scanFiles(ctx, paths, results)
 	if err != nil {
 		return nil, err
 	}
 
-	images, err = i.db.RemoveKnownImages(images)
+	for idx := range results {
+		if results[idx].Status == "" {
+			byPath[results[idx].Path] = &results[idx]
+		}
+	}
+
+	unknown, err := i.db.RemoveKnownImages(ctx, images)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(images) == 0 && i.verbose {
-		i.logger("no new images found at %s\n", dir)
-		return images, nil
+	known := make(map[string]bool)
+	for _, img := range images {
+		known[img.PathOriginal] = true
+	}
+	for _, img := range unknown {
+		delete(known, img.PathOriginal)
+	}
+	for p := range known {
+		*byPath[p] = FileResult{Path: p, Status: FileDuplicate, Reason: "already in the database"}
+	}
+
+	images = unknown
+	if len(images) == 0 {
+		return results, nil
+	}
+
+	failed := make(failures)
+
+	// a dry run must not leave any files behind
+	workDir := ""
+	if i.dryRun {
+		if workDir, err = os.MkdirTemp("", "coa-dry-run"); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := os.RemoveAll(workDir); err != nil && i.verbose {
+				i.logger("unable to remove temporary directory %s: %v\n", workDir, err)
+			}
+		}()
 	}
 
-	images, err = i.resizeImages(images)
+	images, err = i.normalizeImages(ctx, images, workDir, failed)
 	if err != nil {
-		return nil, fmt.Errorf("error while resizing images: %w", err)
+		return nil, fmt.Errorf("error while creating large renditions: %w", err)
+	}
+
+	images, duplicates, err := i.findNearDuplicates(ctx, images, failed)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking for near-duplicates: %w", err)
+	}
+
+	for idx, d := range duplicates {
+		r := byPath[d.Path]
+		r.NearDuplicate = &duplicates[idx]
+
+		if d.Skipped {
+			r.Status = FileDuplicate
+			r.Reason = fmt.Sprintf("looks like image %d, distance %d", d.MatchID, d.Distance)
+		}
 	}
 
 	// This needs to happen before fixing timezones and geocoding, to avoid redundant requests to the Google Maps API.
-	images, err = i.setCoordinateID(images)
-	if err != nil && i.verbose {
+	withCoordinateIDs, err := i.setCoordinateID(ctx, images)
+	if err == nil {
+		images = withCoordinateIDs
+	} else if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if i.verbose {
 		i.logger("unable to add existing locations from DB: %v\n", err)
 	}
 
-	images, err = i.fixTimezones(images)
+	status := FileNew
+	if !i.dryRun {
+		images, err = i.storeImages(ctx, images, failed)
+		if err != nil {
+			return nil, err
+		}
+		status = FileIngested
+	}
+
+	for _, img := range images {
+		r := byPath[img.PathOriginal]
+		r.Status = status
+		r.Image = img
+	}
+
+	for p, err := range failed {
+		r := byPath[p]
+		r.Status = FileFailed
+		if isRejection(err) {
+			r.Status = FileRejected
+		}
+		r.Reason = err.Error()
+	}
+
+	return results, nil
+}
+
+// storeImages creates the renditions of the images, looks up their time zones and places and adds them to storage and
+// the database.
+func (i *Ingestor) storeImages(ctx context.Context, images []coa.Image, failed failures) ([]coa.Image, error) {
+	images, err := i.resizeImages(ctx, images, failed)
+	if err != nil {
+		return nil, fmt.Errorf("error while resizing images: %w", err)
+	}
+
+	images, err = i.fixTimezones(ctx, images, failed)
 	if err != nil {
 		return nil, fmt.Errorf("error while fixing timezones: %w", err)
 	}
 
-	images, err = i.reverseGeocode(images)
+	images, err = i.reverseGeocode(ctx, images, failed)
 	if err != nil {
 		return nil, fmt.Errorf("error while reverse geocoding: %w", err)
 	}
 
-	images, err = i.uploadImages(images)
+	images, err = i.uploadImages(ctx, images, failed)
 	if err != nil {
-		return nil, fmt.Errorf("error while uploading files to Google Drive: %w", err)
+		return nil, fmt.Errorf("error while uploading files to storage: %w", err)
 	}
 
-	err = i.insertImages(images)
+	err = i.insertImages(ctx, images)
 	if err != nil {
 		return nil, fmt.Errorf("error while inserting new images into db: %w", err)
 	}
-
 	return images, nil
 }
 
-func (i *Ingestor) collectFileInfo(dir string) ([]coa.Image, error) {
+// scanFiles reads the checksum and EXIF data of each file and returns an image for each file that can be ingested. The
+// results of the other files are set.
+func (i *Ingestor) scanFiles(ctx context.Context, paths []string, results []FileResult) ([]coa.Image, error) {
 	if i.verbose {
-		i.logger("scanning directory %s...", dir)
+		i.logger("scanning %d files...", len(paths))
 	}
 
-	entries, err := os.ReadDir(dir)
+	var files []coa.Image
+	// indices of the results of files
+	var indices []int
+
+	for idx, p := range paths {
+		results[idx].Path = p
+
+		format := coa.MediaFormat(p)
+		if format == "" {
+			results[idx].Status = FileRejected
+			results[idx].Reason = "unsupported file type"
+			continue
+		}
+
+		files = append(files, coa.Image{PathOriginal: p, PathLarge: p, Format: format})
+		indices = append(indices, idx)
+	}
+
+	scanned, errs, err := mapEach(ctx, i.concurrency.Scan, files, i.readFileInfo)
 	if err != nil {
-		return nil, fmt.Errorf("os.ReadDir(%s): %w", dir, err)
+		return nil, err
 	}
 
 	var images []coa.Image
+	// seen maps checksums to the path of the first file with that checksum
+	seen := make(map[string]string)
 
-	for _, entry := range entries {
-		name := entry.Name()
-		if !coa.IsSupportedMedia(name) {
+	for n, img := range scanned {
+		r := &results[indices[n]]
+
+		if errs[n] != nil {
+			r.Status = FileFailed
+			if isRejection(errs[n]) {
+				r.Status = FileRejected
+			}
+			r.Reason = errs[n].Error()
 			continue
 		}
 
-		// skip resized images that may have been created in a previous run
-		basename := strings.TrimSuffix(name, filepath.Ext(name))
-		if strings.HasSuffix(basename, imageSuffixSmall) || strings.HasSuffix(basename, imageSuffixMedium) {
+		if first, ok := seen[img.SHA256]; ok {
+			r.Status = FileDuplicate
+			r.Reason = fmt.Sprintf("same file as %s", first)
 			continue
 		}
 
-		abspath := path.Join(dir, entry.Name())
-		f, err := os.Open(abspath)
-		if err != nil {
-			return nil, fmt.Errorf("unable to open file at %s: %w", abspath, err)
-		}
+		seen[img.SHA256] = img.PathOriginal
+		images = append(images, img)
+	}
 
-		h := sha256.New()
-		if _, err := io.Copy(h, f); err != nil {
-			i.close(f)
-			return nil, fmt.Errorf("unable to calculate SHA256 checksum of file at %s: %w", abspath, err)
-		}
+	if i.verbose {
+		i.logger("done\n")
+	}
+	return images, nil
+}
 
-		hash := fmt.Sprintf("%x", h.Sum(nil))
-		if _, err := f.Seek(0, 0); err != nil {
-			i.close(f)
-			return nil, fmt.Errorf("unable to seek back to beginning of file at %s: %w", abspath, err)
-		}
+// readFileInfo calculates the checksum of the file of an image and reads the coordinates and timestamp from its EXIF
+// data.
+func (i *Ingestor) readFileInfo(_ context.Context, img coa.Image) (coa.Image, error) {
+	abspath := img.PathOriginal
 
-		exifData, err := exif.Decode(f)
-		if err != nil {
-			i.close(f)
-			return nil, fmt.Errorf("unable to decode exif data from file at %s: %w", abspath, err)
-		}
-		i.close(f)
+	f, err := os.Open(abspath)
+	if err != nil {
+		return img, fmt.Errorf("unable to open file at %s: %w", abspath, err)
+	}
 
-		latitude, longitude, err := exifData.LatLong()
-		if err != nil {
-			return nil, fmt.Errorf("unable to read GPS coords from exif data in file at %s: %w", abspath, err)
-		}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		i.close(f)
+		return img, fmt.Errorf("unable to calculate SHA256 checksum of file at %s: %w", abspath, err)
+	}
 
-		// Timestamps are assumed to have the wrong timezone, because cameras suck apparently. Will be fixed later.
-		creationTime, err := exifData.DateTime()
-		if err != nil {
-			return nil, fmt.Errorf("unable to read timestamp from  exif data in file at %s: %w", abspath, err)
-		}
+	img.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+	i.close(f)
 
-		img := coa.Image{
-			PathLarge: abspath,
-			SHA256:    hash,
-			Latitude:  latitude,
-			Longitude: longitude,
-			Timestamp: creationTime,
-		}
+	exifData, err := readExif(abspath, img.Format)
+	if err != nil {
+		return img, rejectInvalid(fmt.Errorf("unable to decode exif data from file at %s: %w", abspath, err))
+	}
 
-		images = append(images, img)
+	img.Latitude, img.Longitude, err = exifData.LatLong()
+	if err != nil {
+		return img, reject(fmt.Errorf("unable to read GPS coords from exif data in file at %s: %w", abspath, err))
 	}
 
-	if i.verbose {
-		i.logger("done\n")
+	// Timestamps are assumed to have the wrong timezone, because cameras suck apparently. Will be fixed later.
+	img.Timestamp, err = exifData.DateTime()
+	if err != nil {
+		return img, reject(fmt.Errorf("unable to read timestamp from  exif data in file at %s: %w", abspath, err))
 	}
-	return images, nil
+
+	return img, nil
 }
 
 // setCoordinateID on images for which the data already exists in the db. This avoids unnecessary requests to the
-// Google Maps API.
-func (i *Ingestor) setCoordinateID(images []coa.Image) ([]coa.Image, error) {
+// Google Maps API. The place and time zone are set as well, so that they are known even in a dry run.
+func (i *Ingestor) setCoordinateID(ctx context.Context, images []coa.Image) ([]coa.Image, error) {
 	var withCoordinateIDs []coa.Image
 
 	for _, img := range images {
-		coordID, err := i.db.GetCoordinateID(img.Latitude, img.Longitude)
+		loc, err := i.db.GetKnownLocation(ctx, img.Latitude, img.Longitude)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				withCoordinateIDs = append(withCoordinateIDs, img)
@@ -249,43 +473,23 @@ func (i *Ingestor) setCoordinateID(images []coa.Image) ([]coa.Image, error) {
 			return nil, err
 		}
 
-		img.CoordinateID = &coordID
+		img.CoordinateID = &loc.CoordinateID
+		img.City = loc.City
+		img.Country = loc.Country
+		img.Timezone = loc.Timezone
 		withCoordinateIDs = append(withCoordinateIDs, img)
 	}
 	return withCoordinateIDs, nil
 }
 
-func (i *Ingestor) fixTimezones(images []coa.Image) ([]coa.Image, error) {
+func (i *Ingestor) fixTimezones(ctx context.Context, images []coa.Image, failed failures) ([]coa.Image, error) {
 	if i.verbose {
 		i.logger("fixing timezones...\n")
 	}
 
-	var fixed []coa.Image
-
-	for _, img := range images {
-		fixedImg := img
-
-		if img.CoordinateID != nil {
-			if i.verbose {
-				i.logger("coordinate ID already set for image %s. skipping\n", img.PathLarge)
-			}
-			fixed = append(fixed, fixedImg)
-			continue
-		}
-
-		tzID, err := i.getTimezoneID(img.Timestamp, img.Latitude, img.Longitude)
-		if err != nil {
-			return nil, err
-		}
-
-		localTS, err := time.ParseInLocation(time.DateTime, img.Timestamp.Format(time.DateTime), tzID)
-		if err != nil {
-			return nil, err
-		}
-
-		fixedImg.Timestamp = localTS.UTC()
-		fixedImg.Timezone = tzID.String()
-		fixed = append(fixed, fixedImg)
+	fixed, err := i.runStage(ctx, i.concurrency.Lookup, images, failed, i.fixTimezone)
+	if err != nil {
+		return nil, err
 	}
 
 	if i.verbose {
@@ -294,116 +498,88 @@ func (i *Ingestor) fixTimezones(images []coa.Image) ([]coa.Image, error) {
 	return fixed, nil
 }
 
-func (i *Ingestor) getTimezoneID(t time.Time, lat float64, lng float64) (*time.Location, error) {
-	t, err := time.ParseInLocation(time.DateTime, t.Format(time.DateTime), time.UTC)
-	if err != nil {
-		return nil, err
+func (i *Ingestor) fixTimezone(ctx context.Context, img coa.Image) (coa.Image, error) {
+	if img.CoordinateID != nil {
+		if i.verbose {
+			i.logger("coordinate ID already set for image %s. skipping\n", img.PathLarge)
+		}
+		return img, nil
 	}
 
-	req := maps.TimezoneRequest{
-		Location: &maps.LatLng{
-			Lat: lat,
-			Lng: lng,
-		},
-		Timestamp: t,
-		Language:  "English",
+	tzID, err := i.timezones.Timezone(ctx, img.Latitude, img.Longitude, img.Timestamp)
+	if err != nil {
+		return img, err
 	}
 
-	res, err := i.gmaps.Timezone(context.Background(), &req)
+	localTS, err := time.ParseInLocation(time.DateTime, img.Timestamp.Format(time.DateTime), tzID)
 	if err != nil {
-		return nil, err
+		return img, err
 	}
 
-	return time.LoadLocation(res.TimeZoneID)
+	img.Timestamp = localTS.UTC()
+	img.Timezone = tzID.String()
+	return img, nil
 }
 
-func (i *Ingestor) reverseGeocode(images []coa.Image) ([]coa.Image, error) {
+func (i *Ingestor) reverseGeocode(ctx context.Context, images []coa.Image, failed failures) ([]coa.Image, error) {
 	if i.verbose {
 		i.logger("reverse geocoding...\n")
 	}
 
-	var geocoded []coa.Image
-
-	for _, img := range images {
-		imgWithLoc := img
-
-		if img.CoordinateID != nil {
-			if i.verbose {
-				i.logger("coordinate ID already set for image %s. skipping\n", img.PathLarge)
-			}
-			geocoded = append(geocoded, imgWithLoc)
-			continue
-		}
-
-		r := &maps.GeocodingRequest{
-			LatLng: &maps.LatLng{
-				Lat: img.Latitude,
-				Lng: img.Longitude,
-			},
-		}
+	aliases, err := i.db.GetPlaceAliases(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load place aliases: %w", err)
+	}
 
-		locs, err := i.gmaps.ReverseGeocode(context.Background(), r)
-		if err != nil {
-			return nil, err
-		}
+	geocode := func(ctx context.Context, img coa.Image) (coa.Image, error) {
+		return i.reverseGeocodeImage(ctx, img, aliases)
+	}
 
-		if len(locs) == 0 || len(locs[0].AddressComponents) == 0 {
-			return nil, fmt.Errorf(
-				"the Google Maps API did not return required address components for latitude %f, longitude %f",
-				img.Latitude,
-				img.Longitude,
-			)
-		}
+	geocoded, err := i.runStage(ctx, i.concurrency.Lookup, images, failed, geocode)
+	if err != nil {
+		return nil, err
+	}
 
-		var neighborhood string
-		for _, comp := range locs[0].AddressComponents {
-			for _, t := range comp.Types {
-				if t == "neighborhood" {
-					neighborhood = comp.LongName
-				} else if t == "administrative_area_level_1" {
-					switch comp.LongName {
-					case "กรุงเทพมหานคร":
-						imgWithLoc.City = "Bangkok"
-					case "เชียงใหม่":
-						imgWithLoc.City = "Chang Wat Chiang Mai"
-					case "Chang Wat Samut Prakan":
-						imgWithLoc.City = "Samut Prakan"
-					case "Wilayah Persekutuan Kuala Lumpur":
-						imgWithLoc.City = "Kuala Lumpur"
-					default:
-						imgWithLoc.City = comp.LongName
-					}
-				} else if t == "country" {
-					imgWithLoc.Country = comp.LongName
-					if comp.LongName == "Taiwan" {
-						imgWithLoc.City = neighborhood
-					}
-				}
-				if imgWithLoc.City != "" && imgWithLoc.Country != "" {
-					break
-				}
-			}
-		}
+	if i.verbose {
+		i.logger("done\n")
+	}
+	return geocoded, nil
+}
 
-		if imgWithLoc.City == "" || imgWithLoc.Country == "" {
-			return nil, fmt.Errorf("couldn't find either city or country for coordinates %f, %f", img.Latitude, img.Longitude)
+func (i *Ingestor) reverseGeocodeImage(
+	ctx context.Context,
+	img coa.Image,
+	aliases []coa.PlaceAlias,
+) (coa.Image, error) {
+	if img.CoordinateID != nil {
+		if i.verbose {
+			i.logger("coordinate ID already set for image %s. skipping\n", img.PathLarge)
 		}
+		return img, nil
+	}
 
-		geocoded = append(geocoded, imgWithLoc)
+	place, err := i.geocoder.ReverseGeocode(ctx, img.Latitude, img.Longitude)
+	if err != nil {
+		return img, err
 	}
 
-	if i.verbose {
-		i.logger("done\n")
+	place = coa.ApplyPlaceAliases(place, aliases)
+	img.City = place.City
+	img.Country = place.Country
+
+	if img.City == "" || img.Country == "" {
+		err := fmt.Errorf("couldn't find either city or country for coordinates %f, %f", img.Latitude, img.Longitude)
+		return img, reject(err)
 	}
-	return geocoded, nil
+	return img, nil
 }
 
-func (i *Ingestor) insertImages(images []coa.Image) error {
+func (i *Ingestor) insertImages(ctx context.Context, images []coa.Image) error {
 	if i.verbose {
 		i.logger("inserting images into db...\n")
 	}
 
-	if err := i.db.InsertImages(images); err != nil {
+	if err := i.db.InsertImages(ctx, images); err != nil {
 		return err
 	}
 
@@ -419,147 +595,108 @@ func (i *Ingestor) close(c io.Closer) {
 	}
 }
 
-func (i *Ingestor) resizeImages(images []coa.Image) ([]coa.Image, error) {
-	if i.verbose {
-		i.logger("resizing images...\n")
-	}
-
-	var resized []coa.Image
-
-	for _, img := range images {
-		imgWithResized := img
-		var err error
-
-		imgWithResized.PathSmall, err = i.resizeImage(img.PathLarge, imageSuffixSmall, imageWidthSmall)
-		if err != nil {
-			return nil, err
-		}
-
-		imgWithResized.PathMedium, err = i.resizeImage(img.PathLarge, imageSuffixMedium, imageWidthMedium)
-		if err != nil {
-			return nil, err
-		}
-
-		resized = append(resized, imgWithResized)
-	}
-
-	if i.verbose {
-		i.logger("done\n")
-	}
-	return resized, nil
-}
-
-func (i *Ingestor) resizeImage(path, suffix string, width int) (string, error) {
-	dir := filepath.Dir(path)
-	basename := filepath.Base(path)
-	ext := filepath.Ext(path)
-	withoutExt := strings.TrimSuffix(basename, ext)
-	pathResized := filepath.Join(dir, fmt.Sprintf("%s%s%s", withoutExt, suffix, ext))
-
-	// make sure the resized file does not exist already and there is no directory with the same name
-	stats, err := os.Stat(pathResized)
+// outputExists checks whether a converted or resized image file has been created in a previous run already. It is an
+// error if there is a directory with the same name.
+func (i *Ingestor) outputExists(path string) (bool, error) {
+	stats, err := os.Stat(path)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return "", err
+		return false, err
 	}
 	if err == nil && stats.IsDir() {
-		return "", fmt.Errorf("cannot write resized image to %s. a directory with that name already exists", pathResized)
+		return false, fmt.Errorf("cannot write image to %s. a directory with that name already exists", path)
 	}
 	// file already exists, nothing to do
 	if err == nil {
 		if i.verbose {
-			i.logger("resized image file %s already exists\n", pathResized)
+			i.logger("image file %s already exists\n", path)
 		}
-		return pathResized, nil
+		return true, nil
 	}
+	return false, nil
+}
 
-	src, err := decodeImage(path)
-	if err != nil {
-		return "", err
+func (i *Ingestor) uploadImages(ctx context.Context, images []coa.Image, failed failures) ([]coa.Image, error) {
+	if i.verbose {
+		i.logger("uploading %d images to storage...\n", len(images))
 	}
 
-	height := src.Bounds().Max.Y / (src.Bounds().Max.X / width)
-	dst := image.NewRGBA(image.Rect(0, 0, width, height))
-	draw.CatmullRom.Scale(dst, dst.Rect, src, src.Bounds(), draw.Over, nil)
-
-	if err := encodeImage(dst, pathResized); err != nil {
-		return "", err
+	withURLs, err := i.runStage(ctx, i.concurrency.Upload, images, failed, i.uploadImage)
+	if err != nil {
+		return nil, err
 	}
 
-	return pathResized, nil
-}
-
-func (i *Ingestor) uploadImages(images []coa.Image) ([]coa.Image, error) {
-	var withURLs []coa.Image
-
 	if i.verbose {
-		i.logger("uploading %d images to Google Drive...\n", len(images))
+		i.logger("done\n")
 	}
 
-	for _, img := range images {
-		imgWithURLs := img
-		var err error
+	return withURLs, nil
+}
 
-		imgWithURLs.URLLarge, err = i.uploadFile(imgWithURLs.PathLarge)
-		if err != nil {
-			return nil, err
-		}
+// uploadImage stores all renditions of an image and, if configured, the original file.
+func (i *Ingestor) uploadImage(ctx context.Context, img coa.Image) (coa.Image, error) {
+	imgWithURLs := img
+	var err error
+
+	imgWithURLs.Renditions = nil
 
-		imgWithURLs.URLMedium, err = i.uploadFile(imgWithURLs.PathMedium)
+	for _, r := range img.Renditions {
+		r.URL, err = i.uploadFile(ctx, r.Path, img.StorageKey(r.Name))
 		if err != nil {
-			return nil, err
+			return img, err
 		}
 
-		imgWithURLs.URLSmall, err = i.uploadFile(imgWithURLs.PathSmall)
-		if err != nil {
-			return nil, err
+		switch r.Name {
+		case coa.RenditionLarge:
+			imgWithURLs.URLLarge = r.URL
+		case coa.RenditionMedium:
+			imgWithURLs.URLMedium = r.URL
+		case coa.RenditionSmall:
+			imgWithURLs.URLSmall = r.URL
 		}
 
-		withURLs = append(withURLs, imgWithURLs)
+		imgWithURLs.Renditions = append(imgWithURLs.Renditions, r)
 	}
 
-	if i.verbose {
-		i.logger("done\n")
+	if i.metadata.Originals != nil {
+		if err := i.storeOriginal(ctx, img); err != nil {
+			return img, err
+		}
 	}
 
-	return withURLs, nil
+	return imgWithURLs, nil
 }
 
-// uploadFile uploads a local file at path to Google Drive and returns the URL to the file.
-func (i *Ingestor) uploadFile(path string) (*url.URL, error) {
-	src, err := os.Open(path)
+// storeOriginal keeps the untouched file an image was ingested from in the private storage for originals.
+func (i *Ingestor) storeOriginal(ctx context.Context, img coa.Image) error {
+	src, err := os.Open(img.PathOriginal)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open file %s: %w", path, err)
+		return fmt.Errorf("unable to open file %s: %w", img.PathOriginal, err)
 	}
 	defer i.close(src)
 
-	dst := &drive.File{
-		Name:    filepath.Base(path),
-		Parents: []string{i.folderID},
+	if err := i.metadata.Originals.Put(ctx, img.StorageKey(coa.RenditionOriginal), src); err != nil {
+		return fmt.Errorf("unable to store original file %s: %w", img.PathOriginal, err)
 	}
+	return nil
+}
 
-	res, err := i.createGDriveFile(path, src, dst)
+// uploadFile stores a local file at path under key and returns the URL to the file.
+func (i *Ingestor) uploadFile(ctx context.Context, path, key string) (*url.URL, error) {
+	src, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("unable to upload file %s to Google Drive folder %s: %w", path, i.folderID, err)
+		return nil, fmt.Errorf("unable to open file %s: %w", path, err)
 	}
+	defer i.close(src)
 
-	wcl, err := url.Parse(res.WebContentLink)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse Google Drive file URL %s: %w", res.WebContentLink, err)
+	if err := i.store.Put(ctx, key, src); err != nil {
+		return nil, fmt.Errorf("unable to store file %s: %w", path, err)
 	}
 
-	// Only keep the "id" query parameter. The API also returns at least "export=download" which causes the browser
-	// to download the image instead of displaying it.
-	q := wcl.Query()
-	wcl.RawQuery = fmt.Sprintf("id=%s", q.Get("id"))
-
-	return wcl, nil
-}
-
-func (i *Ingestor) createGDriveFile(path string, src *os.File, dest *drive.File) (*drive.File, error) {
-	return i.gdrive.Files.Create(dest).
-		Media(src, googleapi.ContentType(mime.TypeByExtension(strings.ToLower(filepath.Ext(path))))).
-		Fields("webContentLink").
-		Do()
+	u, err := i.store.URL(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get URL of stored file %s: %w", path, err)
+	}
+	return u, nil
 }
 
 func decodeImage(path string) (image.Image, error) {
@@ -573,16 +710,25 @@ func decodeImage(path string) (image.Image, error) {
 		}
 	}()
 
+	var img image.Image
+
 	switch strings.ToLower(filepath.Ext(path)) {
 	case ".jpg":
 		fallthrough
 	case ".jpeg":
-		return jpeg.Decode(input)
+		img, err = jpeg.Decode(input)
 	case ".png":
-		return png.Decode(input)
+		img, err = png.Decode(input)
+	case ".webp":
+		img, err = webp.Decode(input)
 	default:
-		return nil, fmt.Errorf("unable to determine image format for decoding %s", path)
+		return nil, reject(fmt.Errorf("unable to determine image format for decoding %s", path))
+	}
+
+	if err != nil {
+		return nil, rejectInvalid(fmt.Errorf("unable to decode %s: %w", path, err))
 	}
+	return img, nil
 }
 
 func encodeImage(m image.Image, path string) error {
@@ -0,0 +1,241 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+// Defaults for the fields of JobConfig
+const (
+	DefaultJobWorkers      = 1
+	DefaultJobMaxAttempts  = 5
+	DefaultJobRetryDelay   = time.Minute
+	DefaultJobLease        = 30 * time.Minute
+	DefaultJobPollInterval = 5 * time.Second
+)
+
+// JobConfig configures the ingestion of uploaded files in the background. Zero values mean the defaults.
+type JobConfig struct {
+	// Uploads is the private storage that uploaded files are kept in until they have been ingested.
+	Uploads coa.Storage
+	// Workers is the number of jobs that are processed at the same time.
+	Workers int
+	// MaxAttempts is the number of times a job is tried before it is marked as failed.
+	MaxAttempts int
+	// RetryDelay is the time before the first retry of a job. It doubles with every further attempt.
+	RetryDelay time.Duration
+	// Lease is the time a worker has for a job before it is handed to another worker, in case the first one died.
+	Lease time.Duration
+	// PollInterval is the time idle workers wait before checking the queue again.
+	PollInterval time.Duration
+	// Failed is called when a job has failed for good because of an error, e.g. for reporting it. Files that are
+	// rejected by the ingestor fail right away without calling it. Optional.
+	Failed func(job coa.Job, err error)
+}
+
+func (c JobConfig) withDefaults() JobConfig {
+	if c.Workers <= 0 {
+		c.Workers = DefaultJobWorkers
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultJobMaxAttempts
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = DefaultJobRetryDelay
+	}
+	if c.Lease <= 0 {
+		c.Lease = DefaultJobLease
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultJobPollInterval
+	}
+	return c
+}
+
+// JobQueue ingests uploaded files in the background. The files are kept in storage and the jobs in the database, so
+// that nothing is lost when the process is stopped before a file has been ingested.
+type JobQueue struct {
+	db       coa.Database
+	ingestor *Ingestor
+	cfg      JobConfig
+	logger   Logger
+	// wake is signalled when a job was enqueued, so that an idle worker picks it up without waiting for the next poll
+	wake chan struct{}
+}
+
+func NewJobQueue(db coa.Database, ingestor *Ingestor, cfg JobConfig, logger Logger) *JobQueue {
+	return &JobQueue{
+		db,
+		ingestor,
+		cfg.withDefaults(),
+		logger,
+		make(chan struct{}, 1),
+	}
+}
+
+// SupportsMedia checks whether uploaded files with the given name can be ingested, see Ingestor.SupportsMedia.
+func (q *JobQueue) SupportsMedia(filename string) bool {
+	return q.ingestor.SupportsMedia(filename)
+}
+
+// Enqueue stores an uploaded file and adds a job for ingesting it. It returns the ID of the job.
+func (q *JobQueue) Enqueue(ctx context.Context, name string, r io.Reader) (int64, error) {
+	key, err := uploadKey(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := q.cfg.Uploads.Put(ctx, key, r); err != nil {
+		return 0, fmt.Errorf("unable to store uploaded file %s: %w", name, err)
+	}
+
+	id, err := q.db.InsertJob(ctx, coa.Job{FileName: path.Base(name), StorageKey: key})
+	if err != nil {
+		q.deleteUpload(ctx, key)
+		return 0, fmt.Errorf("unable to add job for uploaded file %s: %w", name, err)
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// uploadKey returns a unique key for an uploaded file, since clients may upload files with the same name.
+func uploadKey(name string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("uploads/%x/%s", b, path.Base(name)), nil
+}
+
+// Run processes jobs until ctx is cancelled. Jobs that are interrupted by that are put back into the queue, so that
+// they are picked up again after a restart.
+func (q *JobQueue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for w := 0; w < q.cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (q *JobQueue) work(ctx context.Context) {
+	// a released job would be claimed again right away if the database doesn't check the context
+	for ctx.Err() == nil {
+		job, err := q.db.ClaimJob(ctx, q.cfg.Lease, q.cfg.MaxAttempts)
+		if err == nil {
+			q.process(ctx, job)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			q.logger("unable to claim job: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(q.cfg.PollInterval):
+		}
+	}
+}
+
+func (q *JobQueue) process(ctx context.Context, job coa.Job) {
+	result, err := q.ingest(ctx, job)
+
+	// the outcome is recorded even if the process is shutting down
+	updateCtx := context.WithoutCancel(ctx)
+	var updateErr error
+
+	switch {
+	case err == nil && result.Status == FileRejected:
+		// trying again won't help. the upload is kept, so that the file can be fixed and ingested by hand
+		q.logger("job %d: rejected %s: %s\n", job.ID, job.FileName, result.Reason)
+		updateErr = q.db.FailJob(updateCtx, job, result.Reason)
+	case err == nil:
+		q.logger("job %d: %v\n", job.ID, result)
+		updateErr = q.db.CompleteJob(updateCtx, job)
+		if updateErr == nil {
+			q.deleteUpload(updateCtx, job.StorageKey)
+		}
+	case ctx.Err() != nil:
+		// the job didn't get a fair chance, so the attempt doesn't count
+		updateErr = q.db.ReleaseJob(updateCtx, job)
+	case job.Attempts >= q.cfg.MaxAttempts:
+		q.logger("job %d for %s failed for good after %d attempts: %v\n", job.ID, job.FileName, job.Attempts, err)
+		updateErr = q.db.FailJob(updateCtx, job, err.Error())
+
+		// the upload is kept, so that the file can still be ingested by hand
+		if q.cfg.Failed != nil {
+			q.cfg.Failed(job, err)
+		}
+	default:
+		delay := q.cfg.RetryDelay << (job.Attempts - 1)
+		q.logger("job %d for %s failed, retrying in %v: %v\n", job.ID, job.FileName, delay, err)
+		updateErr = q.db.RetryJob(updateCtx, job, err.Error(), time.Now().Add(delay))
+	}
+
+	// the job is claimed again once its lease has expired, unless another worker has taken it over already
+	if updateErr != nil {
+		q.logger("unable to update state of job %d: %v\n", job.ID, updateErr)
+	}
+}
+
+// ingest streams the uploaded file of a job from storage into the ingestor.
+func (q *JobQueue) ingest(ctx context.Context, job coa.Job) (FileResult, error) {
+	content, err := q.cfg.Uploads.Get(ctx, job.StorageKey)
+	if err != nil {
+		return FileResult{}, fmt.Errorf("unable to get uploaded file %s: %w", job.StorageKey, err)
+	}
+	defer content.Close()
+
+	result, err := q.ingestor.IngestReader(ctx, job.FileName, content)
+	if err == nil && result.Status == FileFailed {
+		// retried like any other error
+		return result, errors.New(result.Reason)
+	}
+	return result, err
+}
+
+func (q *JobQueue) deleteUpload(ctx context.Context, key string) {
+	if err := q.cfg.Uploads.Delete(ctx, key); err != nil {
+		q.logger("unable to delete uploaded file %s: %v\n", key, err)
+	}
+}
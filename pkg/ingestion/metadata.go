@@ -0,0 +1,341 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/rwcarlsen/goexif/exif"
+	"os"
+)
+
+// readExif decodes the EXIF metadata of an image file. JPEGs keep it in an APP1 segment, PNGs in an eXIf chunk, WebP
+// images in an EXIF chunk and HEIC images in an item of type Exif.
+func readExif(path, format string) (*exif.Exif, error) {
+	if format == coa.FormatJPEG {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return exif.Decode(f)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	switch format {
+	case coa.FormatPNG:
+		raw, err = exifFromPNG(data)
+	case coa.FormatWebP:
+		raw, err = exifFromWebP(data)
+	case coa.FormatHEIC:
+		raw, err = exifFromHEIC(data)
+	default:
+		err = fmt.Errorf("unsupported image format '%s'", format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return exif.Decode(bytes.NewReader(raw))
+}
+
+var errNoExif = errors.New("no EXIF metadata found")
+
+func exifFromPNG(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errors.New("not a PNG file")
+	}
+
+	// each chunk consists of length, type, data and CRC
+	for pos := len(signature); pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		start := pos + 8
+		end := start + length
+
+		// the length is compared to what is left, because start + length can overflow
+		if length < 0 || length > len(data)-start-4 {
+			return nil, errors.New("truncated PNG chunk")
+		}
+
+		if typ == "eXIf" {
+			return data[start:end], nil
+		}
+
+		// the spec wants eXIf before the image data, but some encoders put it after, so only stop at the end
+		if typ == "IEND" {
+			break
+		}
+		pos = end + 4
+	}
+	return nil, errNoExif
+}
+
+func exifFromWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP file")
+	}
+
+	// chunks consist of type, little endian length and data, padded to an even length
+	for pos := 12; pos+8 <= len(data); {
+		typ := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		start := pos + 8
+		end := start + length
+
+		if length < 0 || length > len(data)-start {
+			return nil, errors.New("truncated WebP chunk")
+		}
+
+		if typ == "EXIF" {
+			// some encoders include the "Exif\0\0" header of the JPEG APP1 segment, which exif.Decode handles as well
+			return data[start:end], nil
+		}
+		pos = end + length%2
+	}
+	return nil, errNoExif
+}
+
+// exifFromHEIC finds the Exif item in the meta box of a HEIF file. The item info box (iinf) says which item ID has
+// type Exif and the item location box (iloc) where in the file the data of that item is.
+func exifFromHEIC(data []byte) ([]byte, error) {
+	meta, ok := findBox(data, "meta")
+	if !ok || len(meta) < 4 {
+		return nil, errors.New("no meta box found in HEIF file")
+	}
+	// skip version and flags
+	meta = meta[4:]
+
+	iinf, ok := findBox(meta, "iinf")
+	if !ok {
+		return nil, errors.New("no item info box found in HEIF file")
+	}
+
+	itemID, err := exifItemID(iinf)
+	if err != nil {
+		return nil, err
+	}
+
+	iloc, ok := findBox(meta, "iloc")
+	if !ok {
+		return nil, errors.New("no item location box found in HEIF file")
+	}
+
+	offset, length, err := itemLocation(iloc, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	// offset + length can overflow with 64 bit values from the file
+	if offset > uint64(len(data)) || length > uint64(len(data))-offset || length < 4 {
+		return nil, errors.New("invalid location of Exif item in HEIF file")
+	}
+
+	// the item starts with the offset of the TIFF header, which is usually preceded by "Exif\0\0"
+	item := data[offset : offset+length]
+	headerOffset := uint64(binary.BigEndian.Uint32(item)) + 4
+	if headerOffset >= uint64(len(item)) {
+		return nil, errors.New("invalid Exif item in HEIF file")
+	}
+	return item[headerOffset:], nil
+}
+
+// findBox returns the content of the first ISO base media file format box of the given type in data, which must be
+// a sequence of boxes.
+func findBox(data []byte, typ string) ([]byte, bool) {
+	for pos := uint64(0); pos+8 <= uint64(len(data)); {
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		headerSize := uint64(8)
+
+		switch size {
+		case 0:
+			// the box extends to the end of the data
+			size = uint64(len(data)) - pos
+		case 1:
+			if pos+16 > uint64(len(data)) {
+				return nil, false
+			}
+			size = binary.BigEndian.Uint64(data[pos+8:])
+			headerSize = 16
+		}
+
+		// pos + size can overflow with a 64 bit size, so the size is compared to what is left
+		if size < headerSize || size > uint64(len(data))-pos {
+			return nil, false
+		}
+
+		if string(data[pos+4:pos+8]) == typ {
+			return data[pos+headerSize : pos+size], true
+		}
+		pos += size
+	}
+	return nil, false
+}
+
+func exifItemID(iinf []byte) (uint32, error) {
+	r := &boxReader{data: iinf}
+	version := r.uint(1)
+	r.skip(3)
+
+	entries := r.uint(2)
+	if version > 0 {
+		entries = r.uint(4)
+	}
+
+	for n := uint64(0); n < entries && r.err == nil; n++ {
+		// every entry is an item info entry box (infe)
+		size := r.uint(4)
+		typ := r.bytes(4)
+		if r.err != nil || size < 8 {
+			break
+		}
+
+		entry := &boxReader{data: r.bytes(int(size - 8))}
+		if string(typ) != "infe" {
+			continue
+		}
+
+		// only versions 2 and 3 have an item type
+		entryVersion := entry.uint(1)
+		entry.skip(3)
+		if entryVersion < 2 {
+			continue
+		}
+
+		itemID := entry.uint(2)
+		if entryVersion == 3 {
+			itemID = entry.uint(4)
+		}
+		entry.skip(2) // protection index
+
+		if string(entry.bytes(4)) == "Exif" && entry.err == nil {
+			return uint32(itemID), nil
+		}
+	}
+
+	if r.err != nil {
+		return 0, fmt.Errorf("invalid item info box in HEIF file: %w", r.err)
+	}
+	return 0, errNoExif
+}
+
+// itemLocation returns the offset and length of an item in the file. Only items that are stored in one extent in the
+// file itself (construction method 0) are supported, which is what cameras produce for the Exif item.
+func itemLocation(iloc []byte, itemID uint32) (uint64, uint64, error) {
+	r := &boxReader{data: iloc}
+	version := r.uint(1)
+	r.skip(3)
+
+	sizes := r.uint(2)
+	offsetSize := int(sizes >> 12)
+	lengthSize := int(sizes >> 8 & 0xf)
+	baseOffsetSize := int(sizes >> 4 & 0xf)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+
+	items := r.uint(2)
+	if version == 2 {
+		items = r.uint(4)
+	}
+
+	for n := uint64(0); n < items && r.err == nil; n++ {
+		id := r.uint(2)
+		if version == 2 {
+			id = r.uint(4)
+		}
+
+		constructionMethod := uint64(0)
+		if version == 1 || version == 2 {
+			constructionMethod = r.uint(2) & 0xf
+		}
+
+		r.skip(2) // data reference index
+		baseOffset := r.uint(baseOffsetSize)
+		extents := r.uint(2)
+
+		var offset, length uint64
+		for e := uint64(0); e < extents; e++ {
+			r.skip(indexSize)
+			extentOffset := r.uint(offsetSize)
+			extentLength := r.uint(lengthSize)
+			if e == 0 {
+				offset, length = baseOffset+extentOffset, extentLength
+			}
+		}
+
+		if uint32(id) != itemID {
+			continue
+		}
+
+		if constructionMethod != 0 || extents != 1 {
+			return 0, 0, errors.New("unsupported location of Exif item in HEIF file")
+		}
+		return offset, length, r.err
+	}
+
+	if r.err != nil {
+		return 0, 0, fmt.Errorf("invalid item location box in HEIF file: %w", r.err)
+	}
+	return 0, 0, errors.New("no location found for Exif item in HEIF file")
+}
+
+// boxReader reads big endian integers of varying size from the content of a box. After the first error, all reads
+// return zero values and err is set.
+type boxReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *boxReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.data)-r.pos {
+		r.err = errors.New("unexpected end of box")
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *boxReader) uint(n int) uint64 {
+	var v uint64
+	for _, b := range r.bytes(n) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func (r *boxReader) skip(n int) {
+	r.bytes(n)
+}
@@ -0,0 +1,292 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/rwcarlsen/goexif/exif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// exifTIFF returns EXIF metadata in TIFF format that contains nothing but the orientation tag.
+func exifTIFF(orientation int) []byte {
+	// big-endian TIFF header followed by an IFD with a single SHORT entry and no next IFD
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1}
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	return append(tiff, 0, 0, 0, 0, 0, 0)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	// the CRC isn't checked
+	return append(chunk, 0, 0, 0, 0)
+}
+
+func pngFile(chunks ...[]byte) []byte {
+	data := []byte("\x89PNG\r\n\x1a\n")
+	for _, c := range chunks {
+		data = append(data, c...)
+	}
+	return data
+}
+
+func webPChunk(typ string, data []byte) []byte {
+	chunk := append([]byte(typ), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webPFile(chunks ...[]byte) []byte {
+	var body []byte
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	data = append(data, "WEBP"...)
+	return append(data, body...)
+}
+
+func box(typ string, content ...[]byte) []byte {
+	var data []byte
+	for _, c := range content {
+		data = append(data, c...)
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)+8))
+	b = append(b, typ...)
+	return append(b, data...)
+}
+
+// heicFile returns a HEIF file with an Exif item that contains tiff. The item is stored in an mdat box after the meta
+// box, like cameras do it.
+func heicFile(tiff []byte) []byte {
+	ftyp := box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+
+	// item info entry version 2 with item ID 1, no protection, type Exif and an empty name
+	infe := box("infe", []byte{2, 0, 0, 0, 0, 1, 0, 0}, []byte("Exif\x00"))
+	iinf := box("iinf", []byte{0, 0, 0, 0, 0, 1}, infe)
+
+	item := append([]byte{0, 0, 0, 6}, "Exif\x00\x00"...)
+	item = append(item, tiff...)
+
+	iloc := func(offset uint32) []byte {
+		// version 0, 4 byte offsets and lengths, no base offset, one item with one extent
+		content := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 1, 0, 1, 0, 0, 0, 1}
+		content = binary.BigEndian.AppendUint32(content, offset)
+		content = binary.BigEndian.AppendUint32(content, uint32(len(item)))
+		return box("iloc", content)
+	}
+
+	metaSize := len(box("meta", []byte{0, 0, 0, 0}, iinf, iloc(0)))
+	meta := box("meta", []byte{0, 0, 0, 0}, iinf, iloc(uint32(len(ftyp)+metaSize+8)))
+
+	data := append(ftyp, meta...)
+	return append(data, box("mdat", item)...)
+}
+
+func TestReadExif(t *testing.T) {
+	tiff := exifTIFF(6)
+
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+	}{
+		{"PNG", coa.FormatPNG, pngFile(pngChunk("IHDR", make([]byte, 13)), pngChunk("eXIf", tiff), pngChunk("IEND", nil))},
+		{
+			"PNG with eXIf after the image data",
+			coa.FormatPNG,
+			pngFile(pngChunk("IHDR", make([]byte, 13)), pngChunk("IDAT", []byte{1, 2, 3}), pngChunk("eXIf", tiff)),
+		},
+		{"WebP", coa.FormatWebP, webPFile(webPChunk("VP8X", make([]byte, 10)), webPChunk("EXIF", tiff))},
+		{
+			"WebP with padded chunk and JPEG header",
+			coa.FormatWebP,
+			webPFile(webPChunk("ICCP", []byte{1, 2, 3}), webPChunk("EXIF", append([]byte("Exif\x00\x00"), tiff...))),
+		},
+		{"HEIC", coa.FormatHEIC, heicFile(tiff)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			x, err := readExif(path, tt.format)
+			if err != nil {
+				t.Fatalf("readExif() failed: %v", err)
+			}
+
+			tag, err := x.Get(exif.Orientation)
+			if err != nil {
+				t.Fatalf("orientation tag missing: %v", err)
+			}
+			if orientation, err := tag.Int(0); err != nil || orientation != 6 {
+				t.Fatalf("orientation = %d, %v, want 6", orientation, err)
+			}
+		})
+	}
+}
+
+func TestExifFromPNGInvalid(t *testing.T) {
+	ihdr := pngChunk("IHDR", make([]byte, 13))
+	huge := binary.BigEndian.AppendUint32(nil, 0xffffffff)
+	huge = append(huge, "eXIf"...)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantNoExif bool
+	}{
+		{"not a PNG", []byte("GIF89a"), false},
+		{"no eXIf chunk", pngFile(ihdr, pngChunk("IEND", nil)), true},
+		{"nothing after the signature", pngFile(), true},
+		{"truncated chunk", pngFile(ihdr, pngChunk("eXIf", exifTIFF(1)))[:50], false},
+		{"chunk without CRC", pngFile(ihdr, pngChunk("eXIf", exifTIFF(1)))[:len(pngFile(ihdr))+8+26], false},
+		{"oversized chunk", pngFile(ihdr, huge), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := exifFromPNG(tt.data)
+			if err == nil {
+				t.Fatalf("exifFromPNG() = %v, want error", raw)
+			}
+			if errors.Is(err, errNoExif) != tt.wantNoExif {
+				t.Fatalf("exifFromPNG() returned error '%v', want errNoExif: %v", err, tt.wantNoExif)
+			}
+		})
+	}
+}
+
+func TestExifFromWebPInvalid(t *testing.T) {
+	vp8x := webPChunk("VP8X", make([]byte, 10))
+	huge := append([]byte("EXIF"), 0xff, 0xff, 0xff, 0xff)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantNoExif bool
+	}{
+		{"not a WebP", []byte("RIFF\x00\x00\x00\x00WAVE"), false},
+		{"too short", []byte("RIFF"), false},
+		{"no EXIF chunk", webPFile(vp8x), true},
+		{"truncated chunk", webPFile(vp8x, webPChunk("EXIF", exifTIFF(1)))[:40], false},
+		{"oversized chunk", webPFile(vp8x, huge), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := exifFromWebP(tt.data)
+			if err == nil {
+				t.Fatalf("exifFromWebP() = %v, want error", raw)
+			}
+			if errors.Is(err, errNoExif) != tt.wantNoExif {
+				t.Fatalf("exifFromWebP() returned error '%v', want errNoExif: %v", err, tt.wantNoExif)
+			}
+		})
+	}
+}
+
+func TestExifFromHEICInvalid(t *testing.T) {
+	valid := heicFile(exifTIFF(1))
+
+	// a meta box with a 64 bit size that makes the end of the box overflow
+	largeMeta := box("free")
+	largeMeta = append(largeMeta, 0, 0, 0, 1)
+	largeMeta = append(largeMeta, "meta"...)
+	largeMeta = binary.BigEndian.AppendUint64(largeMeta, 1<<64-8)
+	largeMeta = append(largeMeta, make([]byte, 40-len(largeMeta))...)
+
+	// an Exif item whose end overflows
+	iloc := box("iloc",
+		[]byte{0, 0, 0, 0, 0x88, 0x00, 0, 1, 0, 1, 0, 0, 0, 1},
+		binary.BigEndian.AppendUint64(nil, 1<<64-1),
+		binary.BigEndian.AppendUint64(nil, 16),
+	)
+	infe := box("infe", []byte{2, 0, 0, 0, 0, 1, 0, 0}, []byte("Exif\x00"))
+	farItem := box("meta", []byte{0, 0, 0, 0}, box("iinf", []byte{0, 0, 0, 0, 0, 1}, infe), iloc)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no meta box", box("ftyp", []byte("heic"))},
+		{"meta box with largesize beyond the end", largeMeta},
+		{"box larger than the data", valid[:len(valid)-1]},
+		{"box smaller than its header", append(binary.BigEndian.AppendUint32(nil, 4), "meta"...)},
+		{"truncated largesize", append(binary.BigEndian.AppendUint32(nil, 1), "meta\x00\x00"...)},
+		{"meta box without item info", box("meta", []byte{0, 0, 0, 0})},
+		{"Exif item beyond the end", farItem},
+		{"truncated item info", box("meta", []byte{0, 0, 0, 0}, box("iinf", []byte{0, 0, 0, 0, 0, 5}))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if raw, err := exifFromHEIC(tt.data); err == nil {
+				t.Fatalf("exifFromHEIC() = %v, want error", raw)
+			}
+		})
+	}
+}
+
+func TestFindBox(t *testing.T) {
+	data := append(box("ftyp", []byte("heic")), box("meta", []byte("content"))...)
+
+	content, ok := findBox(data, "meta")
+	if !ok || !bytes.Equal(content, []byte("content")) {
+		t.Fatalf("findBox() = %q, %v, want the content of the meta box", content, ok)
+	}
+
+	// size 0 means that the box extends to the end
+	last := append(box("ftyp", []byte("heic")), 0, 0, 0, 0)
+	last = append(last, "mdat12345"...)
+	content, ok = findBox(last, "mdat")
+	if !ok || !bytes.Equal(content, []byte("12345")) {
+		t.Fatalf("findBox() = %q, %v, want the rest of the data", content, ok)
+	}
+
+	// 64 bit size
+	large := append(binary.BigEndian.AppendUint32(nil, 1), "mdat"...)
+	large = binary.BigEndian.AppendUint64(large, 19)
+	large = append(large, "abc"...)
+	content, ok = findBox(large, "mdat")
+	if !ok || !bytes.Equal(content, []byte("abc")) {
+		t.Fatalf("findBox() = %q, %v, want the content of the box with a 64 bit size", content, ok)
+	}
+
+	if _, ok := findBox(data, "moov"); ok {
+		t.Fatal("findBox() found a box that doesn't exist")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+	"image"
+)
+
+// orientationOf returns the EXIF orientation of the image file at path, from 1 to 8. Files without EXIF metadata or
+// without an orientation tag are upright.
+func orientationOf(path, format string) int {
+	x, err := readExif(path, format)
+	if err != nil {
+		return 1
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// decodeOriented decodes the image file at path and rotates or flips it as its EXIF orientation says, so that it is
+// upright.
+func decodeOriented(path string) (image.Image, error) {
+	src, err := decodeImage(path)
+	if err != nil {
+		return nil, err
+	}
+	return applyOrientation(src, orientationOf(path, coa.MediaFormat(path))), nil
+}
+
+// applyOrientation returns a copy of src that is transformed according to an EXIF orientation. Orientations 5 to 8
+// swap width and height.
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Rect, src, b.Min, draw.Src)
+
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated by 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // mirrored along the top-left to bottom-right diagonal
+				sx, sy = y, x
+			case 6: // needs to be rotated clockwise by 90°
+				sx, sy = y, h-1-x
+			case 7: // mirrored along the top-right to bottom-left diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs to be rotated counterclockwise by 90°
+				sx, sy = w-1-y, x
+			}
+
+			d, s := dst.PixOffset(x, y), rgba.PixOffset(sx, sy)
+			copy(dst.Pix[d:d+4], rgba.Pix[s:s+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"bytes"
+	"encoding/binary"
+	coa "github.com/haikoschol/cats-of-asia"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pixel colors of the test image, by the letters used in the expected layouts below
+var testColors = map[byte]color.RGBA{
+	'a': {255, 0, 0, 255},
+	'b': {0, 255, 0, 255},
+	'c': {0, 0, 255, 255},
+	'd': {255, 255, 0, 255},
+	'e': {0, 255, 255, 255},
+	'f': {255, 0, 255, 255},
+}
+
+// newTestImage creates an image with one pixel per letter, e.g. {"abc", "def"} is 3 pixels wide and 2 pixels high.
+func newTestImage(rows []string) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x := range row {
+			img.SetRGBA(x, y, testColors[row[x]])
+		}
+	}
+	return img
+}
+
+func TestApplyOrientation(t *testing.T) {
+	src := []string{
+		"abc",
+		"def",
+	}
+
+	tests := []struct {
+		orientation int
+		want        []string
+	}{
+		{0, src},
+		{1, src},
+		{2, []string{"cba", "fed"}},
+		{3, []string{"fed", "cba"}},
+		{4, []string{"def", "abc"}},
+		{5, []string{"ad", "be", "cf"}},
+		{6, []string{"da", "eb", "fc"}},
+		{7, []string{"fc", "eb", "da"}},
+		{8, []string{"cf", "be", "ad"}},
+		{9, src},
+	}
+
+	for _, tt := range tests {
+		got := applyOrientation(newTestImage(src), tt.orientation)
+		want := newTestImage(tt.want)
+
+		if got.Bounds().Size() != want.Bounds().Size() {
+			t.Errorf("orientation %d: got size %v, want %v", tt.orientation, got.Bounds().Size(), want.Bounds().Size())
+			continue
+		}
+
+		b := got.Bounds()
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				g := color.RGBAModel.Convert(got.At(b.Min.X+x, b.Min.Y+y))
+				if w := want.RGBAAt(x, y); g != w {
+					t.Errorf("orientation %d: pixel (%d, %d) is %v, want %v", tt.orientation, x, y, g, w)
+				}
+			}
+		}
+	}
+}
+
+func TestApplyOrientationKeepsSource(t *testing.T) {
+	src := newTestImage([]string{"abc", "def"})
+	before := bytes.Clone(src.Pix)
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		applyOrientation(src, orientation)
+	}
+
+	if !bytes.Equal(src.Pix, before) {
+		t.Fatal("applyOrientation modified the source image")
+	}
+}
+
+func TestDecodeOriented(t *testing.T) {
+	dir := t.TempDir()
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		path := filepath.Join(dir, "oriented.jpg")
+		writeOrientedJPEG(t, path, 40, 20, orientation)
+
+		if got := orientationOf(path, coa.FormatJPEG); got != orientation {
+			t.Errorf("orientationOf() = %d, want %d", got, orientation)
+		}
+
+		img, err := decodeOriented(path)
+		if err != nil {
+			t.Fatalf("orientation %d: decodeOriented() failed: %v", orientation, err)
+		}
+
+		wantW, wantH := 40, 20
+		if orientation >= 5 {
+			wantW, wantH = 20, 40
+		}
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != wantW || h != wantH {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", orientation, w, h, wantW, wantH)
+		}
+	}
+}
+
+func TestOrientationOfWithoutExif(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plain.jpg")
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, newTestImage([]string{"abc", "def"}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := orientationOf(path, coa.FormatJPEG); got != 1 {
+		t.Fatalf("orientationOf() = %d, want 1", got)
+	}
+
+	if got := orientationOf(filepath.Join(t.TempDir(), "missing.jpg"), coa.FormatJPEG); got != 1 {
+		t.Fatalf("orientationOf() of a missing file = %d, want 1", got)
+	}
+}
+
+// writeOrientedJPEG writes a JPEG file with an EXIF segment that contains nothing but the orientation tag.
+func writeOrientedJPEG(t *testing.T, path string, width, height, orientation int) {
+	t.Helper()
+
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	app1 := append([]byte("Exif\x00\x00"), exifTIFF(orientation)...)
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(app1)+2))
+	segment = append(segment, app1...)
+
+	// the APP1 segment goes right after the SOI marker
+	data := append([]byte{}, img.Bytes()[:2]...)
+	data = append(data, segment...)
+	data = append(data, img.Bytes()[2:]...)
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		name                string
+		width, height       int
+		maxWidth, maxHeight int
+		wantW, wantH        int
+	}{
+		{"no limits", 4000, 3000, 0, 0, 4000, 3000},
+		{"fits already", 300, 200, 600, 600, 300, 200},
+		{"exactly at the limit", 600, 400, 600, 400, 600, 400},
+		{"limited by width", 4000, 3000, 600, 0, 600, 450},
+		{"limited by height", 3000, 4000, 0, 600, 450, 600},
+		{"portrait in a landscape box", 3000, 4000, 600, 300, 225, 300},
+		{"landscape in a portrait box", 4000, 3000, 300, 600, 300, 225},
+		{"rounded", 1000, 333, 300, 0, 300, 100},
+		{"never below one pixel", 10000, 10, 100, 0, 100, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := fitSize(tt.width, tt.height, tt.maxWidth, tt.maxHeight)
+			if w != tt.wantW || h != tt.wantH {
+				t.Errorf("fitSize(%d, %d, %d, %d) = %dx%d, want %dx%d",
+					tt.width, tt.height, tt.maxWidth, tt.maxHeight, w, h, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"context"
+	"errors"
+	coa "github.com/haikoschol/cats-of-asia"
+	"io/fs"
+	"runtime"
+	"sync"
+)
+
+// Defaults for the network-bound stages of the pipeline. Higher values tend to run into rate limits of the Google APIs.
+const (
+	DefaultLookupConcurrency = 4
+	DefaultUploadConcurrency = 4
+)
+
+// ConcurrencyConfig sets how many images each stage of the pipeline works on at the same time. Zero means the default
+// of the stage.
+type ConcurrencyConfig struct {
+	// Scan is the number of files that are hashed and whose EXIF data is read at the same time. Defaults to the number
+	// of CPUs.
+	Scan int
+	// Process is the number of images that are converted, sanitized and resized at the same time. This is CPU-bound,
+	// so it defaults to the number of CPUs.
+	Process int
+	// Lookup is the number of concurrent requests for time zones and places.
+	Lookup int
+	// Upload is the number of images that are uploaded to storage at the same time.
+	Upload int
+}
+
+func (c ConcurrencyConfig) withDefaults() ConcurrencyConfig {
+	if c.Scan <= 0 {
+		c.Scan = runtime.NumCPU()
+	}
+	if c.Process <= 0 {
+		c.Process = runtime.NumCPU()
+	}
+	if c.Lookup <= 0 {
+		c.Lookup = DefaultLookupConcurrency
+	}
+	if c.Upload <= 0 {
+		c.Upload = DefaultUploadConcurrency
+	}
+	return c
+}
+
+// mapConcurrently calls fn for each item with at most workers calls running at the same time and returns the results in
+// the order of the items. When a call fails, the items that haven't been started yet are skipped and the context of
+// the running calls is cancelled. The error is the same a loop over the items would have returned, i.e. the one of
+// the first failing item, not the context errors of the calls that were cancelled because of it.
+func mapConcurrently[In, Out any](
+	ctx context.Context,
+	workers int,
+	items []In,
+	fn func(ctx context.Context, item In) (Out, error),
+) ([]Out, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]Out, len(items))
+	errs := make([]error, len(items))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(items)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				results[idx], errs[idx] = fn(workerCtx, items[idx])
+				if errs[idx] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for idx := range items {
+		select {
+		case indexes <- idx:
+		case <-workerCtx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var cancelled error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, context.Canceled) {
+			if cancelled == nil {
+				cancelled = err
+			}
+			continue
+		}
+		return nil, err
+	}
+
+	if cancelled != nil {
+		return nil, cancelled
+	}
+	return results, nil
+}
+
+// mapEach is like mapConcurrently, except that a failing item doesn't stop the others. It returns the error of each
+// item, or nil, in the order of the items. Only cancelling ctx fails the whole call.
+func mapEach[In, Out any](
+	ctx context.Context,
+	workers int,
+	items []In,
+	fn func(ctx context.Context, item In) (Out, error),
+) ([]Out, []error, error) {
+	type result struct {
+		out Out
+		err error
+	}
+
+	call := func(ctx context.Context, item In) (result, error) {
+		out, err := fn(ctx, item)
+		return result{out, err}, ctx.Err()
+	}
+
+	results, err := mapConcurrently(ctx, workers, items, call)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outs := make([]Out, len(items))
+	errs := make([]error, len(items))
+
+	for idx, r := range results {
+		outs[idx], errs[idx] = r.out, r.err
+	}
+	return outs, errs, nil
+}
+
+// stage is the work a stage of the pipeline does on a single image.
+type stage func(ctx context.Context, img coa.Image) (coa.Image, error)
+
+// failures collects the errors of the images that dropped out of the pipeline, by the original path of their file.
+type failures map[string]error
+
+// runStage calls fn for each image, with at most workers calls running at the same time, and returns the images for
+// which it succeeded. The errors of the others are added to failed, so that a single bad file doesn't stop the rest.
+func (i *Ingestor) runStage(
+	ctx context.Context,
+	workers int,
+	images []coa.Image,
+	failed failures,
+	fn stage,
+) ([]coa.Image, error) {
+	results, errs, err := mapEach(ctx, workers, images, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var succeeded []coa.Image
+
+	for idx, img := range images {
+		if errs[idx] != nil {
+			if i.verbose {
+				i.logger("leaving out %s: %v\n", img.PathOriginal, errs[idx])
+			}
+			failed[img.PathOriginal] = errs[idx]
+			continue
+		}
+		succeeded = append(succeeded, results[idx])
+	}
+	return succeeded, nil
+}
+
+// rejection is an error caused by the file itself, e.g. because it can't be decoded. Trying again won't help.
+type rejection struct {
+	err error
+}
+
+func (r rejection) Error() string {
+	return r.err.Error()
+}
+
+func (r rejection) Unwrap() error {
+	return r.err
+}
+
+func reject(err error) error {
+	if err == nil {
+		return nil
+	}
+	return rejection{err}
+}
+
+// rejectInvalid rejects a file because of err, unless err happened while reading or writing a file. Those errors, e.g.
+// because the disk is full, may go away.
+func rejectInvalid(err error) error {
+	var pathErr *fs.PathError
+	if err == nil || errors.As(err, &pathErr) {
+		return err
+	}
+	return reject(err)
+}
+
+func isRejection(err error) bool {
+	var r rejection
+	return errors.As(err, &r)
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"context"
+	"encoding/binary"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/memory"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gpsTIFF returns EXIF metadata in TIFF format with the timestamp and GPS coordinates that are required for ingesting
+// a file.
+func gpsTIFF() []byte {
+	be := binary.BigEndian
+	entry := func(b []byte, tag, typ uint16, count uint32, value []byte) []byte {
+		b = be.AppendUint16(b, tag)
+		b = be.AppendUint16(b, typ)
+		b = be.AppendUint32(b, count)
+		return append(b, append(value, make([]byte, 4-len(value))...)...)
+	}
+	rationals := func(b []byte, values ...uint32) []byte {
+		for _, v := range values {
+			b = be.AppendUint32(b, v)
+			b = be.AppendUint32(b, 1)
+		}
+		return b
+	}
+
+	// IFD0 at 8 with 2 entries ends at 38, followed by the timestamp. the GPS IFD with 4 entries starts at 58 and ends
+	// at 112, followed by latitude and longitude.
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 2}
+	tiff = entry(tiff, 0x0132, 2, 20, be.AppendUint32(nil, 38))
+	tiff = entry(tiff, 0x8825, 4, 1, be.AppendUint32(nil, 58))
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "2023:05:01 10:11:12\x00"...)
+
+	tiff = append(tiff, 0, 4)
+	tiff = entry(tiff, 1, 2, 2, []byte("N"))
+	tiff = entry(tiff, 2, 5, 3, be.AppendUint32(nil, 112))
+	tiff = entry(tiff, 3, 2, 2, []byte("E"))
+	tiff = entry(tiff, 4, 5, 3, be.AppendUint32(nil, 136))
+	tiff = append(tiff, 0, 0, 0, 0)
+
+	tiff = rationals(tiff, 13, 45, 0)
+	return rationals(tiff, 100, 30, 0)
+}
+
+func TestIngestFilesRejectsOnlyBrokenFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	heic := filepath.Join(dir, "IMG_0042.HEIC")
+	if err := os.WriteFile(heic, heicFile(gpsTIFF()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the EXIF data is fine, but there is no image after it
+	app1 := append([]byte("Exif\x00\x00"), gpsTIFF()...)
+	jpeg := append([]byte{0xff, 0xd8, 0xff, 0xe1}, binary.BigEndian.AppendUint16(nil, uint16(len(app1)+2))...)
+	jpeg = append(jpeg, app1...)
+	jpeg = append(jpeg, 0xff, 0xdb, 0, 0x43, 1, 2, 3)
+	broken := filepath.Join(dir, "broken.jpg")
+	if err := os.WriteFile(broken, jpeg, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// heif-convert that fails like it does for a file it can't decode
+	failing := filepath.Join(dir, "heif-convert")
+	if err := os.WriteFile(failing, []byte("#!/bin/sh\necho 'invalid input' >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		heifConvert string
+		want        FileStatus
+		wantReason  string
+	}{
+		{"heif-convert not installed", heic, "", FileFailed, "requires heif-convert"},
+		{"heif-convert removed", heic, filepath.Join(dir, "missing", "heif-convert"), FileFailed, "no such file"},
+		{"heif-convert can't decode the file", heic, failing, FileRejected, "invalid input"},
+		{"broken JPEG", broken, "", FileRejected, broken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIngestor(
+				memory.NewDatabase(1),
+				nil,
+				nil,
+				nil,
+				NearDuplicateConfig{},
+				coa.DefaultRenditionProfiles,
+				MetadataConfig{},
+				ConcurrencyConfig{},
+				false,
+				t.Logf,
+				false,
+			)
+			i.heifConvert = tt.heifConvert
+
+			results, err := i.IngestFiles(context.Background(), []string{tt.path})
+			if err != nil {
+				t.Fatalf("IngestFiles() failed: %v", err)
+			}
+
+			if r := results[0]; r.Status != tt.want || !strings.Contains(r.Reason, tt.wantReason) {
+				t.Fatalf("got %s, want status %s and a reason that contains '%s'", r, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
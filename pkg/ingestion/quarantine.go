@@ -0,0 +1,97 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sidecar explains why a file was quarantined. It is stored as JSON next to the file.
+type sidecar struct {
+	// Path is where the file was before it was quarantined.
+	Path          string     `json:"path"`
+	Status        FileStatus `json:"status"`
+	Reason        string     `json:"reason"`
+	QuarantinedAt time.Time  `json:"quarantinedAt"`
+}
+
+// sidecarSuffix is appended to the name of a quarantined file to get the name of its sidecar
+const sidecarSuffix = ".json"
+
+// QuarantineFile moves the file of a result to dst, e.g. in a quarantine directory, so that it isn't picked up again by
+// the next run, and writes a sidecar file next to it that explains why. A file that has been quarantined at dst before
+// is replaced.
+func QuarantineFile(result FileResult, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("unable to create quarantine directory %s: %w", filepath.Dir(dst), err)
+	}
+
+	s := sidecar{
+		Path:          result.Path,
+		Status:        result.Status,
+		Reason:        result.Reason,
+		QuarantinedAt: time.Now().UTC(),
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the sidecar comes first, so that there is never a quarantined file without an explanation
+	if err := os.WriteFile(dst+sidecarSuffix, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write sidecar for %s: %w", result.Path, err)
+	}
+
+	if err := moveFile(result.Path, dst); err != nil {
+		return fmt.Errorf("unable to quarantine %s: %w", result.Path, err)
+	}
+	return nil
+}
+
+// moveFile renames src to dst and falls back to copying if they are on different file systems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
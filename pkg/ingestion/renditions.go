@@ -0,0 +1,423 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"golang.org/x/image/draw"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// jpegtran is the command line tool from libjpeg that is used for making progressive JPEGs, since image/jpeg only
+// writes baseline JPEGs.
+const jpegtran = "jpegtran"
+
+// LoadRenditionProfiles reads a JSON array of rendition profiles from the file at path, e.g.
+//
+//	[{"name": "small", "maxWidth": 300, "format": "jpeg", "quality": 85, "progressive": true}, ...]
+//
+// coa.DefaultRenditionProfiles are returned if path is empty.
+func LoadRenditionProfiles(path string) ([]coa.RenditionProfile, error) {
+	if path == "" {
+		return coa.DefaultRenditionProfiles, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rendition profiles: %w", err)
+	}
+
+	var profiles []coa.RenditionProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("unable to parse rendition profiles in %s: %w", path, err)
+	}
+
+	if err := coa.ValidateRenditionProfiles(profiles); err != nil {
+		return nil, fmt.Errorf("invalid rendition profiles in %s: %w", path, err)
+	}
+	return profiles, nil
+}
+
+// resizeImages creates a rendition for each profile from the large rendition of the images. Files that exist from a
+// previous run are reused.
+func (i *Ingestor) resizeImages(ctx context.Context, images []coa.Image, failed failures) ([]coa.Image, error) {
+	if i.verbose {
+		i.logger("resizing images...\n")
+	}
+
+	resized, err := i.runStage(ctx, i.concurrency.Process, images, failed, i.resizeImage)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.verbose {
+		i.logger("done\n")
+	}
+	return resized, nil
+}
+
+func (i *Ingestor) resizeImage(ctx context.Context, img coa.Image) (coa.Image, error) {
+	large, err := describeRendition(img.PathLarge, coa.RenditionLarge, coa.FormatJPEG)
+	if err != nil {
+		return img, err
+	}
+
+	renditions, err := i.renderProfiles(ctx, img.PathLarge, i.profiles)
+	if err != nil {
+		return img, err
+	}
+
+	img.Renditions = append(renditions, large)
+	sort.SliceStable(img.Renditions, func(a, b int) bool {
+		return img.Renditions[a].Width < img.Renditions[b].Width
+	})
+
+	for _, r := range renditions {
+		switch r.Name {
+		case coa.RenditionMedium:
+			img.PathMedium = r.Path
+		case coa.RenditionSmall:
+			img.PathSmall = r.Path
+		}
+	}
+
+	return img, nil
+}
+
+// renderProfiles creates the renditions for the given profiles next to the large rendition at path. It is only
+// decoded if a rendition doesn't exist yet.
+func (i *Ingestor) renderProfiles(
+	ctx context.Context,
+	path string,
+	profiles []coa.RenditionProfile,
+) ([]coa.Rendition, error) {
+	var src image.Image
+	var renditions []coa.Rendition
+
+	for _, profile := range profiles {
+		pathRendition := renditionPath(path, profile)
+
+		exists, err := i.outputExists(pathRendition)
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			r, err := describeRendition(pathRendition, profile.Name, profile.Format)
+			if err != nil {
+				return nil, err
+			}
+
+			renditions = append(renditions, r)
+			continue
+		}
+
+		if src == nil {
+			if src, err = decodeOriented(path); err != nil {
+				return nil, err
+			}
+		}
+
+		r, err := renderRendition(ctx, src, profile, pathRendition)
+		if err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, r)
+	}
+	return renditions, nil
+}
+
+// BackfillRenditions creates the renditions of the configured profiles that are missing for the given images and
+// records the dimensions of their large renditions, if necessary. The large renditions are copied from storage to
+// temporary directories in workDir, or the default directory for temporary files if workDir is empty. It returns the number of
+// images that got new renditions.
+func (i *Ingestor) BackfillRenditions(ctx context.Context, images []coa.Image, workDir string) (int, error) {
+	updated := 0
+
+	for _, img := range images {
+		if err := ctx.Err(); err != nil {
+			return updated, err
+		}
+
+		_, hasLarge := img.Rendition(coa.RenditionLarge)
+
+		var missing []coa.RenditionProfile
+		for _, profile := range i.profiles {
+			if _, ok := img.Rendition(profile.Name); !ok {
+				missing = append(missing, profile)
+			}
+		}
+
+		if hasLarge && len(missing) == 0 {
+			continue
+		}
+
+		if i.verbose {
+			i.logger("creating %d renditions for image %d...\n", len(missing), img.ID)
+		}
+
+		renditions, err := i.backfillImage(ctx, img, hasLarge, missing, workDir)
+		if err != nil {
+			return updated, fmt.Errorf("unable to create renditions for image %d: %w", img.ID, err)
+		}
+
+		if err := i.db.InsertRenditions(ctx, img.ID, renditions); err != nil {
+			return updated, fmt.Errorf("unable to insert renditions for image %d: %w", img.ID, err)
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+func (i *Ingestor) backfillImage(
+	ctx context.Context,
+	img coa.Image,
+	hasLarge bool,
+	missing []coa.RenditionProfile,
+	workDir string,
+) ([]coa.Rendition, error) {
+	dir, err := os.MkdirTemp(workDir, "coa-renditions-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil && i.verbose {
+			i.logger("unable to remove temporary directory %s: %v\n", dir, err)
+		}
+	}()
+
+	pathLarge := filepath.Join(dir, "image.jpg")
+	if err := i.copyLarge(ctx, img, pathLarge); err != nil {
+		return nil, err
+	}
+
+	var renditions []coa.Rendition
+
+	if !hasLarge {
+		large, err := describeRendition(pathLarge, coa.RenditionLarge, coa.FormatJPEG)
+		if err != nil {
+			return nil, err
+		}
+
+		large.URL = img.URLLarge
+		renditions = append(renditions, large)
+	}
+
+	created, err := i.renderProfiles(ctx, pathLarge, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range created {
+		r.URL, err = i.uploadFile(ctx, r.Path, img.StorageKey(r.Name))
+		if err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, r)
+	}
+	return renditions, nil
+}
+
+// copyLarge writes the large rendition of img to a file at path.
+func (i *Ingestor) copyLarge(ctx context.Context, img coa.Image, path string) error {
+	src, err := i.readLarge(ctx, img)
+	if err != nil {
+		return fmt.Errorf("unable to read image %d: %w", img.ID, err)
+	}
+	defer i.close(src)
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to read image %d: %w", img.ID, err)
+	}
+	return nil
+}
+
+// readLarge opens the large rendition of img in storage. Only images that were stored before keys were derived from
+// checksums are downloaded from their URL, since there is no key for them.
+func (i *Ingestor) readLarge(ctx context.Context, img coa.Image) (io.ReadCloser, error) {
+	// the large rendition is stored under another key after its metadata was removed, see sanitizedKey
+	keys := []string{img.StorageKey(coa.RenditionLarge)}
+	if dir, name := path.Split(img.URLLarge.Path); path.Base(dir) == img.SHA256 {
+		keys = append(keys, img.StorageKey(name))
+	}
+
+	for _, key := range keys {
+		u, err := i.store.URL(ctx, key)
+		if err == nil && u.String() == img.URLLarge.String() {
+			return i.store.Get(ctx, key)
+		}
+	}
+	return img.Read(ctx)
+}
+
+// renditionPath returns the path of the file for a rendition of the image at path, e.g. IMG_0042-small.jpg.
+func renditionPath(path string, profile coa.RenditionProfile) string {
+	ext := ".jpg"
+	if profile.Format == coa.FormatPNG {
+		ext = ".png"
+	}
+
+	withoutExt := strings.TrimSuffix(path, filepath.Ext(path))
+	return fmt.Sprintf("%s-%s%s", withoutExt, profile.Name, ext)
+}
+
+// isRenditionPath checks whether the file at path is a rendition that was created in a previous run.
+func (i *Ingestor) isRenditionPath(path string) bool {
+	basename := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if strings.HasSuffix(basename, imageSuffixLarge) {
+		return true
+	}
+
+	for _, profile := range i.profiles {
+		if strings.HasSuffix(basename, "-"+profile.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderRendition scales src according to profile and writes the result to path. src must be upright already.
+func renderRendition(
+	ctx context.Context,
+	src image.Image,
+	profile coa.RenditionProfile,
+	path string,
+) (coa.Rendition, error) {
+	width, height := fitSize(src.Bounds().Dx(), src.Bounds().Dy(), profile.MaxWidth, profile.MaxHeight)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Rect, src, src.Bounds(), draw.Over, nil)
+
+	output, err := os.Create(path)
+	if err != nil {
+		return coa.Rendition{}, fmt.Errorf("unable to create file for resized image at %s: %w", path, err)
+	}
+
+	if profile.Format == coa.FormatPNG {
+		err = png.Encode(output, dst)
+	} else {
+		err = jpeg.Encode(output, dst, &jpeg.Options{Quality: profile.Quality})
+	}
+
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && profile.Progressive {
+		err = makeProgressive(ctx, path)
+	}
+
+	if err != nil {
+		// don't leave a broken file behind that would be reused on the next run
+		_ = os.Remove(path)
+		return coa.Rendition{}, fmt.Errorf("unable to write rendition %s to %s: %w", profile.Name, path, err)
+	}
+
+	return describeRendition(path, profile.Name, profile.Format)
+}
+
+// makeProgressive converts the baseline JPEG at path to a progressive JPEG in place. jpegtran does this losslessly.
+func makeProgressive(ctx context.Context, path string) error {
+	tmp := path + ".tmp"
+	cmd := exec.CommandContext(ctx, jpegtran, "-progressive", "-copy", "none", "-outfile", tmp, path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(tmp)
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("progressive JPEGs require %s from libjpeg: %w", jpegtran, err)
+		}
+		return fmt.Errorf("%s failed for %s: %w: %s", jpegtran, path, err, out)
+	}
+	return os.Rename(tmp, path)
+}
+
+// describeRendition reads the dimensions and size of the rendition file at path. Only the large rendition can have an
+// EXIF orientation, since the others are created without metadata.
+func describeRendition(path, name, format string) (coa.Rendition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return coa.Rendition{}, fmt.Errorf("unable to open file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return coa.Rendition{}, fmt.Errorf("unable to read dimensions of %s: %w", path, err)
+	}
+
+	stats, err := f.Stat()
+	if err != nil {
+		return coa.Rendition{}, err
+	}
+
+	// the size as displayed, since browsers rotate images according to their EXIF orientation
+	width, height := cfg.Width, cfg.Height
+	if orientationOf(path, format) >= 5 {
+		width, height = height, width
+	}
+
+	return coa.Rendition{
+		Name:   name,
+		Path:   path,
+		Width:  width,
+		Height: height,
+		Size:   stats.Size(),
+		Format: format,
+	}, nil
+}
+
+// fitSize scales width and height down to fit into maxWidth and maxHeight, keeping the aspect ratio. Zero means no
+// limit. Images are never scaled up.
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+
+	if scale == 1.0 {
+		return width, height
+	}
+
+	w := int(math.Max(1, math.Round(float64(width)*scale)))
+	h := int(math.Max(1, math.Round(float64(height)*scale)))
+	return w, h
+}
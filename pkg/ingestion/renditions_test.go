@@ -0,0 +1,91 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"context"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReadLarge(t *testing.T) {
+	ctx := context.Background()
+	hash := strings.Repeat("a", 64)
+
+	// the public URL of the storage is never requested
+	store, err := storage.NewLocal(t.TempDir(), "https://cats.example/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, content := range map[string]string{
+		hash + "/large":          "stored",
+		hash + "/large-0123abcd": "sanitized",
+	} {
+		if err := store.Put(ctx, key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "downloaded "+r.URL.Path)
+	}))
+	defer legacy.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{"large rendition", "https://cats.example/files/" + hash + "/large", "stored"},
+		{"sanitized large rendition", "https://cats.example/files/" + hash + "/large-0123abcd", "sanitized"},
+		{"stored before keys were derived from checksums", legacy.URL + "/IMG_0042.jpg", "downloaded /IMG_0042.jpg"},
+		{"same key at another URL", legacy.URL + "/" + hash + "/large", "downloaded /" + hash + "/large"},
+	}
+
+	i := &Ingestor{store: store, logger: t.Logf}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src, err := i.readLarge(ctx, coa.Image{ID: 1, SHA256: hash, URLLarge: u})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+
+			content, err := io.ReadAll(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(content) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, content)
+			}
+		})
+	}
+}
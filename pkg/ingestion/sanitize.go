@@ -0,0 +1,198 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/sanitize"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MetadataConfig controls which metadata ends up in publicly stored files.
+type MetadataConfig struct {
+	// AllowedExifFields are kept in the large renditions. See sanitize.Fields for the supported names.
+	AllowedExifFields []string
+	// Originals keeps the untouched files the images were ingested from. It must not be publicly accessible. Originals
+	// are not kept if it is nil.
+	Originals coa.Storage
+}
+
+// sanitizeFile writes a copy of the JPEG at src without the metadata that isn't allowed to dst.
+func sanitizeFile(src, dst string, allowed []string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	sanitized, err := sanitize.JPEG(data, allowed)
+	if err != nil {
+		return reject(fmt.Errorf("unable to remove metadata from %s: %w", src, err))
+	}
+
+	if err := os.WriteFile(dst, sanitized, 0o644); err != nil {
+		// don't leave a broken file behind that would be reused on the next run
+		_ = os.Remove(dst)
+		return fmt.Errorf("unable to write %s: %w", dst, err)
+	}
+	return nil
+}
+
+// SanitizeStoredImages removes metadata from the large renditions of images that were stored before ingestion did
+// that. The untouched files are kept in the storage for originals. Originals of images in other formats that were
+// stored publicly are moved there as well. It returns the number of updated images.
+//
+// The sanitized files get new keys and therefore new URLs, since clients and caches may keep the files under the old
+// ones for a long time. The old files are deleted from the public storage.
+func (i *Ingestor) SanitizeStoredImages(ctx context.Context, images []coa.Image, workDir string) (int, error) {
+	if i.metadata.Originals == nil {
+		return 0, errors.New("a storage for originals is required, since the untouched files would be lost otherwise")
+	}
+
+	updated := 0
+
+	for _, img := range images {
+		if err := ctx.Err(); err != nil {
+			return updated, err
+		}
+
+		changed, err := i.sanitizeStoredImage(ctx, img, workDir)
+		if err != nil {
+			return updated, fmt.Errorf("unable to sanitize image %d: %w", img.ID, err)
+		}
+
+		if changed {
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+func (i *Ingestor) sanitizeStoredImage(ctx context.Context, img coa.Image, workDir string) (bool, error) {
+	moved := false
+	if img.HasOriginal() {
+		var err error
+		if moved, err = i.moveOriginal(ctx, img); err != nil {
+			return false, err
+		}
+	}
+
+	src, err := img.Read(ctx)
+	if err != nil {
+		return moved, err
+	}
+	defer i.close(src)
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return moved, err
+	}
+
+	sanitized, err := sanitize.JPEG(data, i.metadata.AllowedExifFields)
+	if err != nil {
+		return moved, err
+	}
+
+	if bytes.Equal(data, sanitized) {
+		return moved, nil
+	}
+
+	if i.verbose {
+		i.logger("removing metadata from image %d...\n", img.ID)
+	}
+
+	// the large rendition of a JPEG is the original
+	if !img.HasOriginal() {
+		key := img.StorageKey(coa.RenditionOriginal)
+		if err := i.metadata.Originals.Put(ctx, key, bytes.NewReader(data)); err != nil {
+			return moved, fmt.Errorf("unable to store original: %w", err)
+		}
+	}
+
+	dir, err := os.MkdirTemp(workDir, "coa-sanitize-")
+	if err != nil {
+		return moved, err
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil && i.verbose {
+			i.logger("unable to remove temporary directory %s: %v\n", dir, err)
+		}
+	}()
+
+	path := filepath.Join(dir, "image.jpg")
+	if err := os.WriteFile(path, sanitized, 0o644); err != nil {
+		return moved, err
+	}
+
+	large, err := describeRendition(path, coa.RenditionLarge, coa.FormatJPEG)
+	if err != nil {
+		return moved, err
+	}
+
+	large.URL, err = i.uploadFile(ctx, path, sanitizedKey(img, sanitized))
+	if err != nil {
+		return moved, err
+	}
+
+	if err := i.db.InsertRenditions(ctx, img.ID, []coa.Rendition{large}); err != nil {
+		return moved, err
+	}
+
+	// nothing refers to the file with metadata anymore. images stored before keys were derived from checksums are
+	// only known by their URL
+	if err := i.store.DeleteURL(ctx, img.URLLarge); err != nil {
+		return true, fmt.Errorf("unable to delete public file with metadata at %s: %w", img.URLLarge, err)
+	}
+	return true, nil
+}
+
+// sanitizedKey returns the key of the sanitized large rendition of img. It is derived from the content, since the
+// file under the key of the large rendition may be cached with all metadata.
+func sanitizedKey(img coa.Image, content []byte) string {
+	sum := sha256.Sum256(content)
+	return img.StorageKey(fmt.Sprintf("%s-%x", coa.RenditionLarge, sum[:8]))
+}
+
+// moveOriginal moves the original of an image from public storage to the storage for originals, if it is there.
+func (i *Ingestor) moveOriginal(ctx context.Context, img coa.Image) (bool, error) {
+	key := img.StorageKey(coa.RenditionOriginal)
+
+	src, err := i.store.Get(ctx, key)
+	if err != nil {
+		// the original was never stored publicly
+		if i.verbose {
+			i.logger("no public original found for image %d: %v\n", img.ID, err)
+		}
+		return false, nil
+	}
+	defer i.close(src)
+
+	if err := i.metadata.Originals.Put(ctx, key, src); err != nil {
+		return false, fmt.Errorf("unable to store original: %w", err)
+	}
+
+	if err := i.store.Delete(ctx, key); err != nil {
+		return false, fmt.Errorf("unable to delete public original: %w", err)
+	}
+	return true, nil
+}
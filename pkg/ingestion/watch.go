@@ -0,0 +1,276 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Defaults for the fields of WatchConfig
+const (
+	DefaultWatchPollInterval = 10 * time.Second
+	DefaultWatchStableFor    = 30 * time.Second
+	DefaultWatchRetryDelay   = 5 * time.Minute
+)
+
+// WatchConfig configures the ingestion of files as they appear in a directory. Zero values mean the defaults.
+type WatchConfig struct {
+	// List determines which files are picked up. Subdirectories are always included.
+	List ListOptions
+	// ArchiveDir is where files are moved after they have been ingested or skipped as duplicates.
+	ArchiveDir string
+	// QuarantineDir is where rejected files are moved, see QuarantineFile.
+	QuarantineDir string
+	// PollInterval is the time between scans of the directory.
+	PollInterval time.Duration
+	// StableFor is the time the size and modification time of a file must stay the same before it is ingested, so
+	// that files that are still being written, e.g. by a sync client, are left alone.
+	StableFor time.Duration
+	// RetryDelay is the time before files that failed are tried again.
+	RetryDelay time.Duration
+	// Processed is called with the results of each batch of files and where each of them was moved, e.g. for printing
+	// a summary. Optional.
+	Processed func(results []FileResult, moved map[string]string)
+}
+
+func (c WatchConfig) withDefaults() WatchConfig {
+	c.List.Recursive = true
+
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultWatchPollInterval
+	}
+	if c.StableFor <= 0 {
+		c.StableFor = DefaultWatchStableFor
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = DefaultWatchRetryDelay
+	}
+	return c
+}
+
+// Watcher ingests files as they appear in a directory tree. The directory is polled instead of relying on file system
+// notifications, which aren't available for many shared folders.
+type Watcher struct {
+	ingestor *Ingestor
+	dir      string
+	cfg      WatchConfig
+	logger   Logger
+	// files maps the paths of the files that haven't been processed yet to what was last seen of them
+	files map[string]watchedFile
+}
+
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// since is when the size and modification time were first seen
+	since time.Time
+	// retryAt is when a file that failed is tried again
+	retryAt time.Time
+}
+
+func NewWatcher(ingestor *Ingestor, dir string, cfg WatchConfig, logger Logger) *Watcher {
+	return &Watcher{
+		ingestor,
+		dir,
+		cfg.withDefaults(),
+		logger,
+		make(map[string]watchedFile),
+	}
+}
+
+// Run watches the directory until ctx is cancelled. A batch that is being ingested at that time is abandoned before
+// anything is inserted into the database, so that its files are picked up again on the next start.
+func (w *Watcher) Run(ctx context.Context) error {
+	if w.cfg.ArchiveDir == "" || w.cfg.QuarantineDir == "" {
+		return errors.New("the archive and quarantine directories are required for watching a directory")
+	}
+
+	if err := w.cfg.List.ValidatePatterns(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.poll(ctx); err != nil && ctx.Err() == nil {
+			w.logger("error while watching %s: %v\n", w.dir, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll scans the directory once and ingests the files that are stable.
+func (w *Watcher) poll(ctx context.Context) error {
+	paths, err := w.ingestor.ListFiles(w.dir, w.cfg.List)
+	if err != nil {
+		return err
+	}
+
+	stable := w.stableFiles(paths, time.Now())
+	if len(stable) == 0 {
+		return nil
+	}
+
+	results, err := w.ingestor.IngestFiles(ctx, stable)
+	if err != nil {
+		return err
+	}
+
+	moved := make(map[string]string)
+	now := time.Now()
+
+	for _, r := range results {
+		if dst := w.finish(r, now); dst != "" {
+			moved[r.Path] = dst
+		}
+	}
+
+	if w.cfg.Processed != nil {
+		w.cfg.Processed(results, moved)
+	}
+	return nil
+}
+
+// stableFiles updates what is known about the files at paths and returns those that haven't changed for long enough.
+// Files that are gone are forgotten.
+func (w *Watcher) stableFiles(paths []string, now time.Time) []string {
+	var stable []string
+	seen := make(map[string]bool)
+
+	for _, p := range paths {
+		seen[p] = true
+
+		info, err := os.Stat(p)
+		if err != nil {
+			// most likely removed since it was listed
+			continue
+		}
+
+		f, ok := w.files[p]
+		if !ok || f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+			w.files[p] = watchedFile{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+
+		if now.Sub(f.since) >= w.cfg.StableFor && !now.Before(f.retryAt) {
+			stable = append(stable, p)
+		}
+	}
+
+	for p := range w.files {
+		if !seen[p] {
+			delete(w.files, p)
+		}
+	}
+	return stable
+}
+
+// finish moves a processed file out of the directory, depending on its result, and removes its local renditions. It
+// returns where the file was moved, if it was. Files that failed at the time now are left in place and tried again
+// once RetryDelay has passed.
+func (w *Watcher) finish(r FileResult, now time.Time) string {
+	if r.Status == FileFailed {
+		f := w.files[r.Path]
+		f.retryAt = now.Add(w.cfg.RetryDelay)
+		w.files[r.Path] = f
+		return ""
+	}
+
+	f := w.files[r.Path]
+	delete(w.files, r.Path)
+	w.ingestor.removeRenditions(r.Path)
+
+	// a file that was replaced while it was ingested is picked up again as a new one
+	if info, err := os.Stat(r.Path); err != nil || info.Size() != f.size || !info.ModTime().Equal(f.modTime) {
+		return ""
+	}
+
+	rel, err := filepath.Rel(w.dir, r.Path)
+	if err != nil {
+		rel = filepath.Base(r.Path)
+	}
+
+	if r.Status == FileRejected {
+		dst := filepath.Join(w.cfg.QuarantineDir, rel)
+		if err := QuarantineFile(r, dst); err != nil {
+			w.logger("%v\n", err)
+			return ""
+		}
+		return dst
+	}
+
+	dst, err := freePath(filepath.Join(w.cfg.ArchiveDir, rel))
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+	}
+	if err == nil {
+		err = moveFile(r.Path, dst)
+	}
+	if err != nil {
+		w.logger("unable to archive %s: %v\n", r.Path, err)
+		return ""
+	}
+	return dst
+}
+
+// removeRenditions removes the renditions that were created locally for the original file at path.
+func (i *Ingestor) removeRenditions(path string) {
+	pathLarge := largePath(path, "")
+	paths := []string{pathLarge}
+
+	for _, profile := range i.profiles {
+		paths = append(paths, renditionPath(pathLarge, profile))
+	}
+
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			i.logger("unable to remove %s: %v\n", p, err)
+		}
+	}
+}
+
+// freePath returns path, or if a file exists there already, path with a number added to the name, so that files with
+// the same name don't replace each other.
+func freePath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	withoutExt := strings.TrimSuffix(path, ext)
+
+	for n := 1; ; n++ {
+		_, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		path = fmt.Sprintf("%s-%d%s", withoutExt, n, ext)
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ingestion
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+const (
+	testStableFor  = time.Minute
+	testRetryDelay = 5 * time.Minute
+)
+
+// fileModTime is the modification time of all test files, so that only the injected times matter
+var fileModTime = time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func newTestWatcher(t *testing.T) *Watcher {
+	t.Helper()
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "inbox")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := WatchConfig{
+		ArchiveDir:    filepath.Join(root, "archive"),
+		QuarantineDir: filepath.Join(root, "quarantine"),
+		StableFor:     testStableFor,
+		RetryDelay:    testRetryDelay,
+	}
+	return NewWatcher(&Ingestor{logger: t.Logf}, dir, cfg, t.Logf)
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, fileModTime, fileModTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStableFiles(t *testing.T) {
+	w := newTestWatcher(t)
+	a := filepath.Join(w.dir, "a.jpg")
+	b := filepath.Join(w.dir, "b.jpg")
+	writeTestFile(t, a, "a")
+	writeTestFile(t, b, "b")
+	paths := []string{a, b}
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if got := w.stableFiles(paths, start); len(got) != 0 {
+		t.Fatalf("files are stable when they are first seen: %v", got)
+	}
+
+	if got := w.stableFiles(paths, start.Add(testStableFor-time.Second)); len(got) != 0 {
+		t.Fatalf("files are stable before StableFor has passed: %v", got)
+	}
+
+	// a is still being written
+	writeTestFile(t, a, "a, but longer")
+	changedAt := start.Add(testStableFor)
+
+	if got := w.stableFiles(paths, changedAt); !slices.Equal(got, []string{b}) {
+		t.Fatalf("stableFiles() = %v, want only %s", got, b)
+	}
+
+	if got := w.stableFiles(paths, changedAt.Add(testStableFor-time.Second)); !slices.Equal(got, []string{b}) {
+		t.Fatalf("stableFiles() = %v, want only %s", got, b)
+	}
+
+	if got := w.stableFiles(paths, changedAt.Add(testStableFor)); !slices.Equal(got, paths) {
+		t.Fatalf("stableFiles() = %v, want %v", got, paths)
+	}
+
+	// a modification time that changes without the size does count as a change
+	later := fileModTime.Add(time.Hour)
+	if err := os.Chtimes(b, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.stableFiles(paths, changedAt.Add(testStableFor)); !slices.Equal(got, []string{a}) {
+		t.Fatalf("stableFiles() = %v, want only %s", got, a)
+	}
+}
+
+func TestStableFilesForgetsRemovedFiles(t *testing.T) {
+	w := newTestWatcher(t)
+	a := filepath.Join(w.dir, "a.jpg")
+	b := filepath.Join(w.dir, "b.jpg")
+	writeTestFile(t, a, "a")
+	writeTestFile(t, b, "b")
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	w.stableFiles([]string{a, b}, start)
+
+	// b is no longer listed, a was removed after it was listed
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.stableFiles([]string{a}, start.Add(testStableFor)); len(got) != 0 {
+		t.Fatalf("stableFiles() = %v, want none", got)
+	}
+
+	if _, ok := w.files[b]; ok {
+		t.Errorf("%s is still watched after it was gone from the directory", b)
+	}
+
+	// a file that comes back is new again
+	writeTestFile(t, b, "b")
+	if got := w.stableFiles([]string{b}, start.Add(testStableFor)); len(got) != 0 {
+		t.Fatalf("stableFiles() = %v, want none", got)
+	}
+}
+
+func TestFinishFailedIsRetriedLater(t *testing.T) {
+	w := newTestWatcher(t)
+	path := filepath.Join(w.dir, "a.jpg")
+	writeTestFile(t, path, "a")
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	w.stableFiles([]string{path}, start)
+	stableAt := start.Add(testStableFor)
+	if got := w.stableFiles([]string{path}, stableAt); len(got) != 1 {
+		t.Fatalf("stableFiles() = %v, want %s", got, path)
+	}
+
+	failedAt := stableAt.Add(time.Minute)
+	if dst := w.finish(FileResult{Path: path, Status: FileFailed, Reason: "geocoder is down"}, failedAt); dst != "" {
+		t.Fatalf("failed file was moved to %s", dst)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("failed file is gone: %v", err)
+	}
+
+	if got := w.stableFiles([]string{path}, failedAt.Add(testRetryDelay-time.Second)); len(got) != 0 {
+		t.Fatalf("failed file is retried before RetryDelay has passed: %v", got)
+	}
+
+	if got := w.stableFiles([]string{path}, failedAt.Add(testRetryDelay)); len(got) != 1 {
+		t.Fatalf("failed file isn't retried after RetryDelay: %v", got)
+	}
+
+	// failing again pushes the next attempt back again
+	failedAgainAt := failedAt.Add(testRetryDelay + time.Minute)
+	w.finish(FileResult{Path: path, Status: FileFailed}, failedAgainAt)
+
+	if got := w.stableFiles([]string{path}, failedAt.Add(testRetryDelay*2)); len(got) != 0 {
+		t.Fatalf("file is retried before RetryDelay has passed since the last failure: %v", got)
+	}
+	if got := w.stableFiles([]string{path}, failedAgainAt.Add(testRetryDelay)); len(got) != 1 {
+		t.Fatalf("file isn't retried after RetryDelay has passed since the last failure: %v", got)
+	}
+}
+
+func TestFinish(t *testing.T) {
+	tests := []struct {
+		name   string
+		status FileStatus
+		// existing is the content of a file that is already in the archive under the same name
+		existing string
+		wantDir  func(w *Watcher) string
+		wantName string
+	}{
+		{"ingested", FileIngested, "", archiveDir, "a.jpg"},
+		{"duplicate", FileDuplicate, "", archiveDir, "a.jpg"},
+		{"name taken in the archive", FileIngested, "older a", archiveDir, "a-1.jpg"},
+		{"rejected", FileRejected, "", quarantineDir, "a.jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWatcher(t)
+			path := filepath.Join(w.dir, "2023", "a.jpg")
+			writeTestFile(t, path, "a")
+			if tt.existing != "" {
+				writeTestFile(t, filepath.Join(w.cfg.ArchiveDir, "2023", "a.jpg"), tt.existing)
+			}
+
+			// renditions that were created next to the file
+			large := largePath(path, "")
+			writeTestFile(t, large, "large")
+
+			start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+			w.stableFiles([]string{path}, start)
+			w.stableFiles([]string{path}, start.Add(testStableFor))
+
+			dst := w.finish(FileResult{Path: path, Status: tt.status}, start.Add(testStableFor+time.Minute))
+
+			want := filepath.Join(tt.wantDir(w), "2023", tt.wantName)
+			if dst != want {
+				t.Fatalf("finish() = %s, want %s", dst, want)
+			}
+
+			if data, err := os.ReadFile(want); err != nil || string(data) != "a" {
+				t.Fatalf("%s contains %q, %v, want the processed file", want, data, err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s is still in the watched directory", path)
+			}
+			if _, err := os.Stat(large); !os.IsNotExist(err) {
+				t.Errorf("rendition %s wasn't removed", large)
+			}
+			if _, ok := w.files[path]; ok {
+				t.Errorf("%s is still watched", path)
+			}
+
+			_, err := os.Stat(want + sidecarSuffix)
+			if hasSidecar := err == nil; hasSidecar != (tt.status == FileRejected) {
+				t.Errorf("sidecar exists: %v, want %v", hasSidecar, tt.status == FileRejected)
+			}
+		})
+	}
+}
+
+func archiveDir(w *Watcher) string {
+	return w.cfg.ArchiveDir
+}
+
+func quarantineDir(w *Watcher) string {
+	return w.cfg.QuarantineDir
+}
+
+func TestFinishReplacedWhileIngested(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace func(t *testing.T, path string)
+	}{
+		{"new content", func(t *testing.T, path string) {
+			writeTestFile(t, path, "a new a")
+		}},
+		{"same size, new modification time", func(t *testing.T, path string) {
+			later := fileModTime.Add(time.Hour)
+			if err := os.Chtimes(path, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"removed", func(t *testing.T, path string) {
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWatcher(t)
+			path := filepath.Join(w.dir, "a.jpg")
+			writeTestFile(t, path, "a")
+
+			start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+			w.stableFiles([]string{path}, start)
+			w.stableFiles([]string{path}, start.Add(testStableFor))
+
+			tt.replace(t, path)
+
+			if dst := w.finish(FileResult{Path: path, Status: FileIngested}, start.Add(testStableFor)); dst != "" {
+				t.Fatalf("file that was replaced while it was ingested was moved to %s", dst)
+			}
+
+			if entries, err := os.ReadDir(w.cfg.ArchiveDir); err == nil && len(entries) > 0 {
+				t.Errorf("archive isn't empty: %v", entries)
+			}
+
+			if _, err := os.Stat(path); err != nil {
+				return
+			}
+
+			// the replacement is picked up as a new file
+			later := start.Add(2 * testStableFor)
+			if got := w.stableFiles([]string{path}, later); len(got) != 0 {
+				t.Fatalf("replacement is stable right away: %v", got)
+			}
+			if got := w.stableFiles([]string{path}, later.Add(testStableFor)); len(got) != 1 {
+				t.Fatalf("replacement isn't picked up: %v", got)
+			}
+		})
+	}
+}
+
+func TestFreePath(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		existing []string
+		path     string
+		want     string
+	}{
+		{"free", nil, "a.jpg", "a.jpg"},
+		{"taken", []string{"b.jpg"}, "b.jpg", "b-1.jpg"},
+		{"taken twice", []string{"c.jpg", "c-1.jpg"}, "c.jpg", "c-2.jpg"},
+		{"gap", []string{"d.jpg", "d-2.jpg"}, "d.jpg", "d-1.jpg"},
+		{"without extension", []string{"e"}, "e", "e-1"},
+		{"directory does not exist", nil, filepath.Join("sub", "f.jpg"), filepath.Join("sub", "f.jpg")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range tt.existing {
+				writeTestFile(t, filepath.Join(dir, name), name)
+			}
+
+			got, err := freePath(filepath.Join(dir, tt.path))
+			if err != nil {
+				t.Fatalf("freePath() failed: %v", err)
+			}
+			if want := filepath.Join(dir, tt.want); got != want {
+				t.Fatalf("freePath() = %s, want %s", got, want)
+			}
+		})
+	}
+}
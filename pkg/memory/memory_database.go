@@ -0,0 +1,1035 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"math/rand"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type location struct {
+	id       int64
+	city     string
+	country  string
+	timezone string
+}
+
+type coordinates struct {
+	id         int64
+	latitude   float64
+	longitude  float64
+	locationID int64
+}
+
+type image struct {
+	id           int64
+	coordinateID int64
+	urlLarge     string
+	urlMedium    string
+	urlSmall     string
+	sha256       string
+	timestamp    time.Time
+	hidden       bool
+	phash        uint64
+	format       string
+}
+
+type rendition struct {
+	name          string
+	url           string
+	width, height int
+	size          int64
+	format        string
+}
+
+type cat struct {
+	id          int64
+	name        string
+	description string
+}
+
+type job struct {
+	coa.Job
+	// lockedUntil is zero unless the job is running
+	lockedUntil time.Time
+}
+
+type memDatabase struct {
+	mu sync.Mutex
+
+	rng *rand.Rand
+
+	locations   map[int64]location
+	coordinates map[int64]coordinates
+	images      map[int64]image
+	posts       map[coa.Platform]map[int64]bool
+	aliases     map[int64]coa.PlaceAlias
+	zones       map[int64]coa.PrivacyZone
+	// tags maps the name of each tag to whether it is controlled
+	tags      map[string]bool
+	imageTags map[int64]map[string]bool
+	// renditions maps the ID of each image to its renditions by name
+	renditions map[int64]map[string]rendition
+	cats       map[int64]cat
+	// catImages maps the ID of each cat to the IDs of its images
+	catImages map[int64]map[int64]bool
+	jobs      map[int64]job
+
+	// the last ID used for each table
+	lastIDs map[string]int64
+}
+
+// NewDatabase creates a coa.Database that keeps everything in memory. It behaves like the PostgreSQL implementation,
+// including returning sql.ErrNoRows when something can't be found. seed is used for selecting random images.
+func NewDatabase(seed int64) coa.Database {
+	return &memDatabase{
+		rng:         rand.New(rand.NewSource(seed)),
+		locations:   make(map[int64]location),
+		coordinates: make(map[int64]coordinates),
+		images:      make(map[int64]image),
+		posts: map[coa.Platform]map[int64]bool{
+			coa.Mastodon: {},
+			coa.X:        {},
+		},
+		aliases:    make(map[int64]coa.PlaceAlias),
+		zones:      make(map[int64]coa.PrivacyZone),
+		tags:       make(map[string]bool),
+		imageTags:  make(map[int64]map[string]bool),
+		renditions: make(map[int64]map[string]rendition),
+		cats:       make(map[int64]cat),
+		catImages:  make(map[int64]map[int64]bool),
+		jobs:       make(map[int64]job),
+		lastIDs:    make(map[string]int64),
+	}
+}
+
+func (d *memDatabase) GetOrCreateLocation(_ context.Context, city, country, timezone string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getOrCreateLocation(city, country, timezone), nil
+}
+
+func (d *memDatabase) getOrCreateLocation(city, country, timezone string) int64 {
+	for _, l := range d.locations {
+		if l.city == city && l.country == country {
+			return l.id
+		}
+	}
+
+	id := d.nextID("locations")
+	d.locations[id] = location{id, city, country, timezone}
+	return id
+}
+
+func (d *memDatabase) GetOrCreateCoordinates(
+	_ context.Context,
+	latitude, longitude float64,
+	locationId int64,
+) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.getOrCreateCoordinates(latitude, longitude, locationId)
+}
+
+func (d *memDatabase) getOrCreateCoordinates(latitude, longitude float64, locationID int64) (int64, error) {
+	if c, ok := d.findCoordinates(latitude, longitude); ok {
+		return c.id, nil
+	}
+
+	if _, ok := d.locations[locationID]; !ok {
+		return 0, fmt.Errorf("location %d does not exist", locationID)
+	}
+
+	id := d.nextID("coordinates")
+	d.coordinates[id] = coordinates{id, latitude, longitude, locationID}
+	return id, nil
+}
+
+func (d *memDatabase) GetCoordinateID(_ context.Context, latitude, longitude float64) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.findCoordinates(latitude, longitude)
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return c.id, nil
+}
+
+func (d *memDatabase) GetKnownLocation(_ context.Context, latitude, longitude float64) (coa.KnownLocation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.findCoordinates(latitude, longitude)
+	if !ok {
+		return coa.KnownLocation{}, sql.ErrNoRows
+	}
+
+	l := d.locations[c.locationID]
+	return coa.KnownLocation{CoordinateID: c.id, City: l.city, Country: l.country, Timezone: l.timezone}, nil
+}
+
+func (d *memDatabase) GetImage(_ context.Context, id int64) (coa.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img, ok := d.images[id]
+	if !ok {
+		return coa.Image{}, sql.ErrNoRows
+	}
+	return d.toImage(img)
+}
+
+func (d *memDatabase) GetImageBySHA256(_ context.Context, sha256 string) (coa.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, img := range d.images {
+		if img.sha256 == sha256 {
+			return d.toImage(img)
+		}
+	}
+	return coa.Image{}, sql.ErrNoRows
+}
+
+func (d *memDatabase) GetImages(_ context.Context) ([]coa.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var images []coa.Image
+	for _, img := range d.sortedImages() {
+		if img.hidden {
+			continue
+		}
+
+		i, err := d.toImage(img)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, i)
+	}
+	return images, nil
+}
+
+func (d *memDatabase) GetRandomUnusedImage(_ context.Context, platform coa.Platform) (coa.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	unused := d.unusedImages(platform)
+	if len(unused) == 0 {
+		return coa.Image{}, sql.ErrNoRows
+	}
+
+	return d.toImage(unused[d.rng.Intn(len(unused))])
+}
+
+func (d *memDatabase) GetUnusedImageCount(_ context.Context, platform coa.Platform) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.unusedImages(platform)), nil
+}
+
+func (d *memDatabase) RemoveKnownImages(_ context.Context, images []coa.Image) ([]coa.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var filtered []coa.Image
+	for _, img := range images {
+		if !d.hasImage(img.SHA256) {
+			filtered = append(filtered, img)
+		}
+	}
+	return filtered, nil
+}
+
+// InsertImages either inserts all images or none of them.
+func (d *memDatabase) InsertImages(_ context.Context, images []coa.Image) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, img := range images {
+		if d.hasImage(img.SHA256) || seen[img.SHA256] {
+			return fmt.Errorf("image with SHA256 %s already exists", img.SHA256)
+		}
+		seen[img.SHA256] = true
+
+		if img.CoordinateID != nil {
+			if _, ok := d.coordinates[*img.CoordinateID]; !ok {
+				return fmt.Errorf("coordinates %d do not exist", *img.CoordinateID)
+			}
+		}
+	}
+
+	for _, img := range images {
+		var coordID int64
+		if img.CoordinateID != nil {
+			coordID = *img.CoordinateID
+		} else {
+			locID := d.getOrCreateLocation(img.City, img.Country, img.Timezone)
+			// can't fail, since the location exists
+			coordID, _ = d.getOrCreateCoordinates(img.Latitude, img.Longitude, locID)
+		}
+
+		id := d.nextID("images")
+		d.images[id] = image{
+			id:           id,
+			coordinateID: coordID,
+			urlLarge:     urlString(img.URLLarge),
+			urlMedium:    urlString(img.URLMedium),
+			urlSmall:     urlString(img.URLSmall),
+			sha256:       img.SHA256,
+			timestamp:    toTimestamp(img.Timestamp),
+			phash:        img.PHash,
+			format:       formatOf(img),
+		}
+		d.setRenditions(id, img.Renditions)
+	}
+	return nil
+}
+
+func (d *memDatabase) InsertRenditions(_ context.Context, imageID int64, renditions []coa.Rendition) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img, ok := d.images[imageID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	d.setRenditions(imageID, renditions)
+
+	for _, r := range renditions {
+		switch r.Name {
+		case coa.RenditionLarge:
+			img.urlLarge = urlString(r.URL)
+		case coa.RenditionMedium:
+			img.urlMedium = urlString(r.URL)
+		case coa.RenditionSmall:
+			img.urlSmall = urlString(r.URL)
+		}
+	}
+
+	d.images[imageID] = img
+	return nil
+}
+
+// setRenditions adds renditions to an image or replaces existing ones with the same name.
+func (d *memDatabase) setRenditions(imageID int64, renditions []coa.Rendition) {
+	if len(renditions) == 0 {
+		return
+	}
+
+	if d.renditions[imageID] == nil {
+		d.renditions[imageID] = make(map[string]rendition)
+	}
+
+	for _, r := range renditions {
+		d.renditions[imageID][r.Name] = rendition{
+			name:   r.Name,
+			url:    urlString(r.URL),
+			width:  r.Width,
+			height: r.Height,
+			size:   r.Size,
+			format: r.Format,
+		}
+	}
+}
+
+func (d *memDatabase) InsertPost(_ context.Context, image coa.Image, platform coa.Platform) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	posts, ok := d.posts[platform]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if _, ok := d.images[image.ID]; !ok {
+		return fmt.Errorf("image %d does not exist", image.ID)
+	}
+
+	if posts[image.ID] {
+		return fmt.Errorf("image %d has already been posted on %s", image.ID, platform)
+	}
+
+	posts[image.ID] = true
+	return nil
+}
+
+func (d *memDatabase) GetPlaceAliases(_ context.Context) ([]coa.PlaceAlias, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var aliases []coa.PlaceAlias
+	for _, a := range d.aliases {
+		aliases = append(aliases, a)
+	}
+
+	sort.Slice(aliases, func(i, j int) bool {
+		if aliases[i].Priority == aliases[j].Priority {
+			return aliases[i].ID < aliases[j].ID
+		}
+		return aliases[i].Priority > aliases[j].Priority
+	})
+	return aliases, nil
+}
+
+func (d *memDatabase) InsertPlaceAlias(_ context.Context, alias coa.PlaceAlias) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, a := range d.aliases {
+		if a.ComponentType == alias.ComponentType && a.ComponentName == alias.ComponentName && a.Country == alias.Country {
+			return 0, fmt.Errorf(
+				"place alias for component type %s, name '%s' and country '%s' already exists",
+				alias.ComponentType,
+				alias.ComponentName,
+				alias.Country,
+			)
+		}
+	}
+
+	alias.ID = d.nextID("place_aliases")
+	d.aliases[alias.ID] = alias
+	return alias.ID, nil
+}
+
+func (d *memDatabase) DeletePlaceAlias(_ context.Context, id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.aliases[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(d.aliases, id)
+	return nil
+}
+
+func (d *memDatabase) GetPrivacyZones(_ context.Context) ([]coa.PrivacyZone, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var zones []coa.PrivacyZone
+	for _, z := range d.zones {
+		z.Polygon = slices.Clone(z.Polygon)
+		zones = append(zones, z)
+	}
+
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].ID < zones[j].ID
+	})
+	return zones, nil
+}
+
+func (d *memDatabase) InsertPrivacyZone(_ context.Context, zone coa.PrivacyZone) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, z := range d.zones {
+		if z.Name == zone.Name {
+			return 0, fmt.Errorf("privacy zone %s already exists", zone.Name)
+		}
+	}
+
+	zone.ID = d.nextID("privacy_zones")
+	zone.Polygon = slices.Clone(zone.Polygon)
+	d.zones[zone.ID] = zone
+	return zone.ID, nil
+}
+
+func (d *memDatabase) DeletePrivacyZone(_ context.Context, id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.zones[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(d.zones, id)
+	return nil
+}
+
+func (d *memDatabase) SetImageHidden(_ context.Context, id int64, hidden bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img, ok := d.images[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	img.hidden = hidden
+	d.images[id] = img
+	return nil
+}
+
+func (d *memDatabase) DeleteImage(_ context.Context, id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img, ok := d.images[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	for _, posts := range d.posts {
+		delete(posts, id)
+	}
+	delete(d.images, id)
+	delete(d.imageTags, id)
+	delete(d.renditions, id)
+	for _, images := range d.catImages {
+		delete(images, id)
+	}
+
+	for _, other := range d.images {
+		if other.coordinateID == img.coordinateID {
+			return nil
+		}
+	}
+
+	locationID := d.coordinates[img.coordinateID].locationID
+	delete(d.coordinates, img.coordinateID)
+
+	for _, c := range d.coordinates {
+		if c.locationID == locationID {
+			return nil
+		}
+	}
+
+	delete(d.locations, locationID)
+	return nil
+}
+
+func (d *memDatabase) GetTags(_ context.Context) ([]coa.Tag, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, tags := range d.imageTags {
+		for tag := range tags {
+			counts[tag]++
+		}
+	}
+
+	var tags []coa.Tag
+	for name, controlled := range d.tags {
+		tags = append(tags, coa.Tag{Name: name, Controlled: controlled, Images: counts[name]})
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	return tags, nil
+}
+
+// CreateTag creates a tag or changes whether an existing tag is controlled.
+func (d *memDatabase) CreateTag(_ context.Context, name string, controlled bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tags[name] = controlled
+	return nil
+}
+
+func (d *memDatabase) DeleteTag(_ context.Context, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.tags[name]; !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(d.tags, name)
+	for _, tags := range d.imageTags {
+		delete(tags, name)
+	}
+	return nil
+}
+
+// TagImages adds tags to images. Tags that don't exist yet are created as free-form tags.
+func (d *memDatabase) TagImages(_ context.Context, imageIDs []int64, tags []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, id := range imageIDs {
+		if _, ok := d.images[id]; !ok {
+			return fmt.Errorf("image %d does not exist", id)
+		}
+	}
+
+	for _, tag := range tags {
+		if _, ok := d.tags[tag]; !ok {
+			d.tags[tag] = false
+		}
+	}
+
+	for _, id := range imageIDs {
+		if d.imageTags[id] == nil {
+			d.imageTags[id] = make(map[string]bool)
+		}
+
+		for _, tag := range tags {
+			d.imageTags[id][tag] = true
+		}
+	}
+	return nil
+}
+
+func (d *memDatabase) UntagImages(_ context.Context, imageIDs []int64, tags []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, id := range imageIDs {
+		for _, tag := range tags {
+			delete(d.imageTags[id], tag)
+		}
+	}
+	return nil
+}
+
+func (d *memDatabase) GetCats(_ context.Context) ([]coa.Cat, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var cats []coa.Cat
+	for _, c := range d.cats {
+		cats = append(cats, d.toCat(c))
+	}
+
+	sort.Slice(cats, func(i, j int) bool {
+		if cats[i].Name == cats[j].Name {
+			return cats[i].ID < cats[j].ID
+		}
+		return cats[i].Name < cats[j].Name
+	})
+	return cats, nil
+}
+
+func (d *memDatabase) GetCat(_ context.Context, id int64) (coa.Cat, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.cats[id]
+	if !ok {
+		return coa.Cat{}, sql.ErrNoRows
+	}
+	return d.toCat(c), nil
+}
+
+func (d *memDatabase) GetSightings(_ context.Context, catID int64) ([]coa.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sightings := d.sightings(catID)
+	sort.SliceStable(sightings, func(i, j int) bool {
+		return sightings[i].timestamp.Before(sightings[j].timestamp)
+	})
+
+	var images []coa.Image
+	for _, img := range sightings {
+		i, err := d.toImage(img)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, i)
+	}
+	return images, nil
+}
+
+func (d *memDatabase) InsertCat(_ context.Context, c coa.Cat) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id := d.nextID("cats")
+	d.cats[id] = cat{id, c.Name, c.Description}
+	d.catImages[id] = make(map[int64]bool)
+	return id, nil
+}
+
+func (d *memDatabase) MergeCats(_ context.Context, targetID int64, sourceIDs []int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.cats[targetID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	// everything is checked first, since there is no transaction to roll back
+	for idx, sourceID := range sourceIDs {
+		if sourceID == targetID {
+			return fmt.Errorf("unable to merge cat %d with itself", targetID)
+		}
+
+		if _, ok := d.cats[sourceID]; !ok || slices.Contains(sourceIDs[:idx], sourceID) {
+			return sql.ErrNoRows
+		}
+	}
+
+	for _, sourceID := range sourceIDs {
+		for id := range d.catImages[sourceID] {
+			d.catImages[targetID][id] = true
+		}
+
+		delete(d.cats, sourceID)
+		delete(d.catImages, sourceID)
+	}
+	return nil
+}
+
+func (d *memDatabase) UpdateCatImages(_ context.Context, catID int64, attach, detach []int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.cats[catID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	for _, id := range attach {
+		if _, ok := d.images[id]; !ok {
+			return sql.ErrNoRows
+		}
+	}
+
+	for _, id := range detach {
+		delete(d.catImages[catID], id)
+	}
+
+	for _, id := range attach {
+		d.catImages[catID][id] = true
+	}
+	return nil
+}
+
+func (d *memDatabase) InsertJob(_ context.Context, j coa.Job) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	id := d.nextID("jobs")
+
+	d.jobs[id] = job{
+		Job: coa.Job{
+			ID:         id,
+			FileName:   j.FileName,
+			StorageKey: j.StorageKey,
+			State:      coa.JobQueued,
+			RunAt:      now,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+	}
+	return id, nil
+}
+
+func (d *memDatabase) ClaimJob(_ context.Context, lease time.Duration, maxAttempts int) (coa.Job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	var claimed *job
+
+	for id := range d.jobs {
+		j := d.jobs[id]
+		expired := j.State == coa.JobRunning && j.lockedUntil.Before(now)
+
+		if expired && j.Attempts >= maxAttempts {
+			j.State = coa.JobFailed
+			j.LastError = coa.JobAbandoned
+			j.lockedUntil = time.Time{}
+			j.UpdatedAt = now
+			d.jobs[id] = j
+			continue
+		}
+
+		due := (j.State == coa.JobQueued && !j.RunAt.After(now)) || expired
+		if !due {
+			continue
+		}
+
+		if claimed == nil || j.RunAt.Before(claimed.RunAt) || (j.RunAt.Equal(claimed.RunAt) && j.ID < claimed.ID) {
+			claimed = &j
+		}
+	}
+
+	if claimed == nil {
+		return coa.Job{}, sql.ErrNoRows
+	}
+
+	claimed.State = coa.JobRunning
+	claimed.Attempts++
+	claimed.Claim++
+	claimed.lockedUntil = now.Add(lease)
+	claimed.UpdatedAt = now
+	d.jobs[claimed.ID] = *claimed
+	return claimed.Job, nil
+}
+
+func (d *memDatabase) CompleteJob(_ context.Context, claimed coa.Job) error {
+	return d.updateJob(claimed, func(j *job) {
+		j.State = coa.JobDone
+	})
+}
+
+func (d *memDatabase) RetryJob(_ context.Context, claimed coa.Job, lastError string, runAt time.Time) error {
+	return d.updateJob(claimed, func(j *job) {
+		j.State = coa.JobQueued
+		j.LastError = lastError
+		j.RunAt = runAt.UTC()
+	})
+}
+
+func (d *memDatabase) FailJob(_ context.Context, claimed coa.Job, lastError string) error {
+	return d.updateJob(claimed, func(j *job) {
+		j.State = coa.JobFailed
+		j.LastError = lastError
+	})
+}
+
+func (d *memDatabase) ReleaseJob(_ context.Context, claimed coa.Job) error {
+	return d.updateJob(claimed, func(j *job) {
+		j.State = coa.JobQueued
+		j.Attempts = max(j.Attempts-1, 0)
+	})
+}
+
+// updateJob applies update to a job and releases it, if it is still claimed as claimed.
+func (d *memDatabase) updateJob(claimed coa.Job, update func(j *job)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	j, ok := d.jobs[claimed.ID]
+	if !ok || j.Claim != claimed.Claim || j.State != coa.JobRunning {
+		return sql.ErrNoRows
+	}
+
+	update(&j)
+	j.lockedUntil = time.Time{}
+	j.UpdatedAt = time.Now().UTC()
+	d.jobs[claimed.ID] = j
+	return nil
+}
+
+func (d *memDatabase) GetJobs(_ context.Context) ([]coa.Job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var jobs []coa.Job
+	for _, j := range d.jobs {
+		jobs = append(jobs, j.Job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID > jobs[j].ID
+	})
+	return jobs, nil
+}
+
+// GetPerceptualHashes returns the perceptual hashes of all images by image ID, including hidden images. Images
+// without a hash are left out.
+func (d *memDatabase) GetPerceptualHashes(_ context.Context) (map[int64]uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hashes := make(map[int64]uint64)
+	for _, img := range d.images {
+		if img.phash != 0 {
+			hashes[img.id] = img.phash
+		}
+	}
+	return hashes, nil
+}
+
+func (d *memDatabase) Close() error {
+	return nil
+}
+
+func (d *memDatabase) unusedImages(platform coa.Platform) []image {
+	var unused []image
+	for _, img := range d.sortedImages() {
+		if !img.hidden && !d.posts[platform][img.id] {
+			unused = append(unused, img)
+		}
+	}
+	return unused
+}
+
+// sightings returns the visible images of a cat, ordered by ID.
+func (d *memDatabase) sightings(catID int64) []image {
+	var images []image
+	for _, img := range d.sortedImages() {
+		if !img.hidden && d.catImages[catID][img.id] {
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+func (d *memDatabase) toCat(c cat) coa.Cat {
+	result := coa.Cat{ID: c.id, Name: c.name, Description: c.description}
+
+	for _, img := range d.sightings(c.id) {
+		if result.Sightings == 0 || img.timestamp.Before(result.FirstSeen) {
+			result.FirstSeen = img.timestamp
+		}
+		if result.Sightings == 0 || img.timestamp.After(result.LastSeen) {
+			result.LastSeen = img.timestamp
+		}
+		result.Sightings++
+	}
+	return result
+}
+
+func (d *memDatabase) hasImage(sha256 string) bool {
+	for _, img := range d.images {
+		if img.sha256 == sha256 {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *memDatabase) findCoordinates(latitude, longitude float64) (coordinates, bool) {
+	for _, c := range d.coordinates {
+		if c.latitude == latitude && c.longitude == longitude {
+			return c, true
+		}
+	}
+	return coordinates{}, false
+}
+
+// sortedImages returns all images ordered by ID, so that results don't depend on the iteration order of maps.
+func (d *memDatabase) sortedImages() []image {
+	images := make([]image, 0, len(d.images))
+	for _, img := range d.images {
+		images = append(images, img)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].id < images[j].id
+	})
+	return images
+}
+
+func (d *memDatabase) nextID(table string) int64 {
+	d.lastIDs[table]++
+	return d.lastIDs[table]
+}
+
+func (d *memDatabase) toImage(img image) (coa.Image, error) {
+	c := d.coordinates[img.coordinateID]
+	l := d.locations[c.locationID]
+
+	i := coa.Image{
+		ID:        img.id,
+		SHA256:    img.sha256,
+		Timestamp: img.timestamp,
+		Timezone:  l.timezone,
+		Latitude:  c.latitude,
+		Longitude: c.longitude,
+		City:      l.city,
+		Country:   l.country,
+		Hidden:    img.hidden,
+		PHash:     img.phash,
+		Format:    img.format,
+	}
+
+	for tag := range d.imageTags[img.id] {
+		i.Tags = append(i.Tags, tag)
+	}
+	sort.Strings(i.Tags)
+
+	for _, r := range d.renditions[img.id] {
+		u, err := url.Parse(r.url)
+		if err != nil {
+			return i, err
+		}
+
+		i.Renditions = append(i.Renditions, coa.Rendition{
+			Name:   r.name,
+			URL:    u,
+			Width:  r.width,
+			Height: r.height,
+			Size:   r.size,
+			Format: r.format,
+		})
+	}
+
+	// same order as the SQL databases
+	sort.Slice(i.Renditions, func(a, b int) bool {
+		ra, rb := i.Renditions[a], i.Renditions[b]
+		if ra.Width != rb.Width {
+			return ra.Width < rb.Width
+		}
+		return ra.Name < rb.Name
+	})
+
+	var err error
+	if i.URLLarge, err = url.Parse(img.urlLarge); err != nil {
+		return i, err
+	}
+	if i.URLMedium, err = url.Parse(img.urlMedium); err != nil {
+		return i, err
+	}
+	if i.URLSmall, err = url.Parse(img.urlSmall); err != nil {
+		return i, err
+	}
+
+	loc, err := time.LoadLocation(i.Timezone)
+	if err != nil {
+		return i, err
+	}
+
+	i.Timestamp = i.Timestamp.In(loc)
+	return i, nil
+}
+
+// toTimestamp mimics storing a time.Time in a PostgreSQL TIMESTAMP column, which drops the time zone and keeps
+// microsecond precision.
+func toTimestamp(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC).
+		Truncate(time.Microsecond)
+}
+
+// formatOf returns the format of the original file of an image, like the default value of the format column in the
+// SQL databases.
+func formatOf(img coa.Image) string {
+	if img.Format == "" {
+		return coa.FormatJPEG
+	}
+	return img.Format
+}
+
+func urlString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
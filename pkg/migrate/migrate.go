@@ -0,0 +1,317 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package migrate applies and reverts SQL migrations. It keeps track of the schema version in the same
+// schema_migrations table as golang-migrate, so databases that have been migrated with the migrate CLI can be used
+// as is.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrDirty = errors.New("database is in dirty state")
+	// ErrTooNew means that the database has been migrated by a newer version of the code.
+	ErrTooNew = errors.New("database schema is newer than the latest migration")
+)
+
+// Migration is a pair of up and down migration files with the same version.
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is the state of a database in regard to the available migrations.
+type Status struct {
+	// Version is the version of the last applied migration. Zero if none have been applied.
+	Version uint64
+	// Dirty is true if a migration failed halfway. This needs to be fixed manually.
+	Dirty bool
+	// Pending contains the migrations that have not been applied yet.
+	Pending []Migration
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New creates a Migrator for the migrations in fsys. File names need to follow the pattern used by golang-migrate, e.g.
+// "20230918141811_init_schema.up.sql".
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db, migrations}, nil
+}
+
+// Latest returns the version of the newest migration.
+func (m *Migrator) Latest() uint64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	version, dirty, err := m.version(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+
+	status := Status{Version: version, Dirty: dirty}
+	for _, mig := range m.migrations {
+		if mig.Version > version {
+			status.Pending = append(status.Pending, mig)
+		}
+	}
+	return status, nil
+}
+
+// Check returns an error if the database is not at the latest version. It doesn't change the database.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, dirty, err := m.version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		return fmt.Errorf("%w at version %d", ErrDirty, version)
+	}
+
+	if version > m.Latest() {
+		return fmt.Errorf(
+			"%w: the database is at version %d, but this binary only knows versions up to %d. deploy a newer one",
+			ErrTooNew,
+			version,
+			m.Latest(),
+		)
+	}
+
+	if version != m.Latest() {
+		return fmt.Errorf(
+			"database schema is at version %d, but version %d is required. run 'admin migrate up' to update it",
+			version,
+			m.Latest(),
+		)
+	}
+	return nil
+}
+
+// Up applies all pending migrations and returns them.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.createTable(ctx); err != nil {
+		return nil, err
+	}
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if status.Dirty {
+		return nil, fmt.Errorf("%w at version %d", ErrDirty, status.Version)
+	}
+
+	if status.Version > m.Latest() {
+		return nil, fmt.Errorf("%w: version %d is newer than %d", ErrTooNew, status.Version, m.Latest())
+	}
+
+	for idx, mig := range status.Pending {
+		if err := m.run(ctx, mig.Version, mig.Up); err != nil {
+			return status.Pending[:idx], fmt.Errorf("migration %d_%s failed: %w", mig.Version, mig.Name, err)
+		}
+	}
+	return status.Pending, nil
+}
+
+// Down reverts the given number of migrations, starting with the latest applied one, and returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if err := m.createTable(ctx); err != nil {
+		return nil, err
+	}
+
+	version, dirty, err := m.version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if dirty {
+		return nil, fmt.Errorf("%w at version %d", ErrDirty, version)
+	}
+
+	var reverted []Migration
+
+	for idx := len(m.migrations) - 1; idx >= 0 && len(reverted) < steps; idx-- {
+		mig := m.migrations[idx]
+		if mig.Version > version {
+			continue
+		}
+
+		if mig.Version != version {
+			return reverted, fmt.Errorf("no migration found for version %d", version)
+		}
+
+		var previous uint64
+		if idx > 0 {
+			previous = m.migrations[idx-1].Version
+		}
+
+		if err := m.run(ctx, previous, mig.Down); err != nil {
+			return reverted, fmt.Errorf("reverting migration %d_%s failed: %w", mig.Version, mig.Name, err)
+		}
+
+		reverted = append(reverted, mig)
+		version = previous
+	}
+	return reverted, nil
+}
+
+// run executes a migration and sets the version afterwards. Like golang-migrate, migrations are not wrapped in a
+// transaction, since some of them manage transactions themselves. The database is marked dirty until the migration
+// has succeeded.
+func (m *Migrator) run(ctx context.Context, version uint64, query string) error {
+	if err := m.setVersion(ctx, version, true); err != nil {
+		return err
+	}
+
+	if _, err := m.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	return m.setVersion(ctx, version, false)
+}
+
+// createTable creates the schema_migrations table, unless it exists already.
+func (m *Migrator) createTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(
+		ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)",
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// version reads the schema version without changing the database, so that it works with read-only users. A database
+// without the schema_migrations table is at version zero.
+func (m *Migrator) version(ctx context.Context) (uint64, bool, error) {
+	var version uint64
+	var dirty bool
+
+	row := m.db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1")
+	if err := row.Scan(&version, &dirty); err != nil && !errors.Is(err, sql.ErrNoRows) && !isMissingTable(err) {
+		return 0, false, fmt.Errorf("unable to read schema version: %w", err)
+	}
+	return version, dirty, nil
+}
+
+// isMissingTable checks whether err is the error Postgres or SQLite return when the schema_migrations table doesn't
+// exist. Neither driver has a dedicated error value for that.
+func isMissingTable(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "schema_migrations") &&
+		(strings.Contains(msg, "does not exist") || strings.Contains(msg, "no such table"))
+}
+
+// setVersion stores the schema version. Zero means no migration has been applied.
+func (m *Migrator) setVersion(ctx context.Context, version uint64, dirty bool) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+
+	if version > 0 {
+		_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)", version, dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func load(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint64]*Migration)
+
+	for _, p := range paths {
+		base := path.Base(p)
+		v, rest, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid migration file name %s", base)
+		}
+
+		name, direction, ok := strings.Cut(strings.TrimSuffix(rest, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %s", base)
+		}
+
+		content, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: name}
+			byVersion[version] = mig
+		}
+
+		if direction == "up" {
+			mig.Up = string(content)
+		} else {
+			mig.Down = string(content)
+		}
+	}
+
+	var migrations []Migration
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
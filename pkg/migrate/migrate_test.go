@@ -0,0 +1,108 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/haikoschol/cats-of-asia/pkg/migrate"
+	"github.com/haikoschol/cats-of-asia/pkg/sqlite"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func migrations(versions ...string) fstest.MapFS {
+	fsys := make(fstest.MapFS)
+	for _, v := range versions {
+		fsys[v+"_table.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE t" + v + " (id INTEGER)")}
+		fsys[v+"_table.down.sql"] = &fstest.MapFile{Data: []byte("DROP TABLE t" + v)}
+	}
+	return fsys
+}
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "coa.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newMigrator(t *testing.T, db *sql.DB, versions ...string) *migrate.Migrator {
+	m, err := migrate.New(db, migrations(versions...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCheckDoesNotChangeDatabase(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	if err := newMigrator(t, db, "1").Check(ctx); err == nil {
+		t.Fatal("Check() succeeded for a database without migrations")
+	}
+
+	var tables int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("Check() created %d tables", tables)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	if _, err := newMigrator(t, db, "1", "2").Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newMigrator(t, db, "1", "2").Check(ctx); err != nil {
+		t.Errorf("Check() failed for a database at the latest version: %v", err)
+	}
+
+	err := newMigrator(t, db, "1", "2", "3").Check(ctx)
+	if err == nil || errors.Is(err, migrate.ErrTooNew) {
+		t.Errorf("expected an error about pending migrations, got %v", err)
+	}
+
+	if err := newMigrator(t, db, "1").Check(ctx); !errors.Is(err, migrate.ErrTooNew) {
+		t.Errorf("expected ErrTooNew for a database that is newer than the migrations, got %v", err)
+	}
+
+	if _, err := newMigrator(t, db, "1").Up(ctx); !errors.Is(err, migrate.ErrTooNew) {
+		t.Errorf("expected ErrTooNew from Up() for a database that is newer than the migrations, got %v", err)
+	}
+}
+
+func TestStatusWithoutTable(t *testing.T) {
+	status, err := newMigrator(t, openDB(t), "1", "2").Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Version != 0 || status.Dirty || len(status.Pending) != 2 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
@@ -17,9 +17,13 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/migrations"
+	"github.com/haikoschol/cats-of-asia/pkg/migrate"
 	"github.com/lib/pq"
 	"net/url"
 	"time"
@@ -38,18 +42,36 @@ type pgDatabase struct {
 	db *sql.DB
 }
 
+// NewDatabase connects to Postgres and makes sure the schema is at the version of the embedded migrations.
 func NewDatabase(dbUser, dbPassword, dbHost, dbName string, dbSSLMode SSLMode) (coa.Database, error) {
-	dbURL := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s", dbUser, dbPassword, dbHost, dbName, dbSSLMode)
-	db, err := sql.Open("postgres", dbURL)
+	db, err := Open(dbUser, dbPassword, dbHost, dbName, dbSSLMode)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := migrate.New(db, migrations.Postgres)
 	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := m.Check(context.Background()); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return &pgDatabase{db}, nil
 }
 
-func (d *pgDatabase) GetOrCreateLocation(city, country, timezone string) (int64, error) {
-	_, err := d.db.Exec(
+// Open connects to Postgres without checking the schema version, e.g. for running migrations.
+func Open(dbUser, dbPassword, dbHost, dbName string, dbSSLMode SSLMode) (*sql.DB, error) {
+	dbURL := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s", dbUser, dbPassword, dbHost, dbName, dbSSLMode)
+	return sql.Open("postgres", dbURL)
+}
+
+func (d *pgDatabase) GetOrCreateLocation(ctx context.Context, city, country, timezone string) (int64, error) {
+	_, err := d.db.ExecContext(
+		ctx,
 		`INSERT INTO
     			locations(city, country, timezone)
 			VALUES
@@ -63,7 +85,7 @@ func (d *pgDatabase) GetOrCreateLocation(city, country, timezone string) (int64,
 		return 0, err
 	}
 
-	row := d.db.QueryRow("SELECT id FROM locations WHERE city = $1 and country = $2", city, country)
+	row := d.db.QueryRowContext(ctx, "SELECT id FROM locations WHERE city = $1 and country = $2", city, country)
 	var id int64
 	err = row.Scan(&id)
 	if err != nil {
@@ -72,8 +94,13 @@ func (d *pgDatabase) GetOrCreateLocation(city, country, timezone string) (int64,
 	return id, nil
 }
 
-func (d *pgDatabase) GetOrCreateCoordinates(latitude, longitude float64, locationId int64) (int64, error) {
-	_, err := d.db.Exec(
+func (d *pgDatabase) GetOrCreateCoordinates(
+	ctx context.Context,
+	latitude, longitude float64,
+	locationId int64,
+) (int64, error) {
+	_, err := d.db.ExecContext(
+		ctx,
 		`INSERT INTO
     			coordinates(latitude, longitude, location_id)
 			VALUES
@@ -87,7 +114,12 @@ func (d *pgDatabase) GetOrCreateCoordinates(latitude, longitude float64, locatio
 		return 0, err
 	}
 
-	row := d.db.QueryRow("SELECT id FROM coordinates WHERE latitude = $1 and longitude = $2", latitude, longitude)
+	row := d.db.QueryRowContext(
+		ctx,
+		"SELECT id FROM coordinates WHERE latitude = $1 and longitude = $2",
+		latitude,
+		longitude,
+	)
 	var id int64
 	err = row.Scan(&id)
 	if err != nil {
@@ -96,15 +128,35 @@ func (d *pgDatabase) GetOrCreateCoordinates(latitude, longitude float64, locatio
 	return id, nil
 }
 
-func (d *pgDatabase) GetCoordinateID(latitude, longitude float64) (int64, error) {
-	row := d.db.QueryRow("SELECT id FROM coordinates WHERE latitude = $1 AND longitude = $2", latitude, longitude)
+func (d *pgDatabase) GetCoordinateID(ctx context.Context, latitude, longitude float64) (int64, error) {
+	row := d.db.QueryRowContext(
+		ctx,
+		"SELECT id FROM coordinates WHERE latitude = $1 AND longitude = $2",
+		latitude,
+		longitude,
+	)
 	var id int64
 	err := row.Scan(&id)
 	return id, err
 }
 
-func (d *pgDatabase) GetImage(id int64) (coa.Image, error) {
-	row := d.db.QueryRow(`
+func (d *pgDatabase) GetKnownLocation(ctx context.Context, latitude, longitude float64) (coa.KnownLocation, error) {
+	row := d.db.QueryRowContext(
+		ctx,
+		`SELECT c.id, l.city, l.country, l.timezone
+		FROM coordinates AS c
+		JOIN locations AS l ON c.location_id = l.id
+		WHERE c.latitude = $1 AND c.longitude = $2`,
+		latitude,
+		longitude,
+	)
+	var loc coa.KnownLocation
+	err := row.Scan(&loc.CoordinateID, &loc.City, &loc.Country, &loc.Timezone)
+	return loc, err
+}
+
+func (d *pgDatabase) GetImage(ctx context.Context, id int64) (coa.Image, error) {
+	row := d.db.QueryRowContext(ctx, `
 		SELECT 
 			i.id AS image_id,
 			i.url_large,
@@ -116,7 +168,10 @@ func (d *pgDatabase) GetImage(id int64) (coa.Image, error) {
 			c.longitude,
 			l.city,
 			l.country,
-			l.timezone
+			l.timezone,
+			i.hidden,
+			i.phash,
+			i.format
 		FROM images AS i
 		JOIN coordinates AS c ON i.coordinate_id = c.id
 		JOIN locations AS l ON c.location_id = l.id
@@ -125,6 +180,7 @@ func (d *pgDatabase) GetImage(id int64) (coa.Image, error) {
 
 	var img coa.Image
 	var ul, um, us string
+	var phash sql.NullInt64
 
 	err := row.Scan(
 		&img.ID,
@@ -137,12 +193,18 @@ func (d *pgDatabase) GetImage(id int64) (coa.Image, error) {
 		&img.Longitude,
 		&img.City,
 		&img.Country,
-		&img.Timezone)
+		&img.Timezone,
+		&img.Hidden,
+		&phash,
+		&img.Format)
 
 	if err != nil {
 		return img, err
 	}
 
+	// the bits are stored as a signed integer
+	img.PHash = uint64(phash.Int64)
+
 	img.URLLarge, err = url.Parse(ul)
 	if err != nil {
 		return img, err
@@ -158,11 +220,32 @@ func (d *pgDatabase) GetImage(id int64) (coa.Image, error) {
 		return img, err
 	}
 
-	return fixTimezone(img)
+	img, err = fixTimezone(img)
+	if err != nil {
+		return img, err
+	}
+
+	images := []coa.Image{img}
+	err = d.loadRelated(ctx, images)
+	return images[0], err
+}
+
+func (d *pgDatabase) GetImageBySHA256(ctx context.Context, sha256 string) (coa.Image, error) {
+	var id int64
+	if err := d.db.QueryRowContext(ctx, "SELECT id FROM images WHERE sha256 = $1", sha256).Scan(&id); err != nil {
+		return coa.Image{}, err
+	}
+	return d.GetImage(ctx, id)
+}
+
+func (d *pgDatabase) GetImages(ctx context.Context) ([]coa.Image, error) {
+	return d.queryImages(ctx, "WHERE NOT i.hidden")
 }
 
-func (d *pgDatabase) GetImages() ([]coa.Image, error) {
-	rows, err := d.db.Query(`
+// queryImages selects images with all their columns. The rest of the query after the FROM clause, which can contain
+// further joins, is given by conditions.
+func (d *pgDatabase) queryImages(ctx context.Context, conditions string, args ...any) ([]coa.Image, error) {
+	rows, err := d.db.QueryContext(ctx, `
 		SELECT 
 			i.id AS image_id,
 			i.url_large,
@@ -174,17 +257,24 @@ func (d *pgDatabase) GetImages() ([]coa.Image, error) {
 			c.longitude,
 			l.city,
 			l.country,
-			l.timezone
+			l.timezone,
+			i.hidden,
+			i.phash,
+			i.format
 		FROM images AS i
 		JOIN coordinates AS c ON i.coordinate_id = c.id
-		JOIN locations AS l ON c.location_id = l.id`)
+		JOIN locations AS l ON c.location_id = l.id
+		`+conditions,
+		args...)
 
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var images []coa.Image
 	var ul, um, us string
+	var phash sql.NullInt64
 
 	for rows.Next() {
 		var img coa.Image
@@ -200,12 +290,18 @@ func (d *pgDatabase) GetImages() ([]coa.Image, error) {
 			&img.Longitude,
 			&img.City,
 			&img.Country,
-			&img.Timezone)
+			&img.Timezone,
+			&img.Hidden,
+			&phash,
+			&img.Format)
 
 		if err != nil {
 			return nil, err
 		}
 
+		// the bits are stored as a signed integer
+		img.PHash = uint64(phash.Int64)
+
 		img.URLLarge, err = url.Parse(ul)
 		if err != nil {
 			return nil, err
@@ -228,11 +324,18 @@ func (d *pgDatabase) GetImages() ([]coa.Image, error) {
 		images = append(images, img)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := d.loadRelated(ctx, images); err != nil {
+		return nil, err
+	}
 	return images, nil
 }
 
-func (d *pgDatabase) GetRandomUnusedImage(platform coa.Platform) (coa.Image, error) {
-	row := d.db.QueryRow(`
+func (d *pgDatabase) GetRandomUnusedImage(ctx context.Context, platform coa.Platform) (coa.Image, error) {
+	row := d.db.QueryRowContext(ctx, `
 		SELECT 
 			i.id AS image_id,
 			i.url_large,
@@ -244,11 +347,14 @@ func (d *pgDatabase) GetRandomUnusedImage(platform coa.Platform) (coa.Image, err
 			c.longitude,
 			l.city,
 			l.country,
-			l.timezone
+			l.timezone,
+			i.hidden,
+			i.phash,
+			i.format
 		FROM images AS i
 		JOIN coordinates AS c ON i.coordinate_id = c.id
 		JOIN locations AS l ON c.location_id = l.id
-		WHERE i.id NOT IN (
+		WHERE NOT i.hidden AND i.id NOT IN (
 			SELECT image_id FROM posts where platform_id = (SELECT id FROM platforms WHERE name = $1)
 	    )
 		ORDER BY random()
@@ -257,6 +363,7 @@ func (d *pgDatabase) GetRandomUnusedImage(platform coa.Platform) (coa.Image, err
 
 	var img coa.Image
 	var ul, um, us string
+	var phash sql.NullInt64
 
 	err := row.Scan(
 		&img.ID,
@@ -269,12 +376,18 @@ func (d *pgDatabase) GetRandomUnusedImage(platform coa.Platform) (coa.Image, err
 		&img.Longitude,
 		&img.City,
 		&img.Country,
-		&img.Timezone)
+		&img.Timezone,
+		&img.Hidden,
+		&phash,
+		&img.Format)
 
 	if err != nil {
 		return img, err
 	}
 
+	// the bits are stored as a signed integer
+	img.PHash = uint64(phash.Int64)
+
 	img.URLLarge, err = url.Parse(ul)
 	if err != nil {
 		return img, err
@@ -290,15 +403,22 @@ func (d *pgDatabase) GetRandomUnusedImage(platform coa.Platform) (coa.Image, err
 		return img, err
 	}
 
-	return fixTimezone(img)
+	img, err = fixTimezone(img)
+	if err != nil {
+		return img, err
+	}
+
+	images := []coa.Image{img}
+	err = d.loadRelated(ctx, images)
+	return images[0], err
 }
 
-func (d *pgDatabase) GetUnusedImageCount(platform coa.Platform) (int, error) {
-	row := d.db.QueryRow(`
+func (d *pgDatabase) GetUnusedImageCount(ctx context.Context, platform coa.Platform) (int, error) {
+	row := d.db.QueryRowContext(ctx, `
 		SELECT 
 			COUNT(id)
 		FROM images
-		WHERE id NOT IN (
+		WHERE NOT hidden AND id NOT IN (
 			SELECT image_id FROM posts where platform_id = (SELECT id FROM platforms WHERE name = $1)
 	    )
 		ORDER BY random()
@@ -310,14 +430,14 @@ func (d *pgDatabase) GetUnusedImageCount(platform coa.Platform) (int, error) {
 	return count, err
 }
 
-func (d *pgDatabase) RemoveKnownImages(images []coa.Image) ([]coa.Image, error) {
+func (d *pgDatabase) RemoveKnownImages(ctx context.Context, images []coa.Image) ([]coa.Image, error) {
 	var hashes []string
 
 	for _, img := range images {
 		hashes = append(hashes, img.SHA256)
 	}
 
-	rows, err := d.db.Query(`SELECT url_large, sha256 FROM images WHERE sha256 = ANY($1)`, pq.Array(hashes))
+	rows, err := d.db.QueryContext(ctx, `SELECT url_large, sha256 FROM images WHERE sha256 = ANY($1)`, pq.Array(hashes))
 	if err != nil {
 		return nil, err
 	}
@@ -347,49 +467,361 @@ func (d *pgDatabase) RemoveKnownImages(images []coa.Image) ([]coa.Image, error)
 	return filtered, nil
 }
 
-func (d *pgDatabase) InsertImages(images []coa.Image) error {
+// InsertImages inserts all images in a single transaction. Locations and coordinates are created as needed for images
+// without a CoordinateID. Each table is written with a single statement, regardless of the number of images.
+func (d *pgDatabase) InsertImages(ctx context.Context, images []coa.Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	locationIDs, err := insertLocations(ctx, tx, images)
+	if err != nil {
+		return fmt.Errorf("unable to insert locations: %w", err)
+	}
+
+	coordinateIDs, err := insertCoordinates(ctx, tx, images, locationIDs)
+	if err != nil {
+		return fmt.Errorf("unable to insert coordinates: %w", err)
+	}
+
+	var urlsLarge, urlsMedium, urlsSmall, hashes, timestamps []string
+	var coordIDs []int64
+	var phashes []sql.NullInt64
+	var formats []string
+
 	for _, img := range images {
-		if img.CoordinateID == nil {
-			locId, err := d.GetOrCreateLocation(img.City, img.Country, img.Timezone)
-			if err != nil {
-				return err
-			}
+		coordID, ok := coordinateIDs[coordinatesOf(img)]
+		if img.CoordinateID != nil {
+			coordID, ok = *img.CoordinateID, true
+		}
+		if !ok {
+			return fmt.Errorf("no coordinates found for image %s", img.SHA256)
+		}
 
-			coordId, err := d.GetOrCreateCoordinates(img.Latitude, img.Longitude, locId)
-			if err != nil {
-				return err
-			}
+		urlsLarge = append(urlsLarge, img.URLLarge.String())
+		urlsMedium = append(urlsMedium, img.URLMedium.String())
+		urlsSmall = append(urlsSmall, img.URLSmall.String())
+		hashes = append(hashes, img.SHA256)
+		// the offset is dropped when casting to timestamp, same as when inserting a time.Time
+		timestamps = append(timestamps, img.Timestamp.Format(time.RFC3339Nano))
+		coordIDs = append(coordIDs, coordID)
+		phashes = append(phashes, toPHash(img))
+		formats = append(formats, formatOf(img))
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`INSERT INTO
+    			images(url_large, url_medium, url_small, sha256, timestamp, coordinate_id, phash, format)
+			SELECT * FROM unnest(
+				$1::text[],
+				$2::text[],
+				$3::text[],
+				$4::text[],
+				$5::timestamp[],
+				$6::integer[],
+				$7::bigint[],
+				$8::text[]
+			)
+			RETURNING id, sha256`,
+		pq.Array(urlsLarge),
+		pq.Array(urlsMedium),
+		pq.Array(urlsSmall),
+		pq.Array(hashes),
+		pq.Array(timestamps),
+		pq.Array(coordIDs),
+		pq.Array(phashes),
+		pq.Array(formats),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-			img.CoordinateID = &coordId
+	imageIDs := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var sha256 string
+		if err := rows.Scan(&id, &sha256); err != nil {
+			return err
 		}
-		_, err := d.db.Exec(
-			`INSERT INTO
-    			images(url_large, url_medium, url_small, sha256, timestamp, coordinate_id)
-			VALUES
-			    ($1, $2, $3, $4, $5, $6)`,
-			img.URLLarge.String(),
-			img.URLMedium.String(),
-			img.URLSmall.String(),
-			img.SHA256,
-			img.Timestamp,
-			img.CoordinateID,
-		)
-		if err != nil {
+		imageIDs[sha256] = id
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	renditions := make(map[int64][]coa.Rendition)
+	for _, img := range images {
+		renditions[imageIDs[img.SHA256]] = img.Renditions
+	}
+
+	if err := insertRenditions(ctx, tx, renditions); err != nil {
+		return fmt.Errorf("unable to insert renditions: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (d *pgDatabase) InsertRenditions(ctx context.Context, imageID int64, renditions []coa.Rendition) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int64
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM images WHERE id = $1", imageID).Scan(&found); err != nil {
+		return err
+	}
+
+	if err := insertRenditions(ctx, tx, map[int64][]coa.Rendition{imageID: renditions}); err != nil {
+		return err
+	}
+
+	columns := map[string]string{
+		coa.RenditionLarge:  "url_large",
+		coa.RenditionMedium: "url_medium",
+		coa.RenditionSmall:  "url_small",
+	}
+
+	for _, r := range renditions {
+		column, ok := columns[r.Name]
+		if !ok {
+			continue
+		}
+
+		query := fmt.Sprintf("UPDATE images SET %s = $1 WHERE id = $2", column)
+		if _, err := tx.ExecContext(ctx, query, r.URL.String(), imageID); err != nil {
 			return err
 		}
 	}
-	return nil
+
+	return tx.Commit()
+}
+
+// insertRenditions adds the renditions of several images, by image ID, with a single statement.
+func insertRenditions(ctx context.Context, tx *sql.Tx, renditions map[int64][]coa.Rendition) error {
+	var imageIDs, widths, heights, sizes []int64
+	var names, urls, formats []string
+
+	for imageID, rs := range renditions {
+		for _, r := range rs {
+			imageIDs = append(imageIDs, imageID)
+			names = append(names, r.Name)
+			urls = append(urls, r.URL.String())
+			widths = append(widths, int64(r.Width))
+			heights = append(heights, int64(r.Height))
+			sizes = append(sizes, r.Size)
+			formats = append(formats, r.Format)
+		}
+	}
+
+	if len(imageIDs) == 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO renditions(image_id, name, url, width, height, size, format)
+			SELECT * FROM unnest(
+				$1::integer[],
+				$2::text[],
+				$3::text[],
+				$4::integer[],
+				$5::integer[],
+				$6::bigint[],
+				$7::text[]
+			)
+			ON CONFLICT (image_id, name) DO UPDATE
+			SET url = EXCLUDED.url,
+				width = EXCLUDED.width,
+				height = EXCLUDED.height,
+				size = EXCLUDED.size,
+				format = EXCLUDED.format`,
+		pq.Array(imageIDs),
+		pq.Array(names),
+		pq.Array(urls),
+		pq.Array(widths),
+		pq.Array(heights),
+		pq.Array(sizes),
+		pq.Array(formats),
+	)
+	return err
+}
+
+type location struct {
+	city, country string
+}
+
+type coordinates struct {
+	latitude, longitude float64
+}
+
+func coordinatesOf(img coa.Image) coordinates {
+	return coordinates{img.Latitude, img.Longitude}
+}
+
+// insertLocations creates the locations of all images without a CoordinateID that don't exist yet and returns the
+// IDs of all of them.
+func insertLocations(ctx context.Context, tx *sql.Tx, images []coa.Image) (map[location]int64, error) {
+	seen := make(map[location]bool)
+	var cities, countries, timezones []string
+
+	for _, img := range images {
+		loc := location{img.City, img.Country}
+		if img.CoordinateID != nil || seen[loc] {
+			continue
+		}
+
+		seen[loc] = true
+		cities = append(cities, img.City)
+		countries = append(countries, img.Country)
+		timezones = append(timezones, img.Timezone)
+	}
+
+	ids := make(map[location]int64)
+	if len(cities) == 0 {
+		return ids, nil
+	}
+
+	// conflicting rows are not returned by the INSERT, so the existing ones are selected separately
+	rows, err := tx.QueryContext(
+		ctx,
+		`WITH input AS (
+			SELECT * FROM unnest($1::text[], $2::text[], $3::text[]) AS t(city, country, timezone)
+		), inserted AS (
+			INSERT INTO
+				locations(city, country, timezone)
+			SELECT city, country, timezone FROM input
+			ON CONFLICT (city, country) DO NOTHING
+			RETURNING id, city, country
+		)
+		SELECT id, city, country FROM inserted
+		UNION ALL
+		SELECT l.id, l.city, l.country FROM locations AS l JOIN input AS i ON l.city = i.city AND l.country = i.country`,
+		pq.Array(cities),
+		pq.Array(countries),
+		pq.Array(timezones),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var loc location
+		if err := rows.Scan(&id, &loc.city, &loc.country); err != nil {
+			return nil, err
+		}
+		ids[loc] = id
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for loc := range seen {
+		if _, ok := ids[loc]; !ok {
+			return nil, fmt.Errorf("location %s, %s was neither inserted nor found", loc.city, loc.country)
+		}
+	}
+	return ids, nil
+}
+
+// insertCoordinates creates the coordinates of all images without a CoordinateID that don't exist yet and returns the
+// IDs of all of them.
+func insertCoordinates(
+	ctx context.Context,
+	tx *sql.Tx,
+	images []coa.Image,
+	locationIDs map[location]int64,
+) (map[coordinates]int64, error) {
+	seen := make(map[coordinates]bool)
+	var latitudes, longitudes []float64
+	var locIDs []int64
+
+	for _, img := range images {
+		coords := coordinatesOf(img)
+		if img.CoordinateID != nil || seen[coords] {
+			continue
+		}
+
+		seen[coords] = true
+		latitudes = append(latitudes, img.Latitude)
+		longitudes = append(longitudes, img.Longitude)
+		locIDs = append(locIDs, locationIDs[location{img.City, img.Country}])
+	}
+
+	ids := make(map[coordinates]int64)
+	if len(latitudes) == 0 {
+		return ids, nil
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`WITH input AS (
+			SELECT * FROM unnest($1::float[], $2::float[], $3::integer[]) AS t(latitude, longitude, location_id)
+		), inserted AS (
+			INSERT INTO
+				coordinates(latitude, longitude, location_id)
+			SELECT latitude, longitude, location_id FROM input
+			ON CONFLICT (latitude, longitude) DO NOTHING
+			RETURNING id, latitude, longitude
+		)
+		SELECT id, latitude, longitude FROM inserted
+		UNION ALL
+		SELECT c.id, c.latitude, c.longitude
+		FROM coordinates AS c
+		JOIN input AS i ON c.latitude = i.latitude AND c.longitude = i.longitude`,
+		pq.Array(latitudes),
+		pq.Array(longitudes),
+		pq.Array(locIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var coords coordinates
+		if err := rows.Scan(&id, &coords.latitude, &coords.longitude); err != nil {
+			return nil, err
+		}
+		ids[coords] = id
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for coords := range seen {
+		if _, ok := ids[coords]; !ok {
+			return nil, fmt.Errorf("coordinates %f, %f were neither inserted nor found", coords.latitude, coords.longitude)
+		}
+	}
+	return ids, nil
 }
 
-func (d *pgDatabase) InsertPost(image coa.Image, platform coa.Platform) error {
-	row := d.db.QueryRow("SELECT id FROM platforms WHERE name = $1", platform)
+func (d *pgDatabase) InsertPost(ctx context.Context, image coa.Image, platform coa.Platform) error {
+	row := d.db.QueryRowContext(ctx, "SELECT id FROM platforms WHERE name = $1", platform)
 	var pID int64
 	err := row.Scan(&pID)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.db.Exec(
+	_, err = d.db.ExecContext(
+		ctx,
 		`INSERT INTO
     			posts(image_id, platform_id)
 			VALUES
@@ -403,8 +835,829 @@ func (d *pgDatabase) InsertPost(image coa.Image, platform coa.Platform) error {
 	return nil
 }
 
-func (d *pgDatabase) Close() error {
-	return d.db.Close()
+func (d *pgDatabase) GetPlaceAliases(ctx context.Context) ([]coa.PlaceAlias, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT
+			id,
+			component_type,
+			component_name,
+			country,
+			city,
+			priority
+		FROM place_aliases
+		ORDER BY priority DESC, id`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases []coa.PlaceAlias
+
+	for rows.Next() {
+		var a coa.PlaceAlias
+		err := rows.Scan(&a.ID, &a.ComponentType, &a.ComponentName, &a.Country, &a.City, &a.Priority)
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+
+	return aliases, nil
+}
+
+func (d *pgDatabase) InsertPlaceAlias(ctx context.Context, alias coa.PlaceAlias) (int64, error) {
+	row := d.db.QueryRowContext(
+		ctx,
+		`INSERT INTO
+    			place_aliases(component_type, component_name, country, city, priority)
+			VALUES
+			    ($1, $2, $3, $4, $5)
+			RETURNING id`,
+		alias.ComponentType,
+		alias.ComponentName,
+		alias.Country,
+		alias.City,
+		alias.Priority,
+	)
+
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+func (d *pgDatabase) DeletePlaceAlias(ctx context.Context, id int64) error {
+	res, err := d.db.ExecContext(ctx, "DELETE FROM place_aliases WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *pgDatabase) GetPrivacyZones(ctx context.Context) ([]coa.PrivacyZone, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT
+			id,
+			name,
+			latitude,
+			longitude,
+			radius,
+			polygon
+		FROM privacy_zones
+		ORDER BY id`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var zones []coa.PrivacyZone
+
+	for rows.Next() {
+		var z coa.PrivacyZone
+		var polygon string
+		err := rows.Scan(&z.ID, &z.Name, &z.Center.Latitude, &z.Center.Longitude, &z.Radius, &polygon)
+		if err != nil {
+			return nil, err
+		}
+
+		if polygon != "" {
+			if err := json.Unmarshal([]byte(polygon), &z.Polygon); err != nil {
+				return nil, fmt.Errorf("invalid polygon of privacy zone %d: %w", z.ID, err)
+			}
+		}
+		zones = append(zones, z)
+	}
+
+	return zones, rows.Err()
+}
+
+func (d *pgDatabase) InsertPrivacyZone(ctx context.Context, zone coa.PrivacyZone) (int64, error) {
+	polygon, err := encodePolygon(zone.Polygon)
+	if err != nil {
+		return 0, err
+	}
+
+	row := d.db.QueryRowContext(
+		ctx,
+		`INSERT INTO
+    			privacy_zones(name, latitude, longitude, radius, polygon)
+			VALUES
+			    ($1, $2, $3, $4, $5)
+			RETURNING id`,
+		zone.Name,
+		zone.Center.Latitude,
+		zone.Center.Longitude,
+		zone.Radius,
+		polygon,
+	)
+
+	var id int64
+	err = row.Scan(&id)
+	return id, err
+}
+
+func (d *pgDatabase) DeletePrivacyZone(ctx context.Context, id int64) error {
+	res, err := d.db.ExecContext(ctx, "DELETE FROM privacy_zones WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// encodePolygon returns the JSON representation of the corners of a privacy zone, or an empty string for circular
+// zones.
+func encodePolygon(polygon []coa.GeoPoint) (string, error) {
+	if len(polygon) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(polygon)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *pgDatabase) SetImageHidden(ctx context.Context, id int64, hidden bool) error {
+	res, err := d.db.ExecContext(ctx, "UPDATE images SET hidden = $2 WHERE id = $1", id, hidden)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteImage removes an image and its posts, as well as its coordinates and location if no other image uses them.
+func (d *pgDatabase) DeleteImage(ctx context.Context, id int64) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var coordID, locID int64
+	row := tx.QueryRowContext(
+		ctx,
+		`SELECT c.id, c.location_id FROM images AS i JOIN coordinates AS c ON i.coordinate_id = c.id WHERE i.id = $1`,
+		id,
+	)
+	if err := row.Scan(&coordID, &locID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM posts WHERE image_id = $1", id); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM images WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM coordinates AS c WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM images WHERE coordinate_id = c.id)",
+		coordID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM locations AS l WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM coordinates WHERE location_id = l.id)",
+		locID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *pgDatabase) GetTags(ctx context.Context) ([]coa.Tag, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT
+			t.name,
+			t.controlled,
+			COUNT(it.image_id)
+		FROM tags AS t
+		LEFT JOIN image_tags AS it ON it.tag_id = t.id
+		GROUP BY t.id
+		ORDER BY t.name`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []coa.Tag
+
+	for rows.Next() {
+		var t coa.Tag
+		if err := rows.Scan(&t.Name, &t.Controlled, &t.Images); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, rows.Err()
+}
+
+// CreateTag creates a tag or changes whether an existing tag is controlled.
+func (d *pgDatabase) CreateTag(ctx context.Context, name string, controlled bool) error {
+	_, err := d.db.ExecContext(
+		ctx,
+		`INSERT INTO
+    			tags(name, controlled)
+			VALUES
+			    ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET controlled = EXCLUDED.controlled`,
+		name,
+		controlled,
+	)
+	return err
+}
+
+func (d *pgDatabase) DeleteTag(ctx context.Context, name string) error {
+	res, err := d.db.ExecContext(ctx, "DELETE FROM tags WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TagImages adds tags to images. Tags that don't exist yet are created as free-form tags.
+func (d *pgDatabase) TagImages(ctx context.Context, imageIDs []int64, tags []string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO tags(name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING",
+		pq.Array(tags),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO
+    			image_tags(image_id, tag_id)
+			SELECT i.id, t.id
+			FROM unnest($1::integer[]) AS i(id)
+			CROSS JOIN tags AS t
+			WHERE t.name = ANY($2)
+			ON CONFLICT DO NOTHING`,
+		pq.Array(imageIDs),
+		pq.Array(tags),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *pgDatabase) UntagImages(ctx context.Context, imageIDs []int64, tags []string) error {
+	_, err := d.db.ExecContext(
+		ctx,
+		`DELETE FROM image_tags
+			WHERE image_id = ANY($1) AND tag_id IN (SELECT id FROM tags WHERE name = ANY($2))`,
+		pq.Array(imageIDs),
+		pq.Array(tags),
+	)
+	return err
+}
+
+func (d *pgDatabase) GetCats(ctx context.Context) ([]coa.Cat, error) {
+	return d.queryCats(ctx, "GROUP BY c.id ORDER BY c.name, c.id")
+}
+
+func (d *pgDatabase) GetCat(ctx context.Context, id int64) (coa.Cat, error) {
+	cats, err := d.queryCats(ctx, "WHERE c.id = $1 GROUP BY c.id", id)
+	if err != nil {
+		return coa.Cat{}, err
+	}
+
+	if len(cats) == 0 {
+		return coa.Cat{}, sql.ErrNoRows
+	}
+	return cats[0], nil
+}
+
+// queryCats selects cats together with the number of their images and when they were first and last seen. Hidden
+// images are not taken into account. The rest of the query after the joins is given by conditions.
+func (d *pgDatabase) queryCats(ctx context.Context, conditions string, args ...any) ([]coa.Cat, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT
+			c.id,
+			c.name,
+			c.description,
+			MIN(i.timestamp),
+			MAX(i.timestamp),
+			COUNT(i.id)
+		FROM cats AS c
+		LEFT JOIN cat_images AS ci ON ci.cat_id = c.id
+		LEFT JOIN images AS i ON ci.image_id = i.id AND NOT i.hidden
+		`+conditions,
+		args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cats []coa.Cat
+
+	for rows.Next() {
+		var c coa.Cat
+		var firstSeen, lastSeen sql.NullTime
+
+		if err := rows.Scan(&c.ID, &c.Name, &c.Description, &firstSeen, &lastSeen, &c.Sightings); err != nil {
+			return nil, err
+		}
+
+		if firstSeen.Valid {
+			c.FirstSeen = firstSeen.Time.UTC()
+			c.LastSeen = lastSeen.Time.UTC()
+		}
+		cats = append(cats, c)
+	}
+
+	return cats, rows.Err()
+}
+
+func (d *pgDatabase) GetSightings(ctx context.Context, catID int64) ([]coa.Image, error) {
+	return d.queryImages(
+		ctx,
+		`JOIN cat_images AS ci ON ci.image_id = i.id
+		WHERE ci.cat_id = $1 AND NOT i.hidden
+		ORDER BY i.timestamp, i.id`,
+		catID,
+	)
+}
+
+func (d *pgDatabase) InsertCat(ctx context.Context, cat coa.Cat) (int64, error) {
+	var id int64
+	err := d.db.QueryRowContext(
+		ctx,
+		"INSERT INTO cats(name, description) VALUES ($1, $2) RETURNING id",
+		cat.Name,
+		cat.Description,
+	).Scan(&id)
+
+	return id, err
+}
+
+func (d *pgDatabase) MergeCats(ctx context.Context, targetID int64, sourceIDs []int64) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := catExists(ctx, tx, targetID); err != nil {
+		return err
+	}
+
+	for _, sourceID := range sourceIDs {
+		if sourceID == targetID {
+			return fmt.Errorf("unable to merge cat %d with itself", targetID)
+		}
+
+		if err := catExists(ctx, tx, sourceID); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO
+    				cat_images(cat_id, image_id)
+				SELECT $1, image_id FROM cat_images WHERE cat_id = $2
+				ON CONFLICT DO NOTHING`,
+			targetID,
+			sourceID,
+		)
+		if err != nil {
+			return err
+		}
+
+		// also deletes the links to the images of the source cat
+		if _, err := tx.ExecContext(ctx, "DELETE FROM cats WHERE id = $1", sourceID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *pgDatabase) UpdateCatImages(ctx context.Context, catID int64, attach, detach []int64) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := catExists(ctx, tx, catID); err != nil {
+		return err
+	}
+
+	// unknown images would only show up as a constraint violation
+	var missing int
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*)
+		FROM unnest($1::integer[]) AS a(id)
+		WHERE NOT EXISTS (SELECT 1 FROM images AS i WHERE i.id = a.id)`,
+		pq.Array(attach),
+	).Scan(&missing)
+	if err != nil {
+		return err
+	}
+
+	if missing > 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM cat_images WHERE cat_id = $1 AND image_id = ANY($2)",
+		catID,
+		pq.Array(detach),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO
+    			cat_images(cat_id, image_id)
+			SELECT $1, unnest($2::integer[])
+			ON CONFLICT DO NOTHING`,
+		catID,
+		pq.Array(attach),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const jobColumns = `
+	id,
+	file_name,
+	storage_key,
+	state,
+	attempts,
+	claim,
+	last_error,
+	run_at,
+	created_at,
+	updated_at`
+
+func (d *pgDatabase) InsertJob(ctx context.Context, job coa.Job) (int64, error) {
+	row := d.db.QueryRowContext(
+		ctx,
+		`INSERT INTO
+    			jobs(file_name, storage_key)
+			VALUES
+			    ($1, $2)
+			RETURNING id`,
+		job.FileName,
+		job.StorageKey,
+	)
+
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+func (d *pgDatabase) ClaimJob(ctx context.Context, lease time.Duration, maxAttempts int) (coa.Job, error) {
+	// the abandoned jobs are failed by the same statement, so they can't be claimed. SKIP LOCKED lets concurrent
+	// workers pass over the row another worker is about to claim
+	row := d.db.QueryRowContext(
+		ctx,
+		`WITH abandoned AS (
+			UPDATE jobs
+			SET state = 'failed', last_error = $3, locked_until = NULL, updated_at = now()
+			WHERE state = 'running' AND locked_until < now() AND attempts >= $2
+		)
+		UPDATE jobs
+		SET
+			state = 'running',
+			attempts = attempts + 1,
+			claim = claim + 1,
+			locked_until = now() + $1::float8 * INTERVAL '1 second',
+			updated_at = now()
+		WHERE id = (
+			SELECT id
+			FROM jobs
+			WHERE (state = 'queued' AND run_at <= now())
+				OR (state = 'running' AND locked_until < now() AND attempts < $2)
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING`+jobColumns,
+		lease.Seconds(),
+		maxAttempts,
+		coa.JobAbandoned,
+	)
+
+	return scanJob(row)
+}
+
+func (d *pgDatabase) CompleteJob(ctx context.Context, job coa.Job) error {
+	return d.updateJob(
+		ctx,
+		`UPDATE jobs
+		SET state = 'done', locked_until = NULL, updated_at = now()
+		WHERE id = $1 AND claim = $2 AND state = 'running'`,
+		job.ID,
+		job.Claim,
+	)
+}
+
+func (d *pgDatabase) RetryJob(ctx context.Context, job coa.Job, lastError string, runAt time.Time) error {
+	return d.updateJob(
+		ctx,
+		`UPDATE jobs
+		SET state = 'queued', last_error = $3, run_at = $4, locked_until = NULL, updated_at = now()
+		WHERE id = $1 AND claim = $2 AND state = 'running'`,
+		job.ID,
+		job.Claim,
+		lastError,
+		runAt,
+	)
+}
+
+func (d *pgDatabase) FailJob(ctx context.Context, job coa.Job, lastError string) error {
+	return d.updateJob(
+		ctx,
+		`UPDATE jobs
+		SET state = 'failed', last_error = $3, locked_until = NULL, updated_at = now()
+		WHERE id = $1 AND claim = $2 AND state = 'running'`,
+		job.ID,
+		job.Claim,
+		lastError,
+	)
+}
+
+func (d *pgDatabase) ReleaseJob(ctx context.Context, job coa.Job) error {
+	return d.updateJob(
+		ctx,
+		`UPDATE jobs
+		SET state = 'queued', attempts = GREATEST(attempts - 1, 0), locked_until = NULL, updated_at = now()
+		WHERE id = $1 AND claim = $2 AND state = 'running'`,
+		job.ID,
+		job.Claim,
+	)
+}
+
+func (d *pgDatabase) updateJob(ctx context.Context, query string, args ...any) error {
+	res, err := d.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *pgDatabase) GetJobs(ctx context.Context) ([]coa.Job, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT"+jobColumns+" FROM jobs ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []coa.Job
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row scanner) (coa.Job, error) {
+	var job coa.Job
+	err := row.Scan(
+		&job.ID,
+		&job.FileName,
+		&job.StorageKey,
+		&job.State,
+		&job.Attempts,
+		&job.Claim,
+		&job.LastError,
+		&job.RunAt,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		return coa.Job{}, err
+	}
+
+	job.RunAt = job.RunAt.UTC()
+	job.CreatedAt = job.CreatedAt.UTC()
+	job.UpdatedAt = job.UpdatedAt.UTC()
+	return job, nil
+}
+
+// catExists returns sql.ErrNoRows if there is no cat with the given ID.
+func catExists(ctx context.Context, tx *sql.Tx, id int64) error {
+	var found int64
+	return tx.QueryRowContext(ctx, "SELECT id FROM cats WHERE id = $1", id).Scan(&found)
+}
+
+// loadRelated sets the tags and renditions of the given images.
+func (d *pgDatabase) loadRelated(ctx context.Context, images []coa.Image) error {
+	if err := d.loadTags(ctx, images); err != nil {
+		return err
+	}
+	return d.loadRenditions(ctx, images)
+}
+
+// loadRenditions sets the renditions of the given images, sorted by width.
+func (d *pgDatabase) loadRenditions(ctx context.Context, images []coa.Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	indexes := make(map[int64]int)
+	var ids []int64
+	for idx, img := range images {
+		indexes[img.ID] = idx
+		ids = append(ids, img.ID)
+	}
+
+	rows, err := d.db.QueryContext(
+		ctx,
+		`SELECT image_id, name, url, width, height, size, format
+			FROM renditions
+			WHERE image_id = ANY($1)
+			ORDER BY width, name`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var r coa.Rendition
+		var u string
+		if err := rows.Scan(&id, &r.Name, &u, &r.Width, &r.Height, &r.Size, &r.Format); err != nil {
+			return err
+		}
+
+		r.URL, err = url.Parse(u)
+		if err != nil {
+			return err
+		}
+
+		idx := indexes[id]
+		images[idx].Renditions = append(images[idx].Renditions, r)
+	}
+
+	return rows.Err()
+}
+
+// loadTags sets the tags of the given images.
+func (d *pgDatabase) loadTags(ctx context.Context, images []coa.Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	indexes := make(map[int64]int)
+	var ids []int64
+	for idx, img := range images {
+		indexes[img.ID] = idx
+		ids = append(ids, img.ID)
+	}
+
+	rows, err := d.db.QueryContext(
+		ctx,
+		`SELECT it.image_id, t.name
+			FROM image_tags AS it
+			JOIN tags AS t ON it.tag_id = t.id
+			WHERE it.image_id = ANY($1)
+			ORDER BY t.name`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+
+		idx := indexes[id]
+		images[idx].Tags = append(images[idx].Tags, tag)
+	}
+
+	return rows.Err()
+}
+
+// GetPerceptualHashes returns the perceptual hashes of all images by image ID, including hidden images. Images
+// without a hash are left out.
+func (d *pgDatabase) GetPerceptualHashes(ctx context.Context) (map[int64]uint64, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, phash FROM images WHERE phash IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[int64]uint64)
+
+	for rows.Next() {
+		var id, phash int64
+		if err := rows.Scan(&id, &phash); err != nil {
+			return nil, err
+		}
+		hashes[id] = uint64(phash)
+	}
+
+	return hashes, rows.Err()
+}
+
+func (d *pgDatabase) Close() error {
+	return d.db.Close()
+}
+
+// formatOf returns the format of the original file of an image. Images ingested before other formats were supported
+// are JPEGs.
+func formatOf(img coa.Image) string {
+	if img.Format == "" {
+		return coa.FormatJPEG
+	}
+	return img.Format
+}
+
+// toPHash converts the perceptual hash of an image for storing it in a BIGINT column. Unknown hashes become NULL.
+func toPHash(img coa.Image) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(img.PHash), Valid: img.PHash != 0}
 }
 
 func fixTimezone(image coa.Image) (coa.Image, error) {
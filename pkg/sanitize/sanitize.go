@@ -0,0 +1,366 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package sanitize removes metadata from JPEG files that could reveal where a photo was taken or which device took
+// it. EXIF fields are only kept if they are on an allowlist. XMP, IPTC, comments and images appended after the end of
+// the JPEG (e.g. depth maps from phones) are always removed.
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ifd int
+
+const (
+	ifd0 ifd = iota
+	exifIFD
+)
+
+type field struct {
+	ifd ifd
+	tag uint16
+}
+
+// fields that may be kept. GPS data, serial numbers, maker notes and everything else are always removed.
+var fields = map[string]field{
+	"ImageDescription":      {ifd0, 0x010e},
+	"Make":                  {ifd0, 0x010f},
+	"Model":                 {ifd0, 0x0110},
+	"Orientation":           {ifd0, 0x0112},
+	"XResolution":           {ifd0, 0x011a},
+	"YResolution":           {ifd0, 0x011b},
+	"ResolutionUnit":        {ifd0, 0x0128},
+	"Software":              {ifd0, 0x0131},
+	"DateTime":              {ifd0, 0x0132},
+	"Artist":                {ifd0, 0x013b},
+	"Copyright":             {ifd0, 0x8298},
+	"ExposureTime":          {exifIFD, 0x829a},
+	"FNumber":               {exifIFD, 0x829d},
+	"ISOSpeedRatings":       {exifIFD, 0x8827},
+	"DateTimeOriginal":      {exifIFD, 0x9003},
+	"DateTimeDigitized":     {exifIFD, 0x9004},
+	"OffsetTime":            {exifIFD, 0x9010},
+	"OffsetTimeOriginal":    {exifIFD, 0x9011},
+	"OffsetTimeDigitized":   {exifIFD, 0x9012},
+	"FocalLength":           {exifIFD, 0x920a},
+	"ColorSpace":            {exifIFD, 0xa001},
+	"FocalLengthIn35mmFilm": {exifIFD, 0xa405},
+	"LensModel":             {exifIFD, 0xa434},
+}
+
+const (
+	tagExifIFD     = 0x8769
+	tagOrientation = 0x0112
+)
+
+// DefaultAllowedFields keeps the time a photo was taken, but nothing about the camera.
+var DefaultAllowedFields = []string{
+	"DateTime",
+	"DateTimeOriginal",
+	"DateTimeDigitized",
+	"OffsetTime",
+	"OffsetTimeOriginal",
+	"OffsetTimeDigitized",
+}
+
+// Fields returns the names of all EXIF fields that can be put on the allowlist, sorted by name.
+func Fields() []string {
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseFields splits a comma separated list of EXIF field names. An empty string stands for DefaultAllowedFields and
+// "none" for an empty list.
+func ParseFields(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return DefaultAllowedFields
+	}
+
+	if s == "none" {
+		return nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ValidateFields checks that all names are EXIF fields that can be kept.
+func ValidateFields(names []string) error {
+	for _, name := range names {
+		if _, ok := fields[name]; !ok {
+			return fmt.Errorf("EXIF field '%s' can't be kept. supported fields: %s", name, strings.Join(Fields(), ", "))
+		}
+	}
+	return nil
+}
+
+// JPEG returns a copy of a JPEG file without metadata, apart from the EXIF fields in allowed. The orientation is always
+// kept, since the image would be displayed sideways otherwise. Color profiles are kept as well.
+func JPEG(data []byte, allowed []string) ([]byte, error) {
+	if err := ValidateFields(allowed); err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("not a JPEG file")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	for pos := 2; ; {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, errors.New("invalid JPEG segment")
+		}
+
+		marker := data[pos+1]
+		// padding
+		if marker == 0xff {
+			pos++
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		segment := data[pos:end]
+		payload := segment[4:]
+
+		switch {
+		case marker == 0xda:
+			// start of scan. the entropy coded data and all following scans are copied up to the end of the image
+			out.Write(data[pos:endOfImage(data, pos)])
+			return out.Bytes(), nil
+		case marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			tiff, err := filterExif(payload[6:], allowed)
+			if err != nil {
+				return nil, fmt.Errorf("unable to filter EXIF metadata: %w", err)
+			}
+
+			if tiff != nil {
+				app1 := append([]byte("Exif\x00\x00"), tiff...)
+				out.Write([]byte{0xff, 0xe1})
+				_ = binary.Write(out, binary.BigEndian, uint16(len(app1)+2))
+				out.Write(app1)
+			}
+		case marker == 0xe2 && !bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			// e.g. the index of additional images appended to the file
+		case marker == 0xe0 || marker == 0xe2 || marker == 0xee:
+			// JFIF, color profile and Adobe color transform
+			out.Write(segment)
+		case marker >= 0xe0 && marker <= 0xef, marker == 0xfe:
+			// XMP, IPTC, comments and vendor specific data
+		default:
+			// tables and frame headers
+			out.Write(segment)
+		}
+
+		pos = end
+	}
+}
+
+// endOfImage returns the position after the end of image marker, searching from the start of the first scan at pos.
+// Markers can't occur in entropy coded data, since 0xff bytes in it are followed by 0x00 or a restart marker. Files
+// without an end of image marker are truncated, but can often still be displayed, so everything is kept then.
+func endOfImage(data []byte, pos int) int {
+	for i := pos; i+1 < len(data); i++ {
+		if data[i] == 0xff && data[i+1] == 0xd9 {
+			return i + 2
+		}
+	}
+	return len(data)
+}
+
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// filterExif returns a TIFF structure with only the allowed fields of the TIFF structure in data, or nil if no field
+// is left.
+func filterExif(data []byte, allowed []string) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, errors.New("TIFF header too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid TIFF byte order")
+	}
+
+	keep := map[field]bool{{ifd0, tagOrientation}: true}
+	for _, name := range allowed {
+		keep[fields[name]] = true
+	}
+
+	entries0, err := readIFD(data, order, order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	var kept0, keptExif []entry
+
+	for _, e := range entries0 {
+		if e.tag == tagExifIFD && len(e.value) == 4 {
+			entriesExif, err := readIFD(data, order, order.Uint32(e.value))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ee := range entriesExif {
+				if keep[field{exifIFD, ee.tag}] {
+					keptExif = append(keptExif, ee)
+				}
+			}
+		} else if keep[field{ifd0, e.tag}] {
+			kept0 = append(kept0, e)
+		}
+	}
+
+	if len(kept0) == 0 && len(keptExif) == 0 {
+		return nil, nil
+	}
+
+	if len(keptExif) > 0 {
+		// the offset is set when writing
+		kept0 = append(kept0, entry{tag: tagExifIFD, typ: 4, count: 1, value: make([]byte, 4)})
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(data[:4])
+	_ = binary.Write(out, order, uint32(8))
+
+	exifPos := writeIFD(out, order, kept0)
+	if len(keptExif) > 0 {
+		exifOffset := uint32(out.Len())
+		writeIFD(out, order, keptExif)
+		order.PutUint32(out.Bytes()[exifPos:], exifOffset)
+	}
+	return out.Bytes(), nil
+}
+
+var typeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+func readIFD(data []byte, order binary.ByteOrder, offset uint32) ([]entry, error) {
+	if int64(offset)+2 > int64(len(data)) {
+		return nil, errors.New("IFD offset out of range")
+	}
+
+	count := int(order.Uint16(data[offset:]))
+	pos := int(offset) + 2
+	if pos+12*count > len(data) {
+		return nil, errors.New("IFD out of range")
+	}
+
+	var entries []entry
+
+	for n := 0; n < count; n++ {
+		raw := data[pos+12*n : pos+12*n+12]
+		e := entry{tag: order.Uint16(raw), typ: order.Uint16(raw[2:]), count: order.Uint32(raw[4:])}
+
+		size, ok := typeSizes[e.typ]
+		if !ok {
+			// unknown types can't be copied
+			continue
+		}
+
+		total := int64(size) * int64(e.count)
+		if total <= 4 {
+			e.value = raw[8 : 8+total]
+		} else {
+			valueOffset := int64(order.Uint32(raw[8:]))
+			if valueOffset+total > int64(len(data)) {
+				return nil, fmt.Errorf("value of tag 0x%04x out of range", e.tag)
+			}
+			e.value = data[valueOffset : valueOffset+total]
+		}
+
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// writeIFD appends an IFD with the given entries and their values to out. It returns the position of the value of the
+// EXIF IFD pointer, if there is one.
+func writeIFD(out *bytes.Buffer, order binary.ByteOrder, entries []entry) int {
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].tag < entries[b].tag
+	})
+
+	start := out.Len()
+	dataPos := start + 2 + 12*len(entries) + 4
+	var values []byte
+	exifPos := -1
+
+	_ = binary.Write(out, order, uint16(len(entries)))
+
+	for _, e := range entries {
+		_ = binary.Write(out, order, e.tag)
+		_ = binary.Write(out, order, e.typ)
+		_ = binary.Write(out, order, e.count)
+
+		if e.tag == tagExifIFD {
+			exifPos = out.Len()
+		}
+
+		if len(e.value) <= 4 {
+			inline := make([]byte, 4)
+			copy(inline, e.value)
+			out.Write(inline)
+			continue
+		}
+
+		// values start at word boundaries
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+		_ = binary.Write(out, order, uint32(dataPos+len(values)))
+		values = append(values, e.value...)
+	}
+
+	// no further IFDs, which drops the thumbnail
+	_ = binary.Write(out, order, uint32(0))
+	out.Write(values)
+	if out.Len()%2 == 1 {
+		out.WriteByte(0)
+	}
+	return exifPos
+}
@@ -0,0 +1,344 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/rwcarlsen/goexif/exif"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+const (
+	tagMake             = 0x010f
+	tagDateTime         = 0x0132
+	tagGPSIFD           = 0x8825
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagDateTimeOriginal = 0x9003
+	tagMakerNote        = 0x927c
+	tagBodySerialNumber = 0xa431
+
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+)
+
+// values of the fields in the fixture that must not survive sanitizing
+var (
+	secretMake      = "AcmePhone 3000"
+	secretMakerNote = "MAKERNOTE-SECRET"
+	secretSerial    = "SERIAL-0123456789"
+	secretLatitude  = []byte{0, 0, 0, 13, 0, 0, 0, 1, 0, 0, 0, 45, 0, 0, 0, 1, 0, 0, 0, 7, 0, 0, 0, 1}
+)
+
+const (
+	fixtureDateTime         = "2023:05:01 10:11:12"
+	fixtureDateTimeOriginal = "2023:05:01 10:11:00"
+)
+
+type testTag struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiTag(tag uint16, s string) testTag {
+	return testTag{tag, typeASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortTag(tag uint16, v uint16) testTag {
+	return testTag{tag, typeShort, 1, binary.BigEndian.AppendUint16(nil, v)}
+}
+
+func longTag(tag uint16, v uint32) testTag {
+	return testTag{tag, typeLong, 1, binary.BigEndian.AppendUint32(nil, v)}
+}
+
+func ifdSize(tags []testTag) int {
+	size := 2 + 12*len(tags) + 4
+	for _, t := range tags {
+		if len(t.value) > 4 {
+			size += len(t.value) + len(t.value)%2
+		}
+	}
+	return size
+}
+
+func appendIFD(buf *bytes.Buffer, tags []testTag) {
+	order := binary.BigEndian
+	dataPos := buf.Len() + 2 + 12*len(tags) + 4
+	var values []byte
+
+	_ = binary.Write(buf, order, uint16(len(tags)))
+	for _, t := range tags {
+		_ = binary.Write(buf, order, t.tag)
+		_ = binary.Write(buf, order, t.typ)
+		_ = binary.Write(buf, order, t.count)
+
+		if len(t.value) <= 4 {
+			inline := make([]byte, 4)
+			copy(inline, t.value)
+			buf.Write(inline)
+			continue
+		}
+
+		_ = binary.Write(buf, order, uint32(dataPos+len(values)))
+		values = append(values, t.value...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	_ = binary.Write(buf, order, uint32(0))
+	buf.Write(values)
+}
+
+// fixtureTIFF returns a big endian TIFF structure with IFD0, an EXIF IFD and a GPS IFD, like the ones written by phones.
+func fixtureTIFF() []byte {
+	ifd0 := []testTag{
+		asciiTag(tagMake, secretMake),
+		shortTag(tagOrientation, 6),
+		asciiTag(tagDateTime, fixtureDateTime),
+	}
+	exifIFD := []testTag{
+		asciiTag(tagDateTimeOriginal, fixtureDateTimeOriginal),
+		{tagMakerNote, typeUndefined, uint32(len(secretMakerNote)), []byte(secretMakerNote)},
+		asciiTag(tagBodySerialNumber, secretSerial),
+	}
+	gpsIFD := []testTag{
+		asciiTag(tagGPSLatitudeRef, "N"),
+		{tagGPSLatitude, typeRational, 3, secretLatitude},
+	}
+
+	// the pointers to the EXIF and GPS IFDs are appended to IFD0, followed by the other IFDs
+	exifOffset := 8 + ifdSize(ifd0) + 2*12
+	gpsOffset := exifOffset + ifdSize(exifIFD)
+	ifd0 = append(ifd0, longTag(tagExifIFD, uint32(exifOffset)), longTag(tagGPSIFD, uint32(gpsOffset)))
+
+	buf := bytes.NewBufferString("MM")
+	_ = binary.Write(buf, binary.BigEndian, uint16(42))
+	_ = binary.Write(buf, binary.BigEndian, uint32(8))
+	appendIFD(buf, ifd0)
+	appendIFD(buf, exifIFD)
+	appendIFD(buf, gpsIFD)
+	return buf.Bytes()
+}
+
+func segment(marker byte, payload []byte) []byte {
+	s := []byte{0xff, marker}
+	s = binary.BigEndian.AppendUint16(s, uint16(len(payload)+2))
+	return append(s, payload...)
+}
+
+// fixtureJPEG returns a small JPEG with the EXIF data from fixtureTIFF, an XMP packet and a comment.
+func fixtureJPEG(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data := append([]byte{}, encoded.Bytes()[:2]...)
+	data = append(data, segment(0xe1, append([]byte("Exif\x00\x00"), fixtureTIFF()...))...)
+	data = append(data, segment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>"+secretSerial+"</x:xmpmeta>"))...)
+	data = append(data, segment(0xfe, []byte(secretMake))...)
+	return append(data, encoded.Bytes()[2:]...)
+}
+
+func TestJPEG(t *testing.T) {
+	fixture := fixtureJPEG(t)
+
+	// the fixture has to be readable, otherwise the checks below prove nothing
+	x, err := exif.Decode(bytes.NewReader(fixture))
+	if err != nil {
+		t.Fatalf("unable to decode EXIF data of the fixture: %v", err)
+	}
+	if _, err := x.Get(exif.GPSLatitude); err != nil {
+		t.Fatalf("fixture has no GPS data: %v", err)
+	}
+
+	out, err := JPEG(fixture, DefaultAllowedFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("sanitized file is not a valid JPEG: %v", err)
+	}
+
+	for _, secret := range [][]byte{[]byte(secretMake), []byte(secretMakerNote), []byte(secretSerial), secretLatitude} {
+		if bytes.Contains(out, secret) {
+			t.Errorf("sanitized file still contains %q", secret)
+		}
+	}
+
+	x, err = exif.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("unable to decode EXIF data of the sanitized file: %v", err)
+	}
+
+	for _, name := range []exif.FieldName{exif.GPSInfoIFDPointer, exif.GPSLatitude, exif.MakerNote, exif.Make} {
+		if _, err := x.Get(name); !exif.IsTagNotPresentError(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+
+	orientation, err := x.Get(exif.Orientation)
+	if err != nil {
+		t.Fatalf("orientation was removed: %v", err)
+	}
+	if v, err := orientation.Int(0); err != nil || v != 6 {
+		t.Errorf("expected orientation 6, got %d (%v)", v, err)
+	}
+
+	expected := map[exif.FieldName]string{
+		exif.DateTime:         fixtureDateTime,
+		exif.DateTimeOriginal: fixtureDateTimeOriginal,
+	}
+	for name, want := range expected {
+		tag, err := x.Get(name)
+		if err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+			continue
+		}
+		if got, err := tag.StringVal(); err != nil || got != want {
+			t.Errorf("expected %s to be %q, got %q (%v)", name, want, got, err)
+		}
+	}
+}
+
+func TestJPEGAllowlist(t *testing.T) {
+	out, err := JPEG(fixtureJPEG(t), []string{"Make"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := exif.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := x.Get(exif.Make); err != nil {
+		t.Errorf("allowlisted field was removed: %v", err)
+	}
+
+	for _, name := range []exif.FieldName{exif.DateTime, exif.DateTimeOriginal, exif.GPSLatitude} {
+		if _, err := x.Get(name); !exif.IsTagNotPresentError(err) {
+			t.Errorf("%s is not on the allowlist but was kept", name)
+		}
+	}
+
+	if _, err := x.Get(exif.Orientation); err != nil {
+		t.Errorf("orientation was removed: %v", err)
+	}
+}
+
+func TestJPEGUnknownField(t *testing.T) {
+	if _, err := JPEG(fixtureJPEG(t), []string{"GPSLatitude"}); err == nil {
+		t.Error("expected an error for a field that can't be kept")
+	}
+}
+
+func TestJPEGMalformed(t *testing.T) {
+	fixture := fixtureJPEG(t)
+	tiff := fixtureTIFF()
+
+	// the TIFF structure with the offset of IFD0 replaced
+	withIFD0Offset := func(offset uint32) []byte {
+		data := append([]byte{}, tiff...)
+		binary.BigEndian.PutUint32(data[4:], offset)
+		return data
+	}
+
+	// the TIFF structure with the number of entries in IFD0 replaced
+	withIFD0Count := func(count uint16) []byte {
+		data := append([]byte{}, tiff...)
+		binary.BigEndian.PutUint16(data[8:], count)
+		return data
+	}
+
+	// the TIFF structure with the offset of the value of the first entry in IFD0 (Make) replaced
+	withValueOffset := func(offset uint32) []byte {
+		data := append([]byte{}, tiff...)
+		binary.BigEndian.PutUint32(data[8+2+8:], offset)
+		return data
+	}
+
+	withExif := func(tiff []byte) []byte {
+		data := []byte{0xff, 0xd8}
+		data = append(data, segment(0xe1, append([]byte("Exif\x00\x00"), tiff...))...)
+		return append(data, fixture[2:]...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a JPEG", []byte("GIF89a\x01\x00\x01\x00")},
+		{"start of image only", []byte{0xff, 0xd8}},
+		{"garbage after start of image", []byte{0xff, 0xd8, 0x00, 0x01, 0x02, 0x03}},
+		{"segment longer than file", []byte{0xff, 0xd8, 0xff, 0xe0, 0xff, 0xff, 0x00}},
+		{"segment length below 2", []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x01, 0x00, 0x00}},
+		{"no start of scan", []byte{0xff, 0xd8, 0xff, 0xfe, 0x00, 0x02}},
+		{"TIFF header too short", withExif([]byte("MM\x00"))},
+		{"invalid byte order", withExif(append([]byte("XX"), tiff[2:]...))},
+		{"IFD0 offset out of range", withExif(withIFD0Offset(0xfffffff0))},
+		{"IFD0 offset at the end", withExif(withIFD0Offset(uint32(len(tiff) - 1)))},
+		{"IFD0 entries out of range", withExif(withIFD0Count(0xffff))},
+		{"value offset out of range", withExif(withValueOffset(0xfffffff0))},
+		{"IFD0 values truncated", withExif(tiff[:8+ifdSize(nil)+12*5+16])},
+		{"EXIF IFD values truncated", withExif(tiff[:len(tiff)-ifdSize(nil)-2*12-24-20])},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := JPEG(tt.data, DefaultAllowedFields); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestJPEGTruncated(t *testing.T) {
+	fixture := fixtureJPEG(t)
+
+	// files cut off in the entropy coded data can often still be displayed and are kept, but everything before the
+	// first scan is required
+	scan := bytes.Index(fixture, []byte{0xff, 0xda})
+	if scan < 0 {
+		t.Fatal("fixture has no start of scan")
+	}
+
+	for n := 0; n < len(fixture); n++ {
+		_, err := JPEG(fixture[:n], DefaultAllowedFields)
+		if n < scan+4 && err == nil {
+			t.Errorf("expected an error for a file truncated to %d bytes", n)
+		}
+	}
+}
@@ -0,0 +1,1426 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/migrations"
+	"github.com/haikoschol/cats-of-asia/pkg/migrate"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const imageColumns = `
+	i.id AS image_id,
+	i.url_large,
+	i.url_medium,
+	i.url_small,
+	i.sha256,
+	i.timestamp,
+	c.latitude,
+	c.longitude,
+	l.city,
+	l.country,
+	l.timezone,
+	i.hidden,
+	i.phash,
+	i.format`
+
+type sqliteDatabase struct {
+	db *sql.DB
+}
+
+// NewDatabase opens the SQLite database at path, creating the file if it doesn't exist, and applies all migrations
+// that have not been applied yet.
+func NewDatabase(path string) (coa.Database, error) {
+	db, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := migrate.New(db, migrations.SQLite)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if _, err := m.Up(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to migrate database %s: %w", path, err)
+	}
+
+	if err := m.Check(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteDatabase{db}, nil
+}
+
+// Open opens the SQLite database at path without applying migrations.
+func Open(path string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL", path)
+	return sql.Open("sqlite3", dsn)
+}
+
+func (d *sqliteDatabase) GetOrCreateLocation(ctx context.Context, city, country, timezone string) (int64, error) {
+	_, err := d.db.ExecContext(
+		ctx,
+		`INSERT INTO
+    			locations(city, country, timezone)
+			VALUES
+			    (?, ?, ?)
+			ON CONFLICT (city, country) DO NOTHING`,
+		city,
+		country,
+		timezone,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	row := d.db.QueryRowContext(ctx, "SELECT id FROM locations WHERE city = ? and country = ?", city, country)
+	var id int64
+	err = row.Scan(&id)
+	return id, err
+}
+
+func (d *sqliteDatabase) GetOrCreateCoordinates(
+	ctx context.Context,
+	latitude, longitude float64,
+	locationId int64,
+) (int64, error) {
+	_, err := d.db.ExecContext(
+		ctx,
+		`INSERT INTO
+    			coordinates(latitude, longitude, location_id)
+			VALUES
+			    (?, ?, ?)
+			ON CONFLICT (latitude, longitude) DO NOTHING`,
+		latitude,
+		longitude,
+		locationId,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return d.GetCoordinateID(ctx, latitude, longitude)
+}
+
+func (d *sqliteDatabase) GetCoordinateID(ctx context.Context, latitude, longitude float64) (int64, error) {
+	row := d.db.QueryRowContext(
+		ctx,
+		"SELECT id FROM coordinates WHERE latitude = ? AND longitude = ?",
+		latitude,
+		longitude,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+func (d *sqliteDatabase) GetKnownLocation(
+	ctx context.Context,
+	latitude, longitude float64,
+) (coa.KnownLocation, error) {
+	row := d.db.QueryRowContext(
+		ctx,
+		`SELECT c.id, l.city, l.country, l.timezone
+		FROM coordinates AS c
+		JOIN locations AS l ON c.location_id = l.id
+		WHERE c.latitude = ? AND c.longitude = ?`,
+		latitude,
+		longitude,
+	)
+	var loc coa.KnownLocation
+	err := row.Scan(&loc.CoordinateID, &loc.City, &loc.Country, &loc.Timezone)
+	return loc, err
+}
+
+func (d *sqliteDatabase) GetImage(ctx context.Context, id int64) (coa.Image, error) {
+	row := d.db.QueryRowContext(ctx, `
+		SELECT `+imageColumns+`
+		FROM images AS i
+		JOIN coordinates AS c ON i.coordinate_id = c.id
+		JOIN locations AS l ON c.location_id = l.id
+		WHERE i.id = ?`,
+		id)
+
+	return d.scanImageWithRelated(ctx, row)
+}
+
+func (d *sqliteDatabase) GetImageBySHA256(ctx context.Context, sha256 string) (coa.Image, error) {
+	var id int64
+	if err := d.db.QueryRowContext(ctx, "SELECT id FROM images WHERE sha256 = ?", sha256).Scan(&id); err != nil {
+		return coa.Image{}, err
+	}
+	return d.GetImage(ctx, id)
+}
+
+func (d *sqliteDatabase) GetImages(ctx context.Context) ([]coa.Image, error) {
+	return d.queryImages(ctx, "WHERE NOT i.hidden")
+}
+
+// queryImages selects images with all their columns. The rest of the query after the FROM clause, which can contain
+// further joins, is given by conditions.
+func (d *sqliteDatabase) queryImages(ctx context.Context, conditions string, args ...any) ([]coa.Image, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT `+imageColumns+`
+		FROM images AS i
+		JOIN coordinates AS c ON i.coordinate_id = c.id
+		JOIN locations AS l ON c.location_id = l.id
+		`+conditions,
+		args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []coa.Image
+
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := d.loadRelated(ctx, images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (d *sqliteDatabase) GetRandomUnusedImage(ctx context.Context, platform coa.Platform) (coa.Image, error) {
+	row := d.db.QueryRowContext(ctx, `
+		SELECT `+imageColumns+`
+		FROM images AS i
+		JOIN coordinates AS c ON i.coordinate_id = c.id
+		JOIN locations AS l ON c.location_id = l.id
+		WHERE NOT i.hidden AND i.id NOT IN (
+			SELECT image_id FROM posts where platform_id = (SELECT id FROM platforms WHERE name = ?)
+	    )
+		ORDER BY random()
+		LIMIT 1`,
+		platform)
+
+	return d.scanImageWithRelated(ctx, row)
+}
+
+func (d *sqliteDatabase) GetUnusedImageCount(ctx context.Context, platform coa.Platform) (int, error) {
+	row := d.db.QueryRowContext(ctx, `
+		SELECT 
+			COUNT(id)
+		FROM images
+		WHERE NOT hidden AND id NOT IN (
+			SELECT image_id FROM posts where platform_id = (SELECT id FROM platforms WHERE name = ?)
+	    )`,
+		platform)
+
+	var count int
+	err := row.Scan(&count)
+	return count, err
+}
+
+func (d *sqliteDatabase) RemoveKnownImages(ctx context.Context, images []coa.Image) ([]coa.Image, error) {
+	if len(images) == 0 {
+		return nil, nil
+	}
+
+	var hashes []any
+	for _, img := range images {
+		hashes = append(hashes, img.SHA256)
+	}
+
+	rows, err := d.db.QueryContext(
+		ctx,
+		`SELECT sha256 FROM images WHERE sha256 IN (`+placeholders(len(hashes))+`)`,
+		hashes...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	knownImages := make(map[string]bool)
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		knownImages[hash] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var filtered []coa.Image
+
+	for _, img := range images {
+		if knownImages[img.SHA256] {
+			continue
+		}
+
+		filtered = append(filtered, img)
+	}
+
+	return filtered, nil
+}
+
+func (d *sqliteDatabase) InsertImages(ctx context.Context, images []coa.Image) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, img := range images {
+		if img.CoordinateID == nil {
+			coordID, err := getOrCreateCoordinates(ctx, tx, img)
+			if err != nil {
+				return err
+			}
+
+			img.CoordinateID = &coordID
+		}
+
+		res, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO
+    			images(url_large, url_medium, url_small, sha256, timestamp, coordinate_id, phash, format)
+			VALUES
+			    (?, ?, ?, ?, ?, ?, ?, ?)`,
+			img.URLLarge.String(),
+			img.URLMedium.String(),
+			img.URLSmall.String(),
+			img.SHA256,
+			toTimestamp(img.Timestamp),
+			img.CoordinateID,
+			toPHash(img),
+			formatOf(img),
+		)
+		if err != nil {
+			return err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		if err := insertRenditions(ctx, tx, id, img.Renditions); err != nil {
+			return fmt.Errorf("unable to insert renditions of image %s: %w", img.SHA256, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *sqliteDatabase) InsertRenditions(ctx context.Context, imageID int64, renditions []coa.Rendition) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int64
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM images WHERE id = ?", imageID).Scan(&found); err != nil {
+		return err
+	}
+
+	if err := insertRenditions(ctx, tx, imageID, renditions); err != nil {
+		return err
+	}
+
+	columns := map[string]string{
+		coa.RenditionLarge:  "url_large",
+		coa.RenditionMedium: "url_medium",
+		coa.RenditionSmall:  "url_small",
+	}
+
+	for _, r := range renditions {
+		column, ok := columns[r.Name]
+		if !ok {
+			continue
+		}
+
+		query := fmt.Sprintf("UPDATE images SET %s = ? WHERE id = ?", column)
+		if _, err := tx.ExecContext(ctx, query, r.URL.String(), imageID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func insertRenditions(ctx context.Context, tx *sql.Tx, imageID int64, renditions []coa.Rendition) error {
+	for _, r := range renditions {
+		_, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO renditions(image_id, name, url, width, height, size, format)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (image_id, name) DO UPDATE
+				SET url = excluded.url,
+					width = excluded.width,
+					height = excluded.height,
+					size = excluded.size,
+					format = excluded.format`,
+			imageID,
+			r.Name,
+			r.URL.String(),
+			r.Width,
+			r.Height,
+			r.Size,
+			r.Format,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *sqliteDatabase) InsertPost(ctx context.Context, image coa.Image, platform coa.Platform) error {
+	row := d.db.QueryRowContext(ctx, "SELECT id FROM platforms WHERE name = ?", platform)
+	var pID int64
+	err := row.Scan(&pID)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.ExecContext(
+		ctx,
+		`INSERT INTO
+    			posts(image_id, platform_id)
+			VALUES
+			    (?, ?)`,
+		image.ID,
+		pID,
+	)
+	return err
+}
+
+func (d *sqliteDatabase) GetPlaceAliases(ctx context.Context) ([]coa.PlaceAlias, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT
+			id,
+			component_type,
+			component_name,
+			country,
+			city,
+			priority
+		FROM place_aliases
+		ORDER BY priority DESC, id`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aliases []coa.PlaceAlias
+
+	for rows.Next() {
+		var a coa.PlaceAlias
+		err := rows.Scan(&a.ID, &a.ComponentType, &a.ComponentName, &a.Country, &a.City, &a.Priority)
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+
+	return aliases, rows.Err()
+}
+
+func (d *sqliteDatabase) InsertPlaceAlias(ctx context.Context, alias coa.PlaceAlias) (int64, error) {
+	res, err := d.db.ExecContext(
+		ctx,
+		`INSERT INTO
+    			place_aliases(component_type, component_name, country, city, priority)
+			VALUES
+			    (?, ?, ?, ?, ?)`,
+		alias.ComponentType,
+		alias.ComponentName,
+		alias.Country,
+		alias.City,
+		alias.Priority,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (d *sqliteDatabase) DeletePlaceAlias(ctx context.Context, id int64) error {
+	res, err := d.db.ExecContext(ctx, "DELETE FROM place_aliases WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *sqliteDatabase) GetPrivacyZones(ctx context.Context) ([]coa.PrivacyZone, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT
+			id,
+			name,
+			latitude,
+			longitude,
+			radius,
+			polygon
+		FROM privacy_zones
+		ORDER BY id`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []coa.PrivacyZone
+
+	for rows.Next() {
+		var z coa.PrivacyZone
+		var polygon string
+		err := rows.Scan(&z.ID, &z.Name, &z.Center.Latitude, &z.Center.Longitude, &z.Radius, &polygon)
+		if err != nil {
+			return nil, err
+		}
+
+		if polygon != "" {
+			if err := json.Unmarshal([]byte(polygon), &z.Polygon); err != nil {
+				return nil, fmt.Errorf("invalid polygon of privacy zone %d: %w", z.ID, err)
+			}
+		}
+		zones = append(zones, z)
+	}
+
+	return zones, rows.Err()
+}
+
+func (d *sqliteDatabase) InsertPrivacyZone(ctx context.Context, zone coa.PrivacyZone) (int64, error) {
+	polygon, err := encodePolygon(zone.Polygon)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := d.db.ExecContext(
+		ctx,
+		`INSERT INTO
+    			privacy_zones(name, latitude, longitude, radius, polygon)
+			VALUES
+			    (?, ?, ?, ?, ?)`,
+		zone.Name,
+		zone.Center.Latitude,
+		zone.Center.Longitude,
+		zone.Radius,
+		polygon,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (d *sqliteDatabase) DeletePrivacyZone(ctx context.Context, id int64) error {
+	res, err := d.db.ExecContext(ctx, "DELETE FROM privacy_zones WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// encodePolygon returns the JSON representation of the corners of a privacy zone, or an empty string for circular
+// zones.
+func encodePolygon(polygon []coa.GeoPoint) (string, error) {
+	if len(polygon) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(polygon)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *sqliteDatabase) SetImageHidden(ctx context.Context, id int64, hidden bool) error {
+	res, err := d.db.ExecContext(ctx, "UPDATE images SET hidden = ? WHERE id = ?", hidden, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteImage removes an image and its posts, as well as its coordinates and location if no other image uses them.
+func (d *sqliteDatabase) DeleteImage(ctx context.Context, id int64) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var coordID, locID int64
+	row := tx.QueryRowContext(
+		ctx,
+		`SELECT c.id, c.location_id FROM images AS i JOIN coordinates AS c ON i.coordinate_id = c.id WHERE i.id = ?`,
+		id,
+	)
+	if err := row.Scan(&coordID, &locID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM posts WHERE image_id = ?", id); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM images WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM coordinates WHERE id = ? AND NOT EXISTS (SELECT 1 FROM images WHERE coordinate_id = coordinates.id)",
+		coordID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM locations WHERE id = ? AND NOT EXISTS (SELECT 1 FROM coordinates WHERE location_id = locations.id)",
+		locID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *sqliteDatabase) GetTags(ctx context.Context) ([]coa.Tag, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT
+			t.name,
+			t.controlled,
+			COUNT(it.image_id)
+		FROM tags AS t
+		LEFT JOIN image_tags AS it ON it.tag_id = t.id
+		GROUP BY t.id
+		ORDER BY t.name`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []coa.Tag
+
+	for rows.Next() {
+		var t coa.Tag
+		if err := rows.Scan(&t.Name, &t.Controlled, &t.Images); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, rows.Err()
+}
+
+// CreateTag creates a tag or changes whether an existing tag is controlled.
+func (d *sqliteDatabase) CreateTag(ctx context.Context, name string, controlled bool) error {
+	_, err := d.db.ExecContext(
+		ctx,
+		`INSERT INTO
+    			tags(name, controlled)
+			VALUES
+			    (?, ?)
+			ON CONFLICT (name) DO UPDATE SET controlled = excluded.controlled`,
+		name,
+		controlled,
+	)
+	return err
+}
+
+func (d *sqliteDatabase) DeleteTag(ctx context.Context, name string) error {
+	res, err := d.db.ExecContext(ctx, "DELETE FROM tags WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TagImages adds tags to images. Tags that don't exist yet are created as free-form tags.
+func (d *sqliteDatabase) TagImages(ctx context.Context, imageIDs []int64, tags []string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, tag := range tags {
+		_, err := tx.ExecContext(ctx, "INSERT INTO tags(name) VALUES (?) ON CONFLICT (name) DO NOTHING", tag)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range imageIDs {
+			_, err := tx.ExecContext(
+				ctx,
+				"INSERT OR IGNORE INTO image_tags(image_id, tag_id) SELECT ?, id FROM tags WHERE name = ?",
+				id,
+				tag,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *sqliteDatabase) UntagImages(ctx context.Context, imageIDs []int64, tags []string) error {
+	if len(imageIDs) == 0 || len(tags) == 0 {
+		return nil
+	}
+
+	var args []any
+	for _, id := range imageIDs {
+		args = append(args, id)
+	}
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+
+	_, err := d.db.ExecContext(
+		ctx,
+		`DELETE FROM image_tags
+			WHERE image_id IN (`+placeholders(len(imageIDs))+`)
+			AND tag_id IN (SELECT id FROM tags WHERE name IN (`+placeholders(len(tags))+`))`,
+		args...,
+	)
+	return err
+}
+
+func (d *sqliteDatabase) GetCats(ctx context.Context) ([]coa.Cat, error) {
+	return d.queryCats(ctx, "ORDER BY name, id")
+}
+
+func (d *sqliteDatabase) GetCat(ctx context.Context, id int64) (coa.Cat, error) {
+	cats, err := d.queryCats(ctx, "WHERE id = ?", id)
+	if err != nil {
+		return coa.Cat{}, err
+	}
+
+	if len(cats) == 0 {
+		return coa.Cat{}, sql.ErrNoRows
+	}
+	return cats[0], nil
+}
+
+// queryCats selects cats together with the number of their images and when they were first and last seen. Hidden
+// images are not taken into account. The rest of the query after the FROM clause is given by conditions.
+func (d *sqliteDatabase) queryCats(ctx context.Context, conditions string, args ...any) ([]coa.Cat, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, name, description FROM cats "+conditions, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cats []coa.Cat
+	indexes := make(map[int64]int)
+
+	for rows.Next() {
+		var c coa.Cat
+		if err := rows.Scan(&c.ID, &c.Name, &c.Description); err != nil {
+			return nil, err
+		}
+
+		indexes[c.ID] = len(cats)
+		cats = append(cats, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// MIN() and MAX() would return the timestamps as text, because the column type is lost
+	sightings, err := d.db.QueryContext(ctx, `
+		SELECT ci.cat_id, i.timestamp
+		FROM cat_images AS ci
+		JOIN images AS i ON ci.image_id = i.id
+		WHERE NOT i.hidden`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer sightings.Close()
+
+	for sightings.Next() {
+		var catID int64
+		var timestamp time.Time
+		if err := sightings.Scan(&catID, &timestamp); err != nil {
+			return nil, err
+		}
+
+		idx, ok := indexes[catID]
+		if !ok {
+			continue
+		}
+
+		c := &cats[idx]
+		timestamp = timestamp.UTC()
+		if c.Sightings == 0 || timestamp.Before(c.FirstSeen) {
+			c.FirstSeen = timestamp
+		}
+		if c.Sightings == 0 || timestamp.After(c.LastSeen) {
+			c.LastSeen = timestamp
+		}
+		c.Sightings++
+	}
+
+	return cats, sightings.Err()
+}
+
+func (d *sqliteDatabase) GetSightings(ctx context.Context, catID int64) ([]coa.Image, error) {
+	return d.queryImages(
+		ctx,
+		`JOIN cat_images AS ci ON ci.image_id = i.id
+		WHERE ci.cat_id = ? AND NOT i.hidden
+		ORDER BY i.timestamp, i.id`,
+		catID,
+	)
+}
+
+func (d *sqliteDatabase) InsertCat(ctx context.Context, cat coa.Cat) (int64, error) {
+	res, err := d.db.ExecContext(
+		ctx,
+		"INSERT INTO cats(name, description) VALUES (?, ?)",
+		cat.Name,
+		cat.Description,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (d *sqliteDatabase) MergeCats(ctx context.Context, targetID int64, sourceIDs []int64) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := catExists(ctx, tx, targetID); err != nil {
+		return err
+	}
+
+	for _, sourceID := range sourceIDs {
+		if sourceID == targetID {
+			return fmt.Errorf("unable to merge cat %d with itself", targetID)
+		}
+
+		if err := catExists(ctx, tx, sourceID); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT OR IGNORE INTO cat_images(cat_id, image_id) SELECT ?, image_id FROM cat_images WHERE cat_id = ?",
+			targetID,
+			sourceID,
+		)
+		if err != nil {
+			return err
+		}
+
+		// also deletes the links to the images of the source cat
+		if _, err := tx.ExecContext(ctx, "DELETE FROM cats WHERE id = ?", sourceID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *sqliteDatabase) UpdateCatImages(ctx context.Context, catID int64, attach, detach []int64) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := catExists(ctx, tx, catID); err != nil {
+		return err
+	}
+
+	if len(detach) > 0 {
+		args := []any{catID}
+		for _, id := range detach {
+			args = append(args, id)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			"DELETE FROM cat_images WHERE cat_id = ? AND image_id IN ("+placeholders(len(detach))+")",
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range attach {
+		// unknown images would only show up as a constraint violation
+		var found int64
+		if err := tx.QueryRowContext(ctx, "SELECT id FROM images WHERE id = ?", id).Scan(&found); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO cat_images(cat_id, image_id) VALUES (?, ?)", catID, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const jobColumns = `
+	id,
+	file_name,
+	storage_key,
+	state,
+	attempts,
+	claim,
+	last_error,
+	run_at,
+	created_at,
+	updated_at`
+
+func (d *sqliteDatabase) InsertJob(ctx context.Context, job coa.Job) (int64, error) {
+	now := jobTime(time.Now())
+
+	res, err := d.db.ExecContext(
+		ctx,
+		`INSERT INTO
+    			jobs(file_name, storage_key, run_at, created_at, updated_at)
+			VALUES
+			    (?, ?, ?, ?, ?)`,
+		job.FileName,
+		job.StorageKey,
+		now,
+		now,
+		now,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (d *sqliteDatabase) ClaimJob(ctx context.Context, lease time.Duration, maxAttempts int) (coa.Job, error) {
+	now := jobTime(time.Now())
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return coa.Job{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE jobs
+		SET state = 'failed', last_error = ?, locked_until = NULL, updated_at = ?
+		WHERE state = 'running' AND locked_until < ? AND attempts >= ?`,
+		coa.JobAbandoned,
+		now,
+		now,
+		maxAttempts,
+	)
+	if err != nil {
+		return coa.Job{}, err
+	}
+
+	// SQLite only allows one writer at a time, so the statement can't hand out a job twice
+	row := tx.QueryRowContext(
+		ctx,
+		`UPDATE jobs
+		SET
+			state = 'running',
+			attempts = attempts + 1,
+			claim = claim + 1,
+			locked_until = ?,
+			updated_at = ?
+		WHERE id = (
+			SELECT id
+			FROM jobs
+			WHERE (state = 'queued' AND run_at <= ?) OR (state = 'running' AND locked_until < ? AND attempts < ?)
+			ORDER BY run_at, id
+			LIMIT 1
+		)
+		RETURNING`+jobColumns,
+		jobTime(now.Add(lease)),
+		now,
+		now,
+		now,
+		maxAttempts,
+	)
+
+	job, err := scanJob(row)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return coa.Job{}, err
+	}
+
+	// the abandoned jobs are failed even if there is nothing to claim
+	if commitErr := tx.Commit(); commitErr != nil {
+		return coa.Job{}, commitErr
+	}
+	return job, err
+}
+
+func (d *sqliteDatabase) CompleteJob(ctx context.Context, job coa.Job) error {
+	return d.updateJob(
+		ctx,
+		`UPDATE jobs
+		SET state = 'done', locked_until = NULL, updated_at = ?
+		WHERE id = ? AND claim = ? AND state = 'running'`,
+		jobTime(time.Now()),
+		job.ID,
+		job.Claim,
+	)
+}
+
+func (d *sqliteDatabase) RetryJob(ctx context.Context, job coa.Job, lastError string, runAt time.Time) error {
+	return d.updateJob(
+		ctx,
+		`UPDATE jobs
+		SET state = 'queued', last_error = ?, run_at = ?, locked_until = NULL, updated_at = ?
+		WHERE id = ? AND claim = ? AND state = 'running'`,
+		lastError,
+		jobTime(runAt),
+		jobTime(time.Now()),
+		job.ID,
+		job.Claim,
+	)
+}
+
+func (d *sqliteDatabase) FailJob(ctx context.Context, job coa.Job, lastError string) error {
+	return d.updateJob(
+		ctx,
+		`UPDATE jobs
+		SET state = 'failed', last_error = ?, locked_until = NULL, updated_at = ?
+		WHERE id = ? AND claim = ? AND state = 'running'`,
+		lastError,
+		jobTime(time.Now()),
+		job.ID,
+		job.Claim,
+	)
+}
+
+func (d *sqliteDatabase) ReleaseJob(ctx context.Context, job coa.Job) error {
+	return d.updateJob(
+		ctx,
+		`UPDATE jobs
+		SET state = 'queued', attempts = MAX(attempts - 1, 0), locked_until = NULL, updated_at = ?
+		WHERE id = ? AND claim = ? AND state = 'running'`,
+		jobTime(time.Now()),
+		job.ID,
+		job.Claim,
+	)
+}
+
+func (d *sqliteDatabase) updateJob(ctx context.Context, query string, args ...any) error {
+	res, err := d.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *sqliteDatabase) GetJobs(ctx context.Context) ([]coa.Job, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT"+jobColumns+" FROM jobs ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []coa.Job
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+func scanJob(row scanner) (coa.Job, error) {
+	var job coa.Job
+	err := row.Scan(
+		&job.ID,
+		&job.FileName,
+		&job.StorageKey,
+		&job.State,
+		&job.Attempts,
+		&job.Claim,
+		&job.LastError,
+		&job.RunAt,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		return coa.Job{}, err
+	}
+
+	job.RunAt = job.RunAt.UTC()
+	job.CreatedAt = job.CreatedAt.UTC()
+	job.UpdatedAt = job.UpdatedAt.UTC()
+	return job, nil
+}
+
+// jobTime converts a time to UTC with second precision, so that the timestamps of jobs can be compared as text.
+func jobTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// catExists returns sql.ErrNoRows if there is no cat with the given ID.
+func catExists(ctx context.Context, tx *sql.Tx, id int64) error {
+	var found int64
+	return tx.QueryRowContext(ctx, "SELECT id FROM cats WHERE id = ?", id).Scan(&found)
+}
+
+// loadRelated sets the tags and renditions of the given images.
+func (d *sqliteDatabase) loadRelated(ctx context.Context, images []coa.Image) error {
+	if err := d.loadTags(ctx, images); err != nil {
+		return err
+	}
+	return d.loadRenditions(ctx, images)
+}
+
+// loadRenditions sets the renditions of the given images, sorted by width.
+func (d *sqliteDatabase) loadRenditions(ctx context.Context, images []coa.Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	indexes := make(map[int64]int)
+	var ids []any
+	for idx, img := range images {
+		indexes[img.ID] = idx
+		ids = append(ids, img.ID)
+	}
+
+	rows, err := d.db.QueryContext(
+		ctx,
+		`SELECT image_id, name, url, width, height, size, format
+			FROM renditions
+			WHERE image_id IN (`+placeholders(len(ids))+`)
+			ORDER BY width, name`,
+		ids...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var r coa.Rendition
+		var u string
+		if err := rows.Scan(&id, &r.Name, &u, &r.Width, &r.Height, &r.Size, &r.Format); err != nil {
+			return err
+		}
+
+		r.URL, err = url.Parse(u)
+		if err != nil {
+			return err
+		}
+
+		idx := indexes[id]
+		images[idx].Renditions = append(images[idx].Renditions, r)
+	}
+
+	return rows.Err()
+}
+
+// loadTags sets the tags of the given images.
+func (d *sqliteDatabase) loadTags(ctx context.Context, images []coa.Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	indexes := make(map[int64]int)
+	var ids []any
+	for idx, img := range images {
+		indexes[img.ID] = idx
+		ids = append(ids, img.ID)
+	}
+
+	rows, err := d.db.QueryContext(
+		ctx,
+		`SELECT it.image_id, t.name
+			FROM image_tags AS it
+			JOIN tags AS t ON it.tag_id = t.id
+			WHERE it.image_id IN (`+placeholders(len(ids))+`)
+			ORDER BY t.name`,
+		ids...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+
+		idx := indexes[id]
+		images[idx].Tags = append(images[idx].Tags, tag)
+	}
+
+	return rows.Err()
+}
+
+func (d *sqliteDatabase) scanImageWithRelated(ctx context.Context, row scanner) (coa.Image, error) {
+	img, err := scanImage(row)
+	if err != nil {
+		return img, err
+	}
+
+	images := []coa.Image{img}
+	err = d.loadRelated(ctx, images)
+	return images[0], err
+}
+
+// GetPerceptualHashes returns the perceptual hashes of all images by image ID, including hidden images. Images
+// without a hash are left out.
+func (d *sqliteDatabase) GetPerceptualHashes(ctx context.Context) (map[int64]uint64, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, phash FROM images WHERE phash IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[int64]uint64)
+
+	for rows.Next() {
+		var id, phash int64
+		if err := rows.Scan(&id, &phash); err != nil {
+			return nil, err
+		}
+		hashes[id] = uint64(phash)
+	}
+
+	return hashes, rows.Err()
+}
+
+func (d *sqliteDatabase) Close() error {
+	return d.db.Close()
+}
+
+func getOrCreateCoordinates(ctx context.Context, tx *sql.Tx, img coa.Image) (int64, error) {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO locations(city, country, timezone) VALUES (?, ?, ?) ON CONFLICT (city, country) DO NOTHING",
+		img.City,
+		img.Country,
+		img.Timezone,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO
+    			coordinates(latitude, longitude, location_id)
+			SELECT ?, ?, id FROM locations WHERE city = ? AND country = ?
+			ON CONFLICT (latitude, longitude) DO NOTHING`,
+		img.Latitude,
+		img.Longitude,
+		img.City,
+		img.Country,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	row := tx.QueryRowContext(
+		ctx,
+		"SELECT id FROM coordinates WHERE latitude = ? AND longitude = ?",
+		img.Latitude,
+		img.Longitude,
+	)
+	var id int64
+	err = row.Scan(&id)
+	return id, err
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanImage(row scanner) (coa.Image, error) {
+	var img coa.Image
+	var ul, um, us string
+	var phash sql.NullInt64
+
+	err := row.Scan(
+		&img.ID,
+		&ul,
+		&um,
+		&us,
+		&img.SHA256,
+		&img.Timestamp,
+		&img.Latitude,
+		&img.Longitude,
+		&img.City,
+		&img.Country,
+		&img.Timezone,
+		&img.Hidden,
+		&phash,
+		&img.Format)
+
+	if err != nil {
+		return img, err
+	}
+
+	// the bits are stored as a signed integer
+	img.PHash = uint64(phash.Int64)
+
+	img.URLLarge, err = url.Parse(ul)
+	if err != nil {
+		return img, err
+	}
+
+	img.URLMedium, err = url.Parse(um)
+	if err != nil {
+		return img, err
+	}
+
+	img.URLSmall, err = url.Parse(us)
+	if err != nil {
+		return img, err
+	}
+
+	loc, err := time.LoadLocation(img.Timezone)
+	if err != nil {
+		return img, err
+	}
+
+	img.Timestamp = img.Timestamp.In(loc)
+	return img, nil
+}
+
+// formatOf returns the format of the original file of an image. Images ingested before other formats were supported
+// are JPEGs.
+func formatOf(img coa.Image) string {
+	if img.Format == "" {
+		return coa.FormatJPEG
+	}
+	return img.Format
+}
+
+// toPHash converts the perceptual hash of an image for storing it in an INTEGER column. Unknown hashes become NULL.
+func toPHash(img coa.Image) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(img.PHash), Valid: img.PHash != 0}
+}
+
+// placeholders returns a comma-separated list of n query parameters for use with IN.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// toTimestamp drops the time zone, like a TIMESTAMP column in Postgres does. The time zone is restored from the
+// location when reading the image.
+func toTimestamp(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
@@ -0,0 +1,34 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package sqlite
+
+import (
+	coa "github.com/haikoschol/cats-of-asia"
+	"github.com/haikoschol/cats-of-asia/pkg/dbtest"
+	"path/filepath"
+	"testing"
+)
+
+func TestDatabase(t *testing.T) {
+	dbtest.TestDatabase(t, func(t *testing.T) coa.Database {
+		db, err := NewDatabase(filepath.Join(t.TempDir(), "coa.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
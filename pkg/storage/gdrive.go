@@ -0,0 +1,209 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type gdriveStorage struct {
+	service  *drive.Service
+	folderID string
+	// fileIDs caches the Google Drive file IDs of keys to avoid looking them up via the API over and over again
+	fileIDs map[string]string
+	mu      sync.Mutex
+}
+
+// NewGoogleDrive creates a coa.Storage that keeps files in a Google Drive folder. Keys are used as file names.
+func NewGoogleDrive(svcAccountEmail, svcAccountPrivateKey, folderID string) (coa.Storage, error) {
+	config := &jwt.Config{
+		Email:      svcAccountEmail,
+		PrivateKey: []byte(svcAccountPrivateKey),
+		TokenURL:   google.JWTTokenURL,
+		Scopes:     []string{drive.DriveScope},
+	}
+
+	ctx := context.Background()
+	client := config.Client(ctx)
+	service, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Google Drive service: %w", err)
+	}
+
+	return &gdriveStorage{
+		service:  service,
+		folderID: folderID,
+		fileIDs:  make(map[string]string),
+	}, nil
+}
+
+// Put replaces the content of an existing file with the same name, since Google Drive allows several files with the
+// same name in a folder. Otherwise a new file is created.
+func (s *gdriveStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	id, found, err := s.lookUpFileID(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// the content type is detected by the client library
+	if found {
+		if _, err := s.service.Files.Update(id, &drive.File{}).Media(r).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("unable to update file %s in Google Drive folder %s: %w", key, s.folderID, err)
+		}
+		return nil
+	}
+
+	dst := &drive.File{
+		Name:    key,
+		Parents: []string{s.folderID},
+	}
+
+	res, err := s.service.Files.Create(dst).Media(r).Fields("id").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to upload file %s to Google Drive folder %s: %w", key, s.folderID, err)
+	}
+
+	s.mu.Lock()
+	s.fileIDs[key] = res.Id
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *gdriveStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	id, err := s.fileID(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.service.Files.Get(id).Context(ctx).Download()
+	if err != nil {
+		return nil, fmt.Errorf("unable to download file %s from Google Drive: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+func (s *gdriveStorage) Delete(ctx context.Context, key string) error {
+	id, err := s.fileID(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := s.service.Files.Delete(id).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to delete file %s from Google Drive: %w", key, err)
+	}
+
+	s.mu.Lock()
+	delete(s.fileIDs, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// DeleteURL removes the file with the ID in a link returned by URL. Files stored before keys were derived from
+// checksums are named after the file they were ingested from, which isn't unique, so they can only be deleted this way.
+func (s *gdriveStorage) DeleteURL(ctx context.Context, u *url.URL) error {
+	id := u.Query().Get("id")
+	if u.Host != "drive.google.com" || id == "" {
+		return fmt.Errorf("URL %s is not a link to a Google Drive file", u)
+	}
+
+	if err := s.service.Files.Delete(id).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to delete file %s from Google Drive: %w", id, err)
+	}
+
+	s.mu.Lock()
+	for key, cached := range s.fileIDs {
+		if cached == id {
+			delete(s.fileIDs, key)
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// URL returns a link to the file that can be embedded in web pages. The webContentLink returned by the API also
+// contains "export=download", which causes the browser to download the image instead of displaying it.
+func (s *gdriveStorage) URL(ctx context.Context, key string) (*url.URL, error) {
+	id, err := s.fileID(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &url.URL{
+		Scheme:   "https",
+		Host:     "drive.google.com",
+		Path:     "/uc",
+		RawQuery: url.Values{"id": {id}}.Encode(),
+	}, nil
+}
+
+func (s *gdriveStorage) fileID(ctx context.Context, key string) (string, error) {
+	id, found, err := s.lookUpFileID(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	if !found {
+		return "", fmt.Errorf("file %s not found in Google Drive folder %s", key, s.folderID)
+	}
+	return id, nil
+}
+
+// lookUpFileID returns the ID of the file with the name key, if there is one.
+func (s *gdriveStorage) lookUpFileID(ctx context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	id, ok := s.fileIDs[key]
+	s.mu.Unlock()
+	if ok {
+		return id, true, nil
+	}
+
+	q := fmt.Sprintf(
+		"name = '%s' and '%s' in parents and trashed = false",
+		escapeQuery(key),
+		escapeQuery(s.folderID),
+	)
+
+	res, err := s.service.Files.List().Q(q).Fields("files(id)").Context(ctx).Do()
+	if err != nil {
+		return "", false, fmt.Errorf("unable to look up file %s in Google Drive folder %s: %w", key, s.folderID, err)
+	}
+
+	if len(res.Files) == 0 {
+		return "", false, nil
+	}
+
+	id = res.Files[0].Id
+	s.mu.Lock()
+	s.fileIDs[key] = id
+	s.mu.Unlock()
+	return id, true, nil
+}
+
+func escapeQuery(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, `'`, `\'`)
+}
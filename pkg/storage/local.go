@@ -0,0 +1,132 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type localStorage struct {
+	dir     string
+	baseURL *url.URL
+}
+
+// NewLocal creates a coa.Storage that keeps files in a directory on the local filesystem. The URLs it hands out are
+// built by appending keys to baseURL, so whatever serves that URL needs to map it to dir.
+func NewLocal(dir, baseURL string) (coa.Storage, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %s for local storage: %w", baseURL, err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create storage directory %s: %w", dir, err)
+	}
+
+	return &localStorage{dir, u}, nil
+}
+
+func (s *localStorage) Put(_ context.Context, key string, r io.Reader) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("unable to create directory for %s: %w", dst, err)
+	}
+
+	// write to a temporary file first, so that readers never see partially written files
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file for %s: %w", dst, err)
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("unable to write file %s: %w", dst, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("unable to write file %s: %w", dst, err)
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("unable to move file to %s: %w", dst, err)
+	}
+	return nil
+}
+
+func (s *localStorage) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *localStorage) Delete(_ context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	// clean up the directory once it's empty, e.g. after all renditions of an image have been deleted
+	if dir := filepath.Dir(p); dir != filepath.Clean(s.dir) {
+		_ = os.Remove(dir)
+	}
+	return nil
+}
+
+func (s *localStorage) DeleteURL(ctx context.Context, u *url.URL) error {
+	key, err := keyFromURL(s.baseURL, u)
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, key)
+}
+
+func (s *localStorage) URL(_ context.Context, key string) (*url.URL, error) {
+	if _, err := s.path(key); err != nil {
+		return nil, err
+	}
+	return s.baseURL.JoinPath(key), nil
+}
+
+// path returns the location of the file for key, making sure it is inside the storage directory.
+func (s *localStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, `\`) {
+		return "", fmt.Errorf("invalid storage key '%s'", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(cleaned)), nil
+}
@@ -0,0 +1,321 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is used instead of the checksum of the body in signatures, so that the body can be streamed.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Config contains the settings for an S3-compatible object store, e.g. AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PublicURL is the base URL used for links to objects (e.g. a CDN in front of the bucket). Optional, defaults
+	// to the bucket URL.
+	PublicURL string
+}
+
+type s3Storage struct {
+	cfg       S3Config
+	endpoint  *url.URL
+	publicURL *url.URL
+	client    *http.Client
+}
+
+// NewS3 creates a coa.Storage that keeps files as objects in an S3 bucket. Requests use path-style addressing and
+// are signed with AWS Signature Version 4, which is what MinIO and most other S3-compatible services support.
+func NewS3(cfg S3Config) (coa.Storage, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %w", cfg.Endpoint, err)
+	}
+
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: scheme and host are required", cfg.Endpoint)
+	}
+
+	publicURL := endpoint.JoinPath(cfg.Bucket)
+	if cfg.PublicURL != "" {
+		publicURL, err = url.Parse(cfg.PublicURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 public URL %s: %w", cfg.PublicURL, err)
+		}
+	}
+
+	return &s3Storage{
+		cfg:       cfg,
+		endpoint:  endpoint,
+		publicURL: publicURL,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Put streams the content to S3 without hashing it first, so the payload isn't signed. S3 needs to know the size
+// upfront, so content that can't tell its size, i.e. isn't an io.Seeker like files are, is read into memory first.
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader) error {
+	size, err := remainingSize(r)
+	if err != nil {
+		return fmt.Errorf("unable to determine size of content for S3 object %s: %w", key, err)
+	}
+
+	if size < 0 {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("unable to read content for S3 object %s: %w", key, err)
+		}
+		r, size = bytes.NewReader(body), int64(len(body))
+	}
+
+	// the content type is detected from the start of the content, which is read again when it is sent
+	content := bufio.NewReaderSize(r, 512)
+	head, err := content.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to read content for S3 object %s: %w", key, err)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, key, content, size, http.DetectContentType(head))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) DeleteURL(ctx context.Context, u *url.URL) error {
+	key, err := keyFromURL(s.publicURL, u)
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, key)
+}
+
+func (s *s3Storage) URL(ctx context.Context, key string) (*url.URL, error) {
+	return s.publicURL.JoinPath(key), nil
+}
+
+// do sends a signed request for the object with the given key and returns the response if it was successful. body is
+// sent as an unsigned payload and must have the given size.
+func (s *s3Storage) do(
+	ctx context.Context,
+	method, key string,
+	body io.Reader,
+	size int64,
+	contentType string,
+) (*http.Response, error) {
+	objectPath := s3EscapePath(strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.cfg.Bucket + "/" + key)
+	objectURL := fmt.Sprintf("%s://%s%s", s.endpoint.Scheme, s.endpoint.Host, objectPath)
+
+	payloadHash := sha256Hex(nil)
+	if body != nil {
+		payloadHash = unsignedPayload
+		// otherwise an empty body would be sent with chunked encoding, which S3 doesn't support
+		if size == 0 {
+			body = http.NoBody
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, objectURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create S3 request for object %s: %w", key, err)
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 request %s %s failed: %w", method, key, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("S3 request %s %s failed with status %s: %s", method, key, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// sign adds the headers for AWS Signature Version 4 to req. The host and all headers that are set at this point are
+// signed. payloadHash is the hex-encoded SHA256 checksum of the body, or unsignedPayload.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	values := map[string]string{"host": req.URL.Host}
+	for name, v := range req.Header {
+		values[strings.ToLower(name)] = strings.Join(strings.Fields(strings.Join(v, ",")), " ")
+	}
+
+	headers := make([]string, 0, len(values))
+	for name := range values {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		canonicalHeaders.WriteString(h + ":" + values[h] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.cfg.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s.cfg.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// s3CanonicalQuery returns the query parameters sorted by name, with names and values URI-encoded, e.g.
+// "max-keys=2&prefix=J". Parameters without value still get an equals sign.
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3EscapePath URI-encodes every byte of p except unreserved characters and slashes, as required for the canonical
+// request.
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3Escape URI-encodes every byte of s except unreserved characters and, if keepSlashes is true, slashes.
+func s3Escape(s string, keepSlashes bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlashes) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// remainingSize returns the number of bytes left in r, or -1 if r doesn't support seeking.
+func remainingSize(r io.Reader) (int64, error) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return -1, nil
+	}
+
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := seeker.Seek(current, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - current, nil
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
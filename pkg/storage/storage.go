@@ -0,0 +1,71 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"fmt"
+	coa "github.com/haikoschol/cats-of-asia"
+	"net/url"
+	"strings"
+)
+
+type Backend string
+
+const (
+	GoogleDrive Backend = "gdrive"
+	Local               = "local"
+	S3                  = "s3"
+	// None explicitly turns off a storage that is required otherwise, e.g. the one for originals
+	None = "none"
+)
+
+// Config contains the settings for all storage backends. Only the ones for the selected Backend need to be set.
+type Config struct {
+	Backend Backend
+
+	SvcAccountEmail      string
+	SvcAccountPrivateKey string
+	GDriveFolderID       string
+
+	LocalDir string
+	LocalURL string
+
+	S3 S3Config
+}
+
+// New creates a coa.Storage for the backend selected in the config.
+func New(cfg Config) (coa.Storage, error) {
+	switch cfg.Backend {
+	case GoogleDrive:
+		return NewGoogleDrive(cfg.SvcAccountEmail, cfg.SvcAccountPrivateKey, cfg.GDriveFolderID)
+	case Local:
+		return NewLocal(cfg.LocalDir, cfg.LocalURL)
+	case S3:
+		return NewS3(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", cfg.Backend)
+	}
+}
+
+// keyFromURL returns the key of the content at u, which has to be below base.
+func keyFromURL(base, u *url.URL) (string, error) {
+	key, found := strings.CutPrefix(u.Path, strings.TrimSuffix(base.Path, "/")+"/")
+	if u.Scheme != base.Scheme || u.Host != base.Host || !found || key == "" {
+		return "", fmt.Errorf("URL %s is not below %s", u, base)
+	}
+	return key, nil
+}
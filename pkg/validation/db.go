@@ -18,24 +18,220 @@ package validation
 
 import (
 	"fmt"
+	"github.com/haikoschol/cats-of-asia/pkg/database"
+	"github.com/haikoschol/cats-of-asia/pkg/geo"
+	"github.com/haikoschol/cats-of-asia/pkg/ingestion"
+	"github.com/haikoschol/cats-of-asia/pkg/sanitize"
+	"github.com/haikoschol/cats-of-asia/pkg/storage"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
-func ValidateDbEnv(dbHost, dbSSLMode, dbName, dbUser, dbPassword string) (errors []string) {
-	if dbHost == "" {
-		errors = append(errors, "COA_DB_HOST env var missing")
+func ValidateDbEnv(cfg database.Config) (errors []string) {
+	switch cfg.Driver {
+	case database.Postgres:
+		if cfg.Host == "" {
+			errors = append(errors, "COA_DB_HOST env var missing")
+		}
+		if cfg.SSLMode == "" {
+			errors = append(errors, "COA_DB_SSLMODE env var missing")
+		}
+		if cfg.Name == "" {
+			errors = append(errors, "COA_DB_NAME env var missing")
+		}
+		if cfg.User == "" {
+			errors = append(errors, "COA_DB_USER env var missing")
+		}
+		if cfg.Password == "" {
+			errors = append(errors, "COA_DB_PASSWORD env var missing")
+		}
+	case database.SQLite:
+		if cfg.Path == "" {
+			errors = append(errors, "COA_DB_PATH env var missing")
+		}
+	default:
+		errors = append(errors, fmt.Sprintf("COA_DB_DRIVER env var has invalid value '%s'", cfg.Driver))
 	}
-	if dbSSLMode == "" {
-		errors = append(errors, "COA_DB_SSLMODE env var missing")
+
+	return errors
+}
+
+func ValidateStorageEnv(cfg storage.Config) (errors []string) {
+	switch cfg.Backend {
+	case storage.GoogleDrive:
+		if cfg.SvcAccountEmail == "" {
+			errors = append(errors, "env var COA_GOOGLE_DRIVE_EMAIL not set")
+		}
+		if cfg.SvcAccountPrivateKey == "" {
+			errors = append(errors, "env var COA_GOOGLE_DRIVE_PRIVATE_KEY not set")
+		}
+		if cfg.GDriveFolderID == "" {
+			errors = append(errors, "COA_GOOGLE_DRIVE_FOLDER_ID env var missing")
+		}
+	case storage.Local:
+		if cfg.LocalDir == "" {
+			errors = append(errors, "COA_STORAGE_DIR env var missing")
+		}
+		if cfg.LocalURL == "" {
+			errors = append(errors, "COA_STORAGE_URL env var missing")
+		}
+	case storage.S3:
+		if cfg.S3.Endpoint == "" {
+			errors = append(errors, "COA_S3_ENDPOINT env var missing")
+		}
+		if cfg.S3.Region == "" {
+			errors = append(errors, "COA_S3_REGION env var missing")
+		}
+		if cfg.S3.Bucket == "" {
+			errors = append(errors, "COA_S3_BUCKET env var missing")
+		}
+		if cfg.S3.AccessKeyID == "" {
+			errors = append(errors, "COA_S3_ACCESS_KEY_ID env var missing")
+		}
+		if cfg.S3.SecretAccessKey == "" {
+			errors = append(errors, "COA_S3_SECRET_ACCESS_KEY env var missing")
+		}
+	default:
+		errors = append(errors, fmt.Sprintf("COA_STORAGE env var has invalid value '%s'", cfg.Backend))
 	}
-	if dbName == "" {
-		errors = append(errors, "COA_DB_NAME env var missing")
+
+	return errors
+}
+
+func ValidateGeocoderEnv(geocoder, geoNamesDir string) (errors []string) {
+	switch geocoder {
+	case "", geo.Google:
+	case geo.GeoNames:
+		if geoNamesDir == "" {
+			errors = append(errors, "COA_GEONAMES_DIR env var missing")
+		}
+	default:
+		errors = append(errors, fmt.Sprintf("COA_GEOCODER env var has invalid value '%s'", geocoder))
+	}
+
+	return errors
+}
+
+func ValidateNearDuplicateEnv(action, distance string) (errors []string) {
+	switch ingestion.NearDuplicateAction(action) {
+	case "", ingestion.SkipNearDuplicates, ingestion.FlagNearDuplicates, ingestion.IgnoreNearDuplicates:
+	default:
+		errors = append(errors, fmt.Sprintf("COA_NEAR_DUPLICATES env var has invalid value '%s'", action))
 	}
-	if dbUser == "" {
-		errors = append(errors, "COA_DB_USER env var missing")
+
+	if d, err := strconv.Atoi(distance); distance != "" && (err != nil || d < 0 || d > 64) {
+		errors = append(errors, fmt.Sprintf("COA_NEAR_DUPLICATE_DISTANCE env var has invalid value '%s'", distance))
+	}
+
+	return errors
+}
+
+// ValidateConcurrencyEnv checks the optional number of images each stage of the ingestion pipeline works on at the same
+// time.
+func ValidateConcurrencyEnv(scan, process, lookup, upload string) (errors []string) {
+	vars := []struct {
+		name  string
+		value string
+	}{
+		{"COA_SCAN_CONCURRENCY", scan},
+		{"COA_PROCESS_CONCURRENCY", process},
+		{"COA_LOOKUP_CONCURRENCY", lookup},
+		{"COA_UPLOAD_CONCURRENCY", upload},
+	}
+
+	for _, v := range vars {
+		if n, err := strconv.Atoi(v.value); v.value != "" && (err != nil || n < 1) {
+			errors = append(errors, fmt.Sprintf("%s env var has invalid value '%s'", v.name, v.value))
+		}
+	}
+	return errors
+}
+
+// ValidateExitCodeEnv checks an optional env var with an exit code.
+func ValidateExitCodeEnv(name, code string) (errors []string) {
+	if n, err := strconv.Atoi(code); code != "" && (err != nil || n < 0 || n > 125) {
+		errors = append(errors, fmt.Sprintf("%s env var has invalid value '%s'", name, code))
 	}
-	if dbPassword == "" {
-		errors = append(errors, "COA_DB_PASSWORD env var missing")
+	return errors
+}
+
+// ValidateDurationEnv checks an optional env var with a positive duration, e.g. "30s".
+func ValidateDurationEnv(name, duration string) (errors []string) {
+	if d, err := time.ParseDuration(duration); duration != "" && (err != nil || d <= 0) {
+		errors = append(errors, fmt.Sprintf("%s env var has invalid value '%s'", name, duration))
+	}
+	return errors
+}
+
+// ValidateMetadataEnv checks the EXIF allowlist and the storage for originals, which must be separate from the public
+// storage. Since public files don't have all metadata, the storage for originals is required unless it is explicitly
+// turned off.
+func ValidateMetadataEnv(allowlist string, originals, public storage.Config) (errors []string) {
+	if err := sanitize.ValidateFields(sanitize.ParseFields(allowlist)); err != nil {
+		errors = append(errors, fmt.Sprintf("COA_EXIF_ALLOWLIST env var has invalid value: %v", err))
+	}
+
+	switch originals.Backend {
+	case "":
+		errors = append(
+			errors,
+			"COA_ORIGINALS_STORAGE env var missing. without it the metadata removed from public files is lost. "+
+				"set it to 'none' to discard the original files anyway",
+		)
+	case storage.None:
+	default:
+		errors = append(errors, validatePrivateStorageEnv("ORIGINALS", originals, public)...)
+	}
+
+	return errors
+}
+
+// ValidateJobEnv checks the storage for uploaded files, which must be separate from the public storage and survive
+// restarts, and the optional settings of the job queue.
+func ValidateJobEnv(uploads, public storage.Config, workers, maxAttempts string) (errors []string) {
+	if uploads.Backend == "" {
+		errors = append(errors, "COA_UPLOADS_STORAGE env var missing")
+	} else {
+		errors = validatePrivateStorageEnv("UPLOADS", uploads, public)
+	}
+
+	if n, err := strconv.Atoi(workers); workers != "" && (err != nil || n < 1) {
+		errors = append(errors, fmt.Sprintf("COA_JOB_WORKERS env var has invalid value '%s'", workers))
+	}
+
+	if n, err := strconv.Atoi(maxAttempts); maxAttempts != "" && (err != nil || n < 1) {
+		errors = append(errors, fmt.Sprintf("COA_JOB_MAX_ATTEMPTS env var has invalid value '%s'", maxAttempts))
+	}
+
+	return errors
+}
+
+// validatePrivateStorageEnv checks the settings of a storage that must not be publicly accessible. name is the part of
+// the env vars after "COA_", e.g. "ORIGINALS" for COA_ORIGINALS_STORAGE.
+func validatePrivateStorageEnv(name string, private, public storage.Config) (errors []string) {
+	switch private.Backend {
+	case storage.Local:
+		if private.LocalDir == "" {
+			errors = append(errors, fmt.Sprintf("COA_%s_DIR env var missing", name))
+		} else if public.Backend == storage.Local && filepath.Clean(private.LocalDir) == filepath.Clean(public.LocalDir) {
+			errors = append(errors, fmt.Sprintf("COA_%s_DIR must not be the same as COA_STORAGE_DIR", name))
+		}
+	case storage.S3:
+		// everything except for the bucket is shared with the public storage
+		cfg := public
+		cfg.Backend = storage.S3
+		cfg.S3.Bucket = private.S3.Bucket
+		errors = append(errors, ValidateStorageEnv(cfg)...)
+
+		if private.S3.Bucket == "" {
+			errors = append(errors, fmt.Sprintf("COA_%s_S3_BUCKET env var missing", name))
+		} else if public.Backend == storage.S3 && private.S3.Bucket == public.S3.Bucket {
+			errors = append(errors, fmt.Sprintf("COA_%s_S3_BUCKET must not be the same as COA_S3_BUCKET", name))
+		}
+	default:
+		errors = append(errors, fmt.Sprintf("COA_%s_STORAGE env var has invalid value '%s'", name, private.Backend))
 	}
 
 	return errors
@@ -0,0 +1,175 @@
+// Copyright (C) 2023 Haiko Schol
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package coa
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// PrivacyGridSize is the size in degrees of the grid cells that the coordinates of images inside a privacy zone are
+// moved into. At the equator a cell is about 2.2 km wide.
+const PrivacyGridSize = 0.02
+
+// GeoPoint is a pair of coordinates in degrees.
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// PrivacyZone is an area in which the precise location of images isn't published, e.g. the home of a friend. A zone
+// is either a circle around Center or, if Polygon is set, the area inside the polygon.
+type PrivacyZone struct {
+	ID   int64
+	Name string
+	// Center of a circular zone
+	Center GeoPoint
+	// Radius of a circular zone in meters
+	Radius float64
+	// Polygon contains the corners of the zone. The last corner is connected to the first one.
+	Polygon []GeoPoint
+}
+
+// ValidatePrivacyZone checks that a zone has a name and either a radius or a polygon with valid coordinates.
+func ValidatePrivacyZone(zone PrivacyZone) error {
+	if strings.TrimSpace(zone.Name) == "" {
+		return errors.New("privacy zone needs a name")
+	}
+
+	if len(zone.Polygon) > 0 {
+		if zone.Radius != 0 {
+			return errors.New("privacy zone can either have a radius or a polygon")
+		}
+
+		if len(zone.Polygon) < 3 {
+			return fmt.Errorf("polygon of privacy zone needs at least 3 corners, got %d", len(zone.Polygon))
+		}
+
+		for _, p := range zone.Polygon {
+			if err := validateGeoPoint(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if zone.Radius <= 0 {
+		return fmt.Errorf("radius of privacy zone must be positive, got %v", zone.Radius)
+	}
+	return validateGeoPoint(zone.Center)
+}
+
+func validateGeoPoint(p GeoPoint) error {
+	if math.IsNaN(p.Latitude) || p.Latitude < -90 || p.Latitude > 90 {
+		return fmt.Errorf("invalid latitude %v", p.Latitude)
+	}
+	if math.IsNaN(p.Longitude) || p.Longitude < -180 || p.Longitude > 180 {
+		return fmt.Errorf("invalid longitude %v", p.Longitude)
+	}
+	return nil
+}
+
+// Contains checks whether a point lies inside the zone.
+func (z PrivacyZone) Contains(p GeoPoint) bool {
+	if len(z.Polygon) == 0 {
+		return distance(z.Center, p) <= z.Radius
+	}
+
+	// ray casting. a ray from p to the east crosses the edges of the polygon an odd number of times if p is inside.
+	// zones are small enough to treat degrees as planar coordinates.
+	inside := false
+	for i, j := 0, len(z.Polygon)-1; i < len(z.Polygon); j, i = i, i+1 {
+		a, b := z.Polygon[i], z.Polygon[j]
+		if (a.Latitude > p.Latitude) == (b.Latitude > p.Latitude) {
+			continue
+		}
+
+		lng := a.Longitude + (p.Latitude-a.Latitude)/(b.Latitude-a.Latitude)*(b.Longitude-a.Longitude)
+		if p.Longitude < lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// reference returns the point of the zone that determines the grid cell that images inside it are moved into.
+func (z PrivacyZone) reference() GeoPoint {
+	if len(z.Polygon) == 0 {
+		return z.Center
+	}
+
+	var ref GeoPoint
+	for _, p := range z.Polygon {
+		ref.Latitude += p.Latitude
+		ref.Longitude += p.Longitude
+	}
+	ref.Latitude /= float64(len(z.Polygon))
+	ref.Longitude /= float64(len(z.Polygon))
+	return ref
+}
+
+// Obscure returns coordinates for an image inside the zone that don't reveal where it was taken. All images of the zone
+// end up in the same grid cell, so that the cell boundaries don't narrow down the location. The position inside the
+// cell is derived from seed, e.g. the checksum of the image, so that it doesn't change between requests and the
+// positions of several images can't be averaged.
+func (z PrivacyZone) Obscure(seed string) GeoPoint {
+	ref := z.reference()
+	sum := sha256.Sum256([]byte(seed))
+
+	// the upper 53 bits of each half are a uniformly distributed fraction in [0, 1)
+	fracLat := float64(binary.BigEndian.Uint64(sum[0:8])>>11) / (1 << 53)
+	fracLng := float64(binary.BigEndian.Uint64(sum[8:16])>>11) / (1 << 53)
+
+	return GeoPoint{
+		Latitude:  math.Min(90, math.Floor(ref.Latitude/PrivacyGridSize)*PrivacyGridSize+fracLat*PrivacyGridSize),
+		Longitude: math.Min(180, math.Floor(ref.Longitude/PrivacyGridSize)*PrivacyGridSize+fracLng*PrivacyGridSize),
+	}
+}
+
+// ApplyPrivacyZones obscures the coordinates of an image if it was taken inside one of the zones. The first matching
+// zone wins. The image is returned unchanged if no zone matches. Latitude and Longitude keep the true coordinates,
+// only the public representation of the image uses the obscured ones.
+func ApplyPrivacyZones(img Image, zones []PrivacyZone) Image {
+	img.Obscured = nil
+
+	p := GeoPoint{img.Latitude, img.Longitude}
+	for _, z := range zones {
+		if z.Contains(p) {
+			obscured := z.Obscure(img.SHA256)
+			img.Obscured = &obscured
+			break
+		}
+	}
+	return img
+}
+
+// distance returns the great-circle distance between two points in meters.
+func distance(a, b GeoPoint) float64 {
+	const earthRadius = 6371000.0
+
+	phi1 := a.Latitude * math.Pi / 180
+	phi2 := b.Latitude * math.Pi / 180
+	dPhi := (b.Latitude - a.Latitude) * math.Pi / 180
+	dLambda := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Atan2(math.Sqrt(h), math.Sqrt(1-h))
+}